@@ -5,13 +5,14 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/flant/shell-operator/pkg/executor"
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	utils_signal "github.com/flant/shell-operator/pkg/utils/signal"
 
 	operator "github.com/flant/addon-operator/pkg/addon-operator"
 	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/executor"
+	"github.com/flant/addon-operator/pkg/logger"
 )
 
 func main() {
@@ -30,9 +31,17 @@ func main() {
 	kpApp.Command("start", "Start events processing.").
 		Default().
 		Action(func(c *kingpin.ParseContext) error {
+			if app.Namespace == "" {
+				return fmt.Errorf("required flag --namespace not provided")
+			}
+
 			// Setting flag.Parsed() for glog.
 			_ = flag.CommandLine.Parse([]string{})
 
+			if err := logger.SetFormat(app.LogType); err != nil {
+				return err
+			}
+
 			// Be a good parent - clean up after the child processes
 			// in case if addon-operator is a PID 1 process.
 			go executor.Reap()
@@ -42,9 +51,45 @@ func main() {
 			// Block action by waiting signals from OS.
 			utils_signal.WaitForProcessInterruption()
 
+			// Finish running tasks and stop Tiller before exit.
+			operator.Shutdown(app.ShutdownTimeout)
+
 			return nil
 		})
 
+	// render modules without a cluster
+	var configDataPath, hookPatchesPath string
+	renderCmd := kpApp.Command("render", "Render enabled modules, their values and helm templates without a cluster.").
+		Action(func(c *kingpin.ParseContext) error {
+			return operator.Render(configDataPath, hookPatchesPath, os.Stdout)
+		})
+	renderCmd.Flag("config-map-data", "Path to a YAML file with a ConfigMap or ConfigMap data with values.").
+		StringVar(&configDataPath)
+	renderCmd.Flag("hook-patches", "Path to a YAML file with values patches returned by hooks.").
+		StringVar(&hookPatchesPath)
+
+	// run a hook with fixtures
+	testHookOpts := operator.TestHookOptions{}
+	testHookCmd := kpApp.Command("test-hook", "Validate hook config, run a hook with binding context and values fixtures and print resulting values.").
+		Action(func(c *kingpin.ParseContext) error {
+			return operator.TestHook(testHookOpts, os.Stdout)
+		})
+	testHookCmd.Arg("hook", "Path to the hook executable.").
+		Required().
+		StringVar(&testHookOpts.HookPath)
+	testHookCmd.Flag("module", "Module name for a module hook. Hook is a global hook if not set.").
+		StringVar(&testHookOpts.ModuleName)
+	testHookCmd.Flag("binding-context", "Path to a YAML or JSON file with a binding context array.").
+		StringVar(&testHookOpts.BindingContextPath)
+	testHookCmd.Flag("values", "Path to a YAML file with values.").
+		StringVar(&testHookOpts.ValuesPath)
+	testHookCmd.Flag("config-values", "Path to a YAML file with config values.").
+		StringVar(&testHookOpts.ConfigValuesPath)
+	testHookCmd.Flag("expected-values", "Path to a YAML file with expected values after the hook run.").
+		StringVar(&testHookOpts.ExpectedValuesPath)
+	testHookCmd.Flag("expected-config-values", "Path to a YAML file with expected config values after the hook run.").
+		StringVar(&testHookOpts.ExpectedConfigValuesPath)
+
 	kingpin.MustParse(kpApp.Parse(os.Args[1:]))
 
 	return
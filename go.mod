@@ -6,15 +6,20 @@ require (
 	github.com/evanphx/json-patch v4.5.0+incompatible
 	github.com/flant/shell-operator v1.0.0-beta.5.0.20190923140739-5f7d9cca9885 // branch: release-1.0
 	github.com/ghodss/yaml v1.0.0
+	github.com/go-openapi/errors v0.19.2
+	github.com/go-openapi/spec v0.19.3
+	github.com/go-openapi/strfmt v0.19.3
+	github.com/go-openapi/validate v0.19.3
 	github.com/go-yaml/yaml v2.1.0+incompatible
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/kennygrant/sanitize v1.2.4
 	github.com/otiai10/copy v1.0.1
 	github.com/peterbourgon/mergemap v0.0.0-20130613134717-e21c03b7a721
 	github.com/prometheus/client_golang v1.0.0
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90
 	github.com/romana/rlog v0.0.0-20171115192701-f018bc92e7d7
 	github.com/segmentio/go-camelcase v0.0.0-20160726192923-7085f1e3c734
-	github.com/stretchr/testify v1.3.0
+	github.com/stretchr/testify v1.4.0
 	golang.org/x/tools v0.0.0-20190627033414-4874f863e654 // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	gopkg.in/satori/go.uuid.v1 v1.2.0
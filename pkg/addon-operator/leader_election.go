@@ -0,0 +1,100 @@
+package addon_operator
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/romana/rlog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/flant/shell-operator/pkg/kube"
+
+	"github.com/flant/addon-operator/pkg/app"
+)
+
+// RunLeaderElection starts leader election with a Lease lock in the namespace of the operator.
+// onStartedLeading is called when the lease is acquired. The operator is shut down
+// and the process exits when the lease is lost: a new process starts as a standby replica.
+func RunLeaderElection(onStartedLeading func()) error {
+	if err := validateLeaderElectionDurations(); err != nil {
+		return err
+	}
+
+	identity, err := leaderElectionIdentity()
+	if err != nil {
+		return err
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      app.LeaderElectionLeaseName,
+			Namespace: app.Namespace,
+		},
+		Client: kube.Kubernetes.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: app.LeaderElectionLeaseDuration,
+		RenewDeadline: app.LeaderElectionRenewDeadline,
+		RetryPeriod:   app.LeaderElectionRetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(_ context.Context) {
+				rlog.Infof("LEADER_ELECTION: '%s' is the leader", identity)
+				onStartedLeading()
+			},
+			OnStoppedLeading: func() {
+				rlog.Errorf("LEADER_ELECTION: '%s' lost the lease, shut down", identity)
+				// Running commands are stopped at once, the queue state is saved and hooks are disabled as on SIGTERM.
+				ShutdownOnLeaseLoss()
+				os.Exit(1)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					rlog.Infof("LEADER_ELECTION: '%s' is the leader, '%s' is a standby replica", leader, identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	rlog.Infof("LEADER_ELECTION: '%s' waits for Lease/%s", identity, app.LeaderElectionLeaseName)
+	go elector.Run(context.Background())
+	return nil
+}
+
+// validateLeaderElectionDurations checks that the leader stops on the lease loss before a new leader
+// can acquire the lease: a new leader waits for LeaseDuration since the last renew, and the leader
+// detects the loss after RenewDeadline.
+func validateLeaderElectionDurations() error {
+	if app.LeaderElectionRenewDeadline >= app.LeaderElectionLeaseDuration {
+		return fmt.Errorf("renew deadline %s should be less than lease duration %s",
+			app.LeaderElectionRenewDeadline.String(), app.LeaderElectionLeaseDuration.String())
+	}
+	budget := app.LeaderElectionLeaseDuration - app.LeaderElectionRenewDeadline
+	if budget <= leaseLossShutdownDuration() {
+		return fmt.Errorf("lease duration %s minus renew deadline %s should be greater than %s to stop hooks and helm on the lease loss",
+			app.LeaderElectionLeaseDuration.String(), app.LeaderElectionRenewDeadline.String(), leaseLossShutdownDuration().String())
+	}
+	return nil
+}
+
+// leaderElectionIdentity returns a name of the Pod or the hostname.
+func leaderElectionIdentity() (string, error) {
+	if app.PodName != "" {
+		return app.PodName, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("get identity for leader election: %s", err)
+	}
+	return hostname, nil
+}
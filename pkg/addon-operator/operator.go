@@ -3,11 +3,16 @@ package addon_operator
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -16,15 +21,20 @@ import (
 	schedule_hook "github.com/flant/shell-operator/pkg/hook/schedule"
 	"github.com/flant/shell-operator/pkg/kube"
 	"github.com/flant/shell-operator/pkg/kube_events_manager"
-	"github.com/flant/shell-operator/pkg/metrics_storage"
 	"github.com/flant/shell-operator/pkg/schedule_manager"
 
 	"github.com/flant/addon-operator/pkg/app"
 	"github.com/flant/addon-operator/pkg/helm"
 	"github.com/flant/addon-operator/pkg/kube_config_manager"
+	"github.com/flant/addon-operator/pkg/logger"
+	"github.com/flant/addon-operator/pkg/metrics_storage"
+	"github.com/flant/addon-operator/pkg/module_events"
 	"github.com/flant/addon-operator/pkg/module_manager"
 	kube_event_hook "github.com/flant/addon-operator/pkg/module_manager/hook/kube_event"
+	kube_validating_hook "github.com/flant/addon-operator/pkg/module_manager/hook/kube_validating"
+	"github.com/flant/addon-operator/pkg/module_status"
 	"github.com/flant/addon-operator/pkg/task"
+	"github.com/flant/addon-operator/pkg/utils"
 )
 
 var (
@@ -32,8 +42,22 @@ var (
 	GlobalHooksDir string
 	TempDir        string
 
+	// TasksQueues is a set of named queues: the main queue for global hooks and
+	// modules discovery and a queue for each module.
+	TasksQueues *task.TasksQueueSet
+	// TasksQueue is the main queue from TasksQueues.
 	TasksQueue *task.TasksQueue
 
+	// ModulesTasksLock prevents running tasks from the main queue
+	// concurrently with tasks from modules queues.
+	ModulesTasksLock sync.RWMutex
+	// moduleLocks serialize tasks of one module from its queue and from custom queues.
+	moduleLocks   = make(map[string]*sync.Mutex)
+	moduleLocksMu sync.Mutex
+	// globalHookLocks serialize runs of one global hook from different custom queues:
+	// temporary files of the hook are named by the hook.
+	globalHookLocks = make(map[string]*sync.Mutex)
+
 	KubeConfigManager kube_config_manager.KubeConfigManager
 
 	// ModuleManager is the module manager object, which monitors configuration
@@ -46,35 +70,61 @@ var (
 	KubeEventsManager kube_events_manager.KubeEventsManager
 	KubeEventsHooks   kube_event_hook.KubeEventsHooksController
 
+	// ValidatingHooks runs hooks with kubernetesValidating bindings on admission requests outside of queues.
+	ValidatingHooks kube_validating_hook.ValidatingHooksController
+
 	MetricsStorage *metrics_storage.MetricStorage
 
+	// EventRecorder emits Kubernetes Events about modules lifecycle.
+	EventRecorder *module_events.Recorder
+
+	// ModuleStatusManager saves modules statuses into ConfigMaps. Statuses are kept only in memory
+	// if ConfigMaps are disabled.
+	ModuleStatusManager *module_status.StatusManager
+
+	// QueueStateStorage is a file or a ConfigMap with the state of all queues. It is nil
+	// if the state file cannot be written.
+	QueueStateStorage task.QueueStateStorage
+	// QueuePersister saves the state of all queues into QueueStateStorage.
+	QueuePersister *task.TasksQueuePersister
+	// SavedTasks are tasks from QueueStateStorage. Global hooks tasks are restored before onStartup tasks,
+	// module hooks tasks are restored after the first modules discovery. Tasks that are not restored yet
+	// are saved with tasks from queues, so they are not lost if the operator is stopped during start.
+	SavedTasks   []task.TaskState
+	savedTasksMu sync.Mutex
+
 	// ManagersEventsHandlerStopCh is the channel object for stopping infinite loop of the ManagersEventsHandler.
 	ManagersEventsHandlerStopCh chan struct{}
 
 	BeforeHelmInitCb func()
+
+	// helmStarted is 1 after helm client and Tiller are initialized. It is read by the /healthz handler,
+	// so it is accessed atomically.
+	helmStarted int32
+
+	// tasksRunnersStopCh is closed to stop all tasks runners.
+	tasksRunnersStopCh = make(chan struct{})
+	tasksRunnersStopOnce sync.Once
+	// tasksRunnersWg waits for running tasks runners.
+	tasksRunnersWg sync.WaitGroup
 )
 
 
+// TasksQueueStateFileName is a name of the tasks queue state file in the state directory.
+const TasksQueueStateFileName = "tasks-queue.json"
+
 // Defining delays in processing tasks from queue.
 var (
 	QueueIsEmptyDelay = 3 * time.Second
 	FailedHookDelay   = 5 * time.Second
 	FailedModuleDelay = 5 * time.Second
+	// QueueStateSaveInterval limits how often the state of queues is saved.
+	QueueStateSaveInterval = 1 * time.Second
 )
 
-// Init gets all settings, initialize managers and create a working queue.
-//
-// Settings: directories for modules, global hooks, host name, dump file, tiller namespace.
-//
-// Initializing necessary objects: helm/tiller, registry manager, module manager,
-// kube events manager.
-//
-// Creating an empty queue with jobs.
-func Init() error {
-	rlog.Debug("INIT: started")
-
-	var err error
-
+// InitDirectories sets directories for modules and global hooks from MODULES_DIR and GLOBAL_HOOKS_DIR
+// environment variables or relative to the current working directory.
+func InitDirectories() error {
 	cwd, err := os.Getwd()
 	if err != nil {
 		rlog.Errorf("INIT: Cannot get current working directory of process: %s", err)
@@ -91,6 +141,26 @@ func Init() error {
 		GlobalHooksDir = path.Join(cwd, app.GlobalHooksDir)
 	}
 	rlog.Infof("INIT: Modules: '%s', Global hooks: '%s'", ModulesDir, GlobalHooksDir)
+	return nil
+}
+
+// Init gets all settings, initialize managers and create a working queue.
+//
+// Settings: directories for modules, global hooks, host name, dump file, tiller namespace.
+//
+// Initializing necessary objects: helm/tiller, registry manager, module manager,
+// kube events manager.
+//
+// Creating an empty queue with jobs.
+func Init() error {
+	rlog.Debug("INIT: started")
+
+	var err error
+
+	err = InitDirectories()
+	if err != nil {
+		return err
+	}
 
 	TempDir := app.TmpDir
 	err = os.MkdirAll(TempDir, os.FileMode(0777))
@@ -105,7 +175,8 @@ func Init() error {
 	go MetricsStorage.Run()
 
 	// Initializing the empty task queue.
-	TasksQueue = task.NewTasksQueue()
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
 
 	// Initializing the connection to the k8s.
 	err = kube.Init(kube.InitOptions{})
@@ -114,35 +185,13 @@ func Init() error {
 		return err
 	}
 
-	// A useful callback when addon-operator is used as library
-	if BeforeHelmInitCb != nil {
-		rlog.Debugf("INIT: run BeforeHelmInitCallback")
-		BeforeHelmInitCb()
-	}
-
-	err = helm.InitTillerProcess(helm.TillerOptions{
-		Namespace: app.Namespace,
-		HistoryMax: app.TillerMaxHistory,
-		ListenAddress: app.TillerListenAddress,
-		ListenPort: app.TillerListenPort,
-		ProbeListenAddress: app.TillerProbeListenAddress,
-		ProbeListenPort: app.TillerProbeListenPort,
-	})
-	if err != nil {
-		rlog.Errorf("INIT: Tiller is failed to start: %s", err)
-		return err
-	}
-
-	// Initializing helm client
-	err = helm.InitClient()
-	if err != nil {
-		rlog.Errorf("INIT: helm client: %s", err)
-		return err
-	}
-
 	// Initializing module manager.
 
-	KubeConfigManager = kube_config_manager.NewKubeConfigManager()
+	if app.ConfigSource == "moduleconfig" {
+		KubeConfigManager = kube_config_manager.NewModuleConfigKubeConfigManager()
+	} else {
+		KubeConfigManager = kube_config_manager.NewKubeConfigManager()
+	}
 	KubeConfigManager.WithNamespace(app.Namespace)
 	KubeConfigManager.WithConfigMapName(app.ConfigMapName)
 	KubeConfigManager.WithValuesChecksumsAnnotation(app.ValuesChecksumsAnnotation)
@@ -152,20 +201,116 @@ func Init() error {
 		return err
 	}
 
+	EventRecorder = module_events.NewRecorder(app.Namespace, app.PodName, app.ModuleStatusConfigMapPrefix)
+
 	module_manager.Init()
 	ModuleManager = module_manager.NewMainModuleManager()
 	ModuleManager.WithDirectories(ModulesDir, GlobalHooksDir, TempDir)
+	ModuleManager.WithModuleSources(ModuleSourcesList(app.ModuleSources))
 	ModuleManager.WithKubeConfigManager(KubeConfigManager)
+	ModuleManager.WithMetricStorage(MetricsStorage)
+	ModuleManager.WithEventRecorder(EventRecorder)
 	err = ModuleManager.Init()
 	if err != nil {
 		rlog.Errorf("INIT: Cannot initialize module manager: %s", err)
 		return err
 	}
 
+	ModuleStatusManager = module_status.NewStatusManager(app.Namespace, app.ModuleStatusConfigMapPrefix)
+
+	// The label is left on the Pod if the leader container is restarted.
+	if app.LeaderElection && app.ValidatingWebhookCertDir != "" {
+		podName, err := leaderElectionIdentity()
+		if err == nil {
+			err = kube_validating_hook.SetLeaderLabel(kube.Kubernetes, app.Namespace, podName, false)
+		}
+		if err != nil {
+			rlog.Errorf("INIT: Cannot remove validating webhook leader label: %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InitLeader starts helm and initializes managers that change the cluster or
+// receive events. With leader election it is called only in the leader.
+func InitLeader() error {
+	var err error
+
+	// ModuleConfig objects are imported and their statuses are written only by the leader.
+	if leaderInit, ok := KubeConfigManager.(kube_config_manager.LeaderInitializer); ok {
+		err = leaderInit.InitLeader()
+		if err != nil {
+			rlog.Errorf("INIT: Cannot initialize kube config manager: %s", err)
+			return err
+		}
+	}
+
+	// A useful callback when addon-operator is used as library
+	if BeforeHelmInitCb != nil {
+		rlog.Debugf("INIT: run BeforeHelmInitCallback")
+		BeforeHelmInitCb()
+	}
+
+	helm.OnCommandTimeout = func(command string) {
+		MetricsStorage.SendCounterMetric(PrefixMetric("helm_timeouts"), 1.0, map[string]string{"command": command})
+	}
+
+	if app.Helm3 {
+		// Helm 3 works without Tiller.
+		err = helm.InitHelm3Client()
+		if err != nil {
+			rlog.Errorf("INIT: helm 3 client: %s", err)
+			return err
+		}
+	} else {
+		err = helm.InitTillerProcess(helm.TillerOptions{
+			Namespace: app.Namespace,
+			HistoryMax: app.TillerMaxHistory,
+			ListenAddress: app.TillerListenAddress,
+			ListenPort: app.TillerListenPort,
+			ProbeListenAddress: app.TillerProbeListenAddress,
+			ProbeListenPort: app.TillerProbeListenPort,
+		})
+		if err != nil {
+			rlog.Errorf("INIT: Tiller is failed to start: %s", err)
+			return err
+		}
+
+		// Initializing helm client
+		err = helm.InitClient()
+		if err != nil {
+			rlog.Errorf("INIT: helm client: %s", err)
+			return err
+		}
+	}
+	atomic.StoreInt32(&helmStarted, 1)
+
+	// Loading modules statuses from the previous run to not repeat ModuleEnabled events.
+	err = ModuleStatusManager.Load()
+	if err != nil {
+		rlog.Errorf("INIT: Cannot load modules statuses: %s", err)
+	}
+
 	// Initializing the queue dumper, which writes queue changes to the dump file.
 	rlog.Debugf("INIT: Tasks queue dump file: '%s'", app.TasksQueueDumpFilePath)
-	queueWatcher := task.NewTasksQueueDumper(app.TasksQueueDumpFilePath, TasksQueue)
-	TasksQueue.AddWatcher(queueWatcher)
+	queueWatcher := task.NewTasksQueueDumper(app.TasksQueueDumpFilePath, TasksQueues)
+	TasksQueues.AddWatcher(queueWatcher)
+
+	QueueStateStorage = NewQueueStateStorage()
+	if QueueStateStorage != nil {
+		// Loading tasks from the previous run. They are restored in Run and after modules discovery.
+		err = LoadSavedTasks(QueueStateStorage)
+		if err != nil {
+			rlog.Errorf("INIT: Cannot load saved tasks, start with empty queue: %s", err)
+		}
+
+		// Initializing the queue persister, which saves the state of queues on every change.
+		QueuePersister = task.NewTasksQueuePersister(TasksQueues, QueueStateStorage, QueueStateSaveInterval).
+			WithPendingTasks(pendingSavedTasks)
+		TasksQueues.AddWatcher(QueuePersister)
+	}
 
 	// Initializing the hooks schedule.
 	ScheduleManager, err = schedule_manager.Init()
@@ -181,9 +326,38 @@ func Init() error {
 	}
 	KubeEventsHooks = kube_event_hook.NewMainKubeEventsHooksController()
 
+	validatingHooks := kube_validating_hook.NewMainValidatingHooksController(app.Namespace, app.ValidatingWebhookServiceName, app.ValidatingWebhookConfigurationName)
+	if app.LeaderElection {
+		// The Service of the webhook server selects the leader by the label.
+		podName, err := leaderElectionIdentity()
+		if err != nil {
+			return err
+		}
+		validatingHooks.WithPodName(podName)
+	}
+	ValidatingHooks = validatingHooks
+	if app.ValidatingWebhookCertDir != "" {
+		serveErr, err := ValidatingHooks.Start(kube.Kubernetes, app.ValidatingWebhookCertDir, app.ListenAddress, app.ValidatingWebhookListenPort)
+		if err != nil {
+			rlog.Errorf("INIT: Cannot start validating webhook server: %s", err)
+			return err
+		}
+		go func() {
+			if err := <-serveErr; err != nil {
+				rlog.Errorf("MAIN: %s, shut down", err)
+				Shutdown(app.ShutdownTimeout)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	return nil
 }
 
+func isHelmStarted() bool {
+	return atomic.LoadInt32(&helmStarted) == 1
+}
+
 // Run runs all managers, event and queue handlers.
 //
 // The main process is blocked by the 'for-select' in the queue handler.
@@ -193,10 +367,15 @@ func Run() {
 	rlog.Info("MAIN: Start. Trigger onStartup event.")
 	TasksQueue.ChangesDisable()
 
+	// Saved global hooks tasks run before onStartup tasks.
+	RestoreSavedGlobalTasks()
 	CreateOnStartupTasks()
 	CreateReloadAllTasks(true)
 
 	_ = KubeEventsHooks.EnableGlobalHooks(ModuleManager, KubeEventsManager)
+	if err := ValidatingHooks.EnableGlobalHooks(ModuleManager); err != nil {
+		rlog.Errorf("MAIN: %s", err)
+	}
 
 	TasksQueue.ChangesEnable(true)
 
@@ -204,9 +383,10 @@ func Run() {
 	go ScheduleManager.Run()
 
 	// Managers events handler adds task to the queue on every received event/
+	ManagersEventsHandlerStopCh = make(chan struct{})
 	go ManagersEventsHandler()
 
-	// TasksRunner runs tasks from the queue.
+	// TasksRunner runs tasks from the main queue and starts runners for other queues.
 	go TasksRunner()
 
 	RunAddonOperatorMetrics()
@@ -227,7 +407,7 @@ func ManagersEventsHandler() {
 				for _, moduleChange := range moduleEvent.ModulesChanges {
 					rlog.Infof("EVENT ModulesChanged, type=Changed")
 					newTask := task.NewTask(task.ModuleRun, moduleChange.Name)
-					TasksQueue.Add(newTask)
+					AddTask(newTask)
 					rlog.Infof("QUEUE add ModuleRun %s", newTask.Name)
 				}
 				// As module list may have changed, hook schedule index must be re-created.
@@ -242,6 +422,7 @@ func ManagersEventsHandler() {
 				ScheduledHooks = UpdateScheduleHooks(ScheduledHooks)
 			case module_manager.AmbigousState:
 				rlog.Infof("EVENT AmbiguousState")
+				EventRecorder.OperatorWarning(module_events.ReasonAmbiguousState, "Module manager is in ambiguous state, retry after %s", FailedModuleDelay.String())
 				TasksQueue.ChangesDisable()
 				// It is the error in the module manager. The task must be added to
 				// the beginning of the queue so the module manager can restore its
@@ -252,13 +433,18 @@ func ManagersEventsHandler() {
 				TasksQueue.Push(task.NewTaskDelay(FailedModuleDelay))
 				TasksQueue.ChangesEnable(true)
 				rlog.Infof("QUEUE push ModuleManagerRetry, push FailedModuleDelay")
+			case module_manager.FilesChanged:
+				rlog.Infof("EVENT FilesChanged")
+				// One reload task is enough to apply all changes.
+				if !TasksQueue.ContainsTaskTypes(task.ReloadFiles) {
+					TasksQueue.Add(task.NewTask(task.ReloadFiles, ""))
+					rlog.Infof("QUEUE add ReloadFiles")
+				}
 			}
 		case crontab := <-schedule_manager.ScheduleCh:
 			scheduleHooks := ScheduledHooks.GetHooksForSchedule(crontab)
 			for _, hook := range scheduleHooks {
-				var getHookErr error
-
-				_, getHookErr = ModuleManager.GetGlobalHook(hook.Name)
+				globalHook, getHookErr := ModuleManager.GetGlobalHook(hook.Name)
 				if getHookErr == nil {
 					for _, scheduleConfig := range hook.Schedule {
 						bindingName := scheduleConfig.Name
@@ -268,14 +454,15 @@ func ManagersEventsHandler() {
 						newTask := task.NewTask(task.GlobalHookRun, hook.Name).
 							WithBinding(module_manager.Schedule).
 							AppendBindingContext(module_manager.BindingContext{Binding: bindingName}).
-							WithAllowFailure(scheduleConfig.AllowFailure)
-						TasksQueue.Add(newTask)
+							WithAllowFailure(scheduleConfig.AllowFailure).
+							WithQueueName(globalHook.Config.ScheduleQueue(scheduleConfig))
+						AddTask(newTask)
 						rlog.Debugf("QUEUE add GlobalHookRun@Schedule '%s'", hook.Name)
 					}
 					continue
 				}
 
-				_, getHookErr = ModuleManager.GetModuleHook(hook.Name)
+				moduleHook, getHookErr := ModuleManager.GetModuleHook(hook.Name)
 				if getHookErr == nil {
 					for _, scheduleConfig := range hook.Schedule {
 						bindingName := scheduleConfig.Name
@@ -285,8 +472,9 @@ func ManagersEventsHandler() {
 						newTask := task.NewTask(task.ModuleHookRun, hook.Name).
 							WithBinding(module_manager.Schedule).
 							AppendBindingContext(module_manager.BindingContext{Binding: bindingName}).
-							WithAllowFailure(scheduleConfig.AllowFailure)
-						TasksQueue.Add(newTask)
+							WithAllowFailure(scheduleConfig.AllowFailure).
+							WithQueueName(moduleHook.Config.ScheduleQueue(scheduleConfig))
+						AddTask(newTask)
 						rlog.Debugf("QUEUE add ModuleHookRun@Schedule '%s'", hook.Name)
 					}
 					continue
@@ -304,7 +492,7 @@ func ManagersEventsHandler() {
 			}
 
 			for _, task := range res.Tasks {
-				TasksQueue.Add(task)
+				AddTask(task)
 				rlog.Infof("QUEUE add %s@%s %s", task.GetType(), task.GetBinding(), task.GetName())
 			}
 		case <-ManagersEventsHandlerStopCh:
@@ -315,11 +503,18 @@ func ManagersEventsHandler() {
 }
 
 func runDiscoverModulesState(discoverTask task.Task) error {
-	modulesState, err := ModuleManager.DiscoverModulesState()
+	modulesState, err := ModuleManager.DiscoverModulesState(taskLogLabels(discoverTask))
 	if err != nil {
 		return err
 	}
 
+	if statusWriter, ok := KubeConfigManager.(kube_config_manager.ModuleStatusWriter); ok {
+		statusWriter.WriteModulesEnabledStatus(modulesState.EnabledModules)
+	}
+	if ModuleStatusManager != nil {
+		ModuleStatusManager.UpdateEnabled(modulesState.AllModules, modulesState.EnabledByConfigModules, modulesState.EnabledModules, modulesState.DisabledByDependencies)
+	}
+
 	for _, moduleName := range modulesState.EnabledModules {
 		isNewlyEnabled := false
 		for _, name := range modulesState.NewlyEnabledModules {
@@ -333,19 +528,22 @@ func runDiscoverModulesState(discoverTask task.Task) error {
 		newTask := task.NewTask(task.ModuleRun, moduleName).
 			WithOnStartupHooks(runOnStartupHooks)
 
-		TasksQueue.Add(newTask)
+		AddTask(newTask)
 		rlog.Infof("QUEUE add ModuleRun %s", moduleName)
 	}
 
+	// ModulesToDisable are in reverse order of dependencies. ModuleDelete tasks run one by one
+	// in the modules-delete queue, so consumers are deleted and their afterDeleteHelm hooks are run
+	// before helm releases of providers are deleted.
 	for _, moduleName := range modulesState.ModulesToDisable {
 		newTask := task.NewTask(task.ModuleDelete, moduleName)
-		TasksQueue.Add(newTask)
+		AddTask(newTask)
 		rlog.Infof("QUEUE add ModuleDelete %s", moduleName)
 	}
 
 	for _, moduleName := range modulesState.ReleasedUnknownModules {
 		newTask := task.NewTask(task.ModulePurge, moduleName)
-		TasksQueue.Add(newTask)
+		AddTask(newTask)
 		rlog.Infof("QUEUE add ModulePurge %s", moduleName)
 	}
 
@@ -371,6 +569,10 @@ func runDiscoverModulesState(discoverTask task.Task) error {
 		if err != nil {
 			return err
 		}
+		err = ValidatingHooks.EnableModuleHooks(moduleName, ModuleManager)
+		if err != nil {
+			return err
+		}
 	}
 
 	// TODO is queue should be cleaned from hook run tasks of deleted module?
@@ -380,133 +582,402 @@ func runDiscoverModulesState(discoverTask task.Task) error {
 		if err != nil {
 			return err
 		}
+		err = ValidatingHooks.DisableModuleHooks(moduleName)
+		if err != nil {
+			return err
+		}
 	}
 
+	// Saved hook tasks are queued after ModuleRun tasks of enabled modules.
+	RestoreSavedTasks(modulesState.EnabledModules)
+
 	return nil
 }
 
-// TasksRunner handle tasks in queue.
+// runReloadFiles reloads modules and global hooks changed on disk. Informers
+// and schedules are registered again, changed modules are run, removed modules
+// are deleted and modules discovery is started for new modules.
+func runReloadFiles() error {
+	changes, err := ModuleManager.DetectFilesChanges()
+	if err != nil {
+		return err
+	}
+	if changes.IsEmpty() {
+		rlog.Infof("RELOAD: no changes")
+		return nil
+	}
+	rlog.Infof("RELOAD: global hooks changed: %v, values changed: %v, changed modules: %v, removed modules: %v, new modules: %v",
+		changes.GlobalHooksChanged, changes.ValuesChanged, changes.ChangedModules, changes.RemovedModules, changes.NewModules)
+
+	enabledModules := make(map[string]bool)
+	for _, moduleName := range ModuleManager.GetModuleNamesInOrder() {
+		enabledModules[moduleName] = true
+	}
+
+	// Informers and webhooks are stopped before hooks are reloaded.
+	if changes.GlobalHooksChanged {
+		if err := KubeEventsHooks.DisableGlobalHooks(KubeEventsManager); err != nil {
+			return err
+		}
+		if err := ValidatingHooks.DisableGlobalHooks(); err != nil {
+			return err
+		}
+	}
+	for _, moduleName := range append(changes.ChangedModules, changes.RemovedModules...) {
+		if err := KubeEventsHooks.DisableModuleHooks(moduleName, ModuleManager, KubeEventsManager); err != nil {
+			return err
+		}
+		if err := ValidatingHooks.DisableModuleHooks(moduleName); err != nil {
+			return err
+		}
+	}
+
+	if err := ModuleManager.ApplyFilesChanges(changes); err != nil {
+		// Checksums are not saved, so the retry disables hooks again. Hooks are enabled
+		// until then to not lose informers and webhooks if the retry fails too.
+		enableReloadedHooks(changes, enabledModules)
+		return err
+	}
+
+	if changes.GlobalHooksChanged {
+		if err := KubeEventsHooks.EnableGlobalHooks(ModuleManager, KubeEventsManager); err != nil {
+			return err
+		}
+		if err := ValidatingHooks.EnableGlobalHooks(ModuleManager); err != nil {
+			return err
+		}
+	}
+
+	// Removed modules are deleted in reverse order of dependencies.
+	for i := len(changes.RemovedModules) - 1; i >= 0; i-- {
+		moduleName := changes.RemovedModules[i]
+		if enabledModules[moduleName] {
+			AddTask(task.NewTask(task.ModuleDelete, moduleName))
+			rlog.Infof("QUEUE add ModuleDelete %s", moduleName)
+		}
+	}
+
+	switch {
+	case changes.ValuesChanged:
+		// Static values are changed for all modules.
+		CreateReloadAllTasks(false)
+	case changes.DiscoveryNeeded:
+		TasksQueue.Add(task.NewTask(task.DiscoverModulesState, ""))
+		rlog.Infof("QUEUE add DiscoverModulesState")
+	default:
+		for _, moduleName := range changes.ChangedModules {
+			if !enabledModules[moduleName] {
+				continue
+			}
+			if err := KubeEventsHooks.EnableModuleHooks(moduleName, ModuleManager, KubeEventsManager); err != nil {
+				return err
+			}
+			if err := ValidatingHooks.EnableModuleHooks(moduleName, ModuleManager); err != nil {
+				return err
+			}
+			AddTask(task.NewTask(task.ModuleRun, moduleName))
+			rlog.Infof("QUEUE add ModuleRun %s", moduleName)
+		}
+	}
+
+	ScheduledHooks = UpdateScheduleHooks(ScheduledHooks)
+
+	return nil
+}
+
+// enableReloadedHooks enables informers and webhooks of hooks disabled by the failed files reload.
+// Global hooks and hooks of enabled modules are enabled as they are in the index.
+func enableReloadedHooks(changes *module_manager.FilesChanges, enabledModules map[string]bool) {
+	if changes.GlobalHooksChanged {
+		if err := KubeEventsHooks.EnableGlobalHooks(ModuleManager, KubeEventsManager); err != nil {
+			rlog.Errorf("RELOAD: enable global hooks: %s", err)
+		}
+		if err := ValidatingHooks.EnableGlobalHooks(ModuleManager); err != nil {
+			rlog.Errorf("RELOAD: enable global hooks webhooks: %s", err)
+		}
+	}
+	for _, moduleName := range append(changes.ChangedModules, changes.RemovedModules...) {
+		if !enabledModules[moduleName] {
+			continue
+		}
+		if err := KubeEventsHooks.EnableModuleHooks(moduleName, ModuleManager, KubeEventsManager); err != nil {
+			rlog.Errorf("RELOAD: enable hooks of module '%s': %s", moduleName, err)
+		}
+		if err := ValidatingHooks.EnableModuleHooks(moduleName, ModuleManager); err != nil {
+			rlog.Errorf("RELOAD: enable webhooks of module '%s': %s", moduleName, err)
+		}
+	}
+}
+
+// TasksRunner handle tasks in the main queue and starts handlers for other queues.
+// Stop task in the main queue stops all handlers.
+func TasksRunner() {
+	TasksQueues.WithNewQueueCallback(func(tq *task.TasksQueue) {
+		rlog.Infof("QUEUE '%s' created, start tasks runner", tq.Name)
+		tasksRunnersWg.Add(1)
+		go func() {
+			defer tasksRunnersWg.Done()
+			QueueTasksRunner(tq)
+		}()
+	})
+	tasksRunnersWg.Add(1)
+	defer tasksRunnersWg.Done()
+	QueueTasksRunner(TasksQueue)
+}
+
+// StopTasksRunners stops all tasks runners after their current tasks and waits
+// for them until timeout. It returns false if runners are not stopped in time.
+func StopTasksRunners(timeout time.Duration) bool {
+	tasksRunnersStopOnce.Do(func() {
+		close(tasksRunnersStopCh)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		tasksRunnersWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func isTasksRunnersStopped() bool {
+	select {
+	case <-tasksRunnersStopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// QueueTasksRunner handle tasks in queue.
 //
 // Task handler may delay task processing by pushing delay to the queue.
 // FIXME: For now, only one TaskRunner for a TasksQueue. There should be a lock between Peek and Pop to prevent Poping tasks from other TaskRunner
-func TasksRunner() {
+func QueueTasksRunner(tq *task.TasksQueue) {
 	for {
-		if TasksQueue.IsEmpty() {
+		if isTasksRunnersStopped() {
+			rlog.Infof("TASK_RUN queue '%s': tasks runner is stopped", tq.Name)
+			return
+		}
+		if tq.IsEmpty() {
 			time.Sleep(QueueIsEmptyDelay)
 		}
 		for {
-			t, _ := TasksQueue.Peek()
+			// Runner is idle between tasks: stop it with the Stop task.
+			if isTasksRunnersStopped() {
+				tq.Push(task.NewTask(task.Stop, "shutdown"))
+			}
+			t, _ := tq.Peek()
 			if t == nil {
 				break
 			}
 
+			// Failed task waits for retry. Let ready tasks of other modules run, tasks of the same module
+			// and global tasks keep their order. Modules are deleted strictly in order.
+			if now := time.Now(); !task.IsReady(t, now) {
+				if tq.Name != ModulesDeleteQueueName && tq.MoveReadyTaskToHead(now, taskModuleName) {
+					continue
+				}
+				wait := t.GetRetryAt().Sub(now)
+				if wait > QueueIsEmptyDelay {
+					wait = QueueIsEmptyDelay
+				}
+				time.Sleep(wait)
+				continue
+			}
+
+			// afterAll hooks should run after all modules tasks are done. Failed modules tasks can be
+			// retried forever, so afterAll hooks do not wait for them and for tasks queued behind them.
+			if t.GetType() == task.GlobalHookRun && t.GetBinding() == module_manager.AfterAll &&
+				TasksQueues.ContainsPendingTaskTypes(task.ModuleRun, task.ModuleDelete, task.ModulePurge) {
+				rlog.Debugf("TASK_RUN GlobalHookRun@AfterAll %s: wait for modules tasks", t.GetName())
+				time.Sleep(QueueIsEmptyDelay)
+				continue
+			}
+
+			unlock := lockTasks(tq, t)
+
+			logLabels := taskLogLabels(t)
+			taskLogEntry := logger.WithLabels(logLabels).WithField(logger.FailureCountField, t.GetFailureCount())
+			taskStart := time.Now()
+
+			// Wait time is measured for the first run, retries are delayed on purpose.
+			if t.GetFailureCount() == 0 && t.GetType() != task.Delay && !t.GetQueuedAt().IsZero() {
+				MetricsStorage.SendHistogramMetric(PrefixMetric("task_wait_in_queue_seconds"), taskStart.Sub(t.GetQueuedAt()).Seconds(),
+					taskMetricLabels(tq.Name, logLabels), metrics_storage.DurationBuckets)
+			}
+
 			switch t.GetType() {
 			case task.DiscoverModulesState:
-				rlog.Infof("TASK_RUN DiscoverModulesState")
+				taskLogEntry.Infof("TASK_RUN DiscoverModulesState")
 				err := runDiscoverModulesState(t)
 				if err != nil {
 					MetricsStorage.SendCounterMetric(PrefixMetric("modules_discover_errors"), 1.0, map[string]string{})
-					t.IncrementFailureCount()
-					rlog.Errorf("TASK_RUN %s failed. Will retry after delay. Failed count is %d. Error: %s", t.GetType(), t.GetFailureCount(), err)
-					TasksQueue.Push(task.NewTaskDelay(FailedModuleDelay))
-					rlog.Infof("QUEUE push FailedModuleDelay")
+					retryFailedTask(tq, t, FailedModuleDelay, err)
 					break
 				}
 
-				TasksQueue.Pop()
+				tq.Pop()
 
 			case task.ModuleRun:
-				rlog.Infof("TASK_RUN ModuleRun %s", t.GetName())
-				err := ModuleManager.RunModule(t.GetName(), t.GetOnStartupHooks())
+				taskLogEntry.Infof("TASK_RUN ModuleRun %s", t.GetName())
+				// Module can be disabled or removed after the task is queued.
+				if !isModuleEnabled(t.GetName()) {
+					taskLogEntry.Infof("TASK_RUN ModuleRun %s: module is not enabled, skip task", t.GetName())
+					tq.Pop()
+					break
+				}
+				err := ModuleManager.RunModule(t.GetName(), t.GetOnStartupHooks(), logLabels)
+				updateModuleRunStatus(t, err)
 				if err != nil {
 					MetricsStorage.SendCounterMetric(PrefixMetric("module_run_errors"), 1.0, map[string]string{"module": t.GetName()})
-					t.IncrementFailureCount()
-					rlog.Errorf("TASK_RUN ModuleRun '%s' failed. Will retry after delay. Failed count is %d. Error: %s", t.GetName(), t.GetFailureCount(), err)
-					TasksQueue.Push(task.NewTaskDelay(FailedModuleDelay))
-					rlog.Infof("QUEUE push FailedModuleDelay")
+					retryFailedTask(tq, t, FailedModuleDelay, err)
 				} else {
-					TasksQueue.Pop()
+					tq.Pop()
 				}
 			case task.ModuleDelete:
-				rlog.Infof("TASK_RUN ModuleDelete %s", t.GetName())
-				err := ModuleManager.DeleteModule(t.GetName())
+				taskLogEntry.Infof("TASK_RUN ModuleDelete %s", t.GetName())
+				// Module can be enabled again after the task is queued.
+				if isModuleEnabled(t.GetName()) {
+					taskLogEntry.Infof("TASK_RUN ModuleDelete %s: module is enabled, skip task", t.GetName())
+					tq.Pop()
+					break
+				}
+				err := ModuleManager.DeleteModule(t.GetName(), logLabels)
+				updateModuleDeleteStatus(t, err)
 				if err != nil {
 					MetricsStorage.SendCounterMetric(PrefixMetric("module_delete_errors"), 1.0, map[string]string{"module": t.GetName()})
-					t.IncrementFailureCount()
-					rlog.Errorf("%s '%s' failed. Will retry after delay. Failed count is %d. Error: %s", t.GetType(), t.GetName(), t.GetFailureCount(), err)
-					TasksQueue.Push(task.NewTaskDelay(FailedModuleDelay))
-					rlog.Infof("QUEUE push FailedModuleDelay")
+					retryFailedTask(tq, t, FailedModuleDelay, err)
 				} else {
-					TasksQueue.Pop()
+					tq.Pop()
 				}
 			case task.ModuleHookRun:
-				rlog.Infof("TASK_RUN ModuleHookRun@%s %s", t.GetBinding(), t.GetName())
-				err := ModuleManager.RunModuleHook(t.GetName(), t.GetBinding(), t.GetBindingContext())
+				taskLogEntry.Infof("TASK_RUN ModuleHookRun@%s %s", t.GetBinding(), t.GetName())
+				// Hook can be removed from disk after the task is queued.
+				if _, err := ModuleManager.GetModuleHook(t.GetName()); err != nil {
+					taskLogEntry.Warnf("TASK_RUN ModuleHookRun %s: %s, skip task", t.GetName(), err)
+					tq.Pop()
+					break
+				}
+				bindingContext, err := updateSnapshots(t)
+				if err == nil {
+					err = ModuleManager.RunModuleHook(t.GetName(), t.GetBinding(), bindingContext, logLabels)
+				}
 				if err != nil {
-					moduleHook, _ := ModuleManager.GetModuleHook(t.GetName())
-					hookLabel := path.Base(moduleHook.Path)
-					moduleLabel := moduleHook.Module.Name
+					// Hook can be removed by the files reload while it is running.
+					hookLabel, moduleLabel := path.Base(t.GetName()), ""
+					if moduleHook, err := ModuleManager.GetModuleHook(t.GetName()); err == nil && moduleHook != nil {
+						hookLabel = path.Base(moduleHook.Path)
+						if moduleHook.Module != nil {
+							moduleLabel = moduleHook.Module.Name
+						}
+					}
 
 					if t.GetAllowFailure() {
 						MetricsStorage.SendCounterMetric(PrefixMetric("module_hook_allowed_errors"), 1.0, map[string]string{"module": moduleLabel, "hook": hookLabel})
-						TasksQueue.Pop()
+						tq.Pop()
 					} else {
 						MetricsStorage.SendCounterMetric(PrefixMetric("module_hook_errors"), 1.0, map[string]string{"module": moduleLabel, "hook": hookLabel})
-						t.IncrementFailureCount()
-						rlog.Errorf("%s '%s' failed. Will retry after delay. Failed count is %d. Error: %s", t.GetType(), t.GetName(), t.GetFailureCount(), err)
-						TasksQueue.Push(task.NewTaskDelay(FailedModuleDelay))
-						rlog.Infof("QUEUE push FailedModuleDelay")
+						retryFailedTask(tq, t, FailedModuleDelay, err)
 					}
 				} else {
-					TasksQueue.Pop()
+					tq.Pop()
 				}
 			case task.GlobalHookRun:
-				rlog.Infof("TASK_RUN GlobalHookRun@%s %s", t.GetBinding(), t.GetName())
-				err := ModuleManager.RunGlobalHook(t.GetName(), t.GetBinding(), t.GetBindingContext())
+				taskLogEntry.Infof("TASK_RUN GlobalHookRun@%s %s", t.GetBinding(), t.GetName())
+				if _, err := ModuleManager.GetGlobalHook(t.GetName()); err != nil {
+					taskLogEntry.Warnf("TASK_RUN GlobalHookRun %s: %s, skip task", t.GetName(), err)
+					tq.Pop()
+					break
+				}
+				bindingContext, err := updateSnapshots(t)
+				if err == nil {
+					err = ModuleManager.RunGlobalHook(t.GetName(), t.GetBinding(), bindingContext, logLabels)
+				}
 				if err != nil {
-					globalHook, _ := ModuleManager.GetGlobalHook(t.GetName())
-					hookLabel := path.Base(globalHook.Path)
+					// Hook can be removed by the files reload while it is running.
+					hookLabel := path.Base(t.GetName())
+					if globalHook, err := ModuleManager.GetGlobalHook(t.GetName()); err == nil && globalHook != nil {
+						hookLabel = path.Base(globalHook.Path)
+					}
 
 					if t.GetAllowFailure() {
 						MetricsStorage.SendCounterMetric(PrefixMetric("global_hook_allowed_errors"), 1.0, map[string]string{"hook": hookLabel})
-						TasksQueue.Pop()
+						tq.Pop()
 					} else {
 						MetricsStorage.SendCounterMetric(PrefixMetric("global_hook_errors"), 1.0, map[string]string{"hook": hookLabel})
-						t.IncrementFailureCount()
-						rlog.Errorf("TASK_RUN %s '%s' on '%s' failed. Will retry after delay. Failed count is %d. Error: %s", t.GetType(), t.GetName(), t.GetBinding(), t.GetFailureCount(), err)
-						TasksQueue.Push(task.NewTaskDelay(FailedHookDelay))
+						retryFailedTask(tq, t, FailedHookDelay, err)
 					}
 				} else {
-					TasksQueue.Pop()
+					tq.Pop()
 				}
 			case task.ModulePurge:
-				rlog.Infof("TASK_RUN ModulePurge %s", t.GetName())
+				taskLogEntry.Infof("TASK_RUN ModulePurge %s", t.GetName())
 				// Module for purge is unknown so log deletion error is enough.
 				err := helm.Client.DeleteRelease(t.GetName())
 				if err != nil {
-					rlog.Errorf("TASK_RUN %s Helm delete '%s' failed. Error: %s", t.GetType(), t.GetName(), err)
+					taskLogEntry.Errorf("TASK_RUN %s Helm delete '%s' failed. Error: %s", t.GetType(), t.GetName(), err)
+					EventRecorder.OperatorWarning(module_events.ReasonModulePurgeFailed, "Helm release of unknown module '%s' is not deleted: %s", t.GetName(), err)
+				} else {
+					EventRecorder.OperatorNormal(module_events.ReasonModulePurged, "Helm release of unknown module '%s' is deleted", t.GetName())
+				}
+				if ModuleStatusManager != nil {
+					ModuleStatusManager.Delete(t.GetName())
+				}
+				tq.Pop()
+			case task.ReloadFiles:
+				taskLogEntry.Infof("TASK_RUN ReloadFiles")
+				err := runReloadFiles()
+				if err != nil {
+					MetricsStorage.SendCounterMetric(PrefixMetric("reload_files_errors"), 1.0, map[string]string{})
+					retryFailedTask(tq, t, FailedModuleDelay, err)
+					break
 				}
-				TasksQueue.Pop()
+				tq.Pop()
 			case task.ModuleManagerRetry:
-				rlog.Infof("TASK_RUN ModuleManagerRetry")
+				taskLogEntry.Infof("TASK_RUN ModuleManagerRetry")
 				MetricsStorage.SendCounterMetric(PrefixMetric("modules_discover_errors"), 1.0, map[string]string{})
 				ModuleManager.Retry()
-				TasksQueue.Pop()
+				tq.Pop()
 				// Adding a delay before retrying module/hook task.
-				TasksQueue.Push(task.NewTaskDelay(FailedModuleDelay))
+				tq.Push(task.NewTaskDelay(FailedModuleDelay))
 				rlog.Infof("QUEUE push FailedModuleDelay")
 			case task.Delay:
-				rlog.Infof("TASK_RUN Delay for %s", t.GetDelay().String())
-				TasksQueue.Pop()
-				time.Sleep(t.GetDelay())
+				taskLogEntry.Infof("TASK_RUN Delay for %s", t.GetDelay().String())
+				tq.Pop()
+				// Shutdown should not wait for the whole delay.
+				delayTimer := time.NewTimer(t.GetDelay())
+				select {
+				case <-delayTimer.C:
+				case <-tasksRunnersStopCh:
+					delayTimer.Stop()
+				}
 			case task.Stop:
-				rlog.Infof("TASK_RUN Stop: Exiting TASK_RUN loop.")
-				TasksQueue.Pop()
+				taskLogEntry.Infof("TASK_RUN Stop: Exiting TASK_RUN loop.")
+				tq.Pop()
+				// Runners of other queues are stopped by themselves on shutdown.
+				if tq.Name == task.MainQueueName && !isTasksRunnersStopped() {
+					stopQueuesRunners()
+				}
 				return
 			}
 
+			if t.GetType() != task.Delay {
+				taskDuration := time.Since(taskStart)
+				taskLogEntry.WithField(logger.DurationField, taskDuration).
+					Infof("TASK_RUN %s '%s' finished in %s", t.GetType(), t.GetName(), taskDuration.String())
+			}
+
+			unlock()
+
 			// Breaking, if the task queue is empty to prevent the infinite loop.
-			if TasksQueue.IsEmpty() {
+			if tq.IsEmpty() {
 				rlog.Debug("Task queue is empty. Will sleep now.")
 				break
 			}
@@ -514,6 +985,423 @@ func TasksRunner() {
 	}
 }
 
+// retryFailedTask increments a failure count of the task at the head of the queue
+// and schedules a retry after an exponential backoff delay.
+//
+// Task is moved to the failed tasks if max retries count is exceeded. Tasks in the modules-delete
+// queue are retried until success: a module is deleted only after modules that require it.
+// Failed schedule and kubernetes events hook tasks stay at the head of the queue with
+// a retry time if RequeueFailedHookTasks is enabled, so tasks of other modules are not blocked.
+func retryFailedTask(tq *task.TasksQueue, t task.Task, initialDelay time.Duration, err error) {
+	t.IncrementFailureCount()
+	logEntry := logger.WithLabels(taskLogLabels(t)).WithField(logger.FailureCountField, t.GetFailureCount())
+
+	maxRetries := taskMaxRetries(t)
+	if maxRetries > 0 && t.GetFailureCount() > maxRetries && tq.Name != ModulesDeleteQueueName {
+		logEntry.Errorf("TASK_RUN %s '%s' on '%s' failed %d times, max retries %d is exceeded. Move task to failed tasks. Error: %s", t.GetType(), t.GetName(), t.GetBinding(), t.GetFailureCount(), maxRetries, err)
+		tq.Pop()
+		TasksQueues.AddFailed(tq.Name, t)
+		return
+	}
+
+	delay := task.CalculateBackoff(t.GetFailureCount(), initialDelay, app.FailedTaskMaxDelay)
+	logEntry.Errorf("TASK_RUN %s '%s' on '%s' failed. Will retry after %s. Failed count is %d. Error: %s", t.GetType(), t.GetName(), t.GetBinding(), delay.String(), t.GetFailureCount(), err)
+
+	if app.RequeueFailedHookTasks && isHookEventTask(t) {
+		t.SetRetryAt(time.Now().Add(delay))
+		rlog.Infof("QUEUE %s '%s' waits for retry, tasks of other modules can run", t.GetType(), t.GetName())
+		return
+	}
+
+	tq.Push(task.NewTaskDelay(delay))
+	rlog.Infof("QUEUE push FailedTaskDelay %s", delay.String())
+}
+
+// updateModuleRunStatus saves a result of the ModuleRun task, the helm release and the source of the module.
+// The ModuleEnabled event is emitted once after the module is deployed.
+func updateModuleRunStatus(t task.Task, err error) {
+	if ModuleStatusManager == nil {
+		return
+	}
+	revision, checksum := "", ""
+	module, getErr := ModuleManager.GetModule(t.GetName())
+	if getErr == nil {
+		revision, checksum = module.HelmReleaseRevision, module.HelmReleaseChecksum
+	}
+	if ModuleStatusManager.UpdateRun(t.GetName(), err, t.GetFailureCount(), revision, checksum) {
+		EventRecorder.ModuleNormal(t.GetName(), module_events.ReasonModuleEnabled, "Module is enabled, helm release revision '%s'", revision)
+	}
+	// Source and version of deployed files.
+	if getErr == nil && err == nil {
+		ModuleStatusManager.UpdateSource(t.GetName(), module.Source, module.Version)
+	}
+}
+
+// ModuleSourcesList returns paths from a comma-separated list of module sources.
+func ModuleSourcesList(sources string) []string {
+	res := make([]string, 0)
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.TrimSpace(source)
+		if source != "" {
+			res = append(res, source)
+		}
+	}
+	return res
+}
+
+// updateModuleDeleteStatus saves a result of the ModuleDelete task. The ModuleDisabled event is emitted
+// if the module was deployed. The status ConfigMap of a module removed from the modules directory
+// is deleted with its helm release.
+func updateModuleDeleteStatus(t task.Task, err error) {
+	if ModuleStatusManager == nil {
+		return
+	}
+	if ModuleStatusManager.UpdateDelete(t.GetName(), err, t.GetFailureCount()) {
+		EventRecorder.ModuleNormal(t.GetName(), module_events.ReasonModuleDisabled, "Module is disabled, helm release is deleted")
+	}
+	if err == nil && !isModuleEnabled(t.GetName()) {
+		ModuleStatusManager.Delete(t.GetName())
+	}
+}
+
+// taskLogLabels returns labels for log messages of the task and for output of its hooks.
+func taskLogLabels(t task.Task) map[string]string {
+	logLabels := map[string]string{
+		logger.TaskField:    string(t.GetType()),
+		logger.EventIDField: t.GetEventID(),
+	}
+	if t.GetBinding() != "" {
+		logLabels[logger.BindingField] = string(t.GetBinding())
+	}
+
+	switch t.GetType() {
+	case task.ModuleRun, task.ModuleDelete, task.ModulePurge:
+		logLabels[logger.ModuleField] = t.GetName()
+	case task.GlobalHookRun:
+		logLabels[logger.HookField] = t.GetName()
+	case task.ModuleHookRun:
+		logLabels[logger.HookField] = t.GetName()
+		moduleHook, err := ModuleManager.GetModuleHook(t.GetName())
+		if err == nil && moduleHook != nil && moduleHook.Module != nil {
+			logLabels[logger.ModuleField] = moduleHook.Module.Name
+		}
+	}
+	return logLabels
+}
+
+// updateSnapshots returns a binding context of the hook run task with current objects
+// from informers for onKubernetesEvent bindings with includeSnapshots.
+func updateSnapshots(t task.Task) ([]module_manager.BindingContext, error) {
+	if t.GetBinding() != module_manager.KubeEvents || KubeEventsHooks == nil {
+		return t.GetBindingContext(), nil
+	}
+	return KubeEventsHooks.UpdateSnapshots(t.GetName(), t.GetBindingContext())
+}
+
+// taskMetricLabels returns labels for task metrics from task log labels.
+// All labels are set to have the same label names for all tasks.
+func taskMetricLabels(queueName string, logLabels map[string]string) map[string]string {
+	return map[string]string{
+		"queue":   queueName,
+		"module":  logLabels[logger.ModuleField],
+		"hook":    logLabels[logger.HookField],
+		"binding": logLabels[logger.BindingField],
+	}
+}
+
+// isHookEventTask returns true for hook run tasks for schedule and kubernetes events.
+func isHookEventTask(t task.Task) bool {
+	if t.GetType() != task.GlobalHookRun && t.GetType() != task.ModuleHookRun {
+		return false
+	}
+	return t.GetBinding() == module_manager.Schedule || t.GetBinding() == module_manager.KubeEvents
+}
+
+// taskMaxRetries returns a max retries count for hooks and modules tasks: a setting from hook config,
+// from module static values or a default setting. Other tasks are retried until success.
+func taskMaxRetries(t task.Task) int {
+	maxRetries := 0
+	switch t.GetType() {
+	case task.GlobalHookRun:
+		globalHook, err := ModuleManager.GetGlobalHook(t.GetName())
+		if err == nil && globalHook != nil && globalHook.Config != nil {
+			maxRetries = globalHook.Config.MaxRetries
+		}
+	case task.ModuleHookRun:
+		moduleHook, err := ModuleManager.GetModuleHook(t.GetName())
+		if err == nil && moduleHook != nil {
+			if moduleHook.Config != nil {
+				maxRetries = moduleHook.Config.MaxRetries
+			}
+			if maxRetries == 0 && moduleHook.Module != nil {
+				maxRetries = moduleHook.Module.MaxRetries()
+			}
+		}
+	case task.ModuleRun, task.ModuleDelete:
+		module, err := ModuleManager.GetModule(t.GetName())
+		if err == nil && module != nil {
+			maxRetries = module.MaxRetries()
+		}
+	default:
+		return 0
+	}
+
+	if maxRetries == 0 {
+		maxRetries = app.TaskMaxRetries
+	}
+	return maxRetries
+}
+
+// lockTasks prevents concurrent running of tasks from the main queue and
+// tasks from other queues. Tasks from different modules queues can run concurrently.
+// Tasks of one module are not run concurrently: a module hook from a custom queue
+// waits for the ModuleRun of its module. A global hook with bindings in several
+// custom queues is not run concurrently. Delay and Stop tasks are not locked.
+func lockTasks(tq *task.TasksQueue, t task.Task) (unlock func()) {
+	switch t.GetType() {
+	case task.Delay, task.Stop:
+		return func() {}
+	}
+
+	if tq.Name == task.MainQueueName {
+		ModulesTasksLock.Lock()
+		return ModulesTasksLock.Unlock
+	}
+	ModulesTasksLock.RLock()
+
+	var moduleLock *sync.Mutex
+	if t.GetType() == task.GlobalHookRun {
+		moduleLock = getLock(globalHookLocks, t.GetName())
+	} else {
+		moduleName := taskModuleName(t)
+		if moduleName == "" {
+			return ModulesTasksLock.RUnlock
+		}
+		moduleLock = getLock(moduleLocks, moduleName)
+	}
+	moduleLock.Lock()
+	return func() {
+		moduleLock.Unlock()
+		ModulesTasksLock.RUnlock()
+	}
+}
+
+// isModuleEnabled returns true if the module is in the list of enabled modules.
+// ModuleRun and ModuleDelete tasks are in different queues, so the list is
+// checked before running the task.
+func isModuleEnabled(moduleName string) bool {
+	return utils.ListFullyIn([]string{moduleName}, ModuleManager.GetModuleNamesInOrder())
+}
+
+// taskModuleName returns a name of the module for module tasks and module hooks tasks.
+// Tasks with the same module name are executed in FIFO order, an empty name is for global tasks.
+func taskModuleName(t task.Task) string {
+	switch t.GetType() {
+	case task.ModuleRun, task.ModuleDelete:
+		return t.GetName()
+	case task.ModuleHookRun:
+		moduleHook, err := ModuleManager.GetModuleHook(t.GetName())
+		if err == nil && moduleHook != nil && moduleHook.Module != nil {
+			return moduleHook.Module.Name
+		}
+	}
+	return ""
+}
+
+// getLock returns a lock by name from moduleLocks or globalHookLocks.
+func getLock(locks map[string]*sync.Mutex, name string) *sync.Mutex {
+	moduleLocksMu.Lock()
+	defer moduleLocksMu.Unlock()
+	lock, ok := locks[name]
+	if !ok {
+		lock = &sync.Mutex{}
+		locks[name] = lock
+	}
+	return lock
+}
+
+// stopQueuesRunners pushes Stop task to the head of all queues except the main queue.
+func stopQueuesRunners() {
+	for _, queueName := range TasksQueues.Names() {
+		if queueName == task.MainQueueName {
+			continue
+		}
+		if tq := TasksQueues.Get(queueName); tq != nil {
+			tq.Push(task.NewTask(task.Stop, "stop runner"))
+		}
+	}
+}
+
+// ModulesDeleteQueueName is a name of the queue for ModuleDelete and ModulePurge tasks.
+const ModulesDeleteQueueName = "modules-delete"
+
+// ModuleQueueName returns a name of the queue for module tasks.
+func ModuleQueueName(moduleName string) string {
+	return fmt.Sprintf("module-%s", moduleName)
+}
+
+// TaskQueueName returns a name of the queue for the task. Queue from the task is used if set,
+// ModuleRun and module hooks tasks are queued into the module queue,
+// other tasks are queued into the main queue. ModuleDelete and ModulePurge tasks are
+// in a separate queue to delete modules one by one in order without blocking the main queue.
+func TaskQueueName(t task.Task) string {
+	if t.GetQueueName() != "" {
+		return t.GetQueueName()
+	}
+
+	switch t.GetType() {
+	case task.ModuleRun:
+		return ModuleQueueName(t.GetName())
+	case task.ModuleDelete, task.ModulePurge:
+		return ModulesDeleteQueueName
+	case task.ModuleHookRun:
+		moduleHook, err := ModuleManager.GetModuleHook(t.GetName())
+		if err == nil && moduleHook != nil && moduleHook.Module != nil {
+			return ModuleQueueName(moduleHook.Module.Name)
+		}
+	}
+
+	return task.MainQueueName
+}
+
+// AddTask adds the task to the end of the queue returned by TaskQueueName.
+func AddTask(t task.Task) {
+	TasksQueues.GetOrCreate(TaskQueueName(t)).Add(t)
+}
+
+// NewQueueStateStorage returns a ConfigMap storage if ConfigMap name is set or a file storage.
+// The file is in the state directory by default. Nil is returned if the directory of the file
+// is not writable, so tasks are not saved between restarts.
+func NewQueueStateStorage() task.QueueStateStorage {
+	if app.TasksQueueStateConfigMap != "" {
+		rlog.Infof("INIT: Tasks queue state ConfigMap: '%s'", app.TasksQueueStateConfigMap)
+		return task.NewConfigMapQueueStateStorage(app.Namespace, app.TasksQueueStateConfigMap)
+	}
+	stateFilePath := app.TasksQueueStateFilePath
+	if stateFilePath == "" {
+		stateFilePath = filepath.Join(app.StateDir, TasksQueueStateFileName)
+	}
+	if err := checkWritableDir(filepath.Dir(stateFilePath)); err != nil {
+		rlog.Warnf("INIT: Tasks are not saved between restarts, directory for tasks queue state file is not writable: %s", err)
+		return nil
+	}
+	rlog.Infof("INIT: Tasks queue state file: '%s'", stateFilePath)
+	return task.NewFileQueueStateStorage(stateFilePath)
+}
+
+// checkWritableDir creates the directory if needed and checks that a file can be created in it.
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// LoadSavedTasks loads tasks saved in the storage into SavedTasks.
+func LoadSavedTasks(storage task.QueueStateStorage) error {
+	data, err := storage.Load()
+	if err != nil {
+		return err
+	}
+
+	state, err := task.ParseQueueState(data)
+	if err != nil {
+		return err
+	}
+
+	savedTasksMu.Lock()
+	SavedTasks = state.Tasks
+	savedTasksMu.Unlock()
+	rlog.Infof("INIT: Loaded %d saved tasks", len(state.Tasks))
+	return nil
+}
+
+// pendingSavedTasks returns a copy of SavedTasks that are not restored yet.
+func pendingSavedTasks() []task.TaskState {
+	savedTasksMu.Lock()
+	defer savedTasksMu.Unlock()
+	return append([]task.TaskState{}, SavedTasks...)
+}
+
+// RestoreSavedGlobalTasks adds global hooks tasks from SavedTasks to the queues. Other saved tasks
+// are kept in SavedTasks until modules discovery.
+func RestoreSavedGlobalTasks() {
+	savedTasksMu.Lock()
+	defer savedTasksMu.Unlock()
+
+	rest := make([]task.TaskState, 0)
+	for _, taskState := range SavedTasks {
+		if taskState.Type != task.GlobalHookRun {
+			rest = append(rest, taskState)
+			continue
+		}
+		if !isRestorableTask(taskState, nil) {
+			rlog.Debugf("QUEUE skip saved task %s@%s '%s'", taskState.Type, taskState.Binding, taskState.Name)
+			continue
+		}
+		AddTask(taskState.Task())
+		rlog.Infof("QUEUE restore %s@%s %s", taskState.Type, taskState.Binding, taskState.Name)
+	}
+	SavedTasks = rest
+}
+
+// RestoreSavedTasks adds SavedTasks to the queues and clears them.
+//
+// Only schedule and kubernetes events hook tasks are restored, other tasks are
+// created again on startup. Tasks for hooks that are not found and tasks for hooks
+// of disabled modules are ignored.
+func RestoreSavedTasks(enabledModules []string) {
+	// The lock is held until SavedTasks are cleared, so restored tasks are not saved twice.
+	savedTasksMu.Lock()
+	defer savedTasksMu.Unlock()
+
+	if len(SavedTasks) == 0 {
+		return
+	}
+
+	enabled := make(map[string]bool)
+	for _, moduleName := range enabledModules {
+		enabled[moduleName] = true
+	}
+
+	restored := 0
+	for _, taskState := range SavedTasks {
+		if !isRestorableTask(taskState, enabled) {
+			rlog.Debugf("QUEUE skip saved task %s@%s '%s'", taskState.Type, taskState.Binding, taskState.Name)
+			continue
+		}
+		AddTask(taskState.Task())
+		restored++
+		rlog.Infof("QUEUE restore %s@%s %s", taskState.Type, taskState.Binding, taskState.Name)
+	}
+
+	rlog.Infof("QUEUE restored %d of %d saved tasks", restored, len(SavedTasks))
+	SavedTasks = nil
+}
+
+// isRestorableTask returns true for schedule and kubernetes events hook tasks if the hook
+// still exists and its module is enabled.
+func isRestorableTask(taskState task.TaskState, enabledModules map[string]bool) bool {
+	if taskState.Binding != module_manager.Schedule && taskState.Binding != module_manager.KubeEvents {
+		return false
+	}
+
+	switch taskState.Type {
+	case task.GlobalHookRun:
+		globalHook, err := ModuleManager.GetGlobalHook(taskState.Name)
+		return err == nil && globalHook != nil
+	case task.ModuleHookRun:
+		moduleHook, err := ModuleManager.GetModuleHook(taskState.Name)
+		return err == nil && moduleHook != nil && moduleHook.Module != nil && enabledModules[moduleHook.Module.Name]
+	}
+	return false
+}
+
 // UpdateScheduleHooks creates the new ScheduledHooks.
 // Calculates the difference between the old and the new schedule,
 // removes what was in the old but is missing in the new schedule.
@@ -534,8 +1422,12 @@ func UpdateScheduleHooks(storage schedule_hook.ScheduledHooksStorage) schedule_h
 	globalHooks := ModuleManager.GetGlobalHooksInOrder(module_manager.Schedule)
 LOOP_GLOBAL_HOOKS:
 	for _, globalHookName := range globalHooks {
-		globalHook, _ := ModuleManager.GetGlobalHook(globalHookName)
-		for _, schedule := range globalHook.Config.Schedule {
+		globalHook, err := ModuleManager.GetGlobalHook(globalHookName)
+		if err != nil || globalHook == nil {
+			rlog.Errorf("Schedule: cannot get global hook '%s': %v", globalHookName, err)
+			continue
+		}
+		for _, schedule := range globalHook.Config.ScheduleConfigs() {
 			_, err := ScheduleManager.Add(schedule.Crontab)
 			if err != nil {
 				rlog.Errorf("Schedule: cannot add '%s' for global hook '%s': %s", schedule.Crontab, globalHookName, err)
@@ -543,7 +1435,7 @@ LOOP_GLOBAL_HOOKS:
 			}
 			rlog.Debugf("Schedule: add '%s' for global hook '%s'", schedule.Crontab, globalHookName)
 		}
-		newScheduledTasks.AddHook(globalHook.Name, globalHook.Config.Schedule)
+		newScheduledTasks.AddHook(globalHook.Name, globalHook.Config.ScheduleConfigs())
 	}
 
 	modules := ModuleManager.GetModuleNamesInOrder()
@@ -551,8 +1443,12 @@ LOOP_GLOBAL_HOOKS:
 		moduleHooks, _ := ModuleManager.GetModuleHooksInOrder(moduleName, module_manager.Schedule)
 	LOOP_MODULE_HOOKS:
 		for _, moduleHookName := range moduleHooks {
-			moduleHook, _ := ModuleManager.GetModuleHook(moduleHookName)
-			for _, schedule := range moduleHook.Config.Schedule {
+			moduleHook, err := ModuleManager.GetModuleHook(moduleHookName)
+			if err != nil || moduleHook == nil {
+				rlog.Errorf("Schedule: cannot get hook '%s': %v", moduleHookName, err)
+				continue
+			}
+			for _, schedule := range moduleHook.Config.ScheduleConfigs() {
 				_, err := ScheduleManager.Add(schedule.Crontab)
 				if err != nil {
 					rlog.Errorf("Schedule: cannot add '%s' for hook '%s': %s", schedule.Crontab, moduleHookName, err)
@@ -560,7 +1456,7 @@ LOOP_GLOBAL_HOOKS:
 				}
 				rlog.Debugf("Schedule: add '%s' for hook '%s'", schedule.Crontab, moduleHookName)
 			}
-			newScheduledTasks.AddHook(moduleHook.Name, moduleHook.Config.Schedule)
+			newScheduledTasks.AddHook(moduleHook.Name, moduleHook.Config.ScheduleConfigs())
 		}
 	}
 
@@ -629,8 +1525,27 @@ func RunAddonOperatorMetrics() {
 
 	go func() {
 		for {
-			queueLen := float64(TasksQueue.Length())
-			MetricsStorage.SendGaugeMetric(PrefixMetric("tasks_queue_length"), queueLen, map[string]string{})
+			for _, queueName := range TasksQueues.Names() {
+				tq := TasksQueues.Get(queueName)
+				if tq == nil {
+					continue
+				}
+				queueLen := float64(tq.Length())
+				MetricsStorage.SendGaugeMetric(PrefixMetric("tasks_queue_length"), queueLen, map[string]string{"queue": queueName})
+				headAge := tq.HeadTaskAge(time.Now()).Seconds()
+				MetricsStorage.SendGaugeMetric(PrefixMetric("tasks_queue_head_age_seconds"), headAge, map[string]string{"queue": queueName})
+			}
+
+			failedCount := map[string]float64{}
+			for _, queueName := range TasksQueues.Names() {
+				failedCount[queueName] = 0.0
+			}
+			for _, failed := range TasksQueues.FailedTasks() {
+				failedCount[failed.QueueName]++
+			}
+			for queueName, count := range failedCount {
+				MetricsStorage.SendGaugeMetric(PrefixMetric("tasks_failed_count"), count, map[string]string{"queue": queueName})
+			}
 			time.Sleep(5 * time.Second)
 		}
 	}()
@@ -649,11 +1564,16 @@ func InitHttpServer(listenAddr string, listenPort string) error {
 	http.Handle("/metrics", promhttp.Handler())
 
 	http.HandleFunc("/healthz", func(writer http.ResponseWriter, request *http.Request) {
+		if app.Helm3 || !isHelmStarted() {
+			// There is no Tiller to check.
+			writer.WriteHeader(http.StatusOK)
+			return
+		}
 		helm.TillerHealthHandler(app.TillerProbeListenAddress, app.TillerProbeListenPort)(writer, request)
 	})
 
 	http.HandleFunc("/queue", func(writer http.ResponseWriter, request *http.Request) {
-		_, _ = io.Copy(writer, TasksQueue.DumpReader())
+		_, _ = io.Copy(writer, TasksQueues.DumpReader())
 	})
 
 	address := fmt.Sprintf("%s:%s", listenAddr, listenPort)
@@ -3,10 +3,14 @@ package addon_operator
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,13 +20,16 @@ import (
 	"gopkg.in/satori/go.uuid.v1"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/flant/shell-operator/pkg/kube_events_manager"
-	"github.com/flant/shell-operator/pkg/metrics_storage"
 	"github.com/flant/shell-operator/pkg/schedule_manager"
 
+	"github.com/flant/addon-operator/pkg/app"
 	"github.com/flant/addon-operator/pkg/helm"
 	"github.com/flant/addon-operator/pkg/kube_config_manager"
+	"github.com/flant/addon-operator/pkg/metrics_storage"
+	"github.com/flant/addon-operator/pkg/module_events"
 	"github.com/flant/addon-operator/pkg/module_manager"
 	"github.com/flant/addon-operator/pkg/task"
 )
@@ -41,10 +48,55 @@ func (obj *KubeEventsHooksControllerMock) DisableModuleHooks(moduleName string,
 	return nil
 }
 
+func (obj *KubeEventsHooksControllerMock) DisableGlobalHooks(eventsManager kube_events_manager.KubeEventsManager) error {
+	return nil
+}
+
+func (obj *KubeEventsHooksControllerMock) DisableAllHooks(eventsManager kube_events_manager.KubeEventsManager) error {
+	return nil
+}
+
 func (obj *KubeEventsHooksControllerMock) HandleEvent(kubeEvent kube_events_manager.KubeEvent) (*struct{ Tasks []task.Task }, error) {
 	return nil, nil
 }
 
+func (obj *KubeEventsHooksControllerMock) UpdateSnapshots(hookName string, bindingContext []module_manager.BindingContext) ([]module_manager.BindingContext, error) {
+	return bindingContext, nil
+}
+
+type ValidatingHooksControllerMock struct{}
+
+func (obj *ValidatingHooksControllerMock) Start(client kubernetes.Interface, certDir string, listenAddress string, listenPort string) (<-chan error, error) {
+	return make(chan error), nil
+}
+
+func (obj *ValidatingHooksControllerMock) Stop() error {
+	return nil
+}
+
+func (obj *ValidatingHooksControllerMock) DeleteConfiguration() error {
+	return nil
+}
+
+func (obj *ValidatingHooksControllerMock) EnableGlobalHooks(moduleManager module_manager.ModuleManager) error {
+	return nil
+}
+
+func (obj *ValidatingHooksControllerMock) EnableModuleHooks(moduleName string, moduleManager module_manager.ModuleManager) error {
+	return nil
+}
+
+func (obj *ValidatingHooksControllerMock) DisableModuleHooks(moduleName string) error {
+	return nil
+}
+
+func (obj *ValidatingHooksControllerMock) DisableGlobalHooks() error {
+	return nil
+}
+
+func (obj *ValidatingHooksControllerMock) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+}
+
 type KubeEventsManagerMock struct{}
 
 func (kem *KubeEventsManagerMock) Run(eventTypes []kube_events_manager.OnKubernetesEventType, kind, namespace string, labelSelector *metav1.LabelSelector, objectName, jqFilter string, debug bool) (string, error) {
@@ -60,6 +112,8 @@ type ModuleManagerMock struct {
 	TestModuleErrorsCount    int
 	DeleteModuleErrorsCount  int
 	ScheduledHookErrorsCount int
+	// RemoveHookOnError removes a failed scheduled hook like the files reload does.
+	RemoveHookOnError bool
 }
 
 var mainTestGlobalHooksMap = map[module_manager.BindingType][]string{
@@ -94,6 +148,7 @@ var scheduledHooks = map[string]schedule_manager.ScheduleConfig{
 }
 
 var runOrder = []int{}
+var runOrderLock sync.Mutex
 
 var globalT *testing.T
 
@@ -107,14 +162,20 @@ func (m *ModuleManagerMock) Run() {
 }
 
 func (m *ModuleManagerMock) GetModule(name string) (*module_manager.Module, error) {
-	panic("implement GetModule")
+	state, _ := m.DiscoverModulesState(nil)
+	for _, moduleName := range append(state.EnabledModules, state.ModulesToDisable...) {
+		if moduleName == name {
+			return &module_manager.Module{Name: name}, nil
+		}
+	}
+	panic(fmt.Sprintf("implement GetModule for '%s'", name))
 }
 
 func (m *ModuleManagerMock) GetModuleNamesInOrder() []string {
 	return []string{"test_module_1__101", "test_module_2__102"}
 }
 
-func (m *ModuleManagerMock) DiscoverModulesState() (*module_manager.ModulesState, error) {
+func (m *ModuleManagerMock) DiscoverModulesState(logLabels map[string]string) (*module_manager.ModulesState, error) {
 	return &module_manager.ModulesState{
 		EnabledModules: []string{"test_module_1__101", "test_module_2__102"},
 		ModulesToDisable: []string{"disabled_module_1__111", "disabled_2__112", "disabled_3.14__113"},
@@ -133,8 +194,8 @@ func (m *ModuleManagerMock) GetGlobalHook(name string) (*module_manager.GlobalHo
 			},
 			Config: &module_manager.GlobalHookConfig{
 				HookConfig: module_manager.HookConfig{
-					Schedule: []schedule_manager.ScheduleConfig{
-						scheduledHooks[name],
+					Schedule: []module_manager.ScheduleConfig{
+						{ScheduleConfig: scheduledHooks[name]},
 					},
 				},
 			},
@@ -171,8 +232,8 @@ func (m *ModuleManagerMock) GetModuleHook(name string) (*module_manager.ModuleHo
 			},
 			Config: &module_manager.ModuleHookConfig{
 				HookConfig: module_manager.HookConfig{
-					Schedule: []schedule_manager.ScheduleConfig{
-						scheduledHooks[name],
+					Schedule: []module_manager.ScheduleConfig{
+						{ScheduleConfig: scheduledHooks[name]},
 					},
 				},
 			},
@@ -207,7 +268,7 @@ func (m *ModuleManagerMock) GetModuleHooksInOrder(moduleName string, bindingType
 	return []string{"test_module_hook_1", "test_module_hook_2"}, nil
 }
 
-func (m *ModuleManagerMock) DeleteModule(moduleName string) error {
+func (m *ModuleManagerMock) DeleteModule(moduleName string, logLabels map[string]string) error {
 	addRunOrder(moduleName)
 	fmt.Printf("ModuleManagerMock DeleteModule '%s'\n", moduleName)
 	if strings.Contains(moduleName, "disabled_module_1") && m.DeleteModuleErrorsCount > 0 {
@@ -217,7 +278,7 @@ func (m *ModuleManagerMock) DeleteModule(moduleName string) error {
 	return nil
 }
 
-func (m *ModuleManagerMock) RunModule(moduleName string, onStartup bool) error {
+func (m *ModuleManagerMock) RunModule(moduleName string, onStartup bool, logLabels map[string]string) error {
 	addRunOrder(moduleName)
 	fmt.Printf("ModuleManagerMock RunModule '%s'\n", moduleName)
 	if strings.Contains(moduleName, "test_module_2") && m.TestModuleErrorsCount > 0 {
@@ -227,7 +288,7 @@ func (m *ModuleManagerMock) RunModule(moduleName string, onStartup bool) error {
 	return nil
 }
 
-func (m *ModuleManagerMock) RunGlobalHook(hookName string, binding module_manager.BindingType, bindingContext []module_manager.BindingContext) error {
+func (m *ModuleManagerMock) RunGlobalHook(hookName string, binding module_manager.BindingType, bindingContext []module_manager.BindingContext, logLabels map[string]string) error {
 	addRunOrder(hookName)
 	fmt.Printf("Run global hook name '%s' binding '%s'\n", hookName, binding)
 	if strings.Contains(hookName, "before_hook_1") && m.BeforeHookErrorsCount > 0 {
@@ -237,11 +298,14 @@ func (m *ModuleManagerMock) RunGlobalHook(hookName string, binding module_manage
 	return nil
 }
 
-func (m *ModuleManagerMock) RunModuleHook(hookName string, binding module_manager.BindingType, bindingContext []module_manager.BindingContext) error {
+func (m *ModuleManagerMock) RunModuleHook(hookName string, binding module_manager.BindingType, bindingContext []module_manager.BindingContext, logLabels map[string]string) error {
 	addRunOrder(hookName)
 	fmt.Printf("Run module hook name '%s' binding '%s'\n", hookName, binding)
 	if strings.Contains(hookName, "scheduled_module_1") && m.ScheduledHookErrorsCount > 0 {
 		m.ScheduledHookErrorsCount--
+		if m.RemoveHookOnError {
+			delete(scheduledHooks, hookName)
+		}
 		return fmt.Errorf("fake module hook error: /bin/ash not found")
 	}
 	return nil
@@ -251,16 +315,39 @@ func (m *ModuleManagerMock) Retry() {
 	fmt.Println("ModuleManagerMock Retry")
 }
 
+func (m *ModuleManagerMock) DetectFilesChanges() (*module_manager.FilesChanges, error) {
+	return &module_manager.FilesChanges{}, nil
+}
+
+func (m *ModuleManagerMock) ApplyFilesChanges(changes *module_manager.FilesChanges) error {
+	return nil
+}
+
 func (m *ModuleManagerMock) WithDirectories(modulesDir string, globalHooksDir string, tempDir string) module_manager.ModuleManager {
 	fmt.Println("WithDirectories")
 	return m
 }
 
+func (m *ModuleManagerMock) WithModuleSources(moduleSources []string) module_manager.ModuleManager {
+	fmt.Println("WithModuleSources")
+	return m
+}
+
 func (m *ModuleManagerMock) WithKubeConfigManager(kubeConfigManager kube_config_manager.KubeConfigManager) module_manager.ModuleManager {
 	fmt.Println("WithKubeConfigManager")
 	return m
 }
 
+func (m *ModuleManagerMock) WithMetricStorage(metricStorage *metrics_storage.MetricStorage) module_manager.ModuleManager {
+	fmt.Println("WithMetricStorage")
+	return m
+}
+
+func (m *ModuleManagerMock) WithEventRecorder(eventRecorder *module_events.Recorder) module_manager.ModuleManager {
+	fmt.Println("WithEventRecorder")
+	return m
+}
+
 
 type MockHelmClient struct {
 	helm.HelmClient
@@ -290,7 +377,65 @@ func addRunOrder(name string) {
 	if err != nil {
 		globalT.Fatalf("Cannot parse number from order '%s' from name '%s'", order, name)
 	}
+	runOrderLock.Lock()
 	runOrder = append(runOrder, orderI)
+	runOrderLock.Unlock()
+}
+
+// tasksCount returns a count of tasks in all queues.
+func tasksCount() int {
+	count := 0
+	for _, name := range TasksQueues.Names() {
+		count += TasksQueues.Get(name).Length()
+	}
+	return count
+}
+
+// isModuleTaskOrder returns true for orders of ModuleRun tasks from ModuleManagerMock.
+// These tasks are running concurrently in modules queues.
+func isModuleTaskOrder(ord int) bool {
+	return ord > 100 && ord < 110
+}
+
+// isModulesDeleteTaskOrder returns true for orders of ModuleDelete and ModulePurge tasks from ModuleManagerMock.
+// These tasks run in order in the modules-delete queue.
+func isModulesDeleteTaskOrder(ord int) bool {
+	return ord > 110 && ord < 130
+}
+
+// assertMainQueueRunOrder checks that tasks from the main queue and from the modules-delete queue
+// run in order and afterAll hooks run after the first run of every ModuleRun task.
+// Failed modules tasks can be retried after afterAll hooks.
+func assertMainQueueRunOrder(t *testing.T) {
+	runOrderLock.Lock()
+	defer runOrderLock.Unlock()
+
+	accum := 0
+	deleteAccum := 0
+	lastModuleFirstRunIdx := -1
+	moduleRuns := map[int]bool{}
+	for i, ord := range runOrder {
+		if isModuleTaskOrder(ord) {
+			if !moduleRuns[ord] {
+				moduleRuns[ord] = true
+				lastModuleFirstRunIdx = i
+			}
+			continue
+		}
+		if isModulesDeleteTaskOrder(ord) {
+			assert.True(t, ord >= deleteAccum, "detect unordered delete: '%d' '%d'\n%+v", deleteAccum, ord, runOrder)
+			deleteAccum = ord
+			continue
+		}
+		assert.True(t, ord >= accum, "detect unordered execution: '%d' '%d'\n%+v", accum, ord, runOrder)
+		accum = ord
+	}
+
+	for i, ord := range runOrder {
+		if ord >= 200 && ord < 300 {
+			assert.True(t, i > lastModuleFirstRunIdx, "afterAll hook '%d' run before modules tasks\n%+v", ord, runOrder)
+		}
+	}
 }
 
 type QueueDumperTest struct {
@@ -313,9 +458,10 @@ func TestMain_TaskRunner_CreateOnStartupTasks(t *testing.T) {
 
 	fmt.Println("Create queue")
 	// Fill a queue
-	TasksQueue = task.NewTasksQueue()
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
 	// watcher for more verbosity of CreateStartupTasks and
-	TasksQueue.AddWatcher(&QueueDumperTest{})
+	TasksQueues.AddWatcher(&QueueDumperTest{})
 	TasksQueue.ChangesEnable(true)
 
 	// Add StartupTasks
@@ -347,9 +493,10 @@ func TestMain_ModulesEventsHandler(t *testing.T) {
 
 	fmt.Println("Create queue")
 	// Fill a queue
-	TasksQueue = task.NewTasksQueue()
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
 	// watcher for more verbosity of CreateStartupTasks and
-	TasksQueue.AddWatcher(&QueueDumperTest{})
+	TasksQueues.AddWatcher(&QueueDumperTest{})
 	TasksQueue.ChangesEnable(true)
 
 	assert.Equal(t, 0, TasksQueue.Length())
@@ -401,24 +548,31 @@ func TestMain_ModulesEventsHandler(t *testing.T) {
 	expectedCount += len(ModuleManager.GetGlobalHooksInOrder(module_manager.BeforeAll))
 	expectedCount += 1 // DiscoverModulesState task
 
-	assert.Equal(t, expectedCount, TasksQueue.Length())
+	assert.Equal(t, expectedCount, tasksCount())
+
+	// ModuleRun tasks are in modules queues.
+	assert.Equal(t, 2, TasksQueues.Get(ModuleQueueName("test_module_1")).Length())
+	assert.Equal(t, 2, TasksQueues.Get(ModuleQueueName("test_module_2")).Length())
 }
 
 func TestMain(m *testing.M) {
 
 	MetricsStorage = metrics_storage.Init()
+	ValidatingHooks = &ValidatingHooksControllerMock{}
 
 	os.Exit(m.Run())
 }
 
 // Тест совместной работы ManagersEventsHandler и TaskRunner.
-// один модуль выдаёт ошибку, TaskRunner должен его перезапускать, не запуская другие модули
-// проверяется, что модули запускаются по порядку (порядок в runOrder — суффикс имени "__число")
+// один модуль выдаёт ошибку, TaskRunner должен его перезапускать, другие модули запускаются в своих очередях,
+// afterAll хуки и следующие задания основной очереди не ждут модуль с ошибкой.
+// проверяется, что задания из основной очереди запускаются по порядку (порядок в runOrder — суффикс имени "__число")
 func TestMain_Run_With_InfiniteModuleError(t *testing.T) {
 	// Настройки задержек при ошибках и пустой очереди, чтобы тест побыстрее завершался.
 	QueueIsEmptyDelay = 50 * time.Millisecond
 	FailedHookDelay = 50 * time.Millisecond
 	FailedModuleDelay = 50 * time.Millisecond
+	app.FailedTaskMaxDelay = 50 * time.Millisecond
 
 	module_manager.EventCh = make(chan module_manager.Event, 1)
 	ManagersEventsHandlerStopCh = make(chan struct{}, 1)
@@ -443,14 +597,19 @@ func TestMain_Run_With_InfiniteModuleError(t *testing.T) {
 	// Создать очередь
 	fmt.Println("Create queue")
 	// Fill a queue
-	TasksQueue = task.NewTasksQueue()
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
 	// watcher for more verbosity of CreateStartupTasks and
-	TasksQueue.AddWatcher(&QueueDumperTest{})
+	TasksQueues.AddWatcher(&QueueDumperTest{})
 	TasksQueue.ChangesEnable(true)
 
 	Run()
 
-	time.Sleep(1000 * time.Millisecond)
+	// A schedule hook task is queued after afterAll hooks.
+	time.Sleep(300 * time.Millisecond)
+	TasksQueue.Add(task.NewTask(task.GlobalHookRun, "later_hook__301").WithBinding(module_manager.Schedule))
+
+	time.Sleep(700 * time.Millisecond)
 	// Stop events handler
 	ManagersEventsHandlerStopCh <- struct{}{}
 	// stop tasks runner: add stop task
@@ -460,17 +619,76 @@ func TestMain_Run_With_InfiniteModuleError(t *testing.T) {
 	fmt.Println("wait for queueIsEmptyDelay")
 	time.Sleep(100 * time.Millisecond)
 
-	assert.True(t, TasksQueue.Length() > 0, "queue is empty with errored module %d", TasksQueue.Length())
+	assert.True(t, TasksQueues.Get(ModuleQueueName("test_module_2__102")).Length() > 0, "module queue is empty with errored module")
 
-	accum := 0
-	for _, ord := range runOrder {
-		assert.True(t, ord >= accum, "detect unordered execution: '%d' '%d'\n%+v", accum, ord, runOrder)
-		accum = ord
+	assertMainQueueRunOrder(t)
+
+	runOrderLock.Lock()
+	for _, ord := range []int{101, 111, 112, 113} {
+		assert.Contains(t, runOrder, ord, "module task '%d' is blocked by errored module", ord)
+	}
+	for _, ord := range []int{201, 202, 301} {
+		assert.Contains(t, runOrder, ord, "main queue task '%d' is blocked by errored module\n%+v", ord, runOrder)
 	}
+	runOrderLock.Unlock()
 
 	fmt.Printf("runOrder: %+v", runOrder)
 }
 
+// Тест ограничения количества повторов: модуль с ошибкой перемещается в список упавших заданий
+// после app.TaskMaxRetries повторов, afterAll хуки запускаются, очереди пустые.
+func TestMain_Run_With_MaxRetries(t *testing.T) {
+	QueueIsEmptyDelay = 50 * time.Millisecond
+	FailedHookDelay = 50 * time.Millisecond
+	FailedModuleDelay = 50 * time.Millisecond
+	app.FailedTaskMaxDelay = 50 * time.Millisecond
+	app.TaskMaxRetries = 3
+	defer func() {
+		app.TaskMaxRetries = 0
+	}()
+
+	module_manager.EventCh = make(chan module_manager.Event, 1)
+	ManagersEventsHandlerStopCh = make(chan struct{}, 1)
+
+	runOrder = []int{}
+
+	helm.Client = MockHelmClient{}
+
+	ModuleManager = &ModuleManagerMock{
+		TestModuleErrorsCount: 10000,
+	}
+
+	ScheduleManager = &MockScheduleManager{}
+
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
+	TasksQueues.AddWatcher(&QueueDumperTest{})
+	TasksQueue.ChangesEnable(true)
+
+	Run()
+
+	time.Sleep(1000 * time.Millisecond)
+	ManagersEventsHandlerStopCh <- struct{}{}
+	TasksQueue.Add(task.NewTask(task.Stop, "stop runner"))
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Equalf(t, 0, tasksCount(), "%d tasks remain in queues after TasksRunner", tasksCount())
+
+	failed := TasksQueues.FailedTasks()
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, ModuleQueueName("test_module_2__102"), failed[0].QueueName)
+		assert.Equal(t, task.ModuleRun, failed[0].Task.GetType())
+		assert.Equal(t, 4, failed[0].Task.GetFailureCount())
+	}
+
+	assertMainQueueRunOrder(t)
+
+	runOrderLock.Lock()
+	assert.Contains(t, runOrder, 201, "afterAll hooks should run after failed module")
+	assert.Contains(t, runOrder, 202, "afterAll hooks should run after failed module")
+	runOrderLock.Unlock()
+}
+
 // Тест совместной работы ManagersEventsHandler и TaskRunner.
 // Модули и хуки выдают ошибки, TaskRunner должен их перезапускать, не запуская следующие задания.
 // Проверяется, что модули и хуки запускаются по порядку (порядок в runOrder — суффикс имени "__число")
@@ -479,6 +697,7 @@ func TestMain_Run_With_RecoverableErrors(t *testing.T) {
 	QueueIsEmptyDelay = 50 * time.Millisecond
 	FailedHookDelay = 50 * time.Millisecond
 	FailedModuleDelay = 50 * time.Millisecond
+	app.FailedTaskMaxDelay = 50 * time.Millisecond
 
 	module_manager.EventCh = make(chan module_manager.Event, 1)
 	ManagersEventsHandlerStopCh = make(chan struct{}, 1)
@@ -502,9 +721,10 @@ func TestMain_Run_With_RecoverableErrors(t *testing.T) {
 
 	fmt.Println("Create queue")
 	// Fill a queue
-	TasksQueue = task.NewTasksQueue()
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
 	// watcher for more verbosity of CreateStartupTasks and
-	TasksQueue.AddWatcher(&QueueDumperTest{})
+	TasksQueues.AddWatcher(&QueueDumperTest{})
 	TasksQueue.ChangesEnable(true)
 
 	Run()
@@ -517,19 +737,115 @@ func TestMain_Run_With_RecoverableErrors(t *testing.T) {
 	TasksQueue.Add(stopTask)
 
 	fmt.Println("wait for queueIsEmptyDelay")
-	time.Sleep(100 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
 
-	assert.Equalf(t, 0, TasksQueue.Length(), "%d tasks remain in queue after TasksRunner", TasksQueue.Length())
+	assert.Equalf(t, 0, tasksCount(), "%d tasks remain in queues after TasksRunner", tasksCount())
 
-	accum := 0
-	for _, ord := range runOrder {
-		assert.True(t, ord >= accum, "detect unordered execution: '%d' '%d'\n%+v", accum, ord, runOrder)
-		accum = ord
-	}
+	assertMainQueueRunOrder(t)
 
 	fmt.Printf("runOrder: %+v", runOrder)
 }
 
+type MockQueueStateStorage struct {
+	Data []byte
+}
+
+func (m *MockQueueStateStorage) Save(data []byte) error {
+	m.Data = data
+	return nil
+}
+
+func (m *MockQueueStateStorage) Load() ([]byte, error) {
+	return m.Data, nil
+}
+
+// Восстановление заданий: восстанавливаются только задания хуков по расписанию и по событиям
+// для существующих хуков включённых модулей, задания для модулей создаются заново при старте.
+func TestRestoreSavedTasks(t *testing.T) {
+	ModuleManager = &ModuleManagerMock{}
+
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
+
+	saved := task.NewTasksQueueSet()
+	saved.GetMain().Add(task.NewTask(task.GlobalHookRun, "scheduled_global_1").WithBinding(module_manager.Schedule))
+	saved.GetMain().Add(task.NewTask(task.GlobalHookRun, "before_hook_1").WithBinding(module_manager.BeforeAll))
+	saved.GetMain().Add(task.NewTask(task.DiscoverModulesState, ""))
+	saved.GetOrCreate("module-test_module").Add(task.NewTask(task.ModuleHookRun, "scheduled_module_1").
+		WithBinding(module_manager.KubeEvents).
+		AppendBindingContext(module_manager.BindingContext{Binding: "kubernetes", ResourceName: "pod-1"}))
+	saved.GetOrCreate("module-test_module").Add(task.NewTask(task.ModuleRun, "test_module"))
+	saved.GetOrCreate("module-removed").Add(task.NewTask(task.ModuleHookRun, "removed_hook").WithBinding(module_manager.Schedule))
+
+	storage := &MockQueueStateStorage{}
+	assert.NoError(t, task.NewTasksQueuePersister(saved, storage, time.Second).Save())
+
+	err := LoadSavedTasks(storage)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tasksCount())
+
+	// Global hooks tasks are restored before onStartup tasks.
+	RestoreSavedGlobalTasks()
+	assert.Equal(t, 1, tasksCount())
+	assert.Equal(t, 1, TasksQueue.Length())
+
+	// Not restored tasks are saved with tasks from queues.
+	pendingStorage := &MockQueueStateStorage{}
+	persister := task.NewTasksQueuePersister(TasksQueues, pendingStorage, time.Second).WithPendingTasks(pendingSavedTasks)
+	assert.NoError(t, persister.Save())
+	state, err := task.ParseQueueState(pendingStorage.Data)
+	if assert.NoError(t, err) {
+		assert.Len(t, state.Tasks, 5)
+	}
+
+	// Module hooks tasks are restored after modules discovery.
+	RestoreSavedTasks([]string{"test_module"})
+	assert.Nil(t, SavedTasks)
+
+	assert.Equal(t, 2, tasksCount())
+	assert.Equal(t, 1, TasksQueue.Length())
+	assert.NoError(t, persister.Save())
+	state, err = task.ParseQueueState(pendingStorage.Data)
+	if assert.NoError(t, err) {
+		assert.Len(t, state.Tasks, 2)
+	}
+	if assert.NotNil(t, TasksQueues.Get(ModuleQueueName("test_module"))) {
+		restored, _ := TasksQueues.Get(ModuleQueueName("test_module")).Peek()
+		assert.Equal(t, task.ModuleHookRun, restored.GetType())
+		assert.Equal(t, "pod-1", restored.GetBindingContext()[0].ResourceName)
+	}
+	assert.Nil(t, TasksQueues.Get("module-removed"))
+
+	// Tasks for hooks of disabled modules are not restored.
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
+	assert.NoError(t, LoadSavedTasks(storage))
+	RestoreSavedGlobalTasks()
+	RestoreSavedTasks([]string{})
+	assert.Equal(t, 1, tasksCount())
+	assert.Nil(t, TasksQueues.Get(ModuleQueueName("test_module")))
+}
+
+// Tasks are not saved if the directory of the state file is not writable.
+func TestNewQueueStateStorage_NotWritable(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	defer func() {
+		app.TasksQueueStateFilePath = ""
+	}()
+
+	app.TasksQueueStateFilePath = filepath.Join(tmpFile.Name(), "tasks-queue.json")
+	assert.Nil(t, NewQueueStateStorage())
+
+	app.TasksQueueStateFilePath = tmpFile.Name() + ".json"
+	defer os.Remove(app.TasksQueueStateFilePath)
+	assert.NotNil(t, NewQueueStateStorage())
+}
+
 type MockScheduleManager struct {
 	schedule_manager.ScheduleManager
 }
@@ -559,6 +875,7 @@ func TestMain_ScheduledTasks(t *testing.T) {
 	QueueIsEmptyDelay = 50 * time.Millisecond
 	FailedHookDelay = 50 * time.Millisecond
 	FailedModuleDelay = 50 * time.Millisecond
+	app.FailedTaskMaxDelay = 50 * time.Millisecond
 
 	module_manager.EventCh = make(chan module_manager.Event, 1)
 	ManagersEventsHandlerStopCh = make(chan struct{}, 1)
@@ -586,9 +903,10 @@ func TestMain_ScheduledTasks(t *testing.T) {
 
 	fmt.Println("Create queue")
 	// Fill a queue
-	TasksQueue = task.NewTasksQueue()
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
 	// watcher for more verbosity of CreateStartupTasks and
-	TasksQueue.AddWatcher(&QueueDumperTest{})
+	TasksQueues.AddWatcher(&QueueDumperTest{})
 	TasksQueue.ChangesEnable(true)
 
 	stepCh := make(chan struct{})
@@ -644,16 +962,12 @@ func TestMain_ScheduledTasks(t *testing.T) {
 	TasksQueue.Add(stopTask)
 
 	fmt.Println("wait for queueIsEmptyDelay")
-	time.Sleep(100 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
 
-	assert.Equalf(t, 0, TasksQueue.Length(), "%d tasks remain in queue after TasksRunner", TasksQueue.Length())
+	assert.Equalf(t, 0, tasksCount(), "%d tasks remain in queues after TasksRunner", tasksCount())
 
 	// TODO надо этот order переделать, чтобы были не чиселки, а лог выполнения модулей/хуков
-	accum := 0
-	for _, ord := range runOrder {
-		assert.True(t, ord >= accum, "detect unordered execution: '%d' '%d'\n%+v", accum, ord, runOrder)
-		accum = ord
-	}
+	assertMainQueueRunOrder(t)
 
 	fmt.Printf("runOrder: %+v", runOrder)
 }
@@ -714,3 +1028,280 @@ func TestDumpModuleManagerInfo(t *testing.T) {
 	}
 	rlog.Debugf("=== END ModuleManager Dump ===")
 }
+
+// Tasks runners are stopped after the current task, other tasks stay in the queue.
+func TestStopTasksRunners(t *testing.T) {
+	QueueIsEmptyDelay = 50 * time.Millisecond
+	defer func() {
+		tasksRunnersStopCh = make(chan struct{})
+		tasksRunnersStopOnce = sync.Once{}
+	}()
+
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
+	TasksQueue.Add(task.NewTaskDelay(10 * time.Second))
+	TasksQueue.Add(task.NewTaskDelay(10 * time.Second))
+	go TasksRunner()
+
+	// The delay is interrupted.
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, StopTasksRunners(2*time.Second))
+	assert.Equal(t, 1, TasksQueue.Length())
+}
+
+// Module hook from a custom queue waits for the ModuleRun of its module.
+func TestLockTasks_ModuleTasks(t *testing.T) {
+	ModuleManager = &ModuleManagerMock{}
+	TasksQueues = task.NewTasksQueueSet()
+	moduleQueue := TasksQueues.GetOrCreate(ModuleQueueName("test_module"))
+	customQueue := TasksQueues.GetOrCreate("custom")
+	otherQueue := TasksQueues.GetOrCreate(ModuleQueueName("other_module"))
+
+	unlock := lockTasks(moduleQueue, task.NewTask(task.ModuleRun, "test_module"))
+
+	// Tasks of other modules are not blocked.
+	unlockOther := lockTasks(otherQueue, task.NewTask(task.ModuleRun, "other_module"))
+	unlockOther()
+
+	locked := make(chan struct{})
+	go func() {
+		unlockHook := lockTasks(customQueue, task.NewTask(task.ModuleHookRun, "scheduled_module_1"))
+		close(locked)
+		unlockHook()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("module hook from a custom queue should wait for ModuleRun")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("module hook is not run after ModuleRun")
+	}
+}
+
+// A global hook with bindings in two custom queues is not run concurrently.
+func TestLockTasks_GlobalHookTasks(t *testing.T) {
+	ModuleManager = &ModuleManagerMock{}
+	TasksQueues = task.NewTasksQueueSet()
+	firstQueue := TasksQueues.GetOrCreate("first")
+	secondQueue := TasksQueues.GetOrCreate("second")
+
+	unlock := lockTasks(firstQueue, task.NewTask(task.GlobalHookRun, "global-hook"))
+
+	// Other global hooks are not blocked.
+	unlockOther := lockTasks(secondQueue, task.NewTask(task.GlobalHookRun, "other-global-hook"))
+	unlockOther()
+
+	locked := make(chan struct{})
+	go func() {
+		unlockHook := lockTasks(secondQueue, task.NewTask(task.GlobalHookRun, "global-hook"))
+		close(locked)
+		unlockHook()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("global hook from the second queue should wait for the first run")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("global hook is not run after the first run")
+	}
+}
+
+// ModuleDelete is queued into the modules-delete queue, so ModuleRun of a disabled module
+// and ModuleDelete of an enabled module are skipped.
+func TestQueueTasksRunner_SkipsModuleTasksForChangedState(t *testing.T) {
+	ModuleManager = &ModuleManagerMock{}
+	TasksQueues = task.NewTasksQueueSet()
+	runOrder = []int{}
+
+	assert.Equal(t, ModulesDeleteQueueName, TaskQueueName(task.NewTask(task.ModuleDelete, "disabled_module_1__111")))
+	assert.Equal(t, ModulesDeleteQueueName, TaskQueueName(task.NewTask(task.ModulePurge, "unknown_module_1__121")))
+	assert.Equal(t, ModuleQueueName("test_module_1__101"), TaskQueueName(task.NewTask(task.ModuleRun, "test_module_1__101")))
+
+	tq := task.NewTasksQueue().WithName("test")
+	tq.Add(task.NewTask(task.ModuleRun, "disabled_module_1__111"))
+	tq.Add(task.NewTask(task.ModuleDelete, "test_module_1__101"))
+	tq.Add(task.NewTask(task.ModuleRun, "test_module_2__102"))
+	tq.Add(task.NewTask(task.Stop, "stop runner"))
+	QueueTasksRunner(tq)
+
+	runOrderLock.Lock()
+	assert.Equal(t, []int{102}, runOrder)
+	runOrderLock.Unlock()
+}
+
+// A hook removed while it is running fails without a panic, its retry is skipped.
+func TestQueueTasksRunner_RemovedHook(t *testing.T) {
+	FailedModuleDelay = 50 * time.Millisecond
+	app.FailedTaskMaxDelay = 50 * time.Millisecond
+	defer func(config schedule_manager.ScheduleConfig) {
+		scheduledHooks["scheduled_module_1"] = config
+	}(scheduledHooks["scheduled_module_1"])
+	ModuleManager = &ModuleManagerMock{ScheduledHookErrorsCount: 1, RemoveHookOnError: true}
+	TasksQueues = task.NewTasksQueueSet()
+	runOrder = []int{}
+
+	tq := task.NewTasksQueue().WithName("custom")
+	tq.Add(task.NewTask(task.ModuleHookRun, "scheduled_module_1").WithBinding(module_manager.Schedule))
+	tq.Add(task.NewTask(task.Stop, "stop runner"))
+	QueueTasksRunner(tq)
+
+	assert.True(t, tq.IsEmpty())
+	assert.Len(t, TasksQueues.FailedTasks(), 0)
+}
+
+// A task waiting for a retry is passed only by tasks of other modules. Tasks of the same module
+// and tasks in the main queue keep their order.
+func TestQueueTasksRunner_FailedTaskOrder(t *testing.T) {
+	QueueIsEmptyDelay = 50 * time.Millisecond
+	ModuleManager = &ModuleManagerMock{}
+	TasksQueues = task.NewTasksQueueSet()
+
+	runQueue := func(tq *task.TasksQueue) []int {
+		runOrder = []int{}
+		done := make(chan struct{})
+		go func() {
+			QueueTasksRunner(tq)
+			close(done)
+		}()
+		time.Sleep(400 * time.Millisecond)
+		tq.Push(task.NewTask(task.Stop, "stop runner"))
+		<-done
+		runOrderLock.Lock()
+		defer runOrderLock.Unlock()
+		return append([]int{}, runOrder...)
+	}
+
+	mainQueue := task.NewTasksQueue().WithName(task.MainQueueName)
+	waitingHook := task.NewTask(task.GlobalHookRun, "hook_1__1").WithBinding(module_manager.Schedule)
+	waitingHook.SetRetryAt(time.Now().Add(200 * time.Millisecond))
+	mainQueue.Add(waitingHook)
+	mainQueue.Add(task.NewTask(task.GlobalHookRun, "hook_2__2").WithBinding(module_manager.Schedule))
+	assert.Equal(t, []int{1, 2}, runQueue(mainQueue))
+
+	customQueue := task.NewTasksQueue().WithName("custom")
+	waitingModule := task.NewTask(task.ModuleRun, "test_module_2__102")
+	waitingModule.SetRetryAt(time.Now().Add(200 * time.Millisecond))
+	customQueue.Add(waitingModule)
+	customQueue.Add(task.NewTask(task.ModuleRun, "test_module_2__102"))
+	customQueue.Add(task.NewTask(task.ModuleRun, "test_module_1__101"))
+	assert.Equal(t, []int{101, 102, 102}, runQueue(customQueue))
+}
+
+// A failed ModuleDelete task blocks the modules-delete queue: a required module is not deleted
+// before a consumer even if retries are exhausted or the task waits for a retry.
+func TestQueueTasksRunner_ModulesDeleteOrder(t *testing.T) {
+	QueueIsEmptyDelay = 50 * time.Millisecond
+	FailedModuleDelay = 50 * time.Millisecond
+	app.FailedTaskMaxDelay = 50 * time.Millisecond
+	defer func(maxRetries int) {
+		app.TaskMaxRetries = maxRetries
+	}(app.TaskMaxRetries)
+	app.TaskMaxRetries = 1
+	ModuleManager = &ModuleManagerMock{DeleteModuleErrorsCount: 2}
+	TasksQueues = task.NewTasksQueueSet()
+
+	deleteQueue := task.NewTasksQueue().WithName(ModulesDeleteQueueName)
+	deleteQueue.Add(task.NewTask(task.ModuleDelete, "disabled_module_1__111"))
+	deleteQueue.Add(task.NewTask(task.ModuleDelete, "disabled_2__112"))
+	waitingTask := task.NewTask(task.ModuleDelete, "disabled_3.14__113")
+	waitingTask.SetRetryAt(time.Now().Add(700 * time.Millisecond))
+	deleteQueue.Add(waitingTask)
+	deleteQueue.Add(task.NewTask(task.ModuleDelete, "disabled_2__112"))
+
+	runOrder = []int{}
+	done := make(chan struct{})
+	go func() {
+		QueueTasksRunner(deleteQueue)
+		close(done)
+	}()
+	time.Sleep(1200 * time.Millisecond)
+	deleteQueue.Push(task.NewTask(task.Stop, "stop runner"))
+	<-done
+
+	runOrderLock.Lock()
+	defer runOrderLock.Unlock()
+	assert.Equal(t, []int{111, 111, 111, 112, 113, 112}, runOrder)
+	assert.Len(t, TasksQueues.FailedTasks(), 0)
+}
+
+type memoryQueueStateStorage struct {
+	data []byte
+}
+
+func (s *memoryQueueStateStorage) Save(data []byte) error {
+	s.data = data
+	return nil
+}
+
+func (s *memoryQueueStateStorage) Load() ([]byte, error) {
+	return s.data, nil
+}
+
+// Shutdown stops the events handler, waits for the current task and saves the rest of the queue.
+func TestShutdown(t *testing.T) {
+	QueueIsEmptyDelay = 50 * time.Millisecond
+	defer func() {
+		tasksRunnersStopCh = make(chan struct{})
+		tasksRunnersStopOnce = sync.Once{}
+		ManagersEventsHandlerStopCh = nil
+		QueuePersister = nil
+		shutdownOnce = sync.Once{}
+	}()
+
+	KubeEventsHooks = &KubeEventsHooksControllerMock{}
+	ManagersEventsHandlerStopCh = make(chan struct{})
+	handlerStopped := make(chan struct{})
+	go func() {
+		ManagersEventsHandler()
+		close(handlerStopped)
+	}()
+
+	TasksQueues = task.NewTasksQueueSet()
+	TasksQueue = TasksQueues.GetMain()
+	storage := &memoryQueueStateStorage{}
+	QueuePersister = task.NewTasksQueuePersister(TasksQueues, storage, time.Hour)
+	TasksQueue.Add(task.NewTaskDelay(200 * time.Millisecond))
+	TasksQueue.Add(task.NewTask(task.GlobalHookRun, "hook-1"))
+	go TasksRunner()
+
+	time.Sleep(50 * time.Millisecond)
+	Shutdown(2 * time.Second)
+
+	<-handlerStopped
+	// Second call, e.g. SIGTERM after the lease loss, does nothing.
+	Shutdown(2 * time.Second)
+	assert.Equal(t, 1, TasksQueue.Length())
+	state, err := task.ParseQueueState(storage.data)
+	if assert.NoError(t, err) && assert.Len(t, state.Tasks, 1) {
+		assert.Equal(t, "hook-1", state.Tasks[0].Name)
+	}
+}
+
+// The leader should stop commands on the lease loss before a new leader acquires the lease.
+func TestValidateLeaderElectionDurations(t *testing.T) {
+	defer func(leaseDuration, renewDeadline time.Duration) {
+		app.LeaderElectionLeaseDuration = leaseDuration
+		app.LeaderElectionRenewDeadline = renewDeadline
+	}(app.LeaderElectionLeaseDuration, app.LeaderElectionRenewDeadline)
+
+	assert.NoError(t, validateLeaderElectionDurations())
+
+	app.LeaderElectionLeaseDuration = 15 * time.Second
+	app.LeaderElectionRenewDeadline = 14 * time.Second
+	assert.Error(t, validateLeaderElectionDurations())
+
+	app.LeaderElectionRenewDeadline = 15 * time.Second
+	assert.Error(t, validateLeaderElectionDurations())
+}
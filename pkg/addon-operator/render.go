@@ -0,0 +1,81 @@
+package addon_operator
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ghodss/yaml"
+	"github.com/romana/rlog"
+
+	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/helm"
+	"github.com/flant/addon-operator/pkg/kube_config_manager"
+	"github.com/flant/addon-operator/pkg/module_manager"
+)
+
+// Render loads modules and global hooks and writes enabled modules, their effective values
+// and helm template output to out in YAML format. Kubernetes, Tiller and hooks runs are not required:
+// values are loaded from a ConfigMap data file and hooks results are loaded from a patches fixtures file.
+// Both files are optional.
+func Render(configDataPath string, hookPatchesPath string, out io.Writer) error {
+	err := InitDirectories()
+	if err != nil {
+		return err
+	}
+
+	tempDir, err := ioutil.TempDir("", "addon-operator-render")
+	if err != nil {
+		return fmt.Errorf("RENDER: cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if app.Helm3 {
+		helm.Client = &helm.Helm3Client{}
+	} else {
+		helm.Client = &helm.CliHelm{}
+	}
+
+	kubeConfig := kube_config_manager.NewConfig()
+	if configDataPath != "" {
+		configData, err := kube_config_manager.ConfigDataFromFile(configDataPath)
+		if err != nil {
+			return fmt.Errorf("RENDER: %s", err)
+		}
+		kubeConfig, err = kube_config_manager.NewConfigFromConfigData(configData)
+		if err != nil {
+			return fmt.Errorf("RENDER: %s", err)
+		}
+	}
+
+	fixtures := make(map[string]module_manager.HookPatchesFixture)
+	if hookPatchesPath != "" {
+		fixtures, err = module_manager.LoadHookPatchesFixtures(hookPatchesPath)
+		if err != nil {
+			return fmt.Errorf("RENDER: %s", err)
+		}
+	}
+
+	module_manager.Init()
+	mm := module_manager.NewMainModuleManager()
+	mm.WithDirectories(ModulesDir, GlobalHooksDir, tempDir)
+	mm.WithKubeConfigManager(kube_config_manager.NewStaticKubeConfigManager(kubeConfig))
+	err = mm.Init()
+	if err != nil {
+		return fmt.Errorf("RENDER: cannot initialize module manager: %s", err)
+	}
+
+	result, err := mm.Render(fixtures)
+	if err != nil {
+		return fmt.Errorf("RENDER: %s", err)
+	}
+	rlog.Infof("RENDER: enabled modules %v", result.EnabledModules)
+
+	data, err := yaml.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("RENDER: cannot dump result: %s", err)
+	}
+	_, err = out.Write(data)
+	return err
+}
@@ -0,0 +1,113 @@
+package addon_operator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/romana/rlog"
+
+	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/executor"
+	"github.com/flant/addon-operator/pkg/helm"
+)
+
+// ShutdownTerminateDelay is a time to wait for tasks after SIGTERM is sent to running commands.
+// Tiller is killed if it is not stopped in this time.
+var ShutdownTerminateDelay = 5 * time.Second
+
+// LeaseLossTerminateDelay is ShutdownTerminateDelay on the lease loss. Running tasks are not waited,
+// commands are killed if they are not stopped in this time: a new leader can start
+// in LeaseDuration - RenewDeadline after the loss.
+var LeaseLossTerminateDelay = time.Second
+
+var shutdownOnce sync.Once
+
+// Shutdown stops the operator gracefully: new events are not handled, running tasks are
+// finished or their commands are terminated after timeout, the queue state is saved,
+// informers, schedules and validating webhooks are stopped, then Tiller is stopped.
+// It is called on SIGTERM, only the first call of Shutdown or ShutdownOnLeaseLoss does the work.
+func Shutdown(timeout time.Duration) {
+	shutdownOnce.Do(func() {
+		shutdown(timeout, ShutdownTerminateDelay, false)
+	})
+}
+
+// ShutdownOnLeaseLoss stops the operator as Shutdown, but running commands are terminated
+// without waiting for tasks and killed after LeaseLossTerminateDelay, so hooks and helm
+// are not run concurrently with a new leader.
+func ShutdownOnLeaseLoss() {
+	shutdownOnce.Do(func() {
+		shutdown(0, LeaseLossTerminateDelay, true)
+	})
+}
+
+// leaseLossShutdownDuration is a max time of ShutdownOnLeaseLoss before commands are stopped:
+// the events handler, running commands and Tiller are waited for terminateDelay.
+func leaseLossShutdownDuration() time.Duration {
+	return 3 * LeaseLossTerminateDelay
+}
+
+func shutdown(timeout time.Duration, terminateDelay time.Duration, kill bool) {
+	rlog.Infof("SHUTDOWN: stop handling events")
+	if ManagersEventsHandlerStopCh != nil {
+		select {
+		case ManagersEventsHandlerStopCh <- struct{}{}:
+		case <-time.After(terminateDelay):
+			rlog.Errorf("SHUTDOWN: events handler is not stopped in %s", terminateDelay.String())
+		}
+	}
+
+	rlog.Infof("SHUTDOWN: wait for running tasks")
+	if !StopTasksRunners(timeout) {
+		count := executor.TerminateRunningCommands()
+		rlog.Warnf("SHUTDOWN: tasks are not done in %s, SIGTERM is sent to %d running commands", timeout.String(), count)
+		if !StopTasksRunners(terminateDelay) {
+			rlog.Errorf("SHUTDOWN: tasks are not done in %s after SIGTERM", terminateDelay.String())
+			if kill {
+				count = executor.KillRunningCommands()
+				rlog.Errorf("SHUTDOWN: SIGKILL is sent to %d running commands", count)
+			}
+		}
+	}
+
+	if QueuePersister != nil {
+		if err := QueuePersister.Save(); err != nil {
+			rlog.Errorf("SHUTDOWN: %v", err)
+		}
+	}
+
+	if KubeEventsHooks != nil && KubeEventsManager != nil {
+		rlog.Infof("SHUTDOWN: stop informers")
+		if err := KubeEventsHooks.DisableAllHooks(KubeEventsManager); err != nil {
+			rlog.Errorf("SHUTDOWN: cannot stop informers: %s", err)
+		}
+	}
+
+	if ValidatingHooks != nil {
+		rlog.Infof("SHUTDOWN: stop validating webhook server")
+		if err := ValidatingHooks.Stop(); err != nil {
+			rlog.Errorf("SHUTDOWN: cannot stop validating webhook server: %s", err)
+		}
+		// Without leader election there is no other replica to handle requests, so webhooks are deleted.
+		// Otherwise the configuration is kept for the next leader.
+		if !app.LeaderElection {
+			rlog.Infof("SHUTDOWN: delete validating webhooks")
+			if err := ValidatingHooks.DeleteConfiguration(); err != nil {
+				rlog.Errorf("SHUTDOWN: cannot delete validating webhooks: %s", err)
+			}
+		}
+	}
+
+	if ScheduleManager != nil && ScheduledHooks != nil {
+		rlog.Infof("SHUTDOWN: stop schedules")
+		for _, crontab := range ScheduledHooks.GetCrontabs() {
+			_ = ScheduleManager.Remove(crontab)
+		}
+	}
+
+	if isHelmStarted() && !app.Helm3 {
+		helm.StopTillerProcess(terminateDelay)
+	}
+
+	rlog.Infof("SHUTDOWN: done")
+}
@@ -28,6 +28,27 @@ func Start() {
 		os.Exit(1)
 	}
 
+	if app.LeaderElection {
+		// Standby replica keeps HTTP server with loaded modules and hooks.
+		err = RunLeaderElection(startLeader)
+		if err != nil {
+			rlog.Errorf("LEADER_ELECTION start failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	startLeader()
+}
+
+// startLeader starts helm, informers, schedules and tasks runners.
+func startLeader() {
+	err := InitLeader()
+	if err != nil {
+		rlog.Errorf("INIT failed: %v", err)
+		os.Exit(1)
+	}
+
 	rlog.Debugf("START: Run")
 	Run()
 }
@@ -0,0 +1,112 @@
+package addon_operator
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/flant/addon-operator/pkg/hook_testing"
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// TestHookOptions are paths to fixtures for the test-hook command. Empty path means no fixture.
+type TestHookOptions struct {
+	HookPath                 string
+	ModuleName               string
+	BindingContextPath       string
+	ValuesPath               string
+	ConfigValuesPath         string
+	ExpectedValuesPath       string
+	ExpectedConfigValuesPath string
+}
+
+// TestHook validates the hook config, runs the hook with fixtures and writes patches, metrics and
+// resulting values to out in YAML format. An error is returned if resulting values
+// differ from expected values.
+func TestHook(opts TestHookOptions, out io.Writer) error {
+	hookTest := hook_testing.NewHookTest(opts.HookPath).WithModuleName(opts.ModuleName)
+
+	if err := hookTest.ValidateConfig(); err != nil {
+		return fmt.Errorf("TEST_HOOK: %s", err)
+	}
+
+	var err error
+	if opts.BindingContextPath != "" {
+		hookTest.BindingContext, err = hook_testing.LoadBindingContext(opts.BindingContextPath)
+		if err != nil {
+			return fmt.Errorf("TEST_HOOK: %s", err)
+		}
+	}
+	if hookTest.Values, err = loadValuesFixture(opts.ValuesPath); err != nil {
+		return err
+	}
+	if hookTest.ConfigValues, err = loadValuesFixture(opts.ConfigValuesPath); err != nil {
+		return err
+	}
+
+	result, err := hookTest.Run()
+	if err != nil {
+		return fmt.Errorf("TEST_HOOK: %s", err)
+	}
+
+	output := map[string]interface{}{
+		"configValues": result.ConfigValues,
+		"values":       result.Values,
+	}
+	if result.ConfigValuesPatch != nil {
+		output["configValuesPatch"] = result.ConfigValuesPatch.Operations
+	}
+	if result.ValuesPatch != nil {
+		output["valuesPatch"] = result.ValuesPatch.Operations
+	}
+	if len(result.Metrics) > 0 {
+		output["metrics"] = result.Metrics
+	}
+	if len(result.KubernetesOperations) > 0 {
+		output["kubernetesPatch"] = result.KubernetesOperations
+	}
+	if result.ValidatingResponse != nil {
+		output["validatingResponse"] = result.ValidatingResponse
+	}
+	data, err := yaml.Marshal(output)
+	if err != nil {
+		return fmt.Errorf("TEST_HOOK: cannot dump result: %s", err)
+	}
+	if _, err := out.Write(data); err != nil {
+		return err
+	}
+
+	if opts.ExpectedValuesPath != "" {
+		expected, err := loadValuesFixture(opts.ExpectedValuesPath)
+		if err != nil {
+			return err
+		}
+		if err := hook_testing.CompareValues(expected, result.Values); err != nil {
+			return fmt.Errorf("TEST_HOOK: unexpected values: %s", err)
+		}
+	}
+
+	if opts.ExpectedConfigValuesPath != "" {
+		expected, err := loadValuesFixture(opts.ExpectedConfigValuesPath)
+		if err != nil {
+			return err
+		}
+		if err := hook_testing.CompareValues(expected, result.ConfigValues); err != nil {
+			return fmt.Errorf("TEST_HOOK: unexpected config values: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func loadValuesFixture(path string) (utils.Values, error) {
+	if path == "" {
+		return nil, nil
+	}
+	values, err := hook_testing.LoadValues(path)
+	if err != nil {
+		return nil, fmt.Errorf("TEST_HOOK: values file '%s': %s", path, err)
+	}
+	return values, nil
+}
@@ -1,7 +1,9 @@
 package app
 
 import (
+	"os"
 	"strconv"
+	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 )
@@ -23,19 +25,93 @@ var TillerProbeListenAddress = "127.0.0.1"
 var TillerProbeListenPort int32 = 44435
 var TillerMaxHistory = 0
 
+// Helm3 enables helm 3 client. Tiller is not started in this mode.
+var Helm3 = false
+
+// FailedTaskMaxDelay limits a delay between retries of a failed task.
+var FailedTaskMaxDelay = 5 * time.Minute
+
+// TaskMaxRetries is a default count of retries for failed modules and hooks. Zero means infinite retries.
+var TaskMaxRetries = 0
+
+// HookTimeout is a default timeout for hooks and enabled scripts. Zero means no limit.
+var HookTimeout = time.Duration(0)
+
+// HelmTimeout is a timeout for helm commands. Zero means no limit.
+var HelmTimeout = time.Duration(0)
+
+// RequeueFailedHookTasks lets tasks of other modules pass failed schedule and kubernetes events
+// hook tasks, so they are not blocked while failed task waits for retry.
+var RequeueFailedHookTasks = false
+
 var ConfigMapName = "addon-operator"
+
+// ConfigSource is a source of values: "configmap" or "moduleconfig" for ModuleConfig custom resources.
+var ConfigSource = "configmap"
 var ValuesChecksumsAnnotation = "addon-operator/values-checksums"
 var TasksQueueDumpFilePath = "/tmp/addon-operator-tasks-queue"
 
+// StateDir is a directory for files that are kept between restarts. It should be on a persistent volume.
+var StateDir = "/var/lib/addon-operator"
+
+// TasksQueueStateFilePath is a file to save and restore tasks between restarts. A file in StateDir is used if empty.
+var TasksQueueStateFilePath = ""
+
+// TasksQueueStateConfigMap is a ConfigMap to save and restore tasks. File is used if empty.
+var TasksQueueStateConfigMap = ""
+
+// ModuleStatusConfigMapPrefix is a prefix for names of ConfigMaps with modules statuses. Statuses are not saved if empty.
+var ModuleStatusConfigMapPrefix = "addon-operator-module"
+
+// PodName is a name of the Pod of the operator. It is used in Kubernetes Events.
+var PodName = ""
+
+// LeaderElection enables Lease-based leader election. Only the leader runs tasks.
+var LeaderElection = false
+
+// LeaderElectionLeaseName is a name of the Lease object for leader election.
+var LeaderElectionLeaseName = "addon-operator-leader"
+
+// Durations for leader election.
+var LeaderElectionLeaseDuration = 15 * time.Second
+var LeaderElectionRenewDeadline = 10 * time.Second
+var LeaderElectionRetryPeriod = 2 * time.Second
+
+// ReloadFilesInterval is an interval to check modules and global hooks on disk. Reload is disabled if zero.
+var ReloadFilesInterval = time.Duration(0)
+
+// ModuleSources is a comma-separated list of directories with .tgz bundles or OCI image layouts with modules.
+var ModuleSources = ""
+
+// ShutdownTimeout is a time to wait for running tasks on shutdown before terminating hooks and helm.
+var ShutdownTimeout = 20 * time.Second
+
+// ValidatingWebhookCertDir is a directory with tls.crt, tls.key and ca.crt for the validating webhook server.
+// The server is not started and kubernetesValidating bindings are ignored if empty.
+var ValidatingWebhookCertDir = ""
+var ValidatingWebhookListenPort = "9680"
+
+// ValidatingWebhookServiceName is a Service in the operator namespace that points to the validating webhook server.
+var ValidatingWebhookServiceName = "addon-operator-validating-webhook"
+
+// ValidatingWebhookConfigurationName is a name of the ValidatingWebhookConfiguration with webhooks of all hooks.
+var ValidatingWebhookConfigurationName = "addon-operator-hooks"
+
+// ValidatingHookTimeout is a timeout for hooks that run on admission requests.
+var ValidatingHookTimeout = 10 * time.Second
+
+// LogType is a format of log messages: "text" or "json".
+var LogType = "text"
+
 var GlobalHooksDir = "global-hooks"
 var ModulesDir = "modules"
 var TmpDir = "/tmp/addon-operator"
 
 // SetupGlobalSettings init global flags with default values
 func SetupGlobalSettings(kpApp *kingpin.Application) {
-	kpApp.Flag("namespace", "Namespace of addon-operator.").
+	// Namespace is required only by the start command: render and test-hook work without a cluster.
+	kpApp.Flag("namespace", "Namespace of addon-operator. Required for the start command.").
 		Envar("ADDON_OPERATOR_NAMESPACE").
-		Required().
 		StringVar(&Namespace)
 
 	kpApp.Flag("prometheus-listen-address", "Address to use to serve metrics to Prometheus.").
@@ -60,9 +136,129 @@ func SetupGlobalSettings(kpApp *kingpin.Application) {
 		Default(strconv.Itoa(int(TillerProbeListenPort))).
 		Int32Var(&TillerProbeListenPort)
 
+	kpApp.Flag("helm3", "Use helm 3 client without Tiller.").
+		Envar("ADDON_OPERATOR_HELM3").
+		Default("false").
+		BoolVar(&Helm3)
+
+	kpApp.Flag("failed-task-max-delay", "Max delay between retries of a failed task.").
+		Envar("ADDON_OPERATOR_FAILED_TASK_MAX_DELAY").
+		Default(FailedTaskMaxDelay.String()).
+		DurationVar(&FailedTaskMaxDelay)
+	kpApp.Flag("task-max-retries", "Default count of retries for failed modules and hooks. 0 means infinite retries.").
+		Envar("ADDON_OPERATOR_TASK_MAX_RETRIES").
+		Default(strconv.Itoa(TaskMaxRetries)).
+		IntVar(&TaskMaxRetries)
+	kpApp.Flag("hook-timeout", "Default timeout for hooks and enabled scripts. Process group of a hook is killed after timeout. 0 means no limit.").
+		Envar("ADDON_OPERATOR_HOOK_TIMEOUT").
+		Default(HookTimeout.String()).
+		DurationVar(&HookTimeout)
+	kpApp.Flag("helm-timeout", "Timeout for helm commands. Process group of helm is killed after timeout. 0 means no limit.").
+		Envar("ADDON_OPERATOR_HELM_TIMEOUT").
+		Default(HelmTimeout.String()).
+		DurationVar(&HelmTimeout)
+	kpApp.Flag("requeue-failed-hook-tasks", "Let tasks of other modules pass failed schedule and kubernetes events hook tasks.").
+		Envar("ADDON_OPERATOR_REQUEUE_FAILED_HOOK_TASKS").
+		Default("false").
+		BoolVar(&RequeueFailedHookTasks)
+
+	kpApp.Flag("state-dir", "Directory for files that are kept between restarts.").
+		Envar("ADDON_OPERATOR_STATE_DIR").
+		Default(StateDir).
+		StringVar(&StateDir)
+	kpApp.Flag("tasks-queue-state-file", "Path to a file to save and restore tasks between restarts. Default is tasks-queue.json in the state directory.").
+		Envar("ADDON_OPERATOR_TASKS_QUEUE_STATE_FILE").
+		Default(TasksQueueStateFilePath).
+		StringVar(&TasksQueueStateFilePath)
+	kpApp.Flag("tasks-queue-state-config-map", "Name of a ConfigMap to save and restore tasks between restarts. File is used if not set.").
+		Envar("ADDON_OPERATOR_TASKS_QUEUE_STATE_CONFIG_MAP").
+		Default(TasksQueueStateConfigMap).
+		StringVar(&TasksQueueStateConfigMap)
+
+	kpApp.Flag("module-status-config-map-prefix", "Prefix for names of ConfigMaps with modules statuses. Set to empty string to disable statuses.").
+		Envar("ADDON_OPERATOR_MODULE_STATUS_CONFIG_MAP_PREFIX").
+		Default(ModuleStatusConfigMapPrefix).
+		StringVar(&ModuleStatusConfigMapPrefix)
+
+	kpApp.Flag("pod-name", "Name of the operator Pod for Kubernetes Events. Default is the hostname.").
+		Envar("ADDON_OPERATOR_POD_NAME").
+		Default(os.Getenv("HOSTNAME")).
+		StringVar(&PodName)
+
+	kpApp.Flag("leader-election", "Enable leader election to run several replicas. Only the leader runs tasks.").
+		Envar("ADDON_OPERATOR_LEADER_ELECTION").
+		Default(strconv.FormatBool(LeaderElection)).
+		BoolVar(&LeaderElection)
+
+	kpApp.Flag("leader-election-lease-name", "Name of the Lease object for leader election.").
+		Envar("ADDON_OPERATOR_LEADER_ELECTION_LEASE_NAME").
+		Default(LeaderElectionLeaseName).
+		StringVar(&LeaderElectionLeaseName)
+
+	kpApp.Flag("leader-election-lease-duration", "Duration that standby replicas wait before acquiring the lease of the leader.").
+		Envar("ADDON_OPERATOR_LEADER_ELECTION_LEASE_DURATION").
+		Default(LeaderElectionLeaseDuration.String()).
+		DurationVar(&LeaderElectionLeaseDuration)
+
+	kpApp.Flag("leader-election-renew-deadline", "Duration that the leader retries to renew the lease before giving up.").
+		Envar("ADDON_OPERATOR_LEADER_ELECTION_RENEW_DEADLINE").
+		Default(LeaderElectionRenewDeadline.String()).
+		DurationVar(&LeaderElectionRenewDeadline)
+
+	kpApp.Flag("leader-election-retry-period", "Duration between attempts to acquire or renew the lease.").
+		Envar("ADDON_OPERATOR_LEADER_ELECTION_RETRY_PERIOD").
+		Default(LeaderElectionRetryPeriod.String()).
+		DurationVar(&LeaderElectionRetryPeriod)
+
+	kpApp.Flag("reload-files-interval", "Interval to check modules and global hooks directories for changes. Zero disables reload.").
+		Envar("ADDON_OPERATOR_RELOAD_FILES_INTERVAL").
+		Default(ReloadFilesInterval.String()).
+		DurationVar(&ReloadFilesInterval)
+
+	kpApp.Flag("module-sources", "Comma-separated list of directories with .tgz bundles of modules or local OCI image layouts.").
+		Envar("ADDON_OPERATOR_MODULE_SOURCES").
+		Default(ModuleSources).
+		StringVar(&ModuleSources)
+
+	kpApp.Flag("shutdown-timeout", "Duration to wait for running tasks on shutdown. Running hooks and helm are terminated after timeout.").
+		Envar("ADDON_OPERATOR_SHUTDOWN_TIMEOUT").
+		Default(ShutdownTimeout.String()).
+		DurationVar(&ShutdownTimeout)
+
+	kpApp.Flag("validating-webhook-cert-dir", "Directory with tls.crt, tls.key and ca.crt for the validating webhook server. The server is not started if not set.").
+		Envar("ADDON_OPERATOR_VALIDATING_WEBHOOK_CERT_DIR").
+		Default(ValidatingWebhookCertDir).
+		StringVar(&ValidatingWebhookCertDir)
+	kpApp.Flag("validating-webhook-listen-port", "Port to use to serve validating webhooks.").
+		Envar("ADDON_OPERATOR_VALIDATING_WEBHOOK_LISTEN_PORT").
+		Default(ValidatingWebhookListenPort).
+		StringVar(&ValidatingWebhookListenPort)
+	kpApp.Flag("validating-webhook-service-name", "Name of a Service in the operator namespace that points to the validating webhook server.").
+		Envar("ADDON_OPERATOR_VALIDATING_WEBHOOK_SERVICE_NAME").
+		Default(ValidatingWebhookServiceName).
+		StringVar(&ValidatingWebhookServiceName)
+	kpApp.Flag("validating-webhook-configuration-name", "Name of the ValidatingWebhookConfiguration for kubernetesValidating bindings.").
+		Envar("ADDON_OPERATOR_VALIDATING_WEBHOOK_CONFIGURATION_NAME").
+		Default(ValidatingWebhookConfigurationName).
+		StringVar(&ValidatingWebhookConfigurationName)
+	kpApp.Flag("validating-hook-timeout", "Timeout for hooks that run on admission requests. Process group of a hook is killed after timeout.").
+		Envar("ADDON_OPERATOR_VALIDATING_HOOK_TIMEOUT").
+		Default(ValidatingHookTimeout.String()).
+		DurationVar(&ValidatingHookTimeout)
+
+	kpApp.Flag("log-type", "Format of log messages: text or json.").
+		Envar("ADDON_OPERATOR_LOG_TYPE").
+		Default(LogType).
+		EnumVar(&LogType, "text", "json")
+
 	kpApp.Flag("config-map", "Name of a ConfigMap to store values.").
 		Envar("ADDON_OPERATOR_CONFIG_MAP").
 		Default(ConfigMapName).
 		StringVar(&ConfigMapName)
 
+	kpApp.Flag("config-source", "Source of values: a ConfigMap or ModuleConfig custom resources. ConfigMap is imported into ModuleConfig resources on the first start.").
+		Envar("ADDON_OPERATOR_CONFIG_SOURCE").
+		Default(ConfigSource).
+		EnumVar(&ConfigSource, "configmap", "moduleconfig")
+
 }
@@ -0,0 +1,179 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/romana/rlog"
+
+	"github.com/flant/addon-operator/pkg/logger"
+)
+
+// runningCommands are started commands that are not exited yet. Zombie reaper skips
+// their processes, so commands run concurrently and their exit statuses are not stolen.
+var runningCommands = make(map[*exec.Cmd]struct{})
+var runningCommandsLock sync.Mutex
+
+// TimeoutError is returned if the command is killed after timeout.
+type TimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("'%s' is killed after timeout %s", e.Command, e.Timeout.String())
+}
+
+// IsTimeout returns true if the command is killed after timeout.
+func IsTimeout(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
+func Run(cmd *exec.Cmd, debug bool) error {
+	return RunWithTimeout(cmd, debug, 0)
+}
+
+// RunWithTimeout runs a command and kills its process group after timeout. Zero timeout means no limit.
+func RunWithTimeout(cmd *exec.Cmd, debug bool, timeout time.Duration) error {
+	if debug {
+		dir := ""
+		if cmd.Dir != "" {
+			dir = " in '" + cmd.Dir + "'"
+		}
+		rlog.Debugf("Executing command%s: '%s'", dir, strings.Join(cmd.Args, " "))
+	}
+
+	return startAndWait(cmd, timeout)
+}
+
+// RunAndLogLines runs a command and logs its stdout and stderr line by line with log labels.
+// The process group of the command is killed after timeout. Zero timeout means no limit.
+func RunAndLogLines(cmd *exec.Cmd, logLabels map[string]string, timeout time.Duration) error {
+	logEntry := logger.WithLabels(logLabels)
+	stdout := logger.NewLineWriter(logEntry, "stdout")
+	stderr := logger.NewLineWriter(logEntry, "stderr")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := RunWithTimeout(cmd, true, timeout)
+
+	stdout.Flush()
+	stderr.Flush()
+	return err
+}
+
+func Output(cmd *exec.Cmd) (output []byte, err error) {
+	return OutputWithTimeout(cmd, 0)
+}
+
+// OutputWithTimeout runs a command with RunWithTimeout and returns its stdout. Zero timeout means no limit.
+func OutputWithTimeout(cmd *exec.Cmd, timeout time.Duration) (output []byte, err error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err = RunWithTimeout(cmd, false, timeout)
+	return stdout.Bytes(), err
+}
+
+// startAndWait runs a command in a new process group and saves it as running until exit.
+// The whole process group is killed after timeout, so children of hooks are not left running.
+func startAndWait(cmd *exec.Cmd, timeout time.Duration) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	// The command is saved under the lock with start, so the reaper cannot see its process untracked.
+	runningCommandsLock.Lock()
+	if err := cmd.Start(); err != nil {
+		runningCommandsLock.Unlock()
+		return err
+	}
+	runningCommands[cmd] = struct{}{}
+	runningCommandsLock.Unlock()
+
+	// state is changed once: from running to killed by the timer or to exited after Wait.
+	const (
+		stateRunning int32 = iota
+		stateKilled
+		stateExited
+	)
+	var state int32
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			if !atomic.CompareAndSwapInt32(&state, stateRunning, stateKilled) {
+				return
+			}
+			rlog.Errorf("Kill process group of '%s' pid %d after timeout %s", strings.Join(cmd.Args, " "), cmd.Process.Pid, timeout.String())
+			_ = signalProcessGroup(cmd, syscall.SIGKILL)
+		})
+	}
+
+	err := cmd.Wait()
+	if timer != nil {
+		timer.Stop()
+		if !atomic.CompareAndSwapInt32(&state, stateRunning, stateExited) {
+			// Timer is fired before the command exits, the command is killed.
+			err = &TimeoutError{Command: strings.Join(cmd.Args, " "), Timeout: timeout}
+		}
+	}
+
+	runningCommandsLock.Lock()
+	delete(runningCommands, cmd)
+	runningCommandsLock.Unlock()
+
+	return err
+}
+
+// TerminateRunningCommands sends SIGTERM to all running hooks, scripts and helm commands.
+// It returns a count of signaled processes.
+func TerminateRunningCommands() int {
+	return signalRunningCommands(syscall.SIGTERM, "SIGTERM")
+}
+
+// KillRunningCommands sends SIGKILL to all running hooks, scripts and helm commands,
+// so they do not outlive the operator process. It returns a count of signaled processes.
+func KillRunningCommands() int {
+	return signalRunningCommands(syscall.SIGKILL, "SIGKILL")
+}
+
+func signalRunningCommands(sig syscall.Signal, sigName string) int {
+	runningCommandsLock.Lock()
+	defer runningCommandsLock.Unlock()
+
+	count := 0
+	for cmd := range runningCommands {
+		if cmd.Process == nil {
+			continue
+		}
+		rlog.Infof("Send %s to '%s' pid %d", sigName, strings.Join(cmd.Args, " "), cmd.Process.Pid)
+		if err := signalProcessGroup(cmd, sig); err != nil {
+			rlog.Errorf("Cannot send %s to pid %d: %s", sigName, cmd.Process.Pid, err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// signalProcessGroup sends a signal to all processes in the group of the command.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+func MakeCommand(dir string, entrypoint string, args []string, envs []string) *exec.Cmd {
+	cmd := exec.Command(entrypoint, args...)
+	cmd.Env = append(cmd.Env, envs...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
@@ -0,0 +1,111 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RunWithTimeout(t *testing.T) {
+	// Child process holds stdout, so Wait returns only if the whole process group is killed.
+	cmd := exec.Command("bash", "-c", "sleep 10 & sleep 10")
+	start := time.Now()
+	err := RunAndLogLines(cmd, map[string]string{}, 200*time.Millisecond)
+	assert.True(t, IsTimeout(err), "expect timeout error, got %v", err)
+	assert.True(t, time.Since(start) < 5*time.Second, "process group is not killed")
+
+	cmd = exec.Command("bash", "-c", "exit 1")
+	err = RunWithTimeout(cmd, false, time.Second)
+	assert.Error(t, err)
+	assert.False(t, IsTimeout(err))
+
+	cmd = exec.Command("true")
+	assert.NoError(t, RunWithTimeout(cmd, false, time.Second))
+
+	cmd = exec.Command("bash", "-c", "echo ok; sleep 10")
+	output, err := OutputWithTimeout(cmd, 200*time.Millisecond)
+	assert.True(t, IsTimeout(err), "expect timeout error, got %v", err)
+	assert.Equal(t, "ok\n", string(output))
+}
+
+func Test_TerminateRunningCommands(t *testing.T) {
+	// Child process holds stdout, so Output returns only if the whole process group is terminated.
+	cmd := exec.Command("bash", "-c", "sleep 10 & sleep 10")
+	done := make(chan error, 1)
+	go func() {
+		_, err := Output(cmd)
+		done <- err
+	}()
+
+	count := 0
+	for i := 0; i < 100 && count == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		count = TerminateRunningCommands()
+	}
+	assert.Equal(t, 1, count)
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("process group is not terminated")
+	}
+}
+
+func Test_KillRunningCommands(t *testing.T) {
+	// SIGTERM is ignored by the process group.
+	cmd := exec.Command("bash", "-c", "trap '' TERM; sleep 10 & sleep 10")
+	done := make(chan error, 1)
+	go func() {
+		_, err := Output(cmd)
+		done <- err
+	}()
+
+	// Wait for the trap.
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 1, TerminateRunningCommands())
+
+	select {
+	case <-done:
+		t.Fatal("process group should ignore SIGTERM")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	assert.Equal(t, 1, KillRunningCommands())
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("process group is not killed")
+	}
+}
+
+func Test_ZombieChildren(t *testing.T) {
+	procDir, err := ioutil.TempDir("", "proc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(procDir)
+
+	stats := map[string]string{
+		"10":   "10 (hook) Z 1 10 10 0",
+		"11":   "11 (sleep) S 1 11 11 0",
+		"12":   "12 (other) Z 5 12 12 0",
+		"13":   "13 (a) Z (b)) Z 1 13 13 0",
+		"self": "1 (addon-operator) S 0 1 1 0",
+	}
+	for name, stat := range stats {
+		assert.NoError(t, os.MkdirAll(filepath.Join(procDir, name), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(procDir, name, "stat"), []byte(stat), 0644))
+	}
+
+	pids := zombieChildren(procDir, 1)
+	sort.Ints(pids)
+	assert.Equal(t, []int{10, 13}, pids)
+}
@@ -0,0 +1,142 @@
+package executor
+
+// This is a zombie reaper from shell-operator with one change:
+// reaper waits only for exited children that are not running commands of this package,
+// so commands run concurrently and the reaper does not steal their exit statuses.
+// https://blog.phusion.nl/2015/01/20/docker-and-the-pid-1-zombie-reaping-problem/
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/romana/rlog"
+
+	shell_executor "github.com/flant/shell-operator/pkg/executor"
+)
+
+// sigChildHandler pushes SIGCHLD signals into notifications channel if there is a waiter.
+func sigChildHandler(notifications chan os.Signal) {
+	rlog.Debugf("Start SIGCHLD handler")
+	var sigs = make(chan os.Signal, 3)
+	signal.Notify(sigs, syscall.SIGCHLD)
+
+	for {
+		var sig = <-sigs
+		select {
+		case notifications <- sig:
+		default:
+			// Notifications channel is full. Reaper waits for all exited
+			// children on notification, so the signal can be dropped.
+		}
+	}
+}
+
+func reapChildren() {
+	rlog.Debugf("Start WAIT4 loop")
+
+	var notifications = make(chan os.Signal, 1)
+
+	go sigChildHandler(notifications)
+
+	for {
+		si := <-notifications
+		rlog.Debugf("REAP: got %v signal", si)
+		reapZombies()
+	}
+}
+
+// reapZombies waits for all exited children except running commands. Commands of shell-operator
+// are not tracked, so they are locked out by ExecutorLock, they are short jq runs.
+func reapZombies() {
+	shell_executor.ExecutorLock.Lock()
+	defer shell_executor.ExecutorLock.Unlock()
+
+	for {
+		pids := untrackedZombies()
+		if len(pids) == 0 {
+			return
+		}
+		reaped := 0
+		for _, pid := range pids {
+			var wstatus syscall.WaitStatus
+			wpid, err := syscall.Wait4(pid, &wstatus, syscall.WNOHANG, nil)
+			for syscall.EINTR == err {
+				wpid, err = syscall.Wait4(pid, &wstatus, syscall.WNOHANG, nil)
+			}
+			if wpid <= 0 {
+				continue
+			}
+			reaped++
+			rlog.Debugf(" - Grim reaper cleanup: pid=%d, wstatus=%+v\n", wpid, wstatus)
+		}
+		if reaped == 0 {
+			return
+		}
+	}
+}
+
+// untrackedZombies returns exited children that are not running commands.
+func untrackedZombies() []int {
+	runningCommandsLock.Lock()
+	defer runningCommandsLock.Unlock()
+
+	pids := make([]int, 0)
+	for _, pid := range zombieChildren("/proc", os.Getpid()) {
+		tracked := false
+		for cmd := range runningCommands {
+			if cmd.Process != nil && cmd.Process.Pid == pid {
+				tracked = true
+				break
+			}
+		}
+		if !tracked {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// zombieChildren returns pids of processes in the zombie state with the parent ppid.
+func zombieChildren(procDir string, ppid int) []int {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		rlog.Errorf("REAP: read %s: %s", procDir, err)
+		return nil
+	}
+
+	pids := make([]int, 0)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "stat"))
+		if err != nil {
+			// Process is gone.
+			continue
+		}
+		// Format is 'pid (comm) state ppid ...', comm can contain spaces and parentheses.
+		data := string(stat)
+		fields := strings.Fields(data[strings.LastIndex(data, ")")+1:])
+		if len(fields) < 2 || fields[0] != "Z" || fields[1] != strconv.Itoa(ppid) {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// Reap starts to reap zombie processes in background if process is running as pid 1.
+func Reap() {
+	if os.Getpid() != 1 {
+		rlog.Debugf(" - Grim reaper disabled, pid not 1\n")
+		return
+	}
+
+	go reapChildren()
+}
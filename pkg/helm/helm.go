@@ -15,8 +15,8 @@ import (
 	kblabels "k8s.io/apimachinery/pkg/labels"
 
 	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/executor"
 	"github.com/flant/addon-operator/pkg/utils"
-	"github.com/flant/shell-operator/pkg/executor"
 	"github.com/flant/shell-operator/pkg/kube"
 )
 
@@ -35,10 +35,23 @@ type HelmClient interface {
 	ListReleases(labelSelector map[string]string) ([]string, error)
 	ListReleasesNames(labelSelector map[string]string) ([]string, error)
 	IsReleaseExists(releaseName string) (bool, error)
+	Render(releaseName string, chart string, valuesPaths []string, setValues []string, namespace string) (string, error)
 }
 
 var Client HelmClient
 
+// OnCommandTimeout is called with a helm command name if the command is killed after app.HelmTimeout.
+var OnCommandTimeout func(command string)
+
+// runCmd runs a helm command with app.HelmTimeout.
+func runCmd(cmd *exec.Cmd, args []string) error {
+	err := executor.RunWithTimeout(cmd, true, app.HelmTimeout)
+	if executor.IsTimeout(err) && OnCommandTimeout != nil && len(args) > 0 {
+		OnCommandTimeout(args[0])
+	}
+	return err
+}
+
 type CliHelm struct {
 }
 
@@ -91,7 +104,7 @@ func (helm *CliHelm) Cmd(args ...string) (stdout string, stderr string, err erro
 	var stderrBuf bytes.Buffer
 	cmd.Stderr = &stderrBuf
 
-	err = executor.Run(cmd, true)
+	err = runCmd(cmd, args)
 	stdout = strings.TrimSpace(stdoutBuf.String())
 	stderr = strings.TrimSpace(stderrBuf.String())
 
@@ -99,6 +112,11 @@ func (helm *CliHelm) Cmd(args ...string) (stdout string, stderr string, err erro
 }
 
 func (helm *CliHelm) DeleteSingleFailedRevision(releaseName string) (err error) {
+	return deleteSingleFailedRevision(helm, releaseName)
+}
+
+// deleteSingleFailedRevision deletes a release if it has only one FAILED revision.
+func deleteSingleFailedRevision(helm HelmClient, releaseName string) (err error) {
 	revision, status, err := helm.LastReleaseStatus(releaseName)
 	if err != nil {
 		if revision == "0" {
@@ -231,6 +249,37 @@ func (helm *CliHelm) UpgradeRelease(releaseName string, chart string, valuesPath
 	return nil
 }
 
+// Render runs helm template and returns rendered manifests. Tiller is not needed.
+func (helm *CliHelm) Render(releaseName string, chart string, valuesPaths []string, setValues []string, namespace string) (string, error) {
+	args := make([]string, 0)
+	args = append(args, "template")
+	args = append(args, chart)
+	args = append(args, "--name")
+	args = append(args, releaseName)
+
+	if namespace != "" {
+		args = append(args, "--namespace")
+		args = append(args, namespace)
+	}
+
+	for _, valuesPath := range valuesPaths {
+		args = append(args, "--values")
+		args = append(args, valuesPath)
+	}
+
+	for _, setValue := range setValues {
+		args = append(args, "--set")
+		args = append(args, setValue)
+	}
+
+	stdout, stderr, err := helm.Cmd(args...)
+	if err != nil {
+		return "", fmt.Errorf("helm template failed: %s:\n%s %s", err, stdout, stderr)
+	}
+
+	return stdout, nil
+}
+
 func (helm *CliHelm) GetReleaseValues(releaseName string) (utils.Values, error) {
 	stdout, stderr, err := helm.Cmd("get", "values", releaseName)
 	if err != nil {
@@ -0,0 +1,362 @@
+package helm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/romana/rlog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kblabels "k8s.io/apimachinery/pkg/labels"
+
+	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/utils"
+	"github.com/flant/shell-operator/pkg/kube"
+)
+
+// Helm 3 stores releases in Secrets with these labels:
+// owner=helm, name=<release name>, status=<release status>, version=<revision>.
+// https://github.com/helm/helm/blob/v3.0.0/pkg/storage/driver/secrets.go
+const (
+	Helm3ReleaseSecretPrefix = "sh.helm.release.v1."
+	Helm3OwnerLabel          = "owner"
+	Helm3OwnerLabelValue     = "helm"
+	Helm3NameLabel           = "name"
+	Helm3StatusLabel         = "status"
+	Helm3VersionLabel        = "version"
+)
+
+// Helm3Client is a HelmClient that uses helm 3 binary. It works without Tiller.
+type Helm3Client struct {
+}
+
+// InitHelm3Client checks helm 3 binary and sets Client.
+func InitHelm3Client() error {
+	rlog.Info("Helm 3: check helm version")
+
+	helm3 := &Helm3Client{}
+
+	stdout, stderr, err := helm3.Cmd("version", "--short")
+	if err != nil {
+		return fmt.Errorf("unable to get helm version: %v\n%v %v", err, stdout, stderr)
+	}
+	rlog.Infof("Helm 3: helm version:\n%v %v", stdout, stderr)
+
+	rlog.Info("Helm 3: successfully initialized")
+
+	Client = helm3
+
+	return nil
+}
+
+// TillerNamespace returns a namespace for releases. There is no Tiller for helm 3.
+func (h *Helm3Client) TillerNamespace() string {
+	return app.Namespace
+}
+
+func (h *Helm3Client) CommandEnv() []string {
+	res := make([]string, 0)
+	res = append(res, fmt.Sprintf("HELM_NAMESPACE=%s", app.Namespace))
+	return res
+}
+
+// Cmd starts helm 3 with specified arguments.
+// Sets the HELM_NAMESPACE environment variable, so commands work with releases in Addon-operator's namespace.
+func (h *Helm3Client) Cmd(args ...string) (stdout string, stderr string, err error) {
+	cmd := exec.Command(HelmPath, args...)
+	cmd.Env = append(os.Environ(), h.CommandEnv()...)
+
+	var stdoutBuf bytes.Buffer
+	cmd.Stdout = &stdoutBuf
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+
+	err = runCmd(cmd, args)
+	stdout = strings.TrimSpace(stdoutBuf.String())
+	stderr = strings.TrimSpace(stderrBuf.String())
+
+	return
+}
+
+func (h *Helm3Client) DeleteSingleFailedRevision(releaseName string) (err error) {
+	return deleteSingleFailedRevision(h, releaseName)
+}
+
+// DeleteOldFailedRevisions removes release Secrets for all FAILED revisions except the last one.
+func (h *Helm3Client) DeleteOldFailedRevisions(releaseName string) error {
+	revisions, err := h.listReleasesRevisions(map[string]string{"STATUS": "FAILED", "NAME": releaseName})
+	if err != nil {
+		return err
+	}
+
+	rlog.Debugf("helm release '%s': found FAILED revisions: %v", releaseName, revisions)
+
+	nums := make([]int, 0)
+	for _, rev := range revisions {
+		if rev.Name == releaseName {
+			nums = append(nums, rev.Revision)
+		}
+	}
+	sort.Ints(nums)
+
+	// Do not removes last FAILED revision.
+	if len(nums) > 0 {
+		nums = nums[:len(nums)-1]
+	}
+
+	for _, revision := range nums {
+		secretName := helm3ReleaseSecretName(releaseName, revision)
+		rlog.Infof("helm release '%s': delete old FAILED revision secret/%s", releaseName, secretName)
+
+		err := kube.Kubernetes.CoreV1().
+			Secrets(app.Namespace).
+			Delete(secretName, &metav1.DeleteOptions{})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// helm3HistoryRecord is an item of 'helm history -o json' output.
+type helm3HistoryRecord struct {
+	Revision    int    `json:"revision"`
+	Status      string `json:"status"`
+	Chart       string `json:"chart"`
+	Description string `json:"description"`
+}
+
+// LastReleaseStatus returns last revision and its status. Status is upper-cased
+// to be compatible with helm 2 statuses, e.g. "deployed" becomes "DEPLOYED".
+func (h *Helm3Client) LastReleaseStatus(releaseName string) (revision string, status string, err error) {
+	stdout, stderr, err := h.Cmd("history", releaseName, "--max", "1", "--output", "json", "--namespace", app.Namespace)
+
+	if err != nil {
+		errLine := strings.Split(stderr, "\n")[0]
+		if strings.Contains(errLine, "Error:") && strings.Contains(errLine, "not found") {
+			// Bad module name or no releases installed
+			err = fmt.Errorf("release '%s' not found\n%v %v", releaseName, stdout, stderr)
+			revision = "0"
+			return
+		}
+
+		err = fmt.Errorf("cannot get history for release '%s'\n%v %v", releaseName, stdout, stderr)
+		return
+	}
+
+	return parseHelm3History(releaseName, stdout)
+}
+
+func parseHelm3History(releaseName string, data string) (revision string, status string, err error) {
+	var history []helm3HistoryRecord
+	err = json.Unmarshal([]byte(data), &history)
+	if err != nil {
+		err = fmt.Errorf("cannot parse history for release '%s': %s\n%s", releaseName, err, data)
+		return
+	}
+
+	if len(history) == 0 {
+		err = fmt.Errorf("release '%s' not found: history is empty", releaseName)
+		revision = "0"
+		return
+	}
+
+	last := history[len(history)-1]
+	revision = strconv.Itoa(last.Revision)
+	status = strings.ToUpper(last.Status)
+	return
+}
+
+func (h *Helm3Client) UpgradeRelease(releaseName string, chart string, valuesPaths []string, setValues []string, namespace string) error {
+	args := make([]string, 0)
+	args = append(args, "upgrade")
+	args = append(args, "--install")
+	args = append(args, releaseName)
+	args = append(args, chart)
+
+	if namespace != "" {
+		args = append(args, "--namespace")
+		args = append(args, namespace)
+	}
+
+	for _, valuesPath := range valuesPaths {
+		args = append(args, "--values")
+		args = append(args, valuesPath)
+	}
+
+	for _, setValue := range setValues {
+		args = append(args, "--set")
+		args = append(args, setValue)
+	}
+
+	rlog.Infof("Running helm upgrade for release '%s' with chart '%s' in namespace '%s' ...", releaseName, chart, namespace)
+	stdout, stderr, err := h.Cmd(args...)
+	if err != nil {
+		return fmt.Errorf("helm upgrade failed: %s:\n%s %s", err, stdout, stderr)
+	}
+	rlog.Infof("Helm upgrade for release '%s' with chart '%s' in namespace '%s' successful:\n%s\n%s", releaseName, chart, namespace, stdout, stderr)
+
+	return nil
+}
+
+// Render runs helm template and returns rendered manifests.
+func (h *Helm3Client) Render(releaseName string, chart string, valuesPaths []string, setValues []string, namespace string) (string, error) {
+	args := make([]string, 0)
+	args = append(args, "template")
+	args = append(args, releaseName)
+	args = append(args, chart)
+
+	if namespace != "" {
+		args = append(args, "--namespace")
+		args = append(args, namespace)
+	}
+
+	for _, valuesPath := range valuesPaths {
+		args = append(args, "--values")
+		args = append(args, valuesPath)
+	}
+
+	for _, setValue := range setValues {
+		args = append(args, "--set")
+		args = append(args, setValue)
+	}
+
+	stdout, stderr, err := h.Cmd(args...)
+	if err != nil {
+		return "", fmt.Errorf("helm template failed: %s:\n%s %s", err, stdout, stderr)
+	}
+
+	return stdout, nil
+}
+
+func (h *Helm3Client) GetReleaseValues(releaseName string) (utils.Values, error) {
+	stdout, stderr, err := h.Cmd("get", "values", releaseName, "--output", "yaml", "--namespace", app.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get values of helm release %s: %s\n%s %s", releaseName, err, stdout, stderr)
+	}
+
+	values, err := utils.NewValuesFromBytes([]byte(stdout))
+	if err != nil {
+		return nil, fmt.Errorf("cannot get values of helm release %s: %s", releaseName, err)
+	}
+
+	return values, nil
+}
+
+func (h *Helm3Client) DeleteRelease(releaseName string) (err error) {
+	rlog.Debugf("helm release '%s': execute helm uninstall", releaseName)
+
+	stdout, stderr, err := h.Cmd("uninstall", releaseName, "--namespace", app.Namespace)
+	if err != nil {
+		return fmt.Errorf("helm uninstall %s invocation error: %v\n%v %v", releaseName, err, stdout, stderr)
+	}
+
+	return
+}
+
+func (h *Helm3Client) IsReleaseExists(releaseName string) (bool, error) {
+	revision, _, err := h.LastReleaseStatus(releaseName)
+	if err != nil && revision == "0" {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ListReleases returns all known releases as strings — "<release_name>.v<release_number>".
+// Helm 3 stores releases in Secrets labeled with 'owner=helm'. Label selector can contain
+// helm 2 labels 'NAME' and 'STATUS', they are translated to helm 3 labels.
+func (h *Helm3Client) ListReleases(labelSelector map[string]string) ([]string, error) {
+	revisions, err := h.listReleasesRevisions(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make([]string, 0)
+	for _, rev := range revisions {
+		releases = append(releases, fmt.Sprintf("%s.v%d", rev.Name, rev.Revision))
+	}
+
+	sort.Strings(releases)
+
+	return releases, nil
+}
+
+// ListReleasesNames returns list of release names without suffixes ".v<release_number>"
+func (h *Helm3Client) ListReleasesNames(labelSelector map[string]string) ([]string, error) {
+	revisions, err := h.listReleasesRevisions(labelSelector)
+	if err != nil {
+		return []string{}, err
+	}
+
+	releasesNamesMap := map[string]bool{}
+	for _, rev := range revisions {
+		releasesNamesMap[rev.Name] = true
+	}
+
+	releasesNames := make([]string, 0)
+	for releaseName := range releasesNamesMap {
+		releasesNames = append(releasesNames, releaseName)
+	}
+	sort.Strings(releasesNames)
+
+	return releasesNames, nil
+}
+
+type helm3ReleaseRevision struct {
+	Name     string
+	Revision int
+}
+
+// listReleasesRevisions returns names and revisions from labels of release Secrets.
+func (h *Helm3Client) listReleasesRevisions(labelSelector map[string]string) ([]helm3ReleaseRevision, error) {
+	labelsSet := helm3LabelsSet(labelSelector)
+
+	secretList, err := kube.Kubernetes.CoreV1().
+		Secrets(app.Namespace).
+		List(metav1.ListOptions{LabelSelector: labelsSet.AsSelector().String()})
+	if err != nil {
+		rlog.Debugf("helm: list of releases Secrets failed: %s", err)
+		return nil, err
+	}
+
+	revisions := make([]helm3ReleaseRevision, 0)
+	for _, secret := range secretList.Items {
+		name := secret.Labels[Helm3NameLabel]
+		revision, err := strconv.Atoi(secret.Labels[Helm3VersionLabel])
+		if name == "" || err != nil {
+			continue
+		}
+		revisions = append(revisions, helm3ReleaseRevision{Name: name, Revision: revision})
+	}
+
+	return revisions, nil
+}
+
+// helm3LabelsSet returns labels to select release Secrets. Helm 2 labels are
+// translated to lower-cased helm 3 labels, statuses are lower-cased too.
+func helm3LabelsSet(labelSelector map[string]string) kblabels.Set {
+	labelsSet := make(kblabels.Set)
+	for k, v := range labelSelector {
+		key := strings.ToLower(k)
+		if key == Helm3StatusLabel {
+			v = strings.ToLower(v)
+		}
+		labelsSet[key] = v
+	}
+	labelsSet[Helm3OwnerLabel] = Helm3OwnerLabelValue
+	return labelsSet
+}
+
+func helm3ReleaseSecretName(releaseName string, revision int) string {
+	return fmt.Sprintf("%s%s.v%d", Helm3ReleaseSecretPrefix, releaseName, revision)
+}
@@ -0,0 +1,78 @@
+package helm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/shell-operator/pkg/kube"
+)
+
+func Test_Helm3_ParseHistory(t *testing.T) {
+	revision, status, err := parseHelm3History("test", `[{"revision":3,"updated":"2019-11-29T10:00:00Z","status":"failed","chart":"test-0.1.0","app_version":"","description":"Upgrade failed"}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", revision)
+	assert.Equal(t, "FAILED", status)
+
+	revision, _, err = parseHelm3History("test", `[]`)
+	assert.Error(t, err)
+	assert.Equal(t, "0", revision)
+
+	_, _, err = parseHelm3History("test", `REVISION	UPDATED`)
+	assert.Error(t, err)
+}
+
+func Test_Helm3_LabelsSet(t *testing.T) {
+	labels := helm3LabelsSet(map[string]string{"STATUS": "FAILED", "NAME": "test"})
+	assert.Equal(t, "failed", labels["status"])
+	assert.Equal(t, "test", labels["name"])
+	assert.Equal(t, "helm", labels["owner"])
+}
+
+func helm3ReleaseSecret(name string, revision string, status string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      Helm3ReleaseSecretPrefix + name + ".v" + revision,
+			Namespace: app.Namespace,
+			Labels: map[string]string{
+				"owner":   "helm",
+				"name":    name,
+				"status":  status,
+				"version": revision,
+			},
+		},
+	}
+}
+
+func Test_Helm3_ListReleases(t *testing.T) {
+	app.Namespace = "addon-operator"
+	kube.Kubernetes = fake.NewSimpleClientset(
+		helm3ReleaseSecret("module-a", "1", "superseded"),
+		helm3ReleaseSecret("module-a", "2", "failed"),
+		helm3ReleaseSecret("module-a", "3", "failed"),
+		helm3ReleaseSecret("module-a", "4", "failed"),
+		helm3ReleaseSecret("module-b", "1", "deployed"),
+	)
+
+	h := &Helm3Client{}
+
+	names, err := h.ListReleasesNames(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"module-a", "module-b"}, names)
+
+	releases, err := h.ListReleases(map[string]string{"STATUS": "FAILED"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"module-a.v2", "module-a.v3", "module-a.v4"}, releases)
+
+	// Only the last FAILED revision is kept.
+	err = h.DeleteOldFailedRevisions("module-a")
+	assert.NoError(t, err)
+
+	releases, err = h.ListReleases(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"module-a.v1", "module-a.v4", "module-b.v1"}, releases)
+}
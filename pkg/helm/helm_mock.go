@@ -9,6 +9,7 @@ type MockHelmClient struct {
 	DeleteSingleFailedRevisionExecuted bool
 	UpgradeReleaseExecuted             bool
 	DeleteReleaseExecuted              bool
+	RenderExecuted                     bool
 	ReleaseNames []string
 }
 
@@ -64,3 +65,8 @@ func (h *MockHelmClient) DeleteRelease(_ string) error {
 	h.DeleteReleaseExecuted = true
 	return nil
 }
+
+func (h *MockHelmClient) Render(releaseName string, _ string, _ []string, _ []string, _ string) (string, error) {
+	h.RenderExecuted = true
+	return "# Source: " + releaseName + "\n", nil
+}
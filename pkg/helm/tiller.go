@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/romana/rlog"
@@ -13,6 +15,12 @@ import (
 
 const TillerPath = "tiller"
 
+// tillerProcess is a started Tiller. tillerExited is closed when Tiller is exited.
+var tillerProcess *os.Process
+var tillerExited chan struct{}
+var tillerStopping bool
+var tillerLock sync.Mutex
+
 // TillerOptions
 type TillerOptions struct {
 	Namespace string
@@ -47,6 +55,11 @@ func InitTillerProcess(options TillerOptions) error {
 		return err
 	}
 
+	tillerLock.Lock()
+	tillerProcess = tillerCmd.Process
+	tillerExited = make(chan struct{})
+	tillerLock.Unlock()
+
 	// Wait for success of "helm version"
 	for {
 		cliHelm := &CliHelm{}
@@ -63,6 +76,16 @@ func InitTillerProcess(options TillerOptions) error {
 
 	go func() {
 		err = tillerCmd.Wait()
+		close(tillerExited)
+
+		tillerLock.Lock()
+		stopping := tillerStopping
+		tillerLock.Unlock()
+		if stopping {
+			rlog.Infof("Tiller process is stopped")
+			return
+		}
+
 		if err != nil {
 			rlog.Errorf("Tiller process exited, now stop. (%v)", err)
 		} else {
@@ -74,6 +97,31 @@ func InitTillerProcess(options TillerOptions) error {
 	return nil
 }
 
+// StopTillerProcess sends SIGTERM to Tiller and waits for exit. Tiller is killed after timeout.
+func StopTillerProcess(timeout time.Duration) {
+	tillerLock.Lock()
+	if tillerProcess == nil || tillerStopping {
+		tillerLock.Unlock()
+		return
+	}
+	tillerStopping = true
+	process := tillerProcess
+	exited := tillerExited
+	tillerLock.Unlock()
+
+	rlog.Infof("Stop Tiller process")
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		rlog.Errorf("Cannot send SIGTERM to Tiller: %v", err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		rlog.Errorf("Tiller is not stopped in %s, kill it", timeout.String())
+		_ = process.Kill()
+	}
+}
+
 // TillerHealthHandler translates tiller's /liveness response
 func TillerHealthHandler(tillerProbeAddress string, tillerProbePort int32) func(writer http.ResponseWriter, request *http.Request) {
 	return func(writer http.ResponseWriter, request *http.Request) {
@@ -0,0 +1,337 @@
+package hook_testing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/flant/addon-operator/pkg/executor"
+	"github.com/flant/addon-operator/pkg/kube_patch"
+	"github.com/flant/addon-operator/pkg/metrics_storage"
+	"github.com/flant/addon-operator/pkg/module_manager"
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// HookTest runs a hook outside of the addon-operator: values, config values and binding context
+// are given as fixtures and files for the hook are created in a temporary directory.
+//
+//	result, err := hook_testing.NewHookTest("modules/001-module/hooks/hook").
+//		WithModuleName("module").
+//		WithBindingContext(bindingContext).
+//		WithValues(values).
+//		Run()
+type HookTest struct {
+	HookPath string
+	// ModuleName is a name of a module for a module hook. Empty name means a global hook.
+	ModuleName     string
+	BindingContext []module_manager.BindingContext
+	Values         utils.Values
+	ConfigValues   utils.Values
+
+	tmpDir string
+}
+
+// HookTestResult contains patches, metrics and Kubernetes operations returned by the hook
+// and values with applied patches. Kubernetes operations are not applied.
+type HookTestResult struct {
+	ConfigValuesPatch    *utils.ValuesPatch
+	ValuesPatch          *utils.ValuesPatch
+	ConfigValues         utils.Values
+	Values               utils.Values
+	Metrics              []metrics_storage.MetricOperation
+	KubernetesOperations []kube_patch.Operation
+	// ValidatingResponse is a verdict for kubernetesValidating binding context. It is nil if not written.
+	ValidatingResponse *module_manager.ValidatingResponse
+}
+
+const validatingResponseFile = "validating-response.json"
+
+// HookTest should implement module_manager.Hook
+var _ module_manager.Hook = &HookTest{}
+
+func NewHookTest(hookPath string) *HookTest {
+	return &HookTest{HookPath: hookPath}
+}
+
+func (t *HookTest) WithModuleName(moduleName string) *HookTest {
+	t.ModuleName = moduleName
+	return t
+}
+
+func (t *HookTest) WithBindingContext(bindingContext []module_manager.BindingContext) *HookTest {
+	t.BindingContext = bindingContext
+	return t
+}
+
+func (t *HookTest) WithValues(values utils.Values) *HookTest {
+	t.Values = values
+	return t
+}
+
+func (t *HookTest) WithConfigValues(configValues utils.Values) *HookTest {
+	t.ConfigValues = configValues
+	return t
+}
+
+func (t *HookTest) GetName() string {
+	return filepath.Base(t.HookPath)
+}
+
+func (t *HookTest) GetPath() string {
+	return t.HookPath
+}
+
+// ValuesKey returns a root key of values that the hook can patch: 'global' for a global hook
+// or a values key of a module.
+func (t *HookTest) ValuesKey() string {
+	if t.ModuleName == "" {
+		return "global"
+	}
+	return utils.ModuleNameToValuesKey(t.ModuleName)
+}
+
+// PrepareTmpFilesForHookRun creates files with values, config values, binding context
+// and empty files for patches and metrics in a temporary directory.
+func (t *HookTest) PrepareTmpFilesForHookRun(context []module_manager.BindingContext) (tmpFiles map[string]string, err error) {
+	tmpFiles = make(map[string]string)
+
+	tmpFiles["CONFIG_VALUES_PATH"], err = t.dumpFile("config-values.json", t.configValues())
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFiles["VALUES_PATH"], err = t.dumpFile("values.json", t.values())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(context) > 0 {
+		tmpFiles["BINDING_CONTEXT_PATH"], err = t.dumpFile("binding-context.json", context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tmpFiles["CONFIG_VALUES_JSON_PATCH_PATH"], err = t.dumpFile("config-values.json-patch", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFiles["VALUES_JSON_PATCH_PATH"], err = t.dumpFile("values.json-patch", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFiles["METRICS_PATH"], err = t.dumpFile("metrics.json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFiles["KUBERNETES_PATCH_PATH"], err = t.dumpFile("kubernetes-patch.json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFiles["VALIDATING_RESPONSE_PATH"], err = t.dumpFile(validatingResponseFile, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return tmpFiles, nil
+}
+
+// Run executes the hook in a temporary directory as the addon-operator does, validates patches returned by the hook
+// and applies them to config values and values.
+func (t *HookTest) Run() (*HookTestResult, error) {
+	tmpDir, err := ioutil.TempDir("", "addon-operator-hook-test")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	t.tmpDir = tmpDir
+	defer func() { t.tmpDir = "" }()
+
+	hookExecutor := module_manager.NewHookExecutor(t, t.BindingContext).WithDir(tmpDir)
+	patches, metrics, err := hookExecutor.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &HookTestResult{
+		ConfigValuesPatch:    patches[utils.ConfigMapPatch],
+		ValuesPatch:          patches[utils.MemoryValuesPatch],
+		Metrics:              metrics,
+		KubernetesOperations: hookExecutor.KubernetesOperations,
+	}
+
+	validatingResponsePath := filepath.Join(tmpDir, validatingResponseFile)
+	if info, err := os.Stat(validatingResponsePath); err == nil && info.Size() > 0 {
+		result.ValidatingResponse, err = module_manager.ValidatingResponseFromFile(validatingResponsePath)
+		if err != nil {
+			return nil, fmt.Errorf("hook '%s': %s", t.GetName(), err)
+		}
+	}
+
+	result.ConfigValues, err = t.applyPatch(t.configValues(), result.ConfigValuesPatch)
+	if err != nil {
+		return nil, fmt.Errorf("hook '%s': config values patch: %s", t.GetName(), err)
+	}
+
+	result.Values, err = t.applyPatch(t.values(), result.ValuesPatch)
+	if err != nil {
+		return nil, fmt.Errorf("hook '%s': values patch: %s", t.GetName(), err)
+	}
+
+	return result, nil
+}
+
+// ValidateConfig runs the hook with the --config flag and checks the output
+// with the same validation as the addon-operator uses when it loads hooks.
+func (t *HookTest) ValidateConfig() error {
+	cmd := executor.MakeCommand("", t.HookPath, []string{"--config"}, os.Environ())
+	cmd.Stdout = nil
+	output, err := executor.Output(cmd)
+	if err != nil {
+		return fmt.Errorf("cannot get config for hook '%s': %s\n%s", t.HookPath, err, output)
+	}
+
+	if t.ModuleName == "" {
+		if _, err := module_manager.GlobalHookConfigFromJSON(output); err != nil {
+			return fmt.Errorf("bad config for global hook '%s': %s", t.HookPath, err)
+		}
+		return nil
+	}
+
+	if _, err := module_manager.ModuleHookConfigFromJSON(output); err != nil {
+		return fmt.Errorf("bad config for module '%s' hook '%s': %s", t.ModuleName, t.HookPath, err)
+	}
+	return nil
+}
+
+func (t *HookTest) configValues() utils.Values {
+	return utils.MergeValues(utils.Values{t.ValuesKey(): map[string]interface{}{}}, t.ConfigValues)
+}
+
+func (t *HookTest) values() utils.Values {
+	return utils.MergeValues(utils.Values{t.ValuesKey(): map[string]interface{}{}}, t.Values)
+}
+
+func (t *HookTest) applyPatch(values utils.Values, patch *utils.ValuesPatch) (utils.Values, error) {
+	if patch == nil {
+		return values, nil
+	}
+	if err := module_manager.ValidateHookValuesPatch(*patch, t.ValuesKey()); err != nil {
+		return nil, err
+	}
+	newValues, _, err := utils.ApplyValuesPatch(values, *patch)
+	return newValues, err
+}
+
+func (t *HookTest) dumpFile(name string, data interface{}) (string, error) {
+	path := filepath.Join(t.tmpDir, name)
+
+	content := []byte{}
+	if data != nil {
+		var err error
+		content, err = json.Marshal(data)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// LoadBindingContext reads a binding context fixture from a YAML or JSON file.
+func LoadBindingContext(filePath string) ([]module_manager.BindingContext, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var bindingContext []module_manager.BindingContext
+	if err := yaml.Unmarshal(content, &bindingContext); err != nil {
+		return nil, fmt.Errorf("bad binding context file '%s': %s", filePath, err)
+	}
+	return bindingContext, nil
+}
+
+// LoadValues reads values from a YAML or JSON file.
+func LoadValues(filePath string) (utils.Values, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return utils.NewValuesFromBytes(content)
+}
+
+// GetValue returns a value by a dot separated path, e.g. 'global.discovery.clusterType'.
+func GetValue(values utils.Values, path string) (interface{}, bool) {
+	var value interface{} = map[string]interface{}(values)
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// CheckValue returns an error if values do not contain an expected value by a dot separated path.
+// Expected value is compared with a value from JSON, so 1 and 1.0 are equal.
+func CheckValue(values utils.Values, path string, expected interface{}) error {
+	actual, ok := GetValue(values, path)
+	if !ok {
+		return fmt.Errorf("no value by path '%s' in values:\n%s", path, utils.ValuesToString(values))
+	}
+
+	normalized, err := normalizeJSON(expected)
+	if err != nil {
+		return fmt.Errorf("expected value for path '%s' is not JSON compatible: %s", path, err)
+	}
+
+	if !reflect.DeepEqual(normalized, actual) {
+		return fmt.Errorf("value by path '%s' is not equal\nexpected: %v\nactual: %v", path, normalized, actual)
+	}
+	return nil
+}
+
+// CompareValues returns an error if values are not equal.
+func CompareValues(expected, actual utils.Values) error {
+	normalized, err := normalizeJSON(expected)
+	if err != nil {
+		return err
+	}
+	actualNormalized, err := normalizeJSON(actual)
+	if err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(normalized, actualNormalized) {
+		return nil
+	}
+	return fmt.Errorf("values are not equal\nexpected:\n%s\nactual:\n%s", utils.ValuesToString(expected), utils.ValuesToString(actual))
+}
+
+func normalizeJSON(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var res interface{}
+	err = json.Unmarshal(data, &res)
+	return res, err
+}
@@ -0,0 +1,101 @@
+package hook_testing
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flant/addon-operator/pkg/module_manager"
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+func Test_HookTest_GlobalHook(t *testing.T) {
+	bindingContext, err := LoadBindingContext(filepath.Join("testdata", "binding_context.yaml"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	values, err := LoadValues(filepath.Join("testdata", "values.yaml"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	hookTest := NewHookTest(filepath.Join("testdata", "global-hooks", "discovery")).
+		WithBindingContext(bindingContext).
+		WithValues(values).
+		WithConfigValues(values)
+
+	assert.NoError(t, hookTest.ValidateConfig())
+
+	result, err := hookTest.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, CheckValue(result.Values, "global.discovery.scheduled", true))
+	assert.NoError(t, CheckValue(result.Values, "global.project", "test"))
+	assert.NoError(t, CheckValue(result.ConfigValues, "global.projectChecked", true))
+	assert.Len(t, result.ValuesPatch.Operations, 1)
+
+	_, ok := GetValue(result.ConfigValues, "global.discovery")
+	assert.False(t, ok)
+}
+
+func Test_HookTest_ModuleHook(t *testing.T) {
+	hookTest := NewHookTest(filepath.Join("testdata", "modules", "001-module-one", "hooks", "replicas")).
+		WithModuleName("module-one").
+		WithBindingContext([]module_manager.BindingContext{
+			{Binding: "onKubernetesEvent", ResourceEvent: "add", ResourceKind: "Pod", ResourceName: "pod-0"},
+		})
+
+	assert.NoError(t, hookTest.ValidateConfig())
+
+	result, err := hookTest.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, CheckValue(result.Values, "moduleOne.replicas", 3))
+	if assert.Len(t, result.Metrics, 1) {
+		assert.Equal(t, "module_one_pods", result.Metrics[0].Name)
+	}
+	if assert.Len(t, result.KubernetesOperations, 1) {
+		assert.Equal(t, "MergePatch apps/v1/Deployment 'module-one/app'", result.KubernetesOperations[0].String())
+	}
+	assert.NoError(t, CompareValues(utils.Values{"moduleOne": map[string]interface{}{"replicas": 3}}, result.Values))
+	assert.Error(t, CompareValues(utils.Values{"moduleOne": map[string]interface{}{"replicas": 2}}, result.Values))
+	assert.Error(t, CheckValue(result.Values, "moduleOne.replicas", 2))
+}
+
+func Test_HookTest_BadHook(t *testing.T) {
+	hookTest := NewHookTest(filepath.Join("testdata", "modules", "001-module-one", "hooks", "bad-config")).
+		WithModuleName("module-one")
+
+	err := hookTest.ValidateConfig()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "first")
+	}
+
+	// Module hook cannot patch global values.
+	_, err = hookTest.Run()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "only 'moduleOne' accepted")
+	}
+}
+
+func Test_ValidateHookConfig(t *testing.T) {
+	_, err := module_manager.ModuleHookConfigFromJSON([]byte(`{"schedule":[{"name":"no crontab"}]}`))
+	assert.Error(t, err)
+
+	config := &module_manager.ModuleHookConfig{}
+	config.Schedule = []module_manager.ScheduleConfig{{}}
+	assert.Error(t, module_manager.ValidateModuleHookConfig(config))
+
+	config = &module_manager.ModuleHookConfig{}
+	config.Timeout = "ten seconds"
+	assert.Error(t, module_manager.ValidateModuleHookConfig(config))
+	config.Timeout = "10s"
+	assert.NoError(t, module_manager.ValidateModuleHookConfig(config))
+	assert.Equal(t, 10*time.Second, config.TimeoutDuration())
+}
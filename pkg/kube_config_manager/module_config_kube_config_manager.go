@@ -0,0 +1,674 @@
+package kube_config_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/romana/rlog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/flant/shell-operator/pkg/kube"
+	utils_checksum "github.com/flant/shell-operator/pkg/utils/checksum"
+
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// ModuleConfig custom resource: one object per module and an object named 'global' for global values.
+//
+//	apiVersion: addon-operator.flant.com/v1alpha1
+//	kind: ModuleConfig
+//	metadata:
+//	  name: module-name
+//	spec:
+//	  enabled: true
+//	  maxRetries: 3
+//	  settings:
+//	    param1: value1
+//	status:
+//	  enabled: true
+//	  checksum: <checksum of the applied spec>
+//	  lastError: ""
+const (
+	ModuleConfigGroup      = "addon-operator.flant.com"
+	ModuleConfigVersion    = "v1alpha1"
+	ModuleConfigKind       = "ModuleConfig"
+	ModuleConfigResource   = "moduleconfigs"
+	GlobalModuleConfigName = "global"
+)
+
+var ModuleConfigGVR = schema.GroupVersionResource{
+	Group:    ModuleConfigGroup,
+	Version:  ModuleConfigVersion,
+	Resource: ModuleConfigResource,
+}
+
+// ModuleConfigSpec is a spec of the ModuleConfig custom resource.
+type ModuleConfigSpec struct {
+	Enabled    *bool                  `json:"enabled,omitempty"`
+	MaxRetries *int                   `json:"maxRetries,omitempty"`
+	Settings   map[string]interface{} `json:"settings,omitempty"`
+}
+
+// ModuleStatusWriter is implemented by KubeConfigManagers that can show an enabled state of modules.
+type ModuleStatusWriter interface {
+	WriteModulesEnabledStatus(enabledModules []string)
+}
+
+// LeaderInitializer is implemented by KubeConfigManagers that change the cluster after Init.
+// Init only reads the config, InitLeader is called in the leader before Run.
+type LeaderInitializer interface {
+	InitLeader() error
+}
+
+// ConfigValidator is implemented by KubeConfigManagers that validate each object separately,
+// so an invalid config of one module does not block config updates of other modules.
+type ConfigValidator interface {
+	// WithConfigValidator sets a function that validates values of the object by the object name:
+	// global values for the global object and module values for a module object.
+	WithConfigValidator(validate func(name string, values utils.Values) error)
+	// RejectInitialConfig removes a config of the object that is not valid from the initial config.
+	// The error is written into the object status by InitLeader.
+	RejectInitialConfig(name string, err error)
+}
+
+// moduleConfigKubeConfigManager is a KubeConfigManager with values in ModuleConfig custom resources.
+// An error in one object does not affect other modules: the error is written
+// into the object status and a previous config of the module is used.
+type moduleConfigKubeConfigManager struct {
+	Namespace string
+	// ConfigMapName is a name of the ConfigMap to import values from on the first start.
+	ConfigMapName string
+
+	initialConfig *Config
+	// Specs imported from the ConfigMap by Init. Objects are created by InitLeader.
+	importedSpecs map[string]ModuleConfigSpec
+	// Status fields of objects after Init. They are written by InitLeader.
+	initStatuses map[string]map[string]interface{}
+
+	// validate checks values of a changed object before they are applied.
+	validate func(name string, values utils.Values) error
+
+	m sync.Mutex
+	// Checksums of applied specs by object names.
+	Checksums     map[string]string
+	GlobalValues  utils.Values
+	ModuleConfigs ModuleConfigs
+}
+
+// moduleConfigKubeConfigManager should implement KubeConfigManager and ModuleStatusWriter
+var _ KubeConfigManager = &moduleConfigKubeConfigManager{}
+var _ ModuleStatusWriter = &moduleConfigKubeConfigManager{}
+var _ LeaderInitializer = &moduleConfigKubeConfigManager{}
+var _ ConfigValidator = &moduleConfigKubeConfigManager{}
+
+func NewModuleConfigKubeConfigManager() KubeConfigManager {
+	return &moduleConfigKubeConfigManager{
+		initialConfig: NewConfig(),
+		Checksums:     make(map[string]string),
+		GlobalValues:  make(utils.Values),
+		ModuleConfigs: make(ModuleConfigs),
+	}
+}
+
+func (kcm *moduleConfigKubeConfigManager) WithNamespace(namespace string) {
+	kcm.Namespace = namespace
+}
+
+func (kcm *moduleConfigKubeConfigManager) WithConfigMapName(configMap string) {
+	kcm.ConfigMapName = configMap
+}
+
+// WithValuesChecksumsAnnotation does nothing: checksums are stored in objects status.
+func (kcm *moduleConfigKubeConfigManager) WithValuesChecksumsAnnotation(_ string) {}
+
+func (kcm *moduleConfigKubeConfigManager) InitialConfig() *Config {
+	return kcm.initialConfig
+}
+
+// WithConfigValidator should be called before Run.
+func (kcm *moduleConfigKubeConfigManager) WithConfigValidator(validate func(name string, values utils.Values) error) {
+	kcm.validate = validate
+}
+
+// RejectInitialConfig should be called after Init and before InitLeader. The module is started without
+// its config, the object is validated again when the informer is started.
+func (kcm *moduleConfigKubeConfigManager) RejectInitialConfig(name string, err error) {
+	kcm.m.Lock()
+	defer kcm.m.Unlock()
+
+	rlog.Errorf("KUBE_CONFIG: ModuleConfig/%s is ignored: %s", name, err)
+	delete(kcm.Checksums, name)
+	if name == GlobalModuleConfigName {
+		kcm.GlobalValues = make(utils.Values)
+	} else {
+		delete(kcm.ModuleConfigs, name)
+	}
+	kcm.initialConfig = kcm.currentConfig()
+	if kcm.initStatuses == nil {
+		kcm.initStatuses = make(map[string]map[string]interface{})
+	}
+	kcm.initStatuses[name] = map[string]interface{}{"lastError": err.Error()}
+}
+
+func (kcm *moduleConfigKubeConfigManager) resource() dynamic.ResourceInterface {
+	return kube.DynamicClient.Resource(ModuleConfigGVR).Namespace(kcm.Namespace)
+}
+
+func (kcm *moduleConfigKubeConfigManager) Init() error {
+	rlog.Debug("INIT: KUBE_CONFIG from ModuleConfig resources")
+
+	VerboseDebug = false
+	if os.Getenv("KUBE_CONFIG_MANAGER_DEBUG") != "" {
+		VerboseDebug = true
+	}
+
+	ConfigUpdated = make(chan Config, 1)
+	ModuleConfigsUpdated = make(chan ModuleConfigs, 1)
+
+	list, err := kcm.resource().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("KUBE_CONFIG: list ModuleConfig objects: %s", err)
+	}
+
+	specs := make(map[string]ModuleConfigSpec)
+	var importErrors map[string]error
+	if len(list.Items) == 0 {
+		kcm.importedSpecs, importErrors, err = kcm.importConfigMap()
+		if err != nil {
+			return err
+		}
+		for name, spec := range kcm.importedSpecs {
+			if _, has := importErrors[name]; !has {
+				specs[name] = spec
+			}
+		}
+	}
+
+	statuses := make(map[string]map[string]interface{})
+	kcm.m.Lock()
+	for i := range list.Items {
+		obj := &list.Items[i]
+		spec, err := moduleConfigSpec(obj)
+		if err != nil {
+			rlog.Errorf("KUBE_CONFIG: ModuleConfig/%s is ignored: %s", obj.GetName(), err)
+			statuses[obj.GetName()] = map[string]interface{}{"lastError": err.Error()}
+			continue
+		}
+		specs[obj.GetName()] = spec
+	}
+	for name, spec := range specs {
+		if err := kcm.applySpec(name, spec); err != nil {
+			rlog.Errorf("KUBE_CONFIG: ModuleConfig/%s is ignored: %s", name, err)
+			statuses[name] = map[string]interface{}{"lastError": err.Error()}
+			continue
+		}
+		statuses[name] = map[string]interface{}{"lastError": "", "checksum": kcm.Checksums[name]}
+	}
+	for name, err := range importErrors {
+		rlog.Errorf("KUBE_CONFIG: ModuleConfig/%s is ignored: %s", name, err)
+		statuses[name] = map[string]interface{}{"lastError": err.Error()}
+	}
+	kcm.initialConfig = kcm.currentConfig()
+	kcm.initStatuses = statuses
+	kcm.m.Unlock()
+
+	return nil
+}
+
+// InitLeader creates ModuleConfig objects imported from the ConfigMap and writes statuses
+// of objects read by Init. An object created by a previous leader is not an error.
+func (kcm *moduleConfigKubeConfigManager) InitLeader() error {
+	names := make([]string, 0, len(kcm.importedSpecs))
+	for name := range kcm.importedSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		obj, err := newModuleConfigObject(name, kcm.importedSpecs[name])
+		if err != nil {
+			return err
+		}
+		_, err = kcm.resource().Create(obj, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			rlog.Infof("KUBE_CONFIG: ModuleConfig/%s is already imported from ConfigMap/%s", name, kcm.ConfigMapName)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("KUBE_CONFIG: import ConfigMap/%s: create ModuleConfig/%s: %s", kcm.ConfigMapName, name, err)
+		}
+		rlog.Infof("KUBE_CONFIG: ModuleConfig/%s is imported from ConfigMap/%s", name, kcm.ConfigMapName)
+	}
+	kcm.importedSpecs = nil
+
+	for name, fields := range kcm.initStatuses {
+		kcm.writeStatus(name, fields)
+	}
+	kcm.initStatuses = nil
+	return nil
+}
+
+// importConfigMap returns specs of ModuleConfig objects from the ConfigMap data. It is a migration
+// from the ConfigMap: specs are imported only if there are no objects yet.
+// Sections are imported separately: a broken section gets an object with an empty spec
+// and its error is returned in importErrors to be saved in the object status.
+// The ConfigMap is not changed.
+func (kcm *moduleConfigKubeConfigManager) importConfigMap() (specs map[string]ModuleConfigSpec, importErrors map[string]error, err error) {
+	if kcm.ConfigMapName == "" {
+		return nil, nil, nil
+	}
+
+	cmManager := &kubeConfigManager{Namespace: kcm.Namespace, ConfigMapName: kcm.ConfigMapName}
+	cm, err := cmManager.getConfigMap()
+	if err != nil {
+		return nil, nil, fmt.Errorf("KUBE_CONFIG: import ConfigMap/%s: %s", kcm.ConfigMapName, err)
+	}
+	if cm == nil {
+		return nil, nil, nil
+	}
+
+	specs = make(map[string]ModuleConfigSpec)
+	importErrors = make(map[string]error)
+	reject := func(name string, err error) {
+		specs[name] = ModuleConfigSpec{}
+		importErrors[name] = fmt.Errorf("import from ConfigMap/%s: %s", kcm.ConfigMapName, err)
+	}
+
+	globalKubeConfig, err := GetGlobalKubeConfigFromConfigData(cm.Data)
+	if err != nil {
+		reject(GlobalModuleConfigName, err)
+	} else if globalKubeConfig != nil {
+		settings, err := toSettings(globalKubeConfig.Values[utils.GlobalValuesKey])
+		if err != nil {
+			reject(GlobalModuleConfigName, fmt.Errorf("global values: %s", err))
+		} else {
+			specs[GlobalModuleConfigName] = ModuleConfigSpec{Settings: settings}
+		}
+	}
+
+	for moduleName := range GetModulesNamesFromConfigData(cm.Data) {
+		moduleKubeConfig, err := ExtractModuleKubeConfig(moduleName, cm.Data)
+		if err != nil {
+			reject(moduleName, err)
+			continue
+		}
+		moduleConfig := moduleKubeConfig.ModuleConfig
+		settings, err := toSettings(moduleConfig.Values[utils.ModuleNameToValuesKey(moduleName)])
+		if err != nil {
+			reject(moduleName, fmt.Errorf("module '%s' values: %s", moduleName, err))
+			continue
+		}
+		specs[moduleName] = ModuleConfigSpec{
+			Enabled:    moduleConfig.IsEnabled,
+			MaxRetries: moduleConfig.MaxRetries,
+			Settings:   settings,
+		}
+	}
+
+	return specs, importErrors, nil
+}
+
+func (kcm *moduleConfigKubeConfigManager) SetKubeGlobalValues(values utils.Values) error {
+	globalValues, has := values[utils.GlobalValuesKey]
+	if !has {
+		return nil
+	}
+	rlog.Debugf("Kube config manager: set kube global values:\n%s", utils.ValuesToString(values))
+
+	settings, err := toSettings(globalValues)
+	if err != nil {
+		return fmt.Errorf("global values: %s", err)
+	}
+	return kcm.saveSettings(GlobalModuleConfigName, settings)
+}
+
+func (kcm *moduleConfigKubeConfigManager) SetKubeModuleValues(moduleName string, values utils.Values) error {
+	moduleValues, has := values[utils.ModuleNameToValuesKey(moduleName)]
+	if !has {
+		return nil
+	}
+	rlog.Debugf("Kube config manager: set kube module '%s' values:\n%s", moduleName, utils.ValuesToString(values))
+
+	settings, err := toSettings(moduleValues)
+	if err != nil {
+		return fmt.Errorf("module '%s' values: %s", moduleName, err)
+	}
+	return kcm.saveSettings(moduleName, settings)
+}
+
+// saveSettings updates spec.settings of the object or creates a new object.
+// The new spec is applied only after a successful update. The lock is held during the update,
+// so the informer event is handled after the new checksum is saved and is not treated as a change.
+func (kcm *moduleConfigKubeConfigManager) saveSettings(name string, settings map[string]interface{}) error {
+	kcm.m.Lock()
+	defer kcm.m.Unlock()
+
+	obj, err := kcm.resource().Get(name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	if obj == nil || errors.IsNotFound(err) {
+		spec := ModuleConfigSpec{Settings: settings}
+		obj, err = newModuleConfigObject(name, spec)
+		if err != nil {
+			return err
+		}
+		if _, err := kcm.resource().Create(obj, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		return kcm.applySpec(name, spec)
+	}
+
+	spec, err := moduleConfigSpec(obj)
+	if err != nil {
+		return err
+	}
+	spec.Settings = settings
+	if err := setModuleConfigSpec(obj, spec); err != nil {
+		return err
+	}
+	if _, err := kcm.resource().Update(obj, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	return kcm.applySpec(name, spec)
+}
+
+// WriteModulesEnabledStatus sets status.enabled for ModuleConfig objects of all known modules.
+func (kcm *moduleConfigKubeConfigManager) WriteModulesEnabledStatus(enabledModules []string) {
+	enabled := make(map[string]bool)
+	for _, moduleName := range enabledModules {
+		enabled[moduleName] = true
+	}
+
+	kcm.m.Lock()
+	moduleNames := make([]string, 0, len(kcm.ModuleConfigs))
+	for moduleName := range kcm.ModuleConfigs {
+		moduleNames = append(moduleNames, moduleName)
+	}
+	kcm.m.Unlock()
+
+	for _, moduleName := range moduleNames {
+		kcm.writeStatus(moduleName, map[string]interface{}{"enabled": enabled[moduleName]})
+	}
+}
+
+// writeStatus updates status fields of the object. Errors are logged.
+func (kcm *moduleConfigKubeConfigManager) writeStatus(name string, fields map[string]interface{}) {
+	obj, err := kcm.resource().Get(name, metav1.GetOptions{})
+	if err != nil {
+		rlog.Errorf("KUBE_CONFIG: cannot get ModuleConfig/%s to update status: %s", name, err)
+		return
+	}
+
+	status, _, _ := unstructured.NestedMap(obj.Object, "status")
+	if status == nil {
+		status = make(map[string]interface{})
+	}
+	changed := false
+	for k, v := range fields {
+		if status[k] != v {
+			status[k] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	if err := unstructured.SetNestedMap(obj.Object, status, "status"); err != nil {
+		rlog.Errorf("KUBE_CONFIG: cannot set ModuleConfig/%s status: %s", name, err)
+		return
+	}
+	if _, err := kcm.resource().UpdateStatus(obj, metav1.UpdateOptions{}); err != nil {
+		rlog.Errorf("KUBE_CONFIG: cannot update ModuleConfig/%s status: %s", name, err)
+	}
+}
+
+func (kcm *moduleConfigKubeConfigManager) applySpec(name string, spec ModuleConfigSpec) error {
+	checksum, err := specChecksum(spec)
+	if err != nil {
+		return err
+	}
+
+	if name == GlobalModuleConfigName {
+		globalValues := make(utils.Values)
+		if spec.Settings != nil {
+			globalValues[utils.GlobalValuesKey] = spec.Settings
+		}
+		kcm.GlobalValues = globalValues
+		kcm.Checksums[name] = checksum
+		return nil
+	}
+
+	valuesKey := utils.ModuleNameToValuesKey(name)
+	if utils.ModuleNameFromValuesKey(valuesKey) != name {
+		return fmt.Errorf("bad module name '%s': should be a kebab-cased module name", name)
+	}
+
+	moduleConfig := utils.NewModuleConfig(name)
+	moduleConfig.IsEnabled = spec.Enabled
+	moduleConfig.MaxRetries = spec.MaxRetries
+	moduleConfig.Values = make(utils.Values)
+	if spec.Settings != nil {
+		moduleConfig.Values[valuesKey] = spec.Settings
+	}
+	kcm.ModuleConfigs[name] = *moduleConfig
+	kcm.Checksums[name] = checksum
+	return nil
+}
+
+// validateSpec checks settings of the object with the validator. Settings are
+// global values for the global object and module values for a module object.
+func (kcm *moduleConfigKubeConfigManager) validateSpec(name string, spec ModuleConfigSpec) error {
+	if kcm.validate == nil {
+		return nil
+	}
+	valuesKey := utils.GlobalValuesKey
+	if name != GlobalModuleConfigName {
+		valuesKey = utils.ModuleNameToValuesKey(name)
+	}
+	values := make(utils.Values)
+	if spec.Settings != nil {
+		values[valuesKey] = spec.Settings
+	}
+	return kcm.validate(name, values)
+}
+
+// currentConfig returns a copy of current global values and module configs.
+func (kcm *moduleConfigKubeConfigManager) currentConfig() *Config {
+	config := NewConfig()
+	config.Values = kcm.GlobalValues
+	for moduleName, moduleConfig := range kcm.ModuleConfigs {
+		config.ModuleConfigs[moduleName] = moduleConfig
+	}
+	return config
+}
+
+// handleObject detects changes in the object spec. Global values changes are sent over ConfigUpdated channel,
+// module changes are sent over ModuleConfigsUpdated channel with IsUpdated flag for the changed module.
+// The status is written and the update is sent after the lock is released.
+func (kcm *moduleConfigKubeConfigManager) handleObject(obj *unstructured.Unstructured) {
+	name := obj.GetName()
+
+	spec, err := moduleConfigSpec(obj)
+	if err == nil {
+		var checksum string
+		checksum, err = specChecksum(spec)
+		kcm.m.Lock()
+		unchanged := checksum == kcm.Checksums[name]
+		kcm.m.Unlock()
+		if err == nil && unchanged {
+			return
+		}
+	}
+	// Values are validated without the lock: the validator reads values of the module manager.
+	if err == nil {
+		err = kcm.validateSpec(name, spec)
+	}
+	kcm.m.Lock()
+	if err == nil {
+		err = kcm.applySpec(name, spec)
+	}
+	if err != nil {
+		kcm.m.Unlock()
+		rlog.Errorf("KUBE_CONFIG: ModuleConfig/%s is ignored, previous config is used: %s", name, err)
+		kcm.writeStatus(name, map[string]interface{}{"lastError": err.Error()})
+		return
+	}
+	checksum := kcm.Checksums[name]
+	config, moduleConfigs := kcm.update(name)
+	kcm.m.Unlock()
+
+	rlog.Infof("KUBE_CONFIG: ModuleConfig/%s is changed", name)
+	kcm.writeStatus(name, map[string]interface{}{"lastError": "", "checksum": checksum})
+	sendUpdate(config, moduleConfigs)
+}
+
+func (kcm *moduleConfigKubeConfigManager) handleDelete(name string) {
+	kcm.m.Lock()
+	if _, has := kcm.Checksums[name]; !has {
+		kcm.m.Unlock()
+		return
+	}
+	delete(kcm.Checksums, name)
+	if name == GlobalModuleConfigName {
+		kcm.GlobalValues = make(utils.Values)
+	} else {
+		delete(kcm.ModuleConfigs, name)
+	}
+	config, moduleConfigs := kcm.update(name)
+	kcm.m.Unlock()
+
+	rlog.Infof("KUBE_CONFIG: ModuleConfig/%s is deleted", name)
+	sendUpdate(config, moduleConfigs)
+}
+
+// update returns a current config if the global object is changed or module configs
+// with IsUpdated flag for the changed module. kcm.m should be locked.
+func (kcm *moduleConfigKubeConfigManager) update(name string) (*Config, ModuleConfigs) {
+	if name == GlobalModuleConfigName {
+		return kcm.currentConfig(), nil
+	}
+
+	moduleConfigs := make(ModuleConfigs)
+	for moduleName, moduleConfig := range kcm.ModuleConfigs {
+		moduleConfig.IsUpdated = moduleName == name
+		moduleConfigs[moduleName] = moduleConfig
+	}
+	return nil, moduleConfigs
+}
+
+func sendUpdate(config *Config, moduleConfigs ModuleConfigs) {
+	if config != nil {
+		ConfigUpdated <- *config
+		return
+	}
+	ModuleConfigsUpdated <- moduleConfigs
+}
+
+func (kcm *moduleConfigKubeConfigManager) Run() {
+	rlog.Debugf("Run kube config manager for ModuleConfig resources")
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(kube.DynamicClient, 15*time.Second, kcm.Namespace, nil)
+	informer := factory.ForResource(ModuleConfigGVR).Informer()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				kcm.handleObject(u)
+			}
+		},
+		UpdateFunc: func(_ interface{}, obj interface{}) {
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				kcm.handleObject(u)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				kcm.handleDelete(u.GetName())
+			}
+		},
+	})
+
+	informer.Run(make(<-chan struct{}, 1))
+}
+
+func newModuleConfigObject(name string, spec ModuleConfigSpec) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	obj.SetAPIVersion(ModuleConfigGroup + "/" + ModuleConfigVersion)
+	obj.SetKind(ModuleConfigKind)
+	obj.SetName(name)
+	if err := setModuleConfigSpec(obj, spec); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func moduleConfigSpec(obj *unstructured.Unstructured) (ModuleConfigSpec, error) {
+	spec := ModuleConfigSpec{}
+	rawSpec, has := obj.Object["spec"]
+	if !has || rawSpec == nil {
+		return spec, nil
+	}
+
+	data, err := json.Marshal(rawSpec)
+	if err != nil {
+		return spec, err
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return spec, fmt.Errorf("bad spec: %s", err)
+	}
+	return spec, nil
+}
+
+func setModuleConfigSpec(obj *unstructured.Unstructured, spec ModuleConfigSpec) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	var rawSpec map[string]interface{}
+	if err := json.Unmarshal(data, &rawSpec); err != nil {
+		return err
+	}
+	obj.Object["spec"] = rawSpec
+	return nil
+}
+
+func specChecksum(spec ModuleConfigSpec) (string, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	return utils_checksum.CalculateChecksum(string(data)), nil
+}
+
+// toSettings converts values to a JSON compatible map.
+func toSettings(values interface{}) (map[string]interface{}, error) {
+	if values == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("cannot dump json for settings: %s", err)
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("settings should be a map: %s", err)
+	}
+	return settings, nil
+}
@@ -0,0 +1,244 @@
+package kube_config_manager
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamic_fake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+
+	"github.com/flant/shell-operator/pkg/kube"
+
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+func Test_ModuleConfigKubeConfigManager_ImportConfigMap(t *testing.T) {
+	kube.Kubernetes = fake.NewSimpleClientset()
+	kube.DynamicClient = dynamic_fake.NewSimpleDynamicClient(runtime.NewScheme())
+	_, _ = kube.Kubernetes.CoreV1().ConfigMaps("default").Create(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "addon-operator"},
+		Data: map[string]string{
+			"global":              "project: tfprod\n",
+			"nginxIngress":        "config:\n  hsts: true\n",
+			"nginxIngressEnabled": "true",
+			"kubeLegoEnabled":     "false",
+		},
+	})
+
+	kcm := NewModuleConfigKubeConfigManager()
+	kcm.WithNamespace("default")
+	kcm.WithConfigMapName("addon-operator")
+	if !assert.NoError(t, kcm.Init()) {
+		return
+	}
+
+	config := kcm.InitialConfig()
+	assert.Equal(t, utils.Values{"global": map[string]interface{}{"project": "tfprod"}}, config.Values)
+	if assert.Contains(t, config.ModuleConfigs, "nginx-ingress") {
+		moduleConfig := config.ModuleConfigs["nginx-ingress"]
+		assert.Equal(t, &utils.ModuleEnabled, moduleConfig.IsEnabled)
+		assert.Equal(t, utils.Values{"nginxIngress": map[string]interface{}{"config": map[string]interface{}{"hsts": true}}}, moduleConfig.Values)
+	}
+	if assert.Contains(t, config.ModuleConfigs, "kube-lego") {
+		assert.Equal(t, &utils.ModuleDisabled, config.ModuleConfigs["kube-lego"].IsEnabled)
+	}
+
+	// Objects are created only in the leader.
+	list, err := kube.DynamicClient.Resource(ModuleConfigGVR).Namespace("default").List(metav1.ListOptions{})
+	if assert.NoError(t, err) {
+		assert.Len(t, list.Items, 0)
+	}
+
+	// An object created by another leader is not an error.
+	_, err = kube.DynamicClient.Resource(ModuleConfigGVR).Namespace("default").Create(newTestModuleConfig("global", nil), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, kcm.(LeaderInitializer).InitLeader())
+	list, err = kube.DynamicClient.Resource(ModuleConfigGVR).Namespace("default").List(metav1.ListOptions{})
+	if assert.NoError(t, err) {
+		assert.Len(t, list.Items, 3)
+	}
+	assert.NotEmpty(t, getTestModuleConfigStatus(t, "nginx-ingress")["checksum"])
+}
+
+// A broken section of the ConfigMap does not prevent import of other sections.
+func Test_ModuleConfigKubeConfigManager_ImportConfigMap_BrokenSection(t *testing.T) {
+	kube.Kubernetes = fake.NewSimpleClientset()
+	kube.DynamicClient = dynamic_fake.NewSimpleDynamicClient(runtime.NewScheme())
+	_, _ = kube.Kubernetes.CoreV1().ConfigMaps("default").Create(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "addon-operator"},
+		Data: map[string]string{
+			"global":       "project: tfprod\n",
+			"nginxIngress": "config: [\n",
+			"kubeLego":     "email: admin@example.com\n",
+		},
+	})
+
+	kcm := NewModuleConfigKubeConfigManager()
+	kcm.WithNamespace("default")
+	kcm.WithConfigMapName("addon-operator")
+	if !assert.NoError(t, kcm.Init()) {
+		return
+	}
+
+	config := kcm.InitialConfig()
+	assert.Equal(t, utils.Values{"global": map[string]interface{}{"project": "tfprod"}}, config.Values)
+	assert.NotContains(t, config.ModuleConfigs, "nginx-ingress")
+	if assert.Contains(t, config.ModuleConfigs, "kube-lego") {
+		assert.Equal(t, utils.Values{"kubeLego": map[string]interface{}{"email": "admin@example.com"}}, config.ModuleConfigs["kube-lego"].Values)
+	}
+
+	assert.NoError(t, kcm.(LeaderInitializer).InitLeader())
+	list, err := kube.DynamicClient.Resource(ModuleConfigGVR).Namespace("default").List(metav1.ListOptions{})
+	if assert.NoError(t, err) {
+		assert.Len(t, list.Items, 3)
+	}
+	assert.Contains(t, getTestModuleConfigStatus(t, "nginx-ingress")["lastError"], "import from ConfigMap/addon-operator")
+	assert.Equal(t, "", getTestModuleConfigStatus(t, "kube-lego")["lastError"])
+	assert.NotEmpty(t, getTestModuleConfigStatus(t, "kube-lego")["checksum"])
+}
+
+func Test_ModuleConfigKubeConfigManager_Changes(t *testing.T) {
+	kube.Kubernetes = fake.NewSimpleClientset()
+	dynamicClient := dynamic_fake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newTestModuleConfig("global", map[string]interface{}{"settings": map[string]interface{}{"project": "tfprod"}}),
+		newTestModuleConfig("module-one", map[string]interface{}{"enabled": true, "settings": map[string]interface{}{"replicas": int64(1)}}),
+		newTestModuleConfig("module_two", map[string]interface{}{"enabled": true}),
+	)
+	kube.DynamicClient = dynamicClient
+
+	kcm := NewModuleConfigKubeConfigManager()
+	kcm.WithNamespace("default")
+	if !assert.NoError(t, kcm.Init()) {
+		return
+	}
+	mcm := kcm.(*moduleConfigKubeConfigManager)
+	assert.NoError(t, mcm.InitLeader())
+
+	// Bad module name is ignored and error is written into the status.
+	config := kcm.InitialConfig()
+	assert.Len(t, config.ModuleConfigs, 1)
+	assert.Contains(t, getTestModuleConfigStatus(t, "module_two")["lastError"], "bad module name")
+	assert.NotEmpty(t, getTestModuleConfigStatus(t, "module-one")["checksum"])
+
+	// Unchanged spec is ignored.
+	mcm.handleObject(newTestModuleConfig("module-one", map[string]interface{}{"enabled": true, "settings": map[string]interface{}{"replicas": int64(1)}}))
+	assert.Len(t, ModuleConfigsUpdated, 0)
+
+	mcm.handleObject(newTestModuleConfig("module-one", map[string]interface{}{"enabled": false}))
+	if assert.Len(t, ModuleConfigsUpdated, 1) {
+		moduleConfigs := <-ModuleConfigsUpdated
+		assert.True(t, moduleConfigs["module-one"].IsUpdated)
+		assert.Equal(t, &utils.ModuleDisabled, moduleConfigs["module-one"].IsEnabled)
+	}
+
+	// Bad spec does not change the config.
+	mcm.handleObject(newTestModuleConfig("module-one", map[string]interface{}{"enabled": "yes"}))
+	assert.Len(t, ModuleConfigsUpdated, 0)
+	assert.Contains(t, getTestModuleConfigStatus(t, "module-one")["lastError"], "bad spec")
+	assert.Equal(t, &utils.ModuleDisabled, mcm.ModuleConfigs["module-one"].IsEnabled)
+
+	// Values from hooks are saved into spec.settings.
+	assert.NoError(t, kcm.SetKubeGlobalValues(utils.Values{"global": map[string]interface{}{"project": "tfstage"}}))
+	assert.Len(t, ConfigUpdated, 0)
+	obj, err := kube.DynamicClient.Resource(ModuleConfigGVR).Namespace("default").Get("global", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		project, _, _ := unstructured.NestedString(obj.Object, "spec", "settings", "project")
+		assert.Equal(t, "tfstage", project)
+		mcm.handleObject(obj)
+		assert.Len(t, ConfigUpdated, 0)
+	}
+
+	mcm.WriteModulesEnabledStatus([]string{"module-one"})
+	assert.Equal(t, true, getTestModuleConfigStatus(t, "module-one")["enabled"])
+
+	mcm.handleDelete("module-one")
+	if assert.Len(t, ModuleConfigsUpdated, 1) {
+		assert.NotContains(t, <-ModuleConfigsUpdated, "module-one")
+	}
+
+	// Settings should be a map.
+	assert.Error(t, kcm.SetKubeGlobalValues(utils.Values{"global": "tfstage"}))
+
+	// Failed update does not change the config and the checksum.
+	checksum := mcm.Checksums["global"]
+	dynamicClient.PrependReactor("update", ModuleConfigResource, func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("update failed")
+	})
+	assert.Error(t, kcm.SetKubeGlobalValues(utils.Values{"global": map[string]interface{}{"project": "tfdev"}}))
+	assert.Equal(t, checksum, mcm.Checksums["global"])
+	assert.Equal(t, utils.Values{"global": map[string]interface{}{"project": "tfstage"}}, mcm.GlobalValues)
+}
+
+func Test_ModuleConfigKubeConfigManager_Validation(t *testing.T) {
+	kube.Kubernetes = fake.NewSimpleClientset()
+	kube.DynamicClient = dynamic_fake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newTestModuleConfig("module-one", map[string]interface{}{"settings": map[string]interface{}{"mode": "good"}}),
+		newTestModuleConfig("module-two", map[string]interface{}{"settings": map[string]interface{}{"mode": "bad"}}),
+	)
+
+	validate := func(name string, values utils.Values) error {
+		settings, _ := values[utils.ModuleNameToValuesKey(name)].(map[string]interface{})
+		if settings["mode"] == "bad" {
+			return fmt.Errorf("mode is not valid")
+		}
+		return nil
+	}
+
+	kcm := NewModuleConfigKubeConfigManager()
+	kcm.WithNamespace("default")
+	if !assert.NoError(t, kcm.Init()) {
+		return
+	}
+	mcm := kcm.(*moduleConfigKubeConfigManager)
+
+	// Invalid object is skipped on start, other modules keep their configs.
+	mcm.RejectInitialConfig("module-two", validate("module-two", kcm.InitialConfig().ModuleConfigs["module-two"].Values))
+	mcm.WithConfigValidator(validate)
+	assert.NoError(t, mcm.InitLeader())
+	config := kcm.InitialConfig()
+	assert.Contains(t, config.ModuleConfigs, "module-one")
+	assert.NotContains(t, config.ModuleConfigs, "module-two")
+	assert.Contains(t, getTestModuleConfigStatus(t, "module-two")["lastError"], "mode is not valid")
+
+	// Invalid change is written into the status, the previous config and the checksum are kept.
+	checksum := mcm.Checksums["module-one"]
+	mcm.handleObject(newTestModuleConfig("module-one", map[string]interface{}{"settings": map[string]interface{}{"mode": "bad"}}))
+	assert.Len(t, ModuleConfigsUpdated, 0)
+	assert.Equal(t, checksum, mcm.Checksums["module-one"])
+	assert.Contains(t, getTestModuleConfigStatus(t, "module-one")["lastError"], "mode is not valid")
+	assert.Equal(t, utils.Values{"moduleOne": map[string]interface{}{"mode": "good"}}, mcm.ModuleConfigs["module-one"].Values)
+
+	// Fixed object of another module is applied.
+	mcm.handleObject(newTestModuleConfig("module-two", map[string]interface{}{"settings": map[string]interface{}{"mode": "fixed"}}))
+	if assert.Len(t, ModuleConfigsUpdated, 1) {
+		moduleConfigs := <-ModuleConfigsUpdated
+		assert.True(t, moduleConfigs["module-two"].IsUpdated)
+		assert.False(t, moduleConfigs["module-one"].IsUpdated)
+	}
+	assert.Equal(t, "", getTestModuleConfigStatus(t, "module-two")["lastError"])
+}
+
+func newTestModuleConfig(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	obj.SetAPIVersion(ModuleConfigGroup + "/" + ModuleConfigVersion)
+	obj.SetKind(ModuleConfigKind)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	return obj
+}
+
+func getTestModuleConfigStatus(t *testing.T, name string) map[string]interface{} {
+	obj, err := kube.DynamicClient.Resource(ModuleConfigGVR).Namespace("default").Get(name, metav1.GetOptions{})
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	status, _, _ := unstructured.NestedMap(obj.Object, "status")
+	return status
+}
@@ -14,7 +14,7 @@ import (
 
 // TODO make a method of KubeConfig
 // GetModulesNamesFromConfigData returns all keys in kube config except global
-// modNameEnabled keys are also handled
+// modNameEnabled and modNameMaxRetries keys are also handled
 func GetModulesNamesFromConfigData(configData map[string]string) map[string]bool {
 	res := make(map[string]bool, 0)
 
@@ -26,6 +26,9 @@ func GetModulesNamesFromConfigData(configData map[string]string) map[string]bool
 		if strings.HasSuffix(key, "Enabled") {
 			key = strings.TrimSuffix(key, "Enabled")
 		}
+		if strings.HasSuffix(key, "MaxRetries") {
+			key = strings.TrimSuffix(key, "MaxRetries")
+		}
 
 		modName := utils.ModuleNameFromValuesKey(key)
 
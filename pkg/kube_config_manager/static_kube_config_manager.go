@@ -0,0 +1,103 @@
+package kube_config_manager
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/romana/rlog"
+	"gopkg.in/yaml.v2"
+
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// staticKubeConfigManager is a KubeConfigManager with values from ConfigMap data.
+// It does not use Kubernetes: values set by hooks are not saved anywhere.
+// It is used to render modules without a cluster.
+type staticKubeConfigManager struct {
+	initialConfig *Config
+}
+
+// staticKubeConfigManager should implement KubeConfigManager
+var _ KubeConfigManager = &staticKubeConfigManager{}
+
+func NewStaticKubeConfigManager(config *Config) KubeConfigManager {
+	if config == nil {
+		config = NewConfig()
+	}
+	return &staticKubeConfigManager{initialConfig: config}
+}
+
+func (kcm *staticKubeConfigManager) WithNamespace(_ string) {}
+
+func (kcm *staticKubeConfigManager) WithConfigMapName(_ string) {}
+
+func (kcm *staticKubeConfigManager) WithValuesChecksumsAnnotation(_ string) {}
+
+func (kcm *staticKubeConfigManager) SetKubeGlobalValues(values utils.Values) error {
+	rlog.Debugf("Static kube config manager: global config values are not saved:\n%s", utils.ValuesToString(values))
+	return nil
+}
+
+func (kcm *staticKubeConfigManager) SetKubeModuleValues(moduleName string, values utils.Values) error {
+	rlog.Debugf("Static kube config manager: module '%s' config values are not saved:\n%s", moduleName, utils.ValuesToString(values))
+	return nil
+}
+
+func (kcm *staticKubeConfigManager) Init() error {
+	return nil
+}
+
+// Run does nothing: static config is never updated.
+func (kcm *staticKubeConfigManager) Run() {}
+
+func (kcm *staticKubeConfigManager) InitialConfig() *Config {
+	return kcm.initialConfig
+}
+
+// NewConfigFromConfigData returns a Config with global and modules values from ConfigMap data.
+func NewConfigFromConfigData(configData map[string]string) (*Config, error) {
+	config := NewConfig()
+
+	globalKubeConfig, err := GetGlobalKubeConfigFromConfigData(configData)
+	if err != nil {
+		return nil, err
+	}
+	if globalKubeConfig != nil {
+		config.Values = globalKubeConfig.Values
+	}
+
+	for moduleName := range GetModulesNamesFromConfigData(configData) {
+		moduleKubeConfig, err := ExtractModuleKubeConfig(moduleName, configData)
+		if err != nil {
+			return nil, err
+		}
+		config.ModuleConfigs[moduleKubeConfig.ModuleName] = moduleKubeConfig.ModuleConfig
+	}
+
+	return config, nil
+}
+
+// ConfigDataFromFile reads ConfigMap data from a YAML file. File can contain
+// a ConfigMap manifest or just a content of the data field.
+func ConfigDataFromFile(filePath string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var cm struct {
+		Kind string            `yaml:"kind"`
+		Data map[string]string `yaml:"data"`
+	}
+	err = yaml.Unmarshal(content, &cm)
+	if err == nil && cm.Kind == "ConfigMap" {
+		return cm.Data, nil
+	}
+
+	configData := make(map[string]string)
+	err = yaml.Unmarshal(content, &configData)
+	if err != nil {
+		return nil, fmt.Errorf("ConfigMap data file '%s' should contain a ConfigMap or a map of strings: %s", filePath, err)
+	}
+	return configData, nil
+}
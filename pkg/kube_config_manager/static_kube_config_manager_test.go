@@ -0,0 +1,64 @@
+package kube_config_manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ConfigDataFromFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kube-config-manager")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	cmPath := filepath.Join(tmpDir, "cm.yaml")
+	err = ioutil.WriteFile(cmPath, []byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: addon-operator
+data:
+  global: |
+    project: tfprod
+  moduleOne: |
+    param1: val1
+  moduleTwoEnabled: "false"
+`), 0644)
+	assert.NoError(t, err)
+
+	dataPath := filepath.Join(tmpDir, "data.yaml")
+	err = ioutil.WriteFile(dataPath, []byte(`
+global: |
+  project: tfprod
+moduleOne: |
+  param1: val1
+moduleTwoEnabled: "false"
+`), 0644)
+	assert.NoError(t, err)
+
+	for _, path := range []string{cmPath, dataPath} {
+		configData, err := ConfigDataFromFile(path)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		config, err := NewConfigFromConfigData(configData)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		assert.Equal(t, "tfprod", config.Values["global"].(map[string]interface{})["project"])
+		assert.Contains(t, config.ModuleConfigs, "module-one")
+		assert.Contains(t, config.ModuleConfigs, "module-two")
+		if assert.NotNil(t, config.ModuleConfigs["module-two"].IsEnabled) {
+			assert.False(t, *config.ModuleConfigs["module-two"].IsEnabled)
+		}
+
+		kcm := NewStaticKubeConfigManager(config)
+		assert.NoError(t, kcm.Init())
+		assert.Equal(t, config, kcm.InitialConfig())
+	}
+}
@@ -0,0 +1,254 @@
+package kube_patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/romana/rlog"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// Create creates an object and fails if the object exists.
+	Create = "Create"
+	// CreateOrUpdate creates an object or replaces the existing object.
+	CreateOrUpdate = "CreateOrUpdate"
+	// Delete deletes an object. Absent objects are ignored.
+	Delete = "Delete"
+	// JSONPatch applies a RFC 6902 JSON patch to the existing object.
+	JSONPatch = "JSONPatch"
+	// MergePatch applies a RFC 7386 JSON merge patch to the existing object.
+	MergePatch = "MergePatch"
+)
+
+// Operation is a record in a KUBERNETES_PATCH_PATH file written by a hook. Examples:
+//
+//	{"operation":"CreateOrUpdate","object":{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default"},"data":{"key":"value"}}}
+//	{"operation":"Delete","apiVersion":"v1","kind":"ConfigMap","namespace":"default","name":"cm"}
+//	{"operation":"JSONPatch","apiVersion":"v1","kind":"Pod","namespace":"default","name":"app","patch":[{"op":"add","path":"/metadata/labels/app","value":"app"}]}
+//	{"operation":"MergePatch","apiVersion":"apps/v1","kind":"Deployment","namespace":"default","name":"app","patch":{"spec":{"replicas":2}}}
+type Operation struct {
+	Operation string `json:"operation"`
+	// Object is a manifest for Create and CreateOrUpdate.
+	Object map[string]interface{} `json:"object,omitempty"`
+	// APIVersion, Kind, Namespace and Name identify an object for Delete, JSONPatch and MergePatch.
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+	// Patch is a list of operations for JSONPatch or an object for MergePatch.
+	Patch interface{} `json:"patch,omitempty"`
+}
+
+func (op Operation) Validate() error {
+	switch op.Operation {
+	case Create, CreateOrUpdate:
+		if op.Object == nil {
+			return fmt.Errorf("'object' is required for operation '%s'", op.Operation)
+		}
+		obj := &unstructured.Unstructured{Object: op.Object}
+		if obj.GetAPIVersion() == "" || obj.GetKind() == "" || obj.GetName() == "" {
+			return fmt.Errorf("'apiVersion', 'kind' and 'metadata.name' of object are required for operation '%s'", op.Operation)
+		}
+		return nil
+	case Delete, JSONPatch, MergePatch:
+		if op.APIVersion == "" || op.Kind == "" || op.Name == "" {
+			return fmt.Errorf("'apiVersion', 'kind' and 'name' are required for operation '%s'", op.Operation)
+		}
+		if op.Operation != Delete && op.Patch == nil {
+			return fmt.Errorf("'patch' is required for operation '%s'", op.Operation)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operation '%s': use '%s', '%s', '%s', '%s' or '%s'", op.Operation, Create, CreateOrUpdate, Delete, JSONPatch, MergePatch)
+}
+
+// String returns a short description of the operation for logs and errors.
+func (op Operation) String() string {
+	apiVersion, kind, namespace, name := op.APIVersion, op.Kind, op.Namespace, op.Name
+	if op.Object != nil {
+		obj := &unstructured.Unstructured{Object: op.Object}
+		apiVersion, kind, namespace, name = obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), obj.GetName()
+	}
+	if namespace != "" {
+		name = namespace + "/" + name
+	}
+	return fmt.Sprintf("%s %s/%s '%s'", op.Operation, apiVersion, kind, name)
+}
+
+// OperationsFromBytes parses operations: JSON objects one after another or a JSON array.
+// Empty data means no operations.
+func OperationsFromBytes(data []byte) ([]Operation, error) {
+	operations := make([]Operation, 0)
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		batch := make([]Operation, 1)
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			err = json.Unmarshal(raw, &batch)
+		} else {
+			err = json.Unmarshal(raw, &batch[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, op := range batch {
+			if err := op.Validate(); err != nil {
+				return nil, fmt.Errorf("operation #%d: %s", len(operations), err)
+			}
+			operations = append(operations, op)
+		}
+	}
+
+	return operations, nil
+}
+
+func OperationsFromFile(filePath string) ([]Operation, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", filePath, err)
+	}
+	return OperationsFromBytes(data)
+}
+
+// ObjectPatcher applies operations with a dynamic client. Resources are found with the discovery.
+type ObjectPatcher struct {
+	Client    dynamic.Interface
+	Discovery discovery.DiscoveryInterface
+	// Created are objects created by Create operations. A failed task runs the hook again and
+	// operations are applied again, so an existing object from Created is not an error for Create.
+	Created map[string]bool
+}
+
+func NewObjectPatcher(client dynamic.Interface, discovery discovery.DiscoveryInterface) *ObjectPatcher {
+	return &ObjectPatcher{
+		Client:    client,
+		Discovery: discovery,
+		Created:   make(map[string]bool),
+	}
+}
+
+// WithCreated sets objects created by a previous Apply of the same operations.
+func (p *ObjectPatcher) WithCreated(created map[string]bool) *ObjectPatcher {
+	p.Created = created
+	return p
+}
+
+// Apply applies operations one by one and stops on the first error. Operations are not
+// transactional: operations applied before the error are not rolled back. Resources of all
+// operations are checked first, so an unknown kind fails before any changes.
+func (p *ObjectPatcher) Apply(operations []Operation) error {
+	clients := make([]dynamic.ResourceInterface, len(operations))
+	for i, op := range operations {
+		apiVersion, kind, namespace := op.APIVersion, op.Kind, op.Namespace
+		if op.Object != nil {
+			obj := &unstructured.Unstructured{Object: op.Object}
+			apiVersion, kind, namespace = obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace()
+		}
+		client, err := p.resourceClient(apiVersion, kind, namespace)
+		if err != nil {
+			return fmt.Errorf("%s: %s", op.String(), err)
+		}
+		clients[i] = client
+	}
+
+	for i, op := range operations {
+		if err := p.apply(clients[i], op); err != nil {
+			return fmt.Errorf("%s: %s", op.String(), err)
+		}
+		rlog.Infof("KUBE_PATCH: %s is done", op.String())
+	}
+	return nil
+}
+
+func (p *ObjectPatcher) apply(client dynamic.ResourceInterface, op Operation) error {
+	switch op.Operation {
+	case Create, CreateOrUpdate:
+		obj := &unstructured.Unstructured{Object: op.Object}
+		_, err := client.Create(obj, metav1.CreateOptions{})
+		if op.Operation == Create {
+			// The object is created by the previous try of the same operations.
+			if errors.IsAlreadyExists(err) && p.Created[op.String()] {
+				return nil
+			}
+			if err == nil {
+				p.Created[op.String()] = true
+			}
+			return err
+		}
+		if !errors.IsAlreadyExists(err) {
+			return err
+		}
+		existing, err := client.Get(obj.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		obj.SetResourceVersion(existing.GetResourceVersion())
+		_, err = client.Update(obj, metav1.UpdateOptions{})
+		return err
+
+	case Delete:
+		err := client.Delete(op.Name, &metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+
+	case JSONPatch, MergePatch:
+		data, err := json.Marshal(op.Patch)
+		if err != nil {
+			return err
+		}
+		patchType := types.JSONPatchType
+		if op.Operation == MergePatch {
+			patchType = types.MergePatchType
+		}
+		_, err = client.Patch(op.Name, patchType, data, metav1.PatchOptions{})
+		return err
+	}
+	return op.Validate()
+}
+
+// resourceClient returns a client for the resource of the kind. Namespace is ignored for cluster-wide resources.
+func (p *ObjectPatcher) resourceClient(apiVersion, kind, namespace string) (dynamic.ResourceInterface, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	list, err := p.Discovery.ServerResourcesForGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	for _, resource := range list.APIResources {
+		// Subresources have names like 'deployments/status'.
+		if resource.Kind != kind || strings.Contains(resource.Name, "/") {
+			continue
+		}
+		client := p.Client.Resource(gv.WithResource(resource.Name))
+		if resource.Namespaced {
+			return client.Namespace(namespace), nil
+		}
+		return client, nil
+	}
+	return nil, fmt.Errorf("kind '%s' is not found in '%s'", kind, apiVersion)
+}
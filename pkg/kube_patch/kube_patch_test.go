@@ -0,0 +1,95 @@
+package kube_patch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fake_discovery "k8s.io/client-go/discovery/fake"
+	fake_dynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_OperationsFromBytes(t *testing.T) {
+	operations, err := OperationsFromBytes([]byte(`
+{"operation":"Delete","apiVersion":"v1","kind":"ConfigMap","namespace":"default","name":"a"}
+[{"operation":"Delete","apiVersion":"v1","kind":"ConfigMap","namespace":"default","name":"b"},
+ {"operation":"MergePatch","apiVersion":"v1","kind":"ConfigMap","namespace":"default","name":"c","patch":{"data":{"key":"value"}}}]
+`))
+	if assert.NoError(t, err) && assert.Len(t, operations, 3) {
+		assert.Equal(t, "Delete v1/ConfigMap 'default/b'", operations[1].String())
+	}
+
+	operations, err = OperationsFromBytes([]byte(""))
+	assert.NoError(t, err)
+	assert.Len(t, operations, 0)
+
+	_, err = OperationsFromBytes([]byte(`{"operation":"Replace","apiVersion":"v1","kind":"ConfigMap","name":"a"}`))
+	assert.Error(t, err)
+
+	_, err = OperationsFromBytes([]byte(`{"operation":"JSONPatch","apiVersion":"v1","kind":"ConfigMap","name":"a"}`))
+	assert.Error(t, err)
+
+	_, err = OperationsFromBytes([]byte(`{"operation":"Create","object":{"kind":"ConfigMap"}}`))
+	assert.Error(t, err)
+}
+
+func newConfigMap(name string, data map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"data":       data,
+	}}
+}
+
+func Test_ObjectPatcher_Apply(t *testing.T) {
+	client := fake_dynamic.NewSimpleDynamicClient(runtime.NewScheme(), newConfigMap("existing", map[string]interface{}{"key": "old"}))
+	discovery := fake.NewSimpleClientset().Discovery().(*fake_discovery.FakeDiscovery)
+	discovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "configmaps", Kind: "ConfigMap", Namespaced: true},
+		},
+	}}
+	patcher := NewObjectPatcher(client, discovery)
+	configMaps := client.Resource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).Namespace("default")
+
+	err := patcher.Apply([]Operation{
+		{Operation: Create, Object: newConfigMap("new", map[string]interface{}{"key": "new"}).Object},
+		{Operation: CreateOrUpdate, Object: newConfigMap("existing", map[string]interface{}{"key": "updated"}).Object},
+		{Operation: Delete, APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "absent"},
+	})
+	if assert.NoError(t, err) {
+		obj, err := configMaps.Get("new", metav1.GetOptions{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "new", obj.Object["data"].(map[string]interface{})["key"])
+		}
+		obj, err = configMaps.Get("existing", metav1.GetOptions{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "updated", obj.Object["data"].(map[string]interface{})["key"])
+		}
+	}
+
+	// Create fails for the existing object.
+	err = NewObjectPatcher(client, discovery).Apply([]Operation{{Operation: Create, Object: newConfigMap("new", nil).Object}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Create v1/ConfigMap 'default/new'")
+	}
+
+	// Create of an object created by the previous try is not an error.
+	retried := NewObjectPatcher(client, discovery).WithCreated(patcher.Created)
+	assert.NoError(t, retried.Apply([]Operation{{Operation: Create, Object: newConfigMap("new", nil).Object}}))
+
+	// Unknown kind fails before any changes.
+	err = patcher.Apply([]Operation{
+		{Operation: Delete, APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "existing"},
+		{Operation: Delete, APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "a"},
+	})
+	assert.Error(t, err)
+	_, err = configMaps.Get("existing", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,338 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romana/rlog"
+)
+
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// Names of structured fields.
+const (
+	TaskField         = "task"
+	ModuleField       = "module"
+	HookField         = "hook"
+	BindingField      = "binding"
+	EventIDField      = "event_id"
+	FailureCountField = "failure_count"
+	DurationField     = "duration"
+	OutputField       = "output"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+	levelNone
+)
+
+var levelNames = map[int]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+var (
+	format             = TextFormat
+	minLevel           = levelInfo
+	out      io.Writer = os.Stderr
+	outLock  sync.Mutex
+)
+
+// SetFormat configures a log format. In json format messages from rlog
+// are converted into JSON lines too, so all logs have the same format.
+func SetFormat(logFormat string) error {
+	switch logFormat {
+	case TextFormat:
+		format = TextFormat
+		return nil
+	case JSONFormat:
+	default:
+		return fmt.Errorf("unknown log format '%s', use '%s' or '%s'", logFormat, TextFormat, JSONFormat)
+	}
+
+	format = JSONFormat
+	minLevel = parseLevel(os.Getenv("RLOG_LOG_LEVEL"))
+	switch strings.ToUpper(os.Getenv("RLOG_LOG_STREAM")) {
+	case "STDOUT":
+		out = os.Stdout
+	case "NONE":
+		out = nil
+	default:
+		out = os.Stderr
+	}
+
+	// Time and level are added by the json writer.
+	_ = os.Setenv("RLOG_LOG_NOTIME", "yes")
+	rlog.UpdateEnv()
+	rlog.SetOutput(&rlogJSONWriter{})
+	return nil
+}
+
+// Format returns a configured log format.
+func Format() string {
+	return format
+}
+
+// parseLevel returns a level from RLOG_LOG_LEVEL. Per-file filters are ignored.
+func parseLevel(spec string) int {
+	level := levelInfo
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.Contains(item, "=") {
+			continue
+		}
+		switch strings.ToUpper(item) {
+		case "DEBUG", "TRACE":
+			level = levelDebug
+		case "INFO":
+			level = levelInfo
+		case "WARN":
+			level = levelWarn
+		case "ERROR", "CRITICAL":
+			level = levelError
+		case "NONE":
+			level = levelNone
+		}
+	}
+	return level
+}
+
+// Fields are structured fields of a log line.
+type Fields map[string]interface{}
+
+// Entry is a set of fields for log messages.
+type Entry struct {
+	Fields Fields
+}
+
+// WithLabels returns a new Entry with labels as fields.
+func WithLabels(labels map[string]string) *Entry {
+	return (&Entry{Fields: Fields{}}).WithLabels(labels)
+}
+
+// WithField returns a new Entry with a field.
+func WithField(key string, value interface{}) *Entry {
+	return (&Entry{Fields: Fields{}}).WithField(key, value)
+}
+
+// WithLabels returns a copy of the Entry with additional labels.
+func (e *Entry) WithLabels(labels map[string]string) *Entry {
+	fields := e.copyFields()
+	for k, v := range labels {
+		fields[k] = v
+	}
+	return &Entry{Fields: fields}
+}
+
+// WithField returns a copy of the Entry with an additional field.
+func (e *Entry) WithField(key string, value interface{}) *Entry {
+	fields := e.copyFields()
+	fields[key] = value
+	return &Entry{Fields: fields}
+}
+
+// Labels returns string fields of the Entry. It is used to pass fields to other components.
+func (e *Entry) Labels() map[string]string {
+	labels := make(map[string]string)
+	for k, v := range e.Fields {
+		if s, ok := v.(string); ok {
+			labels[k] = s
+		}
+	}
+	return labels
+}
+
+func (e *Entry) copyFields() Fields {
+	fields := make(Fields, len(e.Fields))
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	return fields
+}
+
+func (e *Entry) Debugf(format string, args ...interface{}) {
+	e.log(levelDebug, format, args...)
+}
+
+func (e *Entry) Infof(format string, args ...interface{}) {
+	e.log(levelInfo, format, args...)
+}
+
+func (e *Entry) Warnf(format string, args ...interface{}) {
+	e.log(levelWarn, format, args...)
+}
+
+func (e *Entry) Errorf(format string, args ...interface{}) {
+	e.log(levelError, format, args...)
+}
+
+// log passes the message with fields to rlog in text format and writes a JSON line in json format.
+func (e *Entry) log(level int, msgFormat string, args ...interface{}) {
+	if format != JSONFormat {
+		msg := fmt.Sprintf(msgFormat, args...) + FormatTextFields(e.Fields)
+		switch level {
+		case levelDebug:
+			rlog.Debugf("%s", msg)
+		case levelInfo:
+			rlog.Infof("%s", msg)
+		case levelWarn:
+			rlog.Warnf("%s", msg)
+		default:
+			rlog.Errorf("%s", msg)
+		}
+		return
+	}
+
+	if level < minLevel {
+		return
+	}
+	writeJSON(level, fmt.Sprintf(msgFormat, args...), e.Fields)
+}
+
+// FormatTextFields returns fields as ' key=value' pairs sorted by keys for the text format.
+// Values with spaces, quotes or '=' are quoted.
+func FormatTextFields(fields Fields) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	for _, k := range keys {
+		value := fmt.Sprintf("%v", fields[k])
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(" " + k + "=" + value)
+	}
+	return buf.String()
+}
+
+// FormatJSON returns a log line in JSON format with a trailing newline.
+// Fields can not override level, msg and time.
+func FormatJSON(level string, msg string, fields Fields, now time.Time) []byte {
+	data := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		data[k] = v
+	}
+	data["level"] = level
+	data["msg"] = msg
+	data["time"] = now.Format(time.RFC3339)
+
+	line, err := json.Marshal(data)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{
+			"level": level,
+			"msg":   msg,
+			"time":  now.Format(time.RFC3339),
+			"error": fmt.Sprintf("cannot marshal log fields: %v", err),
+		})
+	}
+	return append(line, '\n')
+}
+
+func writeJSON(level int, msg string, fields Fields) {
+	line := FormatJSON(levelNames[level], msg, fields, time.Now())
+	outLock.Lock()
+	defer outLock.Unlock()
+	if out != nil {
+		_, _ = out.Write(line)
+	}
+}
+
+// rlogJSONWriter converts rlog lines 'LEVEL    : message' into JSON lines.
+// rlog writes every message with one Write call.
+type rlogJSONWriter struct{}
+
+func (w *rlogJSONWriter) Write(p []byte) (int, error) {
+	level, msg := ParseRlogLine(string(p))
+	writeJSON(level, msg, nil)
+	return len(p), nil
+}
+
+// ParseRlogLine returns a level and a message from a line formatted by rlog without time.
+func ParseRlogLine(line string) (int, string) {
+	line = strings.TrimRight(line, "\n")
+	idx := strings.Index(line, ": ")
+	if idx < 0 {
+		return levelInfo, line
+	}
+	msg := line[idx+2:]
+	switch strings.TrimSpace(line[:idx]) {
+	case "DEBUG":
+		return levelDebug, msg
+	case "WARN":
+		return levelWarn, msg
+	case "ERROR", "CRITICAL":
+		return levelError, msg
+	case "INFO":
+		return levelInfo, msg
+	}
+	if strings.HasPrefix(line, "TRACE") {
+		return levelDebug, msg
+	}
+	return levelInfo, line
+}
+
+// LineWriter logs every line written into it. It is used to log stdout and stderr of hooks.
+// Flush should be called after the last write to log an incomplete last line.
+type LineWriter struct {
+	entry *Entry
+	buf   bytes.Buffer
+	lock  sync.Mutex
+}
+
+// NewLineWriter returns a writer that logs lines with entry fields and an output field.
+func NewLineWriter(entry *Entry, output string) *LineWriter {
+	return &LineWriter{entry: entry.WithField(OutputField, output)}
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(w.buf.Next(idx + 1))
+		w.entry.Infof("%s", strings.TrimRight(line, "\r\n"))
+	}
+	return len(p), nil
+}
+
+// Flush logs buffered data without a trailing newline.
+func (w *LineWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.entry.Infof("%s", w.buf.String())
+		w.buf.Reset()
+	}
+}
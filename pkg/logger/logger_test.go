@@ -0,0 +1,114 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FormatJSON(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	line := FormatJSON("info", "hook done", Fields{
+		ModuleField:       "module-a",
+		FailureCountField: 2,
+		DurationField:     1500 * time.Millisecond,
+		"msg":             "cannot override",
+	}, now)
+
+	assert.True(t, bytes.HasSuffix(line, []byte("\n")))
+
+	data := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(line, &data))
+	assert.Equal(t, "info", data["level"])
+	assert.Equal(t, "hook done", data["msg"])
+	assert.Equal(t, "2019-10-01T12:00:00Z", data["time"])
+	assert.Equal(t, "module-a", data[ModuleField])
+	assert.Equal(t, float64(2), data[FailureCountField])
+	assert.Equal(t, "1.5s", data[DurationField])
+}
+
+func Test_ParseRlogLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		level int
+		msg   string
+	}{
+		{"INFO     : TASK_RUN Delay for 5s\n", levelInfo, "TASK_RUN Delay for 5s"},
+		{"DEBUG    : values: {a: 1}\n\n", levelDebug, "values: {a: 1}"},
+		{"ERROR    : Hook failed: exit 1\n", levelError, "Hook failed: exit 1"},
+		{"WARN     : Module delete: no release\n", levelWarn, "Module delete: no release"},
+		{"TRACE(1) : trace\n", levelDebug, "trace"},
+		{"not rlog line\n", levelInfo, "not rlog line"},
+	}
+
+	for _, tt := range tests {
+		level, msg := ParseRlogLine(tt.line)
+		assert.Equal(t, tt.level, level, tt.line)
+		assert.Equal(t, tt.msg, msg, tt.line)
+	}
+}
+
+func Test_LineWriter_JSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	format, out, minLevel = JSONFormat, buf, levelInfo
+	defer func() {
+		format = TextFormat
+	}()
+
+	entry := WithLabels(map[string]string{HookField: "hook.sh", EventIDField: "123"})
+	w := NewLineWriter(entry, "stdout")
+	_, _ = w.Write([]byte("first line\nsecond "))
+	_, _ = w.Write([]byte("line\r\nlast"))
+	w.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 3)
+
+	expected := []string{"first line", "second line", "last"}
+	for i, line := range lines {
+		data := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &data))
+		assert.Equal(t, expected[i], data["msg"])
+		assert.Equal(t, "hook.sh", data[HookField])
+		assert.Equal(t, "123", data[EventIDField])
+		assert.Equal(t, "stdout", data[OutputField])
+	}
+
+	// Entry fields are not changed by the writer.
+	assert.NotContains(t, entry.Fields, OutputField)
+}
+
+func Test_Entry_Level(t *testing.T) {
+	buf := &bytes.Buffer{}
+	format, out, minLevel = JSONFormat, buf, parseLevel("module_manager/hook.go=DEBUG,WARN")
+	defer func() {
+		format = TextFormat
+	}()
+
+	entry := WithField(TaskField, "TASK_MODULE_RUN")
+	entry.Infof("skipped")
+	entry.Warnf("module %s failed", "a")
+
+	data := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &data))
+	assert.Equal(t, "warn", data["level"])
+	assert.Equal(t, "module a failed", data["msg"])
+	assert.Equal(t, "TASK_MODULE_RUN", data[TaskField])
+}
+
+func Test_FormatTextFields(t *testing.T) {
+	assert.Equal(t, "", FormatTextFields(nil))
+	assert.Equal(t,
+		` binding="on kube events" duration=1.5s hook=hook.sh module=module-a`,
+		FormatTextFields(Fields{
+			ModuleField:   "module-a",
+			HookField:     "hook.sh",
+			BindingField:  "on kube events",
+			DurationField: 1500 * time.Millisecond,
+		}))
+	assert.Equal(t, ` output="" value="a=b"`, FormatTextFields(Fields{OutputField: "", "value": "a=b"}))
+}
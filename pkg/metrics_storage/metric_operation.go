@@ -0,0 +1,91 @@
+package metrics_storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// SetAction sets a gauge value.
+	SetAction = "set"
+	// AddAction increases a counter.
+	AddAction = "add"
+	// ObserveAction adds an observation to a histogram.
+	ObserveAction = "observe"
+	// ExpireAction deletes all metrics of the group.
+	ExpireAction = "expire"
+)
+
+// MetricOperation is a record in a METRICS_PATH file written by a hook. Examples:
+//
+//	{"name":"cluster_nodes","action":"set","value":3,"labels":{"zone":"a"}}
+//	{"name":"backups_total","action":"add","value":1}
+//	{"name":"backup_seconds","action":"observe","value":12.5,"buckets":[1,10,100]}
+//	{"group":"nodes","action":"expire"}
+type MetricOperation struct {
+	Name    string            `json:"name,omitempty"`
+	Group   string            `json:"group,omitempty"`
+	Action  string            `json:"action"`
+	Value   *float64          `json:"value,omitempty"`
+	Buckets []float64         `json:"buckets,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+func (op MetricOperation) Validate() error {
+	switch op.Action {
+	case ExpireAction:
+		if op.Group == "" {
+			return fmt.Errorf("'group' is required for action '%s'", op.Action)
+		}
+		return nil
+	case SetAction, AddAction, ObserveAction:
+		if op.Name == "" {
+			return fmt.Errorf("'name' is required for action '%s'", op.Action)
+		}
+		if op.Value == nil {
+			return fmt.Errorf("'value' is required for action '%s' of metric '%s'", op.Action, op.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown action '%s' for metric '%s': use '%s', '%s', '%s' or '%s'", op.Action, op.Name, SetAction, AddAction, ObserveAction, ExpireAction)
+}
+
+// MetricOperationsFromBytes parses JSON lines with metric operations. Empty lines are ignored.
+func MetricOperationsFromBytes(data []byte) ([]MetricOperation, error) {
+	operations := make([]MetricOperation, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var op MetricOperation
+		if err := json.Unmarshal(line, &op); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		if err := op.Validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		operations = append(operations, op)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return operations, nil
+}
+
+func MetricOperationsFromFile(filePath string) ([]MetricOperation, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", filePath, err)
+	}
+	return MetricOperationsFromBytes(data)
+}
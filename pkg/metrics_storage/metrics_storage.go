@@ -0,0 +1,251 @@
+package metrics_storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/romana/rlog"
+
+	shell_metrics_storage "github.com/flant/shell-operator/pkg/metrics_storage"
+)
+
+// MetricStorage is a shell-operator MetricStorage for operator metrics
+// with histograms and a storage for metrics returned by hooks.
+type MetricStorage struct {
+	*shell_metrics_storage.MetricStorage
+
+	// Registerer is used to register collectors for histograms and hooks metrics.
+	Registerer prometheus.Registerer
+
+	vecsLock      sync.Mutex
+	gaugeVecs     map[string]*prometheus.GaugeVec
+	counterVecs   map[string]*prometheus.CounterVec
+	histogramVecs map[string]*prometheus.HistogramVec
+	// Metrics by groups. Group is unique for a hook.
+	groups map[string]map[string]groupedMetric
+}
+
+type groupedMetric struct {
+	Name   string
+	Labels map[string]string
+}
+
+// DurationBuckets are buckets for histograms of hooks and modules run durations in seconds.
+var DurationBuckets = []float64{0.01, 0.1, 0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300, 600}
+
+func Init() *MetricStorage {
+	return NewMetricStorage()
+}
+
+func NewMetricStorage() *MetricStorage {
+	return &MetricStorage{
+		MetricStorage: shell_metrics_storage.NewMetricStorage(),
+		Registerer:    prometheus.DefaultRegisterer,
+		gaugeVecs:     make(map[string]*prometheus.GaugeVec),
+		counterVecs:   make(map[string]*prometheus.CounterVec),
+		histogramVecs: make(map[string]*prometheus.HistogramVec),
+		groups:        make(map[string]map[string]groupedMetric),
+	}
+}
+
+// SendHistogramMetric adds an observation to a histogram. Histogram is created with buckets
+// on the first observation. Errors are logged.
+func (storage *MetricStorage) SendHistogramMetric(metric string, value float64, labels map[string]string, buckets []float64) {
+	storage.vecsLock.Lock()
+	defer storage.vecsLock.Unlock()
+
+	if err := storage.observeHistogram(metric, value, labels, buckets); err != nil {
+		rlog.Errorf("MSTOR Histogram %s %v update error: %s", metric, labels, err)
+	}
+}
+
+// SendHookMetrics updates metrics with operations from the hook. Labels are added
+// to labels of each metric, they are also used to separate groups of different hooks.
+func (storage *MetricStorage) SendHookMetrics(operations []MetricOperation, labels map[string]string) error {
+	storage.vecsLock.Lock()
+	defer storage.vecsLock.Unlock()
+
+	errs := make([]string, 0)
+	for _, op := range operations {
+		if err := storage.applyHookMetricOperation(op, labels); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (storage *MetricStorage) applyHookMetricOperation(op MetricOperation, labels map[string]string) error {
+	if err := op.Validate(); err != nil {
+		return err
+	}
+
+	groupKey := ""
+	if op.Group != "" {
+		groupKey = labelsKey(labels) + "/" + op.Group
+	}
+
+	if op.Action == ExpireAction {
+		storage.expireGroup(groupKey)
+		return nil
+	}
+
+	metricLabels := make(map[string]string)
+	for k, v := range op.Labels {
+		metricLabels[k] = v
+	}
+	for k, v := range labels {
+		metricLabels[k] = v
+	}
+
+	var err error
+	switch op.Action {
+	case SetAction:
+		err = storage.setGauge(op.Name, *op.Value, metricLabels)
+	case AddAction:
+		err = storage.addCounter(op.Name, *op.Value, metricLabels)
+	case ObserveAction:
+		err = storage.observeHistogram(op.Name, *op.Value, metricLabels, op.Buckets)
+	}
+	if err != nil {
+		return fmt.Errorf("metric '%s': %s", op.Name, err)
+	}
+
+	if groupKey != "" {
+		if _, has := storage.groups[groupKey]; !has {
+			storage.groups[groupKey] = make(map[string]groupedMetric)
+		}
+		storage.groups[groupKey][op.Name+"/"+labelsKey(metricLabels)] = groupedMetric{Name: op.Name, Labels: metricLabels}
+	}
+
+	return nil
+}
+
+func (storage *MetricStorage) setGauge(name string, value float64, labels map[string]string) error {
+	vec, has := storage.gaugeVecs[name]
+	if !has {
+		if err := storage.checkNameIsFree(name); err != nil {
+			return err
+		}
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: name}, labelNames(labels))
+		if err := storage.register(name, vec); err != nil {
+			return err
+		}
+		storage.gaugeVecs[name] = vec
+	}
+
+	gauge, err := vec.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	gauge.Set(value)
+	return nil
+}
+
+func (storage *MetricStorage) addCounter(name string, value float64, labels map[string]string) error {
+	if value < 0 {
+		return fmt.Errorf("counter cannot decrease, got %v", value)
+	}
+
+	vec, has := storage.counterVecs[name]
+	if !has {
+		if err := storage.checkNameIsFree(name); err != nil {
+			return err
+		}
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: name}, labelNames(labels))
+		if err := storage.register(name, vec); err != nil {
+			return err
+		}
+		storage.counterVecs[name] = vec
+	}
+
+	counter, err := vec.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	counter.Add(value)
+	return nil
+}
+
+func (storage *MetricStorage) observeHistogram(name string, value float64, labels map[string]string, buckets []float64) error {
+	vec, has := storage.histogramVecs[name]
+	if !has {
+		if err := storage.checkNameIsFree(name); err != nil {
+			return err
+		}
+		if len(buckets) == 0 {
+			buckets = prometheus.DefBuckets
+		}
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: name, Buckets: buckets}, labelNames(labels))
+		if err := storage.register(name, vec); err != nil {
+			return err
+		}
+		storage.histogramVecs[name] = vec
+	}
+
+	histogram, err := vec.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	histogram.Observe(value)
+	return nil
+}
+
+// expireGroup deletes all metrics of the group.
+func (storage *MetricStorage) expireGroup(groupKey string) {
+	for _, metric := range storage.groups[groupKey] {
+		if vec, has := storage.gaugeVecs[metric.Name]; has {
+			vec.Delete(metric.Labels)
+		}
+		if vec, has := storage.counterVecs[metric.Name]; has {
+			vec.Delete(metric.Labels)
+		}
+		if vec, has := storage.histogramVecs[metric.Name]; has {
+			vec.Delete(metric.Labels)
+		}
+	}
+	delete(storage.groups, groupKey)
+}
+
+// checkNameIsFree returns error if metric is already registered with another type.
+func (storage *MetricStorage) checkNameIsFree(name string) error {
+	_, isGauge := storage.gaugeVecs[name]
+	_, isCounter := storage.counterVecs[name]
+	_, isHistogram := storage.histogramVecs[name]
+	if isGauge || isCounter || isHistogram {
+		return fmt.Errorf("metric is already registered with another type")
+	}
+	return nil
+}
+
+func (storage *MetricStorage) register(name string, collector prometheus.Collector) error {
+	err := storage.Registerer.Register(collector)
+	if err != nil {
+		return fmt.Errorf("cannot register: %s", err)
+	}
+	rlog.Infof("MSTOR Create new hook metric %s", name)
+	return nil
+}
+
+func labelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func labelsKey(labels map[string]string) string {
+	parts := make([]string, 0, len(labels))
+	for _, name := range labelNames(labels) {
+		parts = append(parts, name+"="+labels[name])
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,111 @@
+package metrics_storage
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MetricOperationsFromBytes(t *testing.T) {
+	ops, err := MetricOperationsFromBytes([]byte(`
+{"name":"nodes","group":"g1","action":"set","value":3,"labels":{"zone":"a"}}
+
+{"name":"runs_total","action":"add","value":1}
+{"group":"g1","action":"expire"}
+`))
+	if assert.NoError(t, err) {
+		assert.Len(t, ops, 3)
+		assert.Equal(t, "a", ops[0].Labels["zone"])
+		assert.Equal(t, 3.0, *ops[0].Value)
+		assert.Equal(t, ExpireAction, ops[2].Action)
+	}
+
+	_, err = MetricOperationsFromBytes([]byte(`{"name":"nodes","action":"set"}`))
+	assert.Error(t, err)
+
+	_, err = MetricOperationsFromBytes([]byte(`{"name":"nodes","action":"inc","value":1}`))
+	assert.Error(t, err)
+
+	_, err = MetricOperationsFromBytes([]byte(`{"action":"expire"}`))
+	assert.Error(t, err)
+}
+
+func Test_MetricStorage_SendHookMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	storage := NewMetricStorage()
+	storage.Registerer = registry
+
+	ops, err := MetricOperationsFromBytes([]byte(`
+{"name":"hook_nodes","group":"nodes","action":"set","value":3,"labels":{"zone":"a"}}
+{"name":"hook_nodes","group":"nodes","action":"set","value":2,"labels":{"zone":"b"}}
+{"name":"hook_runs_total","action":"add","value":1}
+{"name":"hook_run_seconds","action":"observe","value":0.5,"buckets":[1,10]}
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	hookLabels := map[string]string{"module": "module-one", "hook": "module-one/hooks/nodes"}
+	assert.NoError(t, storage.SendHookMetrics(ops, hookLabels))
+	assert.NoError(t, storage.SendHookMetrics(ops[2:3], hookLabels))
+
+	families := gather(t, registry)
+	if assert.Contains(t, families, "hook_nodes") {
+		assert.Len(t, families["hook_nodes"].Metric, 2)
+		labels := families["hook_nodes"].Metric[0].Label
+		assert.Len(t, labels, 3)
+	}
+	if assert.Contains(t, families, "hook_runs_total") {
+		assert.Equal(t, 2.0, families["hook_runs_total"].Metric[0].Counter.GetValue())
+	}
+	if assert.Contains(t, families, "hook_run_seconds") {
+		assert.Equal(t, uint64(1), families["hook_run_seconds"].Metric[0].Histogram.GetSampleCount())
+	}
+
+	// Group of another hook is not affected.
+	expire := []MetricOperation{{Group: "nodes", Action: ExpireAction}}
+	assert.NoError(t, storage.SendHookMetrics(expire, map[string]string{"hook": "other"}))
+	assert.Len(t, gather(t, registry)["hook_nodes"].Metric, 2)
+
+	assert.NoError(t, storage.SendHookMetrics(expire, hookLabels))
+	assert.NotContains(t, gather(t, registry), "hook_nodes")
+	assert.Contains(t, gather(t, registry), "hook_runs_total")
+
+	// Metric type cannot be changed, label names should be the same.
+	value := 1.0
+	assert.Error(t, storage.SendHookMetrics([]MetricOperation{{Name: "hook_runs_total", Action: SetAction, Value: &value}}, hookLabels))
+	assert.Error(t, storage.SendHookMetrics([]MetricOperation{{Name: "hook_runs_total", Action: AddAction, Value: &value}}, nil))
+}
+
+func Test_MetricStorage_SendHistogramMetric(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	storage := NewMetricStorage()
+	storage.Registerer = registry
+
+	labels := map[string]string{"module": "module-one", "phase": "helm"}
+	storage.SendHistogramMetric("module_run_seconds", 0.3, labels, DurationBuckets)
+	storage.SendHistogramMetric("module_run_seconds", 15, labels, DurationBuckets)
+	// Bad labels are ignored.
+	storage.SendHistogramMetric("module_run_seconds", 1, map[string]string{"module": "module-one"}, DurationBuckets)
+
+	families := gather(t, registry)
+	if assert.Contains(t, families, "module_run_seconds") {
+		histogram := families["module_run_seconds"].Metric[0].Histogram
+		assert.Equal(t, uint64(2), histogram.GetSampleCount())
+		assert.Equal(t, 15.3, histogram.GetSampleSum())
+		assert.Len(t, histogram.Bucket, len(DurationBuckets))
+	}
+}
+
+func gather(t *testing.T, registry *prometheus.Registry) map[string]*dto.MetricFamily {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	res := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		res[family.GetName()] = family
+	}
+	return res
+}
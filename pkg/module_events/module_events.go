@@ -0,0 +1,139 @@
+package module_events
+
+import (
+	"fmt"
+
+	"github.com/romana/rlog"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/flant/shell-operator/pkg/kube"
+
+	"github.com/flant/addon-operator/pkg/module_status"
+)
+
+// Reasons of events.
+const (
+	ReasonModuleEnabled      = "ModuleEnabled"
+	ReasonModuleDisabled     = "ModuleDisabled"
+	ReasonDependencyDisabled = "DependencyDisabled"
+	ReasonModulePurged       = "ModulePurged"
+	ReasonModuleRunFailed    = "ModuleRunFailed"
+	ReasonModuleDeleteFailed = "ModuleDeleteFailed"
+	ReasonModulePurgeFailed  = "ModulePurgeFailed"
+	ReasonHelmUpgradeFailed  = "HelmUpgradeFailed"
+	ReasonHookFailed         = "HookFailed"
+	ReasonAmbiguousState     = "AmbiguousState"
+)
+
+// EventSourceComponent is a component in the source of events.
+const EventSourceComponent = "addon-operator"
+
+// Events for the same object are limited with a token bucket: BurstSize events at once,
+// then one event in 1/QPS seconds. Similar events are aggregated by the recorder into one event with a count.
+var (
+	EventsBurstSize = 10
+	EventsQPS       = float32(1.0 / 300)
+)
+
+// Recorder emits Kubernetes Events about modules. Module events involve the ConfigMap
+// with the module status if statuses are enabled, or the Pod of the operator otherwise.
+// Events about the operator involve the Pod of the operator. Methods of a nil Recorder do nothing.
+type Recorder struct {
+	Namespace string
+	PodName   string
+	// StatusConfigMapPrefix is a prefix of ConfigMaps with modules statuses.
+	StatusConfigMapPrefix string
+
+	recorder record.EventRecorder
+}
+
+// NewRecorder returns a Recorder that sends events to the cluster.
+func NewRecorder(namespace string, podName string, statusConfigMapPrefix string) *Recorder {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: EventsBurstSize,
+		QPS:       EventsQPS,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: kube.Kubernetes.CoreV1().Events(namespace),
+	})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: EventSourceComponent, Host: podName})
+
+	return NewRecorderWith(recorder, namespace, podName, statusConfigMapPrefix)
+}
+
+// NewRecorderWith returns a Recorder with a custom EventRecorder.
+func NewRecorderWith(recorder record.EventRecorder, namespace string, podName string, statusConfigMapPrefix string) *Recorder {
+	return &Recorder{
+		Namespace:             namespace,
+		PodName:               podName,
+		StatusConfigMapPrefix: statusConfigMapPrefix,
+		recorder:              recorder,
+	}
+}
+
+// ModuleNormal emits a Normal event for the module.
+func (r *Recorder) ModuleNormal(moduleName string, reason string, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.event(r.moduleObject(moduleName), v1.EventTypeNormal, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// ModuleWarning emits a Warning event for the module.
+func (r *Recorder) ModuleWarning(moduleName string, reason string, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.event(r.moduleObject(moduleName), v1.EventTypeWarning, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// OperatorNormal emits a Normal event for the Pod of the operator.
+func (r *Recorder) OperatorNormal(reason string, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.event(r.podObject(), v1.EventTypeNormal, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// OperatorWarning emits a Warning event for the Pod of the operator.
+func (r *Recorder) OperatorWarning(reason string, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.event(r.podObject(), v1.EventTypeWarning, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *Recorder) event(obj *v1.ObjectReference, eventType string, reason string, message string) {
+	if obj == nil {
+		rlog.Debugf("EVENTS: no object for event %s: %s", reason, message)
+		return
+	}
+	r.recorder.Event(obj, eventType, reason, message)
+}
+
+func (r *Recorder) moduleObject(moduleName string) *v1.ObjectReference {
+	if r.StatusConfigMapPrefix == "" {
+		return r.podObject()
+	}
+	return &v1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Namespace:  r.Namespace,
+		Name:       module_status.ConfigMapName(r.StatusConfigMapPrefix, moduleName),
+	}
+}
+
+func (r *Recorder) podObject() *v1.ObjectReference {
+	if r.PodName == "" {
+		return nil
+	}
+	return &v1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  r.Namespace,
+		Name:       r.PodName,
+	}
+}
@@ -0,0 +1,50 @@
+package module_events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// testRecorder saves involved objects of events.
+type testRecorder struct {
+	*record.FakeRecorder
+	Objects []*v1.ObjectReference
+}
+
+func (r *testRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.Objects = append(r.Objects, object.(*v1.ObjectReference))
+	r.FakeRecorder.Event(object, eventtype, reason, message)
+}
+
+func Test_Recorder(t *testing.T) {
+	fake := &testRecorder{FakeRecorder: record.NewFakeRecorder(10)}
+	r := NewRecorderWith(fake, "addon-operator", "addon-operator-0", "addon-operator-module")
+
+	r.ModuleWarning("module-one", ReasonHelmUpgradeFailed, "Module run failed in phase '%s': %s", "helm", "timeout")
+	assert.Equal(t, "Warning HelmUpgradeFailed Module run failed in phase 'helm': timeout", <-fake.Events)
+	assert.Equal(t, "ConfigMap", fake.Objects[0].Kind)
+	assert.Equal(t, "addon-operator-module-module-one", fake.Objects[0].Name)
+
+	r.OperatorWarning(ReasonAmbiguousState, "retry")
+	assert.Equal(t, "Warning AmbiguousState retry", <-fake.Events)
+	assert.Equal(t, "Pod", fake.Objects[1].Kind)
+	assert.Equal(t, "addon-operator-0", fake.Objects[1].Name)
+
+	// Pod is involved if statuses are disabled.
+	r.StatusConfigMapPrefix = ""
+	r.ModuleNormal("module-one", ReasonModuleEnabled, "enabled")
+	assert.Equal(t, "Normal ModuleEnabled enabled", <-fake.Events)
+	assert.Equal(t, "Pod", fake.Objects[2].Kind)
+
+	// No events without an object.
+	r.PodName = ""
+	r.OperatorNormal(ReasonModulePurged, "purged")
+	assert.Len(t, fake.Events, 0)
+
+	var nilRecorder *Recorder
+	nilRecorder.ModuleWarning("module-one", ReasonHookFailed, "failed")
+}
@@ -0,0 +1,262 @@
+package module_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/romana/rlog"
+
+	"github.com/flant/addon-operator/pkg/kube_patch"
+	"github.com/flant/addon-operator/pkg/logger"
+	"github.com/flant/addon-operator/pkg/metrics_storage"
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// GoHook is a hook compiled into the operator binary. It runs in the operator process
+// without temporary files, so it is much cheaper than a shell hook. Go hooks have the same
+// bindings, order, metrics and patches validation as shell hooks.
+//
+//	type cleanupHook struct{}
+//
+//	func (h *cleanupHook) Config() *module_manager.ModuleHookConfig {
+//		return &module_manager.ModuleHookConfig{BeforeHelm: 10}
+//	}
+//
+//	func (h *cleanupHook) Run(input *module_manager.GoHookInput) (*module_manager.GoHookOutput, error) {
+//		...
+//	}
+//
+//	func init() {
+//		module_manager.RegisterModuleGoHook("my-module", "cleanup", &cleanupHook{})
+//	}
+type GoHook interface {
+	Run(input *GoHookInput) (*GoHookOutput, error)
+}
+
+// GlobalGoHook is a Go hook with a configuration of a global hook.
+type GlobalGoHook interface {
+	GoHook
+	Config() *GlobalHookConfig
+}
+
+// ModuleGoHook is a Go hook with a configuration of a module hook.
+type ModuleGoHook interface {
+	GoHook
+	Config() *ModuleHookConfig
+}
+
+// GoHookInput is the same data that a shell hook gets in files. Values are copies,
+// so the hook can change them.
+type GoHookInput struct {
+	BindingType    BindingType
+	BindingContext []BindingContext
+	ConfigValues   utils.Values
+	Values         utils.Values
+	LogEntry       *logger.Entry
+}
+
+// GoHookOutput is the same data that a shell hook writes to files. All fields are optional.
+type GoHookOutput struct {
+	ConfigValuesPatch    *utils.ValuesPatch
+	ValuesPatch          *utils.ValuesPatch
+	Metrics              []metrics_storage.MetricOperation
+	KubernetesOperations []kube_patch.Operation
+	// ValidatingResponse is required for the kubernetesValidating binding.
+	ValidatingResponse *ValidatingResponse
+}
+
+// Go hooks are registered from init functions before the module manager is created.
+var (
+	globalGoHooks   = make(map[string]GlobalGoHook)
+	moduleGoHooks   = make(map[string]map[string]ModuleGoHook)
+	goHooksRegistry sync.Mutex
+)
+
+// RegisterGlobalGoHook registers a global Go hook. The name should be unique among global hooks.
+func RegisterGlobalGoHook(name string, hook GlobalGoHook) {
+	goHooksRegistry.Lock()
+	defer goHooksRegistry.Unlock()
+	globalGoHooks[name] = hook
+}
+
+// RegisterModuleGoHook registers a Go hook for the module. The name should be unique among hooks.
+// The hook is ignored with a warning if there is no such module.
+func RegisterModuleGoHook(moduleName string, name string, hook ModuleGoHook) {
+	goHooksRegistry.Lock()
+	defer goHooksRegistry.Unlock()
+	if moduleGoHooks[moduleName] == nil {
+		moduleGoHooks[moduleName] = make(map[string]ModuleGoHook)
+	}
+	moduleGoHooks[moduleName][name] = hook
+}
+
+// initGlobalGoHooks adds registered global Go hooks after hooks from the global hooks directory.
+// mm.globalHooksLock should be locked.
+func (mm *MainModuleManager) initGlobalGoHooks() error {
+	goHooksRegistry.Lock()
+	defer goHooksRegistry.Unlock()
+
+	names := make([]string, 0, len(globalGoHooks))
+	for name := range globalGoHooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, has := mm.globalHooksByName[name]; has {
+			return fmt.Errorf("INIT: global Go hook '%s': there is a global hook with the same name", name)
+		}
+
+		rlog.Infof("INIT: global Go hook '%s'", name)
+
+		hook := globalGoHooks[name]
+		config := hook.Config()
+		config.BeforeAll = goHookOrder(config.BeforeAll)
+		config.AfterAll = goHookOrder(config.AfterAll)
+		config.OnStartup = goHookOrder(config.OnStartup)
+		if err := ValidateGlobalHookConfig(config); err != nil {
+			return fmt.Errorf("INIT: global Go hook '%s' config is not valid: %s", name, err)
+		}
+
+		prepareHookConfig(&config.HookConfig)
+
+		if err := mm.registerGlobalHook(name, name, config, hook); err != nil {
+			return fmt.Errorf("INIT: cannot add global Go hook '%s': %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// initModuleGoHooks adds registered Go hooks of the module after hooks from the module directory.
+func (mm *MainModuleManager) initModuleGoHooks(module *Module) error {
+	goHooksRegistry.Lock()
+	defer goHooksRegistry.Unlock()
+
+	hooks := moduleGoHooks[module.Name]
+	names := make([]string, 0, len(hooks))
+	for name := range hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := mm.GetModuleHook(name); err == nil {
+			return fmt.Errorf("module '%s' Go hook '%s': there is a hook with the same name", module.SafeName(), name)
+		}
+
+		rlog.Infof("INIT:   Go hook '%s' ...", name)
+
+		hook := hooks[name]
+		config := hook.Config()
+		config.BeforeHelm = goHookOrder(config.BeforeHelm)
+		config.AfterHelm = goHookOrder(config.AfterHelm)
+		config.AfterDeleteHelm = goHookOrder(config.AfterDeleteHelm)
+		config.OnStartup = goHookOrder(config.OnStartup)
+		if err := ValidateModuleHookConfig(config); err != nil {
+			return fmt.Errorf("module '%s' Go hook '%s' config is not valid: %s", module.SafeName(), name, err)
+		}
+
+		prepareHookConfig(&config.HookConfig)
+
+		if err := mm.registerModuleHook(module.Name, name, name, config, hook); err != nil {
+			return fmt.Errorf("adding module '%s' Go hook '%s' failed: %s", module.SafeName(), name, err)
+		}
+	}
+
+	return nil
+}
+
+// warnGoHooksForUnknownModules logs Go hooks registered for modules that are not found.
+func (mm *MainModuleManager) warnGoHooksForUnknownModules() {
+	goHooksRegistry.Lock()
+	defer goHooksRegistry.Unlock()
+
+	for moduleName, hooks := range moduleGoHooks {
+		if _, has := mm.allModulesByName[moduleName]; has || len(hooks) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(hooks))
+		for name := range hooks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rlog.Warnf("INIT: Go hooks %v are registered for unknown module '%s', they are ignored", names, moduleName)
+	}
+}
+
+// goHookOrder converts integer orders to float64 as in a config parsed from JSON.
+func goHookOrder(order interface{}) interface{} {
+	if order == nil {
+		return nil
+	}
+	v := reflect.ValueOf(order)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32:
+		return v.Float()
+	}
+	return order
+}
+
+// runGoHook runs the Go hook with copies of values. A panic in the hook is returned as an error.
+// Bad metrics and bad Kubernetes operations fail the hook as for shell hooks.
+func runGoHook(hook GoHook, input *GoHookInput) (output *GoHookOutput, err error) {
+	if input.ConfigValues, err = copyValues(input.ConfigValues); err != nil {
+		return nil, err
+	}
+	if input.Values, err = copyValues(input.Values); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			output, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	output, err = hook.Run(input)
+	if err != nil {
+		return nil, err
+	}
+	if output == nil {
+		output = &GoHookOutput{}
+	}
+	for _, op := range output.Metrics {
+		if err := op.Validate(); err != nil {
+			return nil, fmt.Errorf("bad metrics: %s", err)
+		}
+	}
+	for _, op := range output.KubernetesOperations {
+		if err := op.Validate(); err != nil {
+			return nil, fmt.Errorf("bad kubernetes patch: %s", err)
+		}
+	}
+	return output, nil
+}
+
+// patches returns values patches in the form of patches from shell hooks.
+func (o *GoHookOutput) patches() map[utils.ValuesPatchType]*utils.ValuesPatch {
+	return map[utils.ValuesPatchType]*utils.ValuesPatch{
+		utils.ConfigMapPatch:    o.ConfigValuesPatch,
+		utils.MemoryValuesPatch: o.ValuesPatch,
+	}
+}
+
+func copyValues(values utils.Values) (utils.Values, error) {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	res := make(utils.Values)
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
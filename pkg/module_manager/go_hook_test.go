@@ -0,0 +1,108 @@
+package module_manager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flant/addon-operator/pkg/metrics_storage"
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+type testModuleGoHook struct {
+	config *ModuleHookConfig
+	run    func(input *GoHookInput) (*GoHookOutput, error)
+}
+
+func (h *testModuleGoHook) Config() *ModuleHookConfig {
+	return h.config
+}
+
+func (h *testModuleGoHook) Run(input *GoHookInput) (*GoHookOutput, error) {
+	return h.run(input)
+}
+
+func Test_ModuleGoHook(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	writeFile(t, filepath.Join(modulesDir, "010-module", "values.yaml"), "moduleEnabled: true\nmodule:\n  internal: {}\n")
+	writeHook(t, filepath.Join(modulesDir, "010-module", "hooks", "hook"), `
+if [[ "$1" == "--config" ]]; then echo '{"beforeHelm": 1}'; exit 0; fi
+echo '[{"op": "add", "path": "/module/internal/shell", "value": true}]' > $VALUES_JSON_PATCH_PATH
+`)
+
+	var bindingType BindingType
+	RegisterModuleGoHook("module", "go-hook", &testModuleGoHook{
+		config: &ModuleHookConfig{BeforeHelm: 2},
+		run: func(input *GoHookInput) (*GoHookOutput, error) {
+			bindingType = input.BindingType
+			internal := input.Values["module"].(map[string]interface{})["internal"].(map[string]interface{})
+			// Changes of input values are not saved.
+			internal["input"] = true
+			return &GoHookOutput{
+				ValuesPatch: &utils.ValuesPatch{Operations: []*utils.ValuesPatchOperation{
+					{Op: "add", Path: "/module/internal/go", Value: internal["shell"]},
+				}},
+			}, nil
+		},
+	})
+	RegisterModuleGoHook("module", "bad-metrics-go-hook", &testModuleGoHook{
+		config: &ModuleHookConfig{AfterDeleteHelm: 1},
+		run: func(input *GoHookInput) (*GoHookOutput, error) {
+			return &GoHookOutput{
+				// Bad metrics fail the hook as for shell hooks.
+				Metrics: []metrics_storage.MetricOperation{{Name: "bad_metric"}},
+			}, nil
+		},
+	})
+	RegisterModuleGoHook("module", "failed-go-hook", &testModuleGoHook{
+		config: &ModuleHookConfig{AfterHelm: 1},
+		run: func(input *GoHookInput) (*GoHookOutput, error) {
+			panic(fmt.Sprintf("binding %s", input.BindingType))
+		},
+	})
+	defer delete(moduleGoHooks, "module")
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, filepath.Join(rootDir, "global-hooks"), rootDir)
+	if err := mm.initModulesIndex(); err != nil {
+		t.Fatal(err)
+	}
+	module, _ := mm.GetModule("module")
+	if err := mm.initModuleHooks(module); err != nil {
+		t.Fatal(err)
+	}
+
+	hook, err := mm.GetModuleHook("go-hook")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []BindingType{BeforeHelm}, hook.Bindings)
+		assert.Equal(t, float64(2), hook.OrderByBinding[BeforeHelm])
+	}
+
+	// The Go hook runs after the shell hook and sees its values.
+	if assert.NoError(t, module.runHooksByBinding(BeforeHelm, nil)) {
+		assert.Equal(t, BeforeHelm, bindingType)
+		internal := module.values()["module"].(map[string]interface{})["internal"].(map[string]interface{})
+		assert.Equal(t, true, internal["go"])
+		assert.NotContains(t, internal, "input")
+	}
+
+	err = module.runHooksByBinding(AfterHelm, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "panic: binding AFTER_HELM")
+	}
+
+	err = module.runHooksByBinding(AfterDeleteHelm, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "bad metrics")
+	}
+}
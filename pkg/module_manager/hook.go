@@ -7,16 +7,24 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/kennygrant/sanitize"
 	"github.com/romana/rlog"
+	admissionregistration "k8s.io/api/admissionregistration/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 
-	"github.com/flant/shell-operator/pkg/executor"
 	"github.com/flant/shell-operator/pkg/kube_events_manager"
 	"github.com/flant/shell-operator/pkg/schedule_manager"
 	utils_data "github.com/flant/shell-operator/pkg/utils/data"
 
+	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/executor"
 	"github.com/flant/addon-operator/pkg/helm"
+	"github.com/flant/addon-operator/pkg/kube_patch"
+	"github.com/flant/addon-operator/pkg/logger"
+	"github.com/flant/addon-operator/pkg/metrics_storage"
 	"github.com/flant/addon-operator/pkg/utils"
 )
 
@@ -40,12 +48,15 @@ type Hook interface {
 type CommonHook struct {
 	// The unique name like 'global-hooks/startup_hook' or '002-module/hooks/cleanup'.
 	Name           string
-	// The absolute path of the executable file.
+	// The absolute path of the executable file. It is equal to Name for Go hooks.
 	Path           string
 
 	Bindings       []BindingType
 	OrderByBinding map[BindingType]float64
 
+	// GoHook is a hook compiled into the binary. It is nil for shell hooks.
+	GoHook GoHook
+
 	moduleManager *MainModuleManager
 }
 
@@ -63,9 +74,75 @@ type ModuleHookConfig struct {
 }
 
 type HookConfig struct {
-	OnStartup         interface{}                                   `json:"onStartup"`
-	Schedule          []schedule_manager.ScheduleConfig             `json:"schedule"`
-	OnKubernetesEvent []kube_events_manager.OnKubernetesEventConfig `json:"onKubernetesEvent"`
+	OnStartup         interface{}               `json:"onStartup"`
+	Schedule          []ScheduleConfig          `json:"schedule"`
+	OnKubernetesEvent []OnKubernetesEventConfig `json:"onKubernetesEvent"`
+	// MaxRetries is a count of retries for a failed hook. Zero means a default setting.
+	MaxRetries int `json:"maxRetries"`
+	// Parallel allows to run the hook concurrently with other hooks with the same order.
+	Parallel bool `json:"parallel"`
+	// Timeout is a duration like "30s". The process group of the hook is killed after timeout.
+	// app.HookTimeout is used if empty.
+	Timeout string `json:"timeout"`
+	// KubernetesValidating bindings run the hook on admission requests outside of queues.
+	KubernetesValidating []KubernetesValidatingConfig `json:"kubernetesValidating"`
+
+	// timeout is parsed from Timeout by validateHookConfig.
+	timeout time.Duration
+}
+
+// TimeoutDuration returns a timeout of the hook or a default timeout.
+func (c *HookConfig) TimeoutDuration() time.Duration {
+	if c.timeout > 0 {
+		return c.timeout
+	}
+	return app.HookTimeout
+}
+
+// ScheduleConfig is a schedule binding with a name of a queue for hook run tasks.
+type ScheduleConfig struct {
+	schedule_manager.ScheduleConfig
+	Queue string `json:"queue"`
+}
+
+// OnKubernetesEventConfig is an onKubernetesEvent binding with a name of a queue for hook run tasks.
+type OnKubernetesEventConfig struct {
+	kube_events_manager.OnKubernetesEventConfig
+	Queue string `json:"queue"`
+	// IncludeObject adds the object or the jqFilter result to the binding context.
+	IncludeObject bool `json:"includeObject"`
+	// IncludeSnapshots adds objects of all onKubernetesEvent bindings of the hook to the binding context.
+	IncludeSnapshots bool `json:"includeSnapshots"`
+}
+
+// KubernetesValidatingConfig is a kubernetesValidating binding: a webhook in the ValidatingWebhookConfiguration
+// of the operator. The hook decides whether the request that matches rules is allowed.
+type KubernetesValidatingConfig struct {
+	// Name is a binding name for the binding context. It should be a DNS label.
+	Name  string                                     `json:"name"`
+	Rules []admissionregistration.RuleWithOperations `json:"rules"`
+	// FailurePolicy is used by the API server if the hook fails or times out. It is "Ignore" if empty.
+	FailurePolicy     *admissionregistration.FailurePolicyType `json:"failurePolicy"`
+	NamespaceSelector *metav1.LabelSelector                    `json:"namespaceSelector"`
+}
+
+// ScheduleConfigs returns schedule bindings without queues.
+func (c *HookConfig) ScheduleConfigs() []schedule_manager.ScheduleConfig {
+	res := make([]schedule_manager.ScheduleConfig, 0, len(c.Schedule))
+	for _, config := range c.Schedule {
+		res = append(res, config.ScheduleConfig)
+	}
+	return res
+}
+
+// ScheduleQueue returns a queue name for schedule binding. Empty string means a default queue.
+func (c *HookConfig) ScheduleQueue(scheduleConfig schedule_manager.ScheduleConfig) string {
+	for _, config := range c.Schedule {
+		if config.ScheduleConfig == scheduleConfig {
+			return config.Queue
+		}
+	}
+	return ""
 }
 
 func NewGlobalHook(name, path string, config *GlobalHookConfig, mm *MainModuleManager) *GlobalHook {
@@ -91,9 +168,12 @@ func NewModuleHook(name, path string, config *ModuleHookConfig, mm *MainModuleMa
 	return moduleHook
 }
 
-func (mm *MainModuleManager) registerGlobalHook(name, path string, config *GlobalHookConfig) (err error) {
+// registerGlobalHook adds a hook to the lists of hooks by binding. goHook is nil for shell hooks.
+// mm.globalHooksLock should be locked.
+func (mm *MainModuleManager) registerGlobalHook(name, path string, config *GlobalHookConfig, goHook GoHook) (err error) {
 	var ok bool
 	globalHook := NewGlobalHook(name, path, config, mm)
+	globalHook.GoHook = goHook
 
 	if config.BeforeAll != nil {
 		globalHook.Bindings = append(globalHook.Bindings, BeforeAll)
@@ -129,14 +209,21 @@ func (mm *MainModuleManager) registerGlobalHook(name, path string, config *Globa
 		mm.globalHooksOrder[KubeEvents] = append(mm.globalHooksOrder[KubeEvents], globalHook)
 	}
 
+	if len(config.KubernetesValidating) != 0 {
+		globalHook.Bindings = append(globalHook.Bindings, KubernetesValidating)
+		mm.globalHooksOrder[KubernetesValidating] = append(mm.globalHooksOrder[KubernetesValidating], globalHook)
+	}
+
 	mm.globalHooksByName[name] = globalHook
 
 	return nil
 }
 
-func (mm *MainModuleManager) registerModuleHook(moduleName, name, path string, config *ModuleHookConfig) (err error) {
+// registerModuleHook adds a hook to the lists of module hooks by binding. goHook is nil for shell hooks.
+func (mm *MainModuleManager) registerModuleHook(moduleName, name, path string, config *ModuleHookConfig, goHook GoHook) (err error) {
 	var ok bool
 	moduleHook := NewModuleHook(name, path, config, mm)
+	moduleHook.GoHook = goHook
 
 	if moduleHook.Module, err = mm.GetModule(moduleName); err != nil {
 		return err
@@ -185,6 +272,11 @@ func (mm *MainModuleManager) registerModuleHook(moduleName, name, path string, c
 		mm.addModulesHooksOrderByName(moduleName, KubeEvents, moduleHook)
 	}
 
+	if len(config.KubernetesValidating) != 0 {
+		moduleHook.Bindings = append(moduleHook.Bindings, KubernetesValidating)
+		mm.addModulesHooksOrderByName(moduleName, KubernetesValidating, moduleHook)
+	}
+
 	return nil
 }
 
@@ -214,7 +306,7 @@ type globalValuesMergeResult struct {
 func (h *GlobalHook) handleGlobalValuesPatch(currentValues utils.Values, valuesPatch utils.ValuesPatch) (*globalValuesMergeResult, error) {
 	acceptableKey := "global"
 
-	if err := validateHookValuesPatch(valuesPatch, acceptableKey); err != nil {
+	if err := ValidateHookValuesPatch(valuesPatch, acceptableKey); err != nil {
 		return nil, fmt.Errorf("merge global values failed: %s", err)
 	}
 
@@ -242,50 +334,115 @@ func (h *GlobalHook) handleGlobalValuesPatch(currentValues utils.Values, valuesP
 	return result, nil
 }
 
-func (h *GlobalHook) run(bindingType BindingType, context []BindingContext) error {
+func (h *GlobalHook) run(bindingType BindingType, context []BindingContext, logLabels map[string]string) error {
 	rlog.Infof("Running global hook '%s' binding '%s' ...", h.Name, bindingType)
 
-	globalHookExecutor := NewHookExecutor(h, context)
-	patches, err := globalHookExecutor.Run()
+	logLabels = utils.MergeLabels(logLabels, map[string]string{
+		logger.HookField:    h.Name,
+		logger.BindingField: string(bindingType),
+	})
+	var patches map[utils.ValuesPatchType]*utils.ValuesPatch
+	var metrics []metrics_storage.MetricOperation
+	var kubeOperations []kube_patch.Operation
+	var err error
+	hookStart := time.Now()
+	if h.GoHook != nil {
+		var output *GoHookOutput
+		output, err = runGoHook(h.GoHook, &GoHookInput{
+			BindingType:    bindingType,
+			BindingContext: context,
+			ConfigValues:   h.configValues(),
+			Values:         h.values(),
+			LogEntry:       logger.WithLabels(logLabels),
+		})
+		if err == nil {
+			patches, metrics, kubeOperations = output.patches(), output.Metrics, output.KubernetesOperations
+		}
+	} else {
+		globalHookExecutor := NewHookExecutor(h, context).WithLogLabels(logLabels).WithTimeout(h.timeout()).WithDir(h.moduleManager.TempDir)
+		patches, metrics, err = globalHookExecutor.Run()
+		kubeOperations = globalHookExecutor.KubernetesOperations
+	}
+	h.moduleManager.observeDuration("global_hook_run_seconds", hookStart, map[string]string{"hook": h.Name, "binding": string(bindingType)})
+	if executor.IsTimeout(err) {
+		h.moduleManager.sendCounterMetric("global_hook_timeouts", map[string]string{"hook": h.Name})
+		return fmt.Errorf("global hook '%s' timed out: %s", h.Name, err)
+	}
 	if err != nil {
 		return fmt.Errorf("global hook '%s' failed: %s", h.Name, err)
 	}
 
+	h.moduleManager.sendHookMetrics(metrics, map[string]string{"hook": h.Name})
+
+	return h.applyValuesPatches(patches, kubeOperations)
+}
+
+func (h *GlobalHook) timeout() time.Duration {
+	if h.Config == nil {
+		return app.HookTimeout
+	}
+	return h.Config.TimeoutDuration()
+}
+
+// applyValuesPatches validates patches for config values and dynamic values returned by the hook,
+// applies Kubernetes operations and then saves values. Values stay unchanged if an operation fails.
+func (h *GlobalHook) applyValuesPatches(patches map[utils.ValuesPatchType]*utils.ValuesPatch, kubeOperations []kube_patch.Operation) error {
+	var configValuesPatchResult *globalValuesMergeResult
 	configValuesPatch, has := patches[utils.ConfigMapPatch]
 	if has && configValuesPatch != nil {
-		preparedConfigValues := utils.MergeValues(
-			utils.Values{"global": map[string]interface{}{}},
-			h.moduleManager.kubeGlobalConfigValues,
-		)
-
-		configValuesPatchResult, err := h.handleGlobalValuesPatch(preparedConfigValues, *configValuesPatch)
+		var err error
+		configValuesPatchResult, err = h.handleGlobalValuesPatch(h.configValues(), *configValuesPatch)
 		if err != nil {
 			return fmt.Errorf("global hook '%s': kube config global values update error: %s", h.Name, err)
 		}
 
-		if configValuesPatchResult.ValuesChanged {
-			if err := h.moduleManager.kubeConfigManager.SetKubeGlobalValues(configValuesPatchResult.Values); err != nil {
-				rlog.Debugf("Global hook '%s' kube config global values stay unchanged:\n%s", utils.ValuesToString(h.moduleManager.kubeGlobalConfigValues))
-				return fmt.Errorf("global hook '%s': set kube config failed: %s", h.Name, err)
-			}
-
-			h.moduleManager.kubeGlobalConfigValues = configValuesPatchResult.Values
-			rlog.Debugf("Global hook '%s': kube config global values updated:\n%s", h.Name, utils.ValuesToString(h.moduleManager.kubeGlobalConfigValues))
+		// Required fields can be set in static values, so patched values are validated with them.
+		h.moduleManager.valuesLock.RLock()
+		validatedValues := utils.MergeValues(h.moduleManager.globalCommonStaticValues, configValuesPatchResult.Values)
+		h.moduleManager.valuesLock.RUnlock()
+		if err := h.moduleManager.ValuesValidator.ValidateGlobalConfigValues(validatedValues); err != nil {
+			return fmt.Errorf("global hook '%s': kube config global values are not valid after patch: %s", h.Name, err)
 		}
 	}
 
+	var valuesPatchResult *globalValuesMergeResult
 	valuesPatch, has := patches[utils.MemoryValuesPatch]
 	if has && valuesPatch != nil {
-		valuesPatchResult, err := h.handleGlobalValuesPatch(h.values(), *valuesPatch)
+		var err error
+		valuesPatchResult, err = h.handleGlobalValuesPatch(h.values(), *valuesPatch)
 		if err != nil {
 			return fmt.Errorf("global hook '%s': dynamic global values update error: %s", h.Name, err)
 		}
-		if valuesPatchResult.ValuesChanged {
-			h.moduleManager.globalDynamicValuesPatches = utils.AppendValuesPatch(h.moduleManager.globalDynamicValuesPatches, valuesPatchResult.ValuesPatch)
-			rlog.Debugf("Global hook '%s': global values updated:\n%s", h.Name, utils.ValuesToString(h.values()))
+
+		if err := h.moduleManager.ValuesValidator.ValidateGlobalValues(valuesPatchResult.Values); err != nil {
+			return fmt.Errorf("global hook '%s': dynamic global values are not valid after patch: %s", h.Name, err)
+		}
+	}
+
+	if err := h.moduleManager.applyKubernetesPatch(h.Name, kubeOperations); err != nil {
+		return fmt.Errorf("global hook '%s': kubernetes patch failed: %s", h.Name, err)
+	}
+
+	if configValuesPatchResult != nil && configValuesPatchResult.ValuesChanged {
+		if err := h.moduleManager.kubeConfigManager.SetKubeGlobalValues(configValuesPatchResult.Values); err != nil {
+			rlog.Debugf("Global hook '%s' kube config global values stay unchanged:\n%s", utils.ValuesToString(h.configValues()))
+			return fmt.Errorf("global hook '%s': set kube config failed: %s", h.Name, err)
 		}
+
+		h.moduleManager.valuesLock.Lock()
+		h.moduleManager.kubeGlobalConfigValues = configValuesPatchResult.Values
+		h.moduleManager.valuesLock.Unlock()
+		rlog.Debugf("Global hook '%s': kube config global values updated:\n%s", h.Name, utils.ValuesToString(h.configValues()))
+	}
+
+	if valuesPatchResult != nil && valuesPatchResult.ValuesChanged {
+		h.moduleManager.valuesLock.Lock()
+		h.moduleManager.globalDynamicValuesPatches = utils.AppendValuesPatch(h.moduleManager.globalDynamicValuesPatches, valuesPatchResult.ValuesPatch)
+		h.moduleManager.valuesLock.Unlock()
+		rlog.Debugf("Global hook '%s': global values updated:\n%s", h.Name, utils.ValuesToString(h.values()))
 	}
 
+	h.moduleManager.forgetKubernetesPatch(h.Name)
 	return nil
 }
 
@@ -320,11 +477,24 @@ func (h *GlobalHook) PrepareTmpFilesForHookRun(context []BindingContext) (tmpFil
 		return
 	}
 
+	tmpFiles["METRICS_PATH"], err = h.prepareMetricsFile()
+	if err != nil {
+		return
+	}
+
+	tmpFiles["KUBERNETES_PATCH_PATH"], err = h.prepareKubernetesPatchFile()
+	if err != nil {
+		return
+	}
+
 	return
 }
 
 
 func (h *GlobalHook) configValues() utils.Values {
+	h.moduleManager.valuesLock.RLock()
+	defer h.moduleManager.valuesLock.RUnlock()
+
 	return utils.MergeValues(
 		utils.Values{"global": map[string]interface{}{}},
 		h.moduleManager.kubeGlobalConfigValues,
@@ -334,8 +504,12 @@ func (h *GlobalHook) configValues() utils.Values {
 func (h *GlobalHook) values() utils.Values {
 	var err error
 
+	h.moduleManager.valuesLock.RLock()
+	defer h.moduleManager.valuesLock.RUnlock()
+
 	res := utils.MergeValues(
 		utils.Values{"global": map[string]interface{}{}},
+		h.moduleManager.ValuesValidator.GlobalDefaults(),
 		h.moduleManager.globalCommonStaticValues,
 		h.moduleManager.kubeGlobalConfigValues,
 	)
@@ -451,7 +625,7 @@ func (h *CommonHook) GetPath() string {
 func (h *ModuleHook) handleModuleValuesPatch(currentValues utils.Values, valuesPatch utils.ValuesPatch) (*moduleValuesMergeResult, error) {
 	moduleValuesKey := utils.ModuleNameToValuesKey(h.Module.Name)
 
-	if err := validateHookValuesPatch(valuesPatch, moduleValuesKey); err != nil {
+	if err := ValidateHookValuesPatch(valuesPatch, moduleValuesKey); err != nil {
 		return nil, fmt.Errorf("merge module '%s' values failed: %s", h.Module.Name, err)
 	}
 
@@ -479,7 +653,7 @@ func (h *ModuleHook) handleModuleValuesPatch(currentValues utils.Values, valuesP
 	return result, nil
 }
 
-func validateHookValuesPatch(valuesPatch utils.ValuesPatch, acceptableKey string) error {
+func ValidateHookValuesPatch(valuesPatch utils.ValuesPatch, acceptableKey string) error {
 	for _, op := range valuesPatch.Operations {
 		if op.Op == "replace" {
 			return fmt.Errorf("unsupported patch operation '%s': '%s'", op.Op, op.ToString())
@@ -497,51 +671,140 @@ func validateHookValuesPatch(valuesPatch utils.ValuesPatch, acceptableKey string
 	return nil
 }
 
-func (h *ModuleHook) run(bindingType BindingType, context []BindingContext) error {
-	moduleName := h.Module.Name
+func (h *ModuleHook) run(bindingType BindingType, context []BindingContext, logLabels map[string]string) error {
+	patches, kubeOperations, err := h.execute(bindingType, context, logLabels)
+	if err != nil {
+		return err
+	}
+	return h.applyValuesPatches(patches, kubeOperations)
+}
+
+// execute runs the hook and sends its metrics. Values patches and Kubernetes operations
+// are returned to apply them later.
+func (h *ModuleHook) execute(bindingType BindingType, context []BindingContext, logLabels map[string]string) (map[utils.ValuesPatchType]*utils.ValuesPatch, []kube_patch.Operation, error) {
 	rlog.Infof("Running module hook '%s' binding '%s' ...", h.Name, bindingType)
 
-	moduleHookExecutor := NewHookExecutor(h, context)
-	patches, err := moduleHookExecutor.Run()
+	logLabels = utils.MergeLabels(logLabels, map[string]string{
+		logger.ModuleField:  h.Module.Name,
+		logger.HookField:    h.Name,
+		logger.BindingField: string(bindingType),
+	})
+	var patches map[utils.ValuesPatchType]*utils.ValuesPatch
+	var metrics []metrics_storage.MetricOperation
+	var kubeOperations []kube_patch.Operation
+	var err error
+	hookStart := time.Now()
+	if h.GoHook != nil {
+		var output *GoHookOutput
+		output, err = runGoHook(h.GoHook, &GoHookInput{
+			BindingType:    bindingType,
+			BindingContext: context,
+			ConfigValues:   h.configValues(),
+			Values:         h.values(),
+			LogEntry:       logger.WithLabels(logLabels),
+		})
+		if err == nil {
+			patches, metrics, kubeOperations = output.patches(), output.Metrics, output.KubernetesOperations
+		}
+	} else {
+		moduleHookExecutor := NewHookExecutor(h, context).WithLogLabels(logLabels).WithTimeout(h.timeout()).WithDir(h.moduleManager.TempDir)
+		patches, metrics, err = moduleHookExecutor.Run()
+		kubeOperations = moduleHookExecutor.KubernetesOperations
+	}
+	h.moduleManager.observeDuration("module_hook_run_seconds", hookStart, map[string]string{"module": h.Module.Name, "hook": h.Name, "binding": string(bindingType)})
+	if executor.IsTimeout(err) {
+		h.moduleManager.sendCounterMetric("module_hook_timeouts", map[string]string{"module": h.Module.Name, "hook": h.Name})
+		return nil, nil, fmt.Errorf("module hook '%s' timed out: %s", h.Name, err)
+	}
 	if err != nil {
-		return fmt.Errorf("module hook '%s' failed: %s", h.Name, err)
+		return nil, nil, fmt.Errorf("module hook '%s' failed: %s", h.Name, err)
 	}
 
+	h.moduleManager.sendHookMetrics(metrics, map[string]string{"module": h.Module.Name, "hook": h.Name})
+
+	return patches, kubeOperations, nil
+}
+
+func (h *ModuleHook) timeout() time.Duration {
+	if h.Config == nil {
+		return app.HookTimeout
+	}
+	return h.Config.TimeoutDuration()
+}
+
+// isParallel returns true if the hook can run concurrently with other hooks of the module.
+func (h *ModuleHook) isParallel() bool {
+	return (h.Config != nil && h.Config.Parallel) || (h.Module != nil && h.Module.ParallelHooks)
+}
+
+// applyValuesPatches validates patches for config values and dynamic values returned by the hook,
+// applies Kubernetes operations and then saves values. Values stay unchanged if an operation fails.
+func (h *ModuleHook) applyValuesPatches(patches map[utils.ValuesPatchType]*utils.ValuesPatch, kubeOperations []kube_patch.Operation) error {
+	moduleName := h.Module.Name
+
+	var configValuesPatchResult *moduleValuesMergeResult
+	var preparedConfigValues utils.Values
 	configValuesPatch, has := patches[utils.ConfigMapPatch]
 	if has && configValuesPatch != nil{
-		preparedConfigValues := utils.MergeValues(
+		h.moduleManager.valuesLock.RLock()
+		preparedConfigValues = utils.MergeValues(
 			utils.Values{utils.ModuleNameToValuesKey(moduleName): map[string]interface{}{}},
 			h.moduleManager.kubeModulesConfigValues[moduleName],
 		)
+		h.moduleManager.valuesLock.RUnlock()
 
-		configValuesPatchResult, err := h.handleModuleValuesPatch(preparedConfigValues, *configValuesPatch)
+		var err error
+		configValuesPatchResult, err = h.handleModuleValuesPatch(preparedConfigValues, *configValuesPatch)
 		if err != nil {
 			return fmt.Errorf("module hook '%s': kube module config values update error: %s", h.Name, err)
 		}
-		if configValuesPatchResult.ValuesChanged {
-			err := h.moduleManager.kubeConfigManager.SetKubeModuleValues(moduleName, configValuesPatchResult.Values)
-			if err != nil {
-				rlog.Debugf("Module hook '%s' kube module config values stay unchanged:\n%s", utils.ValuesToString(h.moduleManager.kubeModulesConfigValues[moduleName]))
-				return fmt.Errorf("module hook '%s': set kube module config failed: %s", h.Name, err)
-			}
 
-			h.moduleManager.kubeModulesConfigValues[moduleName] = configValuesPatchResult.Values
-			rlog.Debugf("Module hook '%s': kube module '%s' config values updated:\n%s", h.Name, moduleName, utils.ValuesToString(h.moduleManager.kubeModulesConfigValues[moduleName]))
+		// Required fields can be set in static values, so patched values are validated with them.
+		validatedValues := utils.MergeValues(h.Module.CommonStaticConfig.Values, h.Module.StaticConfig.Values, configValuesPatchResult.Values)
+		if err := h.moduleManager.ValuesValidator.ValidateModuleConfigValues(configValuesPatchResult.ModuleValuesKey, validatedValues); err != nil {
+			return fmt.Errorf("module hook '%s': kube module config values are not valid after patch: %s", h.Name, err)
 		}
 	}
 
+	var valuesPatchResult *moduleValuesMergeResult
 	valuesPatch, has := patches[utils.MemoryValuesPatch]
 	if has && valuesPatch != nil {
-		valuesPatchResult, err := h.handleModuleValuesPatch(h.values(), *valuesPatch)
+		var err error
+		valuesPatchResult, err = h.handleModuleValuesPatch(h.values(), *valuesPatch)
 		if err != nil {
 			return fmt.Errorf("module hook '%s': dynamic module values update error: %s", h.Name, err)
 		}
-		if valuesPatchResult.ValuesChanged {
-			h.moduleManager.modulesDynamicValuesPatches[moduleName] = utils.AppendValuesPatch(h.moduleManager.modulesDynamicValuesPatches[moduleName], valuesPatchResult.ValuesPatch)
-			rlog.Debugf("Module hook '%s': dynamic module '%s' values updated:\n%s", h.Name, moduleName, utils.ValuesToString(h.values()))
+
+		if err := h.moduleManager.ValuesValidator.ValidateModuleValues(valuesPatchResult.ModuleValuesKey, valuesPatchResult.Values); err != nil {
+			return fmt.Errorf("module hook '%s': dynamic module values are not valid after patch: %s", h.Name, err)
 		}
 	}
 
+	if err := h.moduleManager.applyKubernetesPatch(h.Name, kubeOperations); err != nil {
+		return fmt.Errorf("module hook '%s': kubernetes patch failed: %s", h.Name, err)
+	}
+
+	if configValuesPatchResult != nil && configValuesPatchResult.ValuesChanged {
+		err := h.moduleManager.kubeConfigManager.SetKubeModuleValues(moduleName, configValuesPatchResult.Values)
+		if err != nil {
+			rlog.Debugf("Module hook '%s' kube module config values stay unchanged:\n%s", utils.ValuesToString(preparedConfigValues))
+			return fmt.Errorf("module hook '%s': set kube module config failed: %s", h.Name, err)
+		}
+
+		h.moduleManager.valuesLock.Lock()
+		h.moduleManager.kubeModulesConfigValues[moduleName] = configValuesPatchResult.Values
+		h.moduleManager.valuesLock.Unlock()
+		rlog.Debugf("Module hook '%s': kube module '%s' config values updated:\n%s", h.Name, moduleName, utils.ValuesToString(configValuesPatchResult.Values))
+	}
+
+	if valuesPatchResult != nil && valuesPatchResult.ValuesChanged {
+		h.moduleManager.valuesLock.Lock()
+		h.moduleManager.modulesDynamicValuesPatches[moduleName] = utils.AppendValuesPatch(h.moduleManager.modulesDynamicValuesPatches[moduleName], valuesPatchResult.ValuesPatch)
+		h.moduleManager.valuesLock.Unlock()
+		rlog.Debugf("Module hook '%s': dynamic module '%s' values updated:\n%s", h.Name, moduleName, utils.ValuesToString(h.values()))
+	}
+
+	h.moduleManager.forgetKubernetesPatch(h.Name)
 	return nil
 }
 
@@ -576,6 +839,16 @@ func (h *ModuleHook) PrepareTmpFilesForHookRun(context []BindingContext) (tmpFil
 		return
 	}
 
+	tmpFiles["METRICS_PATH"], err = h.prepareMetricsFile()
+	if err != nil {
+		return
+	}
+
+	tmpFiles["KUBERNETES_PATCH_PATH"], err = h.prepareKubernetesPatchFile()
+	if err != nil {
+		return
+	}
+
 	return
 }
 
@@ -588,8 +861,9 @@ func (h *ModuleHook) values() utils.Values {
 	return h.Module.values()
 }
 
+// prepareValuesJsonFile writes values into a file of the hook: hooks of the module can run concurrently.
 func (h *ModuleHook) prepareValuesJsonFile() (string, error) {
-	return h.Module.prepareValuesJsonFile()
+	return h.prepareJsonFile("values", h.values())
 }
 
 func (h *ModuleHook) prepareValuesYamlFile() (string, error) {
@@ -597,7 +871,19 @@ func (h *ModuleHook) prepareValuesYamlFile() (string, error) {
 }
 
 func (h *ModuleHook) prepareConfigValuesJsonFile() (string, error) {
-	return h.Module.prepareConfigValuesJsonFile()
+	return h.prepareJsonFile("config-values", h.configValues())
+}
+
+func (h *ModuleHook) prepareJsonFile(kind string, values utils.Values) (string, error) {
+	data := utils.MustDump(utils.DumpValuesJson(values))
+	path := filepath.Join(h.moduleManager.TempDir, fmt.Sprintf("%s.module-hook-%s-%s.json", h.Module.SafeName(), h.SafeName(), kind))
+	if err := dumpData(path, data); err != nil {
+		return "", err
+	}
+
+	rlog.Debugf("Prepared module %s hook %s %s:\n%s", h.Module.SafeName(), h.Name, kind, utils.ValuesToString(values))
+
+	return path, nil
 }
 
 func (h *ModuleHook) prepareConfigValuesYamlFile() (string, error) {
@@ -636,11 +922,124 @@ func prepareHookConfig(hookConfig *HookConfig) {
 	}
 }
 
+// ValidateGlobalHookConfig checks bindings of a global hook config: orders should be numbers,
+// schedule bindings should have a crontab and onKubernetesEvent bindings should have a kind.
+func ValidateGlobalHookConfig(config *GlobalHookConfig) error {
+	orders := map[BindingType]interface{}{
+		BeforeAll: config.BeforeAll,
+		AfterAll:  config.AfterAll,
+		OnStartup: config.OnStartup,
+	}
+	if err := validateBindingOrders(orders); err != nil {
+		return err
+	}
+	return validateHookConfig(&config.HookConfig)
+}
+
+// ValidateModuleHookConfig checks bindings of a module hook config: orders should be numbers,
+// schedule bindings should have a crontab and onKubernetesEvent bindings should have a kind.
+func ValidateModuleHookConfig(config *ModuleHookConfig) error {
+	orders := map[BindingType]interface{}{
+		BeforeHelm:      config.BeforeHelm,
+		AfterHelm:       config.AfterHelm,
+		AfterDeleteHelm: config.AfterDeleteHelm,
+		OnStartup:       config.OnStartup,
+	}
+	if err := validateBindingOrders(orders); err != nil {
+		return err
+	}
+	return validateHookConfig(&config.HookConfig)
+}
+
+// GlobalHookConfigFromJSON unmarshals the --config output of a global hook, validates it
+// and fills defaults. The hooks loader and the test-hook command use it to accept the same configs.
+func GlobalHookConfigFromJSON(data []byte) (*GlobalHookConfig, error) {
+	config := &GlobalHookConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal config: %s\n%s", err, data)
+	}
+	if err := ValidateGlobalHookConfig(config); err != nil {
+		return nil, err
+	}
+	prepareHookConfig(&config.HookConfig)
+	return config, nil
+}
+
+// ModuleHookConfigFromJSON unmarshals the --config output of a module hook, validates it
+// and fills defaults.
+func ModuleHookConfigFromJSON(data []byte) (*ModuleHookConfig, error) {
+	config := &ModuleHookConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal config: %s\n%s", err, data)
+	}
+	if err := ValidateModuleHookConfig(config); err != nil {
+		return nil, err
+	}
+	prepareHookConfig(&config.HookConfig)
+	return config, nil
+}
+
+func validateBindingOrders(orders map[BindingType]interface{}) error {
+	for bindingType, order := range orders {
+		if order == nil {
+			continue
+		}
+		if _, ok := order.(float64); !ok {
+			return fmt.Errorf("unsuported value '%v' for binding '%s'", order, bindingType)
+		}
+	}
+	return nil
+}
+
+func validateHookConfig(config *HookConfig) error {
+	for i, schedule := range config.Schedule {
+		if schedule.Crontab == "" {
+			return fmt.Errorf("binding '%s' #%d: crontab is required", Schedule, i)
+		}
+	}
+	for i, kubeEvent := range config.OnKubernetesEvent {
+		if kubeEvent.Kind == "" {
+			return fmt.Errorf("binding '%s' #%d: kind is required", KubeEvents, i)
+		}
+	}
+	validatingNames := make(map[string]bool)
+	for i, validating := range config.KubernetesValidating {
+		if errs := validation.IsDNS1123Label(validating.Name); len(errs) > 0 {
+			return fmt.Errorf("binding '%s' #%d: name '%s' is not valid: %s", KubernetesValidating, i, validating.Name, strings.Join(errs, ", "))
+		}
+		if validatingNames[validating.Name] {
+			return fmt.Errorf("binding '%s' #%d: name '%s' is not unique", KubernetesValidating, i, validating.Name)
+		}
+		validatingNames[validating.Name] = true
+		if len(validating.Rules) == 0 {
+			return fmt.Errorf("binding '%s' #%d: rules are required", KubernetesValidating, i)
+		}
+	}
+	if config.MaxRetries < 0 {
+		return fmt.Errorf("maxRetries should not be negative, got %d", config.MaxRetries)
+	}
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("timeout should be a positive duration like '30s', got '%s'", config.Timeout)
+		}
+		config.timeout = timeout
+	}
+	return nil
+}
+
+// initGlobalHooks loads configs of global hooks and replaces the index of global hooks.
+// Hooks are executed with --config before the lock is taken: the index is read
+// by the events handler while the ReloadFiles task reloads hooks.
 func (mm *MainModuleManager) initGlobalHooks() error {
 	rlog.Debug("INIT: global hooks")
 
-	mm.globalHooksOrder = make(map[BindingType][]*GlobalHook)
-	mm.globalHooksByName = make(map[string]*GlobalHook)
+	type hookConfigItem struct {
+		name   string
+		path   string
+		config *GlobalHookConfig
+	}
+	configs := make([]hookConfigItem, 0)
 
 	hooksDir := mm.GlobalHooksDir
 
@@ -652,17 +1051,12 @@ func (mm *MainModuleManager) initGlobalHooks() error {
 
 		rlog.Infof("INIT: global hook '%s'", hookName)
 
-		hookConfig := &GlobalHookConfig{}
-		if err := json.Unmarshal(output, hookConfig); err != nil {
-			return fmt.Errorf("INIT: cannot unmarshal config from global hook %s: %s\n%s", hookName, err.Error(), output)
-		}
-
-		prepareHookConfig(&hookConfig.HookConfig)
-
-		if err := mm.registerGlobalHook(hookName, hookPath, hookConfig); err != nil {
-			return fmt.Errorf("INIT: cannot add global hook '%s': %s", hookName, err.Error())
+		hookConfig, err := GlobalHookConfigFromJSON(output)
+		if err != nil {
+			return fmt.Errorf("INIT: bad config from global hook %s: %s", hookName, err.Error())
 		}
 
+		configs = append(configs, hookConfigItem{name: hookName, path: hookPath, config: hookConfig})
 		return nil
 	})
 
@@ -670,7 +1064,19 @@ func (mm *MainModuleManager) initGlobalHooks() error {
 		return err
 	}
 
-	return nil
+	mm.globalHooksLock.Lock()
+	defer mm.globalHooksLock.Unlock()
+
+	mm.globalHooksOrder = make(map[BindingType][]*GlobalHook)
+	mm.globalHooksByName = make(map[string]*GlobalHook)
+
+	for _, item := range configs {
+		if err := mm.registerGlobalHook(item.name, item.path, item.config, nil); err != nil {
+			return fmt.Errorf("INIT: cannot add global hook '%s': %s", item.name, err.Error())
+		}
+	}
+
+	return mm.initGlobalGoHooks()
 }
 
 func (mm *MainModuleManager) initModuleHooks(module *Module) error {
@@ -691,20 +1097,22 @@ func (mm *MainModuleManager) initModuleHooks(module *Module) error {
 
 		rlog.Infof("INIT:   hook '%s' ...", hookName)
 
-		hookConfig := &ModuleHookConfig{}
-		if err := json.Unmarshal(output, hookConfig); err != nil {
-			return fmt.Errorf("unmarshaling module '%s' hook '%s' json failed: %s", module.SafeName(), hookName, err.Error())
+		hookConfig, err := ModuleHookConfigFromJSON(output)
+		if err != nil {
+			return fmt.Errorf("bad config from module '%s' hook '%s': %s", module.SafeName(), hookName, err.Error())
 		}
 
-		prepareHookConfig(&hookConfig.HookConfig)
-
-		if err := mm.registerModuleHook(module.Name, hookName, hookPath, hookConfig); err != nil {
+		if err := mm.registerModuleHook(module.Name, hookName, hookPath, hookConfig, nil); err != nil {
 			return fmt.Errorf("adding module '%s' hook '%s' failed: %s", module.SafeName(), hookName, err.Error())
 		}
 
 		return nil
 	})
 
+	if err == nil {
+		err = mm.initModuleGoHooks(module)
+	}
+
 	if err != nil {
 		// cleanup hook indexes on error
 		mm.removeModuleHooks(module.Name)
@@ -773,6 +1181,37 @@ func (h *ModuleHook) prepareValuesJsonPatchFile() (string, error) {
 	return path, nil
 }
 
+func (h *GlobalHook) prepareMetricsFile() (string, error) {
+	path := filepath.Join(h.moduleManager.TempDir, fmt.Sprintf("%s.global-hook-metrics.json", h.SafeName()))
+	if err := createHookResultValuesFile(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (h *ModuleHook) prepareMetricsFile() (string, error) {
+	path := filepath.Join(h.moduleManager.TempDir, fmt.Sprintf("%s.module-hook-metrics.json", h.SafeName()))
+	if err := createHookResultValuesFile(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (h *GlobalHook) prepareKubernetesPatchFile() (string, error) {
+	path := filepath.Join(h.moduleManager.TempDir, fmt.Sprintf("%s.global-hook-kubernetes-patch.json", h.SafeName()))
+	if err := createHookResultValuesFile(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (h *ModuleHook) prepareKubernetesPatchFile() (string, error) {
+	path := filepath.Join(h.moduleManager.TempDir, fmt.Sprintf("%s.module-hook-kubernetes-patch.json", h.SafeName()))
+	if err := createHookResultValuesFile(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
 
 func createHookResultValuesFile(filePath string) error {
 	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
@@ -792,8 +1231,12 @@ func makeCommand(dir string, entrypoint string, envs []string, args []string) *e
 func execCommandOutput(cmd *exec.Cmd) ([]byte, error) {
 	rlog.Debugf("Executing hook in %s: '%s'", cmd.Dir, strings.Join(cmd.Args, " "))
 	cmd.Stdout = nil
+	stderr := logger.NewLineWriter(logger.WithLabels(map[string]string{logger.HookField: cmd.Args[0]}), "stderr")
+	cmd.Stderr = stderr
 
-	output, err := executor.Output(cmd)
+	// Hook config is not known yet, so the default timeout is used.
+	output, err := executor.OutputWithTimeout(cmd, app.HookTimeout)
+	stderr.Flush()
 	if err != nil {
 		rlog.Errorf("Hook '%s' output:\n%s", strings.Join(cmd.Args, " "), string(output))
 		return output, err
@@ -813,6 +1256,14 @@ type HookExecutor struct {
 	ContextPath string
 	ConfigValuesPatchPath string
 	ValuesPatchPath string
+	MetricsPath string
+	KubernetesPatchPath string
+	LogLabels map[string]string
+	Timeout time.Duration
+	// Dir is a working directory for the hook process.
+	Dir string
+	// KubernetesOperations are read from the KUBERNETES_PATCH_PATH file after the hook run.
+	KubernetesOperations []kube_patch.Operation
 }
 
 func NewHookExecutor(h Hook, context []BindingContext) *HookExecutor {
@@ -822,39 +1273,85 @@ func NewHookExecutor(h Hook, context []BindingContext) *HookExecutor {
 	}
 }
 
-func (e *HookExecutor) Run() (patches map[utils.ValuesPatchType]*utils.ValuesPatch, err error) {
+// WithLogLabels sets labels for log lines with hook output.
+func (e *HookExecutor) WithLogLabels(logLabels map[string]string) *HookExecutor {
+	e.LogLabels = logLabels
+	return e
+}
+
+// WithTimeout sets a timeout for the hook process. Zero means no limit.
+func (e *HookExecutor) WithTimeout(timeout time.Duration) *HookExecutor {
+	e.Timeout = timeout
+	return e
+}
+
+// WithDir sets a working directory for the hook process.
+func (e *HookExecutor) WithDir(dir string) *HookExecutor {
+	e.Dir = dir
+	return e
+}
+
+// Run executes the hook and returns values patches and metrics written by the hook.
+// executor.TimeoutError is returned as is if the hook is killed after timeout.
+func (e *HookExecutor) Run() (patches map[utils.ValuesPatchType]*utils.ValuesPatch, metrics []metrics_storage.MetricOperation, err error) {
 	patches = make(map[utils.ValuesPatchType]*utils.ValuesPatch)
 
 	tmpFiles, err := e.Hook.PrepareTmpFilesForHookRun(e.Context)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	e.ConfigValuesPatchPath = tmpFiles["CONFIG_VALUES_JSON_PATCH_PATH"]
 	e.ValuesPatchPath = tmpFiles["VALUES_JSON_PATCH_PATH"]
+	e.MetricsPath = tmpFiles["METRICS_PATH"]
+	e.KubernetesPatchPath = tmpFiles["KUBERNETES_PATCH_PATH"]
 
 	envs := []string{}
 	envs = append(envs, os.Environ()...)
 	for envName, filePath := range tmpFiles {
 		envs = append(envs, fmt.Sprintf("%s=%s", envName, filePath))
 	}
-	envs = append(envs, helm.Client.CommandEnv()...)
+	if helm.Client != nil {
+		envs = append(envs, helm.Client.CommandEnv()...)
+	}
 
-	cmd := executor.MakeCommand("", e.Hook.GetPath(), []string{}, envs)
+	// A relative path of the hook is resolved against Dir, so make it absolute.
+	hookPath, err := filepath.Abs(e.Hook.GetPath())
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := executor.MakeCommand(e.Dir, hookPath, []string{}, envs)
 
-	err = executor.Run(cmd, true)
+	err = executor.RunAndLogLines(cmd, e.LogLabels, e.Timeout)
+	if executor.IsTimeout(err) {
+		return nil, nil, err
+	}
 	if err != nil {
-		return nil, fmt.Errorf("%s FAILED: %s", e.Hook.GetName(), err)
+		return nil, nil, fmt.Errorf("%s FAILED: %s", e.Hook.GetName(), err)
 	}
 
 	patches[utils.ConfigMapPatch], err = utils.ValuesPatchFromFile(e.ConfigValuesPatchPath)
 	if err != nil {
-		return nil, fmt.Errorf("got bad config values json patch from hook %s: %s", e.Hook.GetName(), err)
+		return nil, nil, fmt.Errorf("got bad config values json patch from hook %s: %s", e.Hook.GetName(), err)
 	}
 
 	patches[utils.MemoryValuesPatch], err = utils.ValuesPatchFromFile(e.ValuesPatchPath)
 	if err != nil {
-		return nil, fmt.Errorf("got bad values json patch from hook %s: %s", e.Hook.GetName(), err)
+		return nil, nil, fmt.Errorf("got bad values json patch from hook %s: %s", e.Hook.GetName(), err)
+	}
+
+	if e.MetricsPath != "" {
+		metrics, err = metrics_storage.MetricOperationsFromFile(e.MetricsPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("got bad metrics from hook %s: %s", e.Hook.GetName(), err)
+		}
+	}
+
+	if e.KubernetesPatchPath != "" {
+		e.KubernetesOperations, err = kube_patch.OperationsFromFile(e.KubernetesPatchPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("got bad kubernetes patch from hook %s: %s", e.Hook.GetName(), err)
+		}
 	}
 
-	return patches, nil
+	return patches, metrics, nil
 }
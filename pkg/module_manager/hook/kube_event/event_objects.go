@@ -0,0 +1,174 @@
+package kube_event
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/romana/rlog"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/flant/shell-operator/pkg/kube_events_manager"
+
+	"github.com/flant/addon-operator/pkg/module_manager"
+)
+
+// EventObjectWait is a max time to wait for the object of a kube event. The events manager and
+// the descriptor get informer notifications in different goroutines, so the object can be recorded
+// a bit later than the kube event is received.
+var EventObjectWait = time.Second
+
+// eventObject is an object from an informer notification for a kube event.
+type eventObject struct {
+	EventType string
+	Object    module_manager.ObjectAndFilterResult
+}
+
+// eventObjects keeps objects from informer notifications until kube events for them are handled.
+// Notifications are filtered like the events manager does: an event is sent only if the object
+// or the jqFilter result is changed.
+type eventObjects struct {
+	m    sync.Mutex
+	cond *sync.Cond
+	// queues are objects by object keys in the order of notifications.
+	queues map[string][]eventObject
+	// lastResults are objects or jqFilter results of the last notifications.
+	lastResults map[string]interface{}
+}
+
+func newEventObjects() *eventObjects {
+	e := &eventObjects{
+		queues:      make(map[string][]eventObject),
+		lastResults: make(map[string]interface{}),
+	}
+	e.cond = sync.NewCond(&e.m)
+	return e
+}
+
+// watchEvents records objects from notifications of the informer for kube events.
+// Objects listed on start are not recorded: events are not sent for them.
+func (desc *KubeEventHookDescriptor) watchEvents(informer cache.SharedInformer) {
+	desc.events = newEventObjects()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			desc.handleInformerEvent(string(kube_events_manager.KubernetesEventOnAdd), obj, informer.HasSynced())
+		},
+		UpdateFunc: func(_ interface{}, obj interface{}) {
+			desc.handleInformerEvent(string(kube_events_manager.KubernetesEventOnUpdate), obj, true)
+		},
+		DeleteFunc: func(obj interface{}) {
+			desc.handleInformerEvent(string(kube_events_manager.KubernetesEventOnDelete), obj, true)
+		},
+	})
+}
+
+// handleInformerEvent saves the object for the kube event. Deleted object is the last known state of the object.
+func (desc *KubeEventHookDescriptor) handleInformerEvent(eventType string, obj interface{}, record bool) {
+	// The events manager sends no event for an object with unknown final state.
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		desc.events.m.Lock()
+		delete(desc.events.lastResults, tombstone.Key)
+		desc.events.m.Unlock()
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		rlog.Errorf("MAIN: hook %s: informer event: %s", desc.HookName, err)
+		return
+	}
+
+	item, err := desc.makeObjectAndFilterResult(obj)
+	if err != nil {
+		rlog.Errorf("MAIN: hook %s: informer event: %s", desc.HookName, err)
+		return
+	}
+	result := item.Object
+	if desc.JqFilter != "" {
+		result = item.FilterResult
+	}
+
+	// Events of types that are not in the binding are not sent.
+	record = record && desc.hasEventType(eventType)
+
+	e := desc.events
+	e.m.Lock()
+	defer e.m.Unlock()
+	lastResult, has := e.lastResults[key]
+	var changed bool
+	if eventType == string(kube_events_manager.KubernetesEventOnDelete) {
+		changed = has
+		delete(e.lastResults, key)
+		desc.filterResultsLock.Lock()
+		delete(desc.filterResults, key)
+		desc.filterResultsLock.Unlock()
+	} else {
+		changed = !has || !reflect.DeepEqual(lastResult, result)
+		e.lastResults[key] = result
+	}
+	if !changed || !record {
+		return
+	}
+	e.queues[key] = append(e.queues[key], eventObject{EventType: eventType, Object: item})
+	e.cond.Broadcast()
+}
+
+func (desc *KubeEventHookDescriptor) hasEventType(eventType string) bool {
+	for _, t := range desc.EventTypes {
+		if string(t) == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// eventObject returns the object for the kube event. Objects for previous notifications without kube events
+// are skipped. The object from the informer cache is used if the object of the event is not recorded
+// in time, there is no object for a delete event in this case.
+func (desc *KubeEventHookDescriptor) eventObject(namespace, name string, eventType string) module_manager.ObjectAndFilterResult {
+	key := name
+	if namespace != "" {
+		key = namespace + "/" + name
+	}
+
+	if e := desc.events; e != nil {
+		deadline := time.Now().Add(EventObjectWait)
+		timer := time.AfterFunc(EventObjectWait, func() {
+			e.m.Lock()
+			e.cond.Broadcast()
+			e.m.Unlock()
+		})
+		defer timer.Stop()
+
+		e.m.Lock()
+		for {
+			queue := e.queues[key]
+			for i, item := range queue {
+				if item.EventType != eventType {
+					continue
+				}
+				if i+1 < len(queue) {
+					e.queues[key] = queue[i+1:]
+				} else {
+					delete(e.queues, key)
+				}
+				e.m.Unlock()
+				return item.Object
+			}
+			if !time.Now().Before(deadline) {
+				break
+			}
+			e.cond.Wait()
+		}
+		e.m.Unlock()
+		rlog.Warnf("MAIN: hook %s: no object for '%s' event of '%s', use the informer cache", desc.HookName, eventType, key)
+	}
+
+	if eventType == string(kube_events_manager.KubernetesEventOnDelete) {
+		return module_manager.ObjectAndFilterResult{}
+	}
+	object, _, err := desc.objectAndFilterResult(namespace, name)
+	if err != nil {
+		rlog.Errorf("MAIN: hook %s: get '%s' from informer cache: %s", desc.HookName, key, err)
+	}
+	return object
+}
@@ -2,6 +2,8 @@ package kube_event
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/flant/addon-operator/pkg/module_manager"
 	"github.com/flant/addon-operator/pkg/task"
@@ -9,18 +11,36 @@ import (
 	"github.com/flant/shell-operator/pkg/kube_events_manager"
 
 	"github.com/romana/rlog"
+	"k8s.io/client-go/tools/cache"
 )
 
+// KubeEventHookDescriptor is a KubeEventHook with a name of a queue for hook run tasks
+// and options to add objects from the informer cache to the binding context.
+type KubeEventHookDescriptor struct {
+	*kube_event.KubeEventHook
+	Queue            string
+	IncludeObject    bool
+	IncludeSnapshots bool
+	// Store is a cache of the informer. It is nil if the informer is not started by MainKubeEventsManager.
+	Store cache.Store
+
+	// events are objects from informer notifications for kube events.
+	events *eventObjects
+
+	filterResults     map[string]filterResultCache
+	filterResultsLock sync.Mutex
+}
+
 // MakeKubeEventHookDescriptors converts hook config into KubeEventHook structures
-func MakeKubeEventHookDescriptors(hook module_manager.Hook, hookConfig *module_manager.HookConfig) []*kube_event.KubeEventHook {
-	res := make([]*kube_event.KubeEventHook, 0)
+func MakeKubeEventHookDescriptors(hook module_manager.Hook, hookConfig *module_manager.HookConfig) []*KubeEventHookDescriptor {
+	res := make([]*KubeEventHookDescriptor, 0)
 
 	for _, config := range hookConfig.OnKubernetesEvent {
 		if config.NamespaceSelector.Any {
-			res = append(res, ConvertOnKubernetesEventToKubeEventHook(hook, config, ""))
+			res = append(res, newKubeEventHookDescriptor(hook, config, ""))
 		} else {
 			for _, namespace := range config.NamespaceSelector.MatchNames {
-				res = append(res, ConvertOnKubernetesEventToKubeEventHook(hook, config, namespace))
+				res = append(res, newKubeEventHookDescriptor(hook, config, namespace))
 			}
 		}
 	}
@@ -28,6 +48,16 @@ func MakeKubeEventHookDescriptors(hook module_manager.Hook, hookConfig *module_m
 	return res
 }
 
+func newKubeEventHookDescriptor(hook module_manager.Hook, config module_manager.OnKubernetesEventConfig, namespace string) *KubeEventHookDescriptor {
+	return &KubeEventHookDescriptor{
+		KubeEventHook:    ConvertOnKubernetesEventToKubeEventHook(hook, config.OnKubernetesEventConfig, namespace),
+		Queue:            config.Queue,
+		IncludeObject:    config.IncludeObject,
+		IncludeSnapshots: config.IncludeSnapshots,
+		filterResults:    make(map[string]filterResultCache),
+	}
+}
+
 func ConvertOnKubernetesEventToKubeEventHook(hook module_manager.Hook, config kube_events_manager.OnKubernetesEventConfig, namespace string) *kube_event.KubeEventHook {
 	return &kube_event.KubeEventHook{
 		HookName:     hook.GetName(),
@@ -46,20 +76,26 @@ type KubeEventsHooksController interface {
 	EnableGlobalHooks(moduleManager module_manager.ModuleManager, eventsManager kube_events_manager.KubeEventsManager) error
 	EnableModuleHooks(moduleName string, moduleManager module_manager.ModuleManager, eventsManager kube_events_manager.KubeEventsManager) error
 	DisableModuleHooks(moduleName string, moduleManager module_manager.ModuleManager, eventsManager kube_events_manager.KubeEventsManager) error
+	DisableGlobalHooks(eventsManager kube_events_manager.KubeEventsManager) error
+	DisableAllHooks(eventsManager kube_events_manager.KubeEventsManager) error
 	HandleEvent(kubeEvent kube_events_manager.KubeEvent) (*struct{ Tasks []task.Task }, error)
+	UpdateSnapshots(hookName string, bindingContext []module_manager.BindingContext) ([]module_manager.BindingContext, error)
 }
 
 type MainKubeEventsHooksController struct {
-	GlobalHooks    map[string]*kube_event.KubeEventHook
-	ModuleHooks    map[string]*kube_event.KubeEventHook
+	GlobalHooks    map[string]*KubeEventHookDescriptor
+	ModuleHooks    map[string]*KubeEventHookDescriptor
 	EnabledModules []string
+
+	// m protects maps of descriptors: snapshots are read by tasks of module queues.
+	m sync.RWMutex
 }
 
 // NewMainKubeEventsHooksController returns new instance of MainKubeEventsHooksController
 func NewMainKubeEventsHooksController() *MainKubeEventsHooksController {
 	obj := &MainKubeEventsHooksController{}
-	obj.GlobalHooks = make(map[string]*kube_event.KubeEventHook)
-	obj.ModuleHooks = make(map[string]*kube_event.KubeEventHook)
+	obj.GlobalHooks = make(map[string]*KubeEventHookDescriptor)
+	obj.ModuleHooks = make(map[string]*KubeEventHookDescriptor)
 	obj.EnabledModules = make([]string, 0)
 	return obj
 }
@@ -76,7 +112,10 @@ func (obj *MainKubeEventsHooksController) EnableGlobalHooks(moduleManager module
 			if err != nil {
 				return err
 			}
+			desc.watchInformer(eventsManager, configId)
+			obj.m.Lock()
 			obj.GlobalHooks[configId] = desc
+			obj.m.Unlock()
 
 			rlog.Debugf("MAIN: run informer %s for global hook %s", configId, globalHook.Name)
 		}
@@ -107,7 +146,10 @@ func (obj *MainKubeEventsHooksController) EnableModuleHooks(moduleName string, m
 			if err != nil {
 				return err
 			}
+			desc.watchInformer(eventsManager, configId)
+			obj.m.Lock()
 			obj.ModuleHooks[configId] = desc
+			obj.m.Unlock()
 
 			rlog.Debugf("MAIN: run informer %s for module hook %s", configId, moduleHook.Name)
 		}
@@ -120,6 +162,9 @@ func (obj *MainKubeEventsHooksController) EnableModuleHooks(moduleName string, m
 
 // DisableModuleHooks stops informers for module hooks
 func (obj *MainKubeEventsHooksController) DisableModuleHooks(moduleName string, moduleManager module_manager.ModuleManager, eventsManager kube_events_manager.KubeEventsManager) error {
+	obj.m.Lock()
+	defer obj.m.Unlock()
+
 	moduleEnabledInd := -1
 	for i, enabledModuleName := range obj.EnabledModules {
 		if enabledModuleName == moduleName {
@@ -155,12 +200,48 @@ func (obj *MainKubeEventsHooksController) DisableModuleHooks(moduleName string,
 	return nil
 }
 
+// DisableGlobalHooks stops informers for all global hooks
+func (obj *MainKubeEventsHooksController) DisableGlobalHooks(eventsManager kube_events_manager.KubeEventsManager) error {
+	obj.m.Lock()
+	defer obj.m.Unlock()
+
+	for configId := range obj.GlobalHooks {
+		err := eventsManager.Stop(configId)
+		if err != nil {
+			return err
+		}
+		delete(obj.GlobalHooks, configId)
+	}
+
+	return nil
+}
+
+// DisableAllHooks stops informers for all global and module hooks
+func (obj *MainKubeEventsHooksController) DisableAllHooks(eventsManager kube_events_manager.KubeEventsManager) error {
+	obj.m.Lock()
+	defer obj.m.Unlock()
+
+	for _, hooks := range []map[string]*KubeEventHookDescriptor{obj.GlobalHooks, obj.ModuleHooks} {
+		for configId := range hooks {
+			err := eventsManager.Stop(configId)
+			if err != nil {
+				return err
+			}
+			delete(hooks, configId)
+		}
+	}
+	obj.EnabledModules = make([]string, 0)
+
+	return nil
+}
+
 // HandleEvent creates a task from kube event
 func (obj *MainKubeEventsHooksController) HandleEvent(kubeEvent kube_events_manager.KubeEvent) (*struct{ Tasks []task.Task }, error) {
 	res := &struct{ Tasks []task.Task }{Tasks: make([]task.Task, 0)}
-	var desc *kube_event.KubeEventHook
+	var desc *KubeEventHookDescriptor
 	var taskType task.TaskType
 
+	obj.m.RLock()
 	if moduleDesc, hasKey := obj.ModuleHooks[kubeEvent.ConfigId]; hasKey {
 		desc = moduleDesc
 		taskType = task.ModuleHookRun
@@ -168,28 +249,35 @@ func (obj *MainKubeEventsHooksController) HandleEvent(kubeEvent kube_events_mana
 		desc = globalDesc
 		taskType = task.GlobalHookRun
 	}
+	// Descriptors are not locked while the event object is waited for.
+	obj.m.RUnlock()
 
 	if desc != nil && taskType != "" {
-		bindingName := desc.Name
-		if desc.Name == "" {
-			bindingName = module_manager.ContextBindingType[module_manager.KubeEvents]
-		}
+		bindingName := descBindingName(desc)
 
 		bindingContext := make([]module_manager.BindingContext, 0)
 		for _, kEvent := range kubeEvent.Events {
+			// Each event has the object from its informer notification, the last known state for a delete event.
+			var object module_manager.ObjectAndFilterResult
+			if desc.IncludeObject {
+				object = desc.eventObject(kubeEvent.Namespace, kubeEvent.Name, kEvent)
+			}
 			bindingContext = append(bindingContext, module_manager.BindingContext{
 				Binding:           bindingName,
 				ResourceEvent:     kEvent,
 				ResourceNamespace: kubeEvent.Namespace,
 				ResourceKind:      kubeEvent.Kind,
 				ResourceName:      kubeEvent.Name,
+				Object:            object.Object,
+				FilterResult:      object.FilterResult,
 			})
 		}
 
 		newTask := task.NewTask(taskType, desc.HookName).
 			WithBinding(module_manager.KubeEvents).
 			WithBindingContext(bindingContext).
-			WithAllowFailure(desc.Config.AllowFailure)
+			WithAllowFailure(desc.Config.AllowFailure).
+			WithQueueName(desc.Queue)
 
 		res.Tasks = append(res.Tasks, newTask)
 	} else {
@@ -198,3 +286,57 @@ func (obj *MainKubeEventsHooksController) HandleEvent(kubeEvent kube_events_mana
 
 	return res, nil
 }
+
+// UpdateSnapshots sets snapshots for binding contexts of onKubernetesEvent bindings with
+// includeSnapshots. Snapshots are the current objects from informers of all onKubernetesEvent
+// bindings of the hook, so they are updated right before the hook run and not when the event is queued.
+func (obj *MainKubeEventsHooksController) UpdateSnapshots(hookName string, bindingContext []module_manager.BindingContext) ([]module_manager.BindingContext, error) {
+	obj.m.RLock()
+	defer obj.m.RUnlock()
+
+	descs := make([]*KubeEventHookDescriptor, 0)
+	includeSnapshots := make(map[string]bool)
+	for _, hooks := range []map[string]*KubeEventHookDescriptor{obj.GlobalHooks, obj.ModuleHooks} {
+		for _, desc := range hooks {
+			if desc.HookName != hookName {
+				continue
+			}
+			descs = append(descs, desc)
+			if desc.IncludeSnapshots {
+				includeSnapshots[descBindingName(desc)] = true
+			}
+		}
+	}
+	if len(includeSnapshots) == 0 {
+		return bindingContext, nil
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		return descs[i].Namespace < descs[j].Namespace
+	})
+
+	snapshots := make(map[string][]module_manager.ObjectAndFilterResult)
+	for _, desc := range descs {
+		snapshot, err := desc.snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("snapshot of binding '%s': %s", descBindingName(desc), err)
+		}
+		// Bindings with several namespaces have an informer for each namespace.
+		snapshots[descBindingName(desc)] = append(snapshots[descBindingName(desc)], snapshot...)
+	}
+
+	res := make([]module_manager.BindingContext, 0, len(bindingContext))
+	for _, context := range bindingContext {
+		if includeSnapshots[context.Binding] {
+			context.Snapshots = snapshots
+		}
+		res = append(res, context)
+	}
+	return res, nil
+}
+
+func descBindingName(desc *KubeEventHookDescriptor) string {
+	if desc.Name == "" {
+		return module_manager.ContextBindingType[module_manager.KubeEvents]
+	}
+	return desc.Name
+}
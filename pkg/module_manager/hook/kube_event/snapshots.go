@@ -0,0 +1,179 @@
+package kube_event
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/flant/shell-operator/pkg/kube_events_manager"
+
+	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/executor"
+	"github.com/flant/addon-operator/pkg/module_manager"
+)
+
+// filterResultCache is a jqFilter result for a version of the object. Objects are
+// filtered again only if they are changed.
+type filterResultCache struct {
+	ResourceVersion string
+	FilterResult    interface{}
+}
+
+// watchInformer sets the cache of the informer started by the events manager and records objects
+// for kube events if the binding includes objects. Other implementations of KubeEventsManager have no informers.
+func (desc *KubeEventHookDescriptor) watchInformer(eventsManager kube_events_manager.KubeEventsManager, configId string) {
+	em, ok := eventsManager.(*kube_events_manager.MainKubeEventsManager)
+	if !ok {
+		return
+	}
+	informer, has := em.KubeEventsInformersByConfigId[configId]
+	if !has || informer.SharedInformer == nil {
+		return
+	}
+	desc.Store = informer.SharedInformer.GetStore()
+	if desc.IncludeObject {
+		desc.watchEvents(informer.SharedInformer)
+	}
+}
+
+// objectAndFilterResult returns the object from the informer cache: the whole object if
+// the binding has no jqFilter or the jqFilter result. ok is false if the object is not in the cache.
+// It is used if the object of a kube event is not recorded.
+func (desc *KubeEventHookDescriptor) objectAndFilterResult(namespace, name string) (res module_manager.ObjectAndFilterResult, ok bool, err error) {
+	if desc.Store == nil {
+		return res, false, nil
+	}
+	key := name
+	if namespace != "" {
+		key = namespace + "/" + name
+	}
+	obj, has, err := desc.Store.GetByKey(key)
+	if err != nil {
+		return res, false, err
+	}
+	if !has {
+		desc.filterResultsLock.Lock()
+		delete(desc.filterResults, key)
+		desc.filterResultsLock.Unlock()
+		return res, false, nil
+	}
+	res, err = desc.makeObjectAndFilterResult(obj)
+	return res, err == nil, err
+}
+
+// snapshot returns all objects from the informer cache sorted by namespace and name.
+func (desc *KubeEventHookDescriptor) snapshot() ([]module_manager.ObjectAndFilterResult, error) {
+	res := make([]module_manager.ObjectAndFilterResult, 0)
+	if desc.Store == nil {
+		return res, nil
+	}
+
+	objs := desc.Store.List()
+	keys := make([]string, len(objs))
+	for i, obj := range objs {
+		keys[i], _ = cache.MetaNamespaceKeyFunc(obj)
+	}
+	sort.Sort(byKey{keys: keys, objs: objs})
+
+	actual := make(map[string]bool)
+	for i, obj := range objs {
+		item, err := desc.makeObjectAndFilterResult(obj)
+		if err != nil {
+			return nil, err
+		}
+		actual[keys[i]] = true
+		res = append(res, item)
+	}
+
+	// Forget filter results of deleted objects.
+	desc.filterResultsLock.Lock()
+	for key := range desc.filterResults {
+		if !actual[key] {
+			delete(desc.filterResults, key)
+		}
+	}
+	desc.filterResultsLock.Unlock()
+
+	return res, nil
+}
+
+func (desc *KubeEventHookDescriptor) makeObjectAndFilterResult(obj interface{}) (res module_manager.ObjectAndFilterResult, err error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return res, err
+	}
+	content := obj
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		content = u.Object
+	}
+	if desc.JqFilter == "" {
+		res.Object = content
+		return res, nil
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return res, err
+	}
+
+	desc.filterResultsLock.Lock()
+	cached, has := desc.filterResults[key]
+	desc.filterResultsLock.Unlock()
+	if has && cached.ResourceVersion == accessor.GetResourceVersion() {
+		res.FilterResult = cached.FilterResult
+		return res, nil
+	}
+
+	res.FilterResult, err = applyJqFilter(desc.JqFilter, content)
+	if err != nil {
+		return res, fmt.Errorf("object '%s': %s", key, err)
+	}
+
+	desc.filterResultsLock.Lock()
+	desc.filterResults[key] = filterResultCache{ResourceVersion: accessor.GetResourceVersion(), FilterResult: res.FilterResult}
+	desc.filterResultsLock.Unlock()
+
+	return res, nil
+}
+
+// applyJqFilter runs jq with the object on stdin like the informer does to calculate checksums.
+func applyJqFilter(jqFilter string, obj interface{}) (interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("jq", jqFilter)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := executor.OutputWithTimeout(cmd, app.HookTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("jqFilter '%s' failed: %s: %s", jqFilter, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var res interface{}
+	if err := json.Unmarshal(output, &res); err != nil {
+		return nil, fmt.Errorf("jqFilter '%s' result is not a JSON: %s", jqFilter, err)
+	}
+	return res, nil
+}
+
+type byKey struct {
+	keys []string
+	objs []interface{}
+}
+
+func (s byKey) Len() int           { return len(s.keys) }
+func (s byKey) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s byKey) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.objs[i], s.objs[j] = s.objs[j], s.objs[i]
+}
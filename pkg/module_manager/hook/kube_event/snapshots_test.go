@@ -0,0 +1,141 @@
+package kube_event
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+
+	shell_kube_event "github.com/flant/shell-operator/pkg/hook/kube_event"
+	"github.com/flant/shell-operator/pkg/kube_events_manager"
+
+	"github.com/flant/addon-operator/pkg/module_manager"
+)
+
+func newPod(namespace, name, node string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"namespace":       namespace,
+			"name":            name,
+			"resourceVersion": "1",
+		},
+		"spec": map[string]interface{}{"nodeName": node},
+	}}
+}
+
+func Test_MainKubeEventsHooksController_Snapshots(t *testing.T) {
+	pods := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	_ = pods.Add(newPod("ns", "b", "node-2"))
+	_ = pods.Add(newPod("ns", "a", "node-1"))
+	nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	_ = nodes.Add(newPod("", "node-1", ""))
+
+	newDesc := func(name string, jqFilter string, store cache.Store) *KubeEventHookDescriptor {
+		return &KubeEventHookDescriptor{
+			KubeEventHook:    &shell_kube_event.KubeEventHook{HookName: "hook", Name: name, JqFilter: jqFilter},
+			IncludeObject:    true,
+			IncludeSnapshots: name == "pods",
+			Store:            store,
+			filterResults:    make(map[string]filterResultCache),
+		}
+	}
+
+	obj := NewMainKubeEventsHooksController()
+	obj.GlobalHooks["pods-id"] = newDesc("pods", ".spec.nodeName", pods)
+	obj.GlobalHooks["nodes-id"] = newDesc("nodes", "", nodes)
+
+	res, err := obj.HandleEvent(kube_events_manager.KubeEvent{ConfigId: "pods-id", Events: []string{"update"}, Namespace: "ns", Name: "a", Kind: "Pod"})
+	if !assert.NoError(t, err) || !assert.Len(t, res.Tasks, 1) {
+		return
+	}
+	bindingContext := res.Tasks[0].GetBindingContext()
+	assert.Equal(t, "node-1", bindingContext[0].FilterResult)
+	assert.Nil(t, bindingContext[0].Object)
+
+	// Object is not in the cache after delete.
+	res, err = obj.HandleEvent(kube_events_manager.KubeEvent{ConfigId: "nodes-id", Events: []string{"delete"}, Name: "node-2", Kind: "Node"})
+	if assert.NoError(t, err) {
+		assert.Nil(t, res.Tasks[0].GetBindingContext()[0].Object)
+	}
+
+	bindingContext, err = obj.UpdateSnapshots("hook", append(bindingContext, module_manager.BindingContext{Binding: "nodes"}))
+	if assert.NoError(t, err) {
+		snapshots := bindingContext[0].Snapshots
+		assert.Equal(t, []module_manager.ObjectAndFilterResult{{FilterResult: "node-1"}, {FilterResult: "node-2"}}, snapshots["pods"])
+		if assert.Len(t, snapshots["nodes"], 1) {
+			assert.Equal(t, "node-1", snapshots["nodes"][0].Object.(map[string]interface{})["metadata"].(map[string]interface{})["name"])
+		}
+		// Binding without includeSnapshots.
+		assert.Nil(t, bindingContext[1].Snapshots)
+	}
+}
+
+func Test_MainKubeEventsHooksController_EventObjects(t *testing.T) {
+	EventObjectWait = 100 * time.Millisecond
+	pods := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	_ = pods.Add(newPod("ns", "a", "node-1"))
+	_ = pods.Add(newPod("ns", "b", "node-2"))
+
+	desc := &KubeEventHookDescriptor{
+		KubeEventHook: &shell_kube_event.KubeEventHook{
+			HookName: "hook",
+			Name:     "pods",
+			JqFilter: ".spec.nodeName",
+			EventTypes: []kube_events_manager.OnKubernetesEventType{
+				kube_events_manager.KubernetesEventOnAdd,
+				kube_events_manager.KubernetesEventOnUpdate,
+				kube_events_manager.KubernetesEventOnDelete,
+			},
+		},
+		IncludeObject: true,
+		Store:         pods,
+		filterResults: make(map[string]filterResultCache),
+		events:        newEventObjects(),
+	}
+	obj := NewMainKubeEventsHooksController()
+	obj.GlobalHooks["pods-id"] = desc
+
+	podVersion := func(node string, version string) *unstructured.Unstructured {
+		pod := newPod("ns", "a", node)
+		pod.SetResourceVersion(version)
+		return pod
+	}
+	// Object listed on start and an update without changes of the jqFilter result have no events.
+	desc.handleInformerEvent("add", podVersion("node-1", "1"), false)
+	desc.handleInformerEvent("update", podVersion("node-1", "2"), true)
+	desc.handleInformerEvent("update", podVersion("node-3", "3"), true)
+	desc.handleInformerEvent("update", podVersion("node-4", "4"), true)
+	desc.handleInformerEvent("delete", podVersion("node-4", "4"), true)
+
+	// Each event has its own object, the delete event has the last known state. The cache is not used.
+	res, err := obj.HandleEvent(kube_events_manager.KubeEvent{ConfigId: "pods-id", Events: []string{"update", "update", "delete"}, Namespace: "ns", Name: "a", Kind: "Pod"})
+	if assert.NoError(t, err) && assert.Len(t, res.Tasks, 1) {
+		bindingContext := res.Tasks[0].GetBindingContext()
+		if assert.Len(t, bindingContext, 3) {
+			assert.Equal(t, "node-3", bindingContext[0].FilterResult)
+			assert.Equal(t, "node-4", bindingContext[1].FilterResult)
+			assert.Equal(t, "delete", bindingContext[2].ResourceEvent)
+			assert.Equal(t, "node-4", bindingContext[2].FilterResult)
+		}
+	}
+
+	// Object from the cache is used if the object of the event is not recorded.
+	res, err = obj.HandleEvent(kube_events_manager.KubeEvent{ConfigId: "pods-id", Events: []string{"update"}, Namespace: "ns", Name: "b", Kind: "Pod"})
+	if assert.NoError(t, err) && assert.Len(t, res.Tasks, 1) {
+		assert.Equal(t, "node-2", res.Tasks[0].GetBindingContext()[0].FilterResult)
+	}
+
+	// Object recorded after the event is received.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		desc.handleInformerEvent("add", podVersion("node-5", "5"), true)
+	}()
+	res, err = obj.HandleEvent(kube_events_manager.KubeEvent{ConfigId: "pods-id", Events: []string{"add"}, Namespace: "ns", Name: "a", Kind: "Pod"})
+	if assert.NoError(t, err) && assert.Len(t, res.Tasks, 1) {
+		assert.Equal(t, "node-5", res.Tasks[0].GetBindingContext()[0].FilterResult)
+	}
+}
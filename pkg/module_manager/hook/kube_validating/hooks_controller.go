@@ -0,0 +1,438 @@
+package kube_validating
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/romana/rlog"
+	admission "k8s.io/api/admission/v1beta1"
+	admissionregistration "k8s.io/api/admissionregistration/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/logger"
+	"github.com/flant/addon-operator/pkg/module_manager"
+)
+
+// WebhookPathPrefix is a prefix for paths of webhooks in the ValidatingWebhookConfiguration.
+const WebhookPathPrefix = "/validate/"
+
+// LeaderLabel is set to "true" on the Pod of the leader while the webhook server is started.
+// Only the leader has enabled hooks and their values, so with leader election the Service
+// of the webhook server should select Pods with this label.
+const LeaderLabel = "addon-operator.flant.com/validating-webhook-leader"
+
+// ValidatingHook is a global or a module hook with kubernetesValidating bindings.
+type ValidatingHook interface {
+	GetName() string
+	RunValidating(bindingName string, review *admission.AdmissionReview, logLabels map[string]string) (*module_manager.ValidatingResponse, error)
+}
+
+// ValidatingHookDescriptor is a webhook for a kubernetesValidating binding of a hook.
+type ValidatingHookDescriptor struct {
+	Hook ValidatingHook
+	// ModuleName is empty for global hooks.
+	ModuleName string
+	Config     module_manager.KubernetesValidatingConfig
+}
+
+type ValidatingHooksController interface {
+	Start(client kubernetes.Interface, certDir string, listenAddress string, listenPort string) (<-chan error, error)
+	Stop() error
+	DeleteConfiguration() error
+	EnableGlobalHooks(moduleManager module_manager.ModuleManager) error
+	EnableModuleHooks(moduleName string, moduleManager module_manager.ModuleManager) error
+	DisableModuleHooks(moduleName string) error
+	DisableGlobalHooks() error
+	ServeHTTP(writer http.ResponseWriter, request *http.Request)
+}
+
+// MainValidatingHooksController runs hooks on admission requests. Webhooks of all hooks are
+// in one ValidatingWebhookConfiguration that points to the Service of the operator.
+type MainValidatingHooksController struct {
+	// Hooks are descriptors by webhook names.
+	Hooks map[string]*ValidatingHookDescriptor
+
+	Namespace         string
+	ServiceName       string
+	ConfigurationName string
+	// PodName is a Pod to set LeaderLabel. The label is not set if empty.
+	PodName string
+	// Client is nil until the server is started. Bindings are ignored without the server.
+	Client   kubernetes.Interface
+	CABundle []byte
+
+	listener net.Listener
+	stopCh   chan struct{}
+
+	// applied are webhooks in the cluster. The configuration is not updated if webhooks are the same.
+	// It is reset on Start: another leader could change the configuration in the meantime.
+	applied []admissionregistration.Webhook
+
+	// m protects Hooks: requests are handled concurrently with the main loop.
+	m sync.RWMutex
+}
+
+// NewMainValidatingHooksController returns new instance of MainValidatingHooksController
+func NewMainValidatingHooksController(namespace string, serviceName string, configurationName string) *MainValidatingHooksController {
+	return &MainValidatingHooksController{
+		Hooks:             make(map[string]*ValidatingHookDescriptor),
+		Namespace:         namespace,
+		ServiceName:       serviceName,
+		ConfigurationName: configurationName,
+	}
+}
+
+// WithPodName sets a Pod to label with LeaderLabel while the server is started.
+func (obj *MainValidatingHooksController) WithPodName(podName string) *MainValidatingHooksController {
+	obj.PodName = podName
+	return obj
+}
+
+// Start starts the HTTPS server with tls.crt and tls.key from certDir. ca.crt from certDir
+// is used in the ValidatingWebhookConfiguration. An error of the server is sent to the returned
+// channel, the channel is closed without an error after Stop.
+func (obj *MainValidatingHooksController) Start(client kubernetes.Interface, certDir string, listenAddress string, listenPort string) (<-chan error, error) {
+	caBundle, err := ioutil.ReadFile(filepath.Join(certDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certDir, "tls.crt"), filepath.Join(certDir, "tls.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	address := fmt.Sprintf("%s:%s", listenAddress, listenPort)
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	rlog.Infof("VALIDATING: webhook server listening on %s", address)
+
+	stopCh := make(chan struct{})
+	serveErr := make(chan error, 1)
+	go func() {
+		defer close(serveErr)
+		err := http.Serve(tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}}), obj)
+		select {
+		case <-stopCh:
+		default:
+			serveErr <- fmt.Errorf("validating webhook server: %s", err)
+		}
+	}()
+
+	obj.m.Lock()
+	obj.Client = client
+	obj.CABundle = caBundle
+	obj.listener = ln
+	obj.stopCh = stopCh
+	obj.applied = nil
+	obj.m.Unlock()
+
+	if obj.PodName != "" {
+		if err := SetLeaderLabel(client, obj.Namespace, obj.PodName, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return serveErr, nil
+}
+
+// Stop removes LeaderLabel and stops the server. The ValidatingWebhookConfiguration is kept:
+// on the lease loss the Service selects the new leader that updates the configuration.
+func (obj *MainValidatingHooksController) Stop() error {
+	obj.m.Lock()
+	obj.Hooks = make(map[string]*ValidatingHookDescriptor)
+	client, ln, stopCh := obj.Client, obj.listener, obj.stopCh
+	obj.listener, obj.stopCh = nil, nil
+	obj.m.Unlock()
+
+	if client == nil {
+		return nil
+	}
+
+	errs := make([]string, 0)
+	if obj.PodName != "" {
+		if err := SetLeaderLabel(client, obj.Namespace, obj.PodName, false); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if ln != nil {
+		close(stopCh)
+		if err := ln.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// DeleteConfiguration deletes the ValidatingWebhookConfiguration, so the API server
+// does not send requests when there is no server to handle them.
+func (obj *MainValidatingHooksController) DeleteConfiguration() error {
+	obj.m.RLock()
+	client := obj.Client
+	obj.m.RUnlock()
+
+	if client == nil {
+		return nil
+	}
+
+	err := client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Delete(obj.ConfigurationName, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("delete ValidatingWebhookConfiguration '%s': %s", obj.ConfigurationName, err)
+	}
+	obj.applied = nil
+	return nil
+}
+
+// SetLeaderLabel adds LeaderLabel to the Pod or removes it.
+func SetLeaderLabel(client kubernetes.Interface, namespace string, podName string, isLeader bool) error {
+	pods := client.CoreV1().Pods(namespace)
+	pod, err := pods.Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get Pod '%s': %s", podName, err)
+	}
+	if _, has := pod.Labels[LeaderLabel]; has == isLeader {
+		return nil
+	}
+	if isLeader {
+		if pod.Labels == nil {
+			pod.Labels = make(map[string]string)
+		}
+		pod.Labels[LeaderLabel] = "true"
+	} else {
+		delete(pod.Labels, LeaderLabel)
+	}
+	if _, err := pods.Update(pod); err != nil {
+		return fmt.Errorf("set label '%s' of Pod '%s': %s", LeaderLabel, podName, err)
+	}
+	return nil
+}
+
+// EnableGlobalHooks adds webhooks for all global hooks
+func (obj *MainValidatingHooksController) EnableGlobalHooks(moduleManager module_manager.ModuleManager) error {
+	for _, globalHookName := range moduleManager.GetGlobalHooksInOrder(module_manager.KubernetesValidating) {
+		globalHook, _ := moduleManager.GetGlobalHook(globalHookName)
+		obj.addHook(globalHook, "", globalHook.Config.KubernetesValidating)
+	}
+	return obj.updateConfiguration()
+}
+
+// EnableModuleHooks adds webhooks for all module hooks
+func (obj *MainValidatingHooksController) EnableModuleHooks(moduleName string, moduleManager module_manager.ModuleManager) error {
+	moduleHooks, err := moduleManager.GetModuleHooksInOrder(moduleName, module_manager.KubernetesValidating)
+	if err != nil {
+		return err
+	}
+	for _, moduleHookName := range moduleHooks {
+		moduleHook, _ := moduleManager.GetModuleHook(moduleHookName)
+		obj.addHook(moduleHook, moduleName, moduleHook.Config.KubernetesValidating)
+	}
+	return obj.updateConfiguration()
+}
+
+// DisableModuleHooks removes webhooks of module hooks
+func (obj *MainValidatingHooksController) DisableModuleHooks(moduleName string) error {
+	return obj.removeHooks(moduleName)
+}
+
+// DisableGlobalHooks removes webhooks of all global hooks
+func (obj *MainValidatingHooksController) DisableGlobalHooks() error {
+	return obj.removeHooks("")
+}
+
+func (obj *MainValidatingHooksController) addHook(hook ValidatingHook, moduleName string, configs []module_manager.KubernetesValidatingConfig) {
+	obj.m.Lock()
+	defer obj.m.Unlock()
+
+	if obj.Client == nil {
+		if len(configs) > 0 {
+			rlog.Warnf("VALIDATING: kubernetesValidating bindings of hook '%s' are ignored: webhook server is not started", hook.GetName())
+		}
+		return
+	}
+
+	for _, config := range configs {
+		name := WebhookName(hook.GetName(), config.Name)
+		obj.Hooks[name] = &ValidatingHookDescriptor{
+			Hook:       hook,
+			ModuleName: moduleName,
+			Config:     config,
+		}
+		rlog.Debugf("VALIDATING: add webhook %s for hook %s", name, hook.GetName())
+	}
+}
+
+func (obj *MainValidatingHooksController) removeHooks(moduleName string) error {
+	obj.m.Lock()
+	removed := false
+	for name, desc := range obj.Hooks {
+		if desc.ModuleName == moduleName {
+			delete(obj.Hooks, name)
+			removed = true
+		}
+	}
+	obj.m.Unlock()
+
+	if !removed {
+		return nil
+	}
+	return obj.updateConfiguration()
+}
+
+// updateConfiguration creates, updates or deletes the ValidatingWebhookConfiguration with webhooks of enabled hooks.
+func (obj *MainValidatingHooksController) updateConfiguration() error {
+	obj.m.RLock()
+	if obj.Client == nil {
+		obj.m.RUnlock()
+		return nil
+	}
+	configuration := obj.makeConfiguration()
+	obj.m.RUnlock()
+
+	if obj.applied != nil && reflect.DeepEqual(obj.applied, configuration.Webhooks) {
+		return nil
+	}
+
+	configurations := obj.Client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations()
+
+	if len(configuration.Webhooks) == 0 {
+		err := configurations.Delete(configuration.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("delete ValidatingWebhookConfiguration '%s': %s", configuration.Name, err)
+		}
+		obj.applied = configuration.Webhooks
+		return nil
+	}
+
+	_, err := configurations.Create(configuration)
+	if errors.IsAlreadyExists(err) {
+		var existing *admissionregistration.ValidatingWebhookConfiguration
+		existing, err = configurations.Get(configuration.Name, metav1.GetOptions{})
+		if err == nil {
+			configuration.ResourceVersion = existing.ResourceVersion
+			_, err = configurations.Update(configuration)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("update ValidatingWebhookConfiguration '%s': %s", configuration.Name, err)
+	}
+	obj.applied = configuration.Webhooks
+	rlog.Infof("VALIDATING: ValidatingWebhookConfiguration '%s' is updated, %d webhooks", configuration.Name, len(configuration.Webhooks))
+	return nil
+}
+
+func (obj *MainValidatingHooksController) makeConfiguration() *admissionregistration.ValidatingWebhookConfiguration {
+	names := make([]string, 0, len(obj.Hooks))
+	for name := range obj.Hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The API server waits 30 seconds at most.
+	timeoutSeconds := int32(app.ValidatingHookTimeout.Seconds()) + 1
+	if timeoutSeconds > 30 {
+		timeoutSeconds = 30
+	}
+
+	webhooks := make([]admissionregistration.Webhook, 0, len(names))
+	for _, name := range names {
+		desc := obj.Hooks[name]
+		path := WebhookPathPrefix + name
+		webhooks = append(webhooks, admissionregistration.Webhook{
+			Name: name,
+			ClientConfig: admissionregistration.WebhookClientConfig{
+				Service: &admissionregistration.ServiceReference{
+					Namespace: obj.Namespace,
+					Name:      obj.ServiceName,
+					Path:      &path,
+				},
+				CABundle: obj.CABundle,
+			},
+			Rules:             desc.Config.Rules,
+			FailurePolicy:     desc.Config.FailurePolicy,
+			NamespaceSelector: desc.Config.NamespaceSelector,
+			TimeoutSeconds:    &timeoutSeconds,
+		})
+	}
+
+	return &admissionregistration.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: obj.ConfigurationName},
+		Webhooks:   webhooks,
+	}
+}
+
+// ServeHTTP runs the hook for the AdmissionReview in the request. Hook errors are returned
+// with the 500 status, so the API server uses the failurePolicy of the webhook.
+func (obj *MainValidatingHooksController) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "POST is expected", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(request.URL.Path, WebhookPathPrefix)
+	obj.m.RLock()
+	desc, has := obj.Hooks[name]
+	obj.m.RUnlock()
+	if !has {
+		http.Error(writer, fmt.Sprintf("webhook '%s' is not found", name), http.StatusNotFound)
+		return
+	}
+
+	review := &admission.AdmissionReview{}
+	if err := json.NewDecoder(request.Body).Decode(review); err != nil || review.Request == nil {
+		http.Error(writer, "AdmissionReview with a request is expected", http.StatusBadRequest)
+		return
+	}
+
+	logLabels := map[string]string{logger.EventIDField: string(review.Request.UID)}
+	res, err := desc.Hook.RunValidating(desc.Config.Name, review, logLabels)
+	if err != nil {
+		rlog.Errorf("VALIDATING: webhook %s: %s", name, err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := &admission.AdmissionReview{
+		TypeMeta: review.TypeMeta,
+		Response: &admission.AdmissionResponse{
+			UID:     review.Request.UID,
+			Allowed: res.Allowed,
+		},
+	}
+	if res.Message != "" {
+		response.Response.Result = &metav1.Status{Message: res.Message}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(response)
+}
+
+var notDNSLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// WebhookName returns a name like 'binding.002-module-hooks-policy.addon-operator.flant.com'.
+// Webhook names should be unique in the configuration and should be fully qualified.
+func WebhookName(hookName string, bindingName string) string {
+	hookID := notDNSLabelChars.ReplaceAllString(strings.ToLower(hookName), "-")
+	if len(hookID) > 63 {
+		hookID = hookID[len(hookID)-63:]
+	}
+	hookID = strings.Trim(hookID, "-")
+	return fmt.Sprintf("%s.%s.addon-operator.flant.com", bindingName, hookID)
+}
@@ -0,0 +1,157 @@
+package kube_validating
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admission "k8s.io/api/admission/v1beta1"
+	admissionregistration "k8s.io/api/admissionregistration/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/flant/addon-operator/pkg/module_manager"
+)
+
+type testValidatingHook struct {
+	name string
+	run  func(bindingName string, review *admission.AdmissionReview) (*module_manager.ValidatingResponse, error)
+}
+
+func (h *testValidatingHook) GetName() string {
+	return h.name
+}
+
+func (h *testValidatingHook) RunValidating(bindingName string, review *admission.AdmissionReview, logLabels map[string]string) (*module_manager.ValidatingResponse, error) {
+	return h.run(bindingName, review)
+}
+
+func Test_WebhookName(t *testing.T) {
+	assert.Equal(t, "tls.002-module-hooks-ingress-policy.addon-operator.flant.com", WebhookName("002-module/hooks/ingress_policy", "tls"))
+}
+
+func Test_MainValidatingHooksController(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	obj := NewMainValidatingHooksController("addon-operator", "webhook", "addon-operator-hooks")
+
+	hook := &testValidatingHook{
+		name: "002-module/hooks/policy",
+		run: func(bindingName string, review *admission.AdmissionReview) (*module_manager.ValidatingResponse, error) {
+			if review.Request.Name == "broken" {
+				return nil, fmt.Errorf("hook failed")
+			}
+			return &module_manager.ValidatingResponse{Allowed: review.Request.Name == "good", Message: bindingName}, nil
+		},
+	}
+	configs := []module_manager.KubernetesValidatingConfig{{
+		Name: "tls",
+		Rules: []admissionregistration.RuleWithOperations{{
+			Operations: []admissionregistration.OperationType{admissionregistration.Create},
+			Rule: admissionregistration.Rule{
+				APIGroups:   []string{"networking.k8s.io"},
+				APIVersions: []string{"v1beta1"},
+				Resources:   []string{"ingresses"},
+			},
+		}},
+	}}
+
+	// Bindings are ignored without the server.
+	obj.addHook(hook, "module", configs)
+	assert.Len(t, obj.Hooks, 0)
+
+	obj.Client = client
+	obj.addHook(hook, "module", configs)
+	if !assert.NoError(t, obj.updateConfiguration()) {
+		return
+	}
+	configuration, err := client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Get("addon-operator-hooks", metav1.GetOptions{})
+	if assert.NoError(t, err) && assert.Len(t, configuration.Webhooks, 1) {
+		webhook := configuration.Webhooks[0]
+		assert.Equal(t, "tls.002-module-hooks-policy.addon-operator.flant.com", webhook.Name)
+		assert.Equal(t, "/validate/tls.002-module-hooks-policy.addon-operator.flant.com", *webhook.ClientConfig.Service.Path)
+		assert.Equal(t, "webhook", webhook.ClientConfig.Service.Name)
+	}
+
+	server := httptest.NewServer(obj)
+	defer server.Close()
+	review := func(path string, name string) (int, *admission.AdmissionResponse) {
+		body, _ := json.Marshal(&admission.AdmissionReview{Request: &admission.AdmissionRequest{UID: "uid", Name: name}})
+		resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer resp.Body.Close()
+		res := &admission.AdmissionReview{}
+		_ = json.NewDecoder(resp.Body).Decode(res)
+		return resp.StatusCode, res.Response
+	}
+
+	path := "/validate/tls.002-module-hooks-policy.addon-operator.flant.com"
+	code, response := review(path, "good")
+	if assert.Equal(t, http.StatusOK, code) {
+		assert.True(t, response.Allowed)
+		assert.Equal(t, "uid", string(response.UID))
+	}
+	code, response = review(path, "bad")
+	if assert.Equal(t, http.StatusOK, code) {
+		assert.False(t, response.Allowed)
+		assert.Equal(t, "tls", response.Result.Message)
+	}
+	// Failed hook lets the API server use the failurePolicy.
+	code, _ = review(path, "broken")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	code, _ = review("/validate/unknown", "good")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// The configuration is deleted without webhooks.
+	if assert.NoError(t, obj.DisableModuleHooks("module")) {
+		_, err := client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Get("addon-operator-hooks", metav1.GetOptions{})
+		assert.Error(t, err)
+	}
+}
+
+func Test_MainValidatingHooksController_Stop(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "addon-operator-0", Namespace: "addon-operator"}})
+	obj := NewMainValidatingHooksController("addon-operator", "webhook", "addon-operator-hooks").WithPodName("addon-operator-0")
+	obj.Client = client
+
+	if !assert.NoError(t, SetLeaderLabel(client, "addon-operator", "addon-operator-0", true)) {
+		return
+	}
+	pod, _ := client.CoreV1().Pods("addon-operator").Get("addon-operator-0", metav1.GetOptions{})
+	assert.Equal(t, "true", pod.Labels[LeaderLabel])
+
+	hook := &testValidatingHook{name: "global-hook"}
+	obj.addHook(hook, "", []module_manager.KubernetesValidatingConfig{{Name: "policy"}})
+	if !assert.NoError(t, obj.updateConfiguration()) {
+		return
+	}
+
+	// The Service does not select the Pod anymore, the configuration is kept for the next leader.
+	assert.NoError(t, obj.Stop())
+	assert.Len(t, obj.Hooks, 0)
+	_, err := client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Get("addon-operator-hooks", metav1.GetOptions{})
+	assert.NoError(t, err)
+	pod, _ = client.CoreV1().Pods("addon-operator").Get("addon-operator-0", metav1.GetOptions{})
+	assert.NotContains(t, pod.Labels, LeaderLabel)
+
+	// The next leader changes the configuration.
+	_ = client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Delete("addon-operator-hooks", &metav1.DeleteOptions{})
+
+	// Webhooks applied before the lease loss are not trusted when the replica becomes the leader again.
+	obj.applied = nil
+	obj.addHook(hook, "", []module_manager.KubernetesValidatingConfig{{Name: "policy"}})
+	if assert.NoError(t, obj.updateConfiguration()) {
+		_, err = client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Get("addon-operator-hooks", metav1.GetOptions{})
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, obj.DeleteConfiguration())
+	_, err = client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Get("addon-operator-hooks", metav1.GetOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package module_manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+func Test_MainModuleManager_InitModuleHooks_Validation(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	tempDir := filepath.Join(rootDir, "tmp")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(modulesDir, "010-module", "values.yaml"), "moduleEnabled: true\n")
+	hookPath := filepath.Join(modulesDir, "010-module", "hooks", "hook")
+	writeHook(t, hookPath, `
+if [[ "$1" == "--config" ]]; then echo '{"schedule": [{"name": "no crontab"}]}'; exit 0; fi
+`)
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, filepath.Join(rootDir, "global-hooks"), tempDir)
+	if err := mm.initModulesIndex(); err != nil {
+		t.Fatal(err)
+	}
+	module, _ := mm.GetModule("module")
+
+	// The loader rejects configs that the test-hook command rejects.
+	err = mm.initModuleHooks(module)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "crontab is required")
+	}
+
+	// kubernetesValidating bindings should have a DNS label name and rules.
+	writeHook(t, hookPath, `
+if [[ "$1" == "--config" ]]; then echo '{"kubernetesValidating": [{"name": "Bad_Name", "rules": [{"operations": ["CREATE"]}]}]}'; exit 0; fi
+`)
+	err = mm.initModuleHooks(module)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "name 'Bad_Name' is not valid")
+	}
+	writeHook(t, hookPath, `
+if [[ "$1" == "--config" ]]; then echo '{"kubernetesValidating": [{"name": "policy"}]}'; exit 0; fi
+`)
+	err = mm.initModuleHooks(module)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rules are required")
+	}
+
+	// Bad timeout is rejected on load.
+	writeHook(t, hookPath, `
+if [[ "$1" == "--config" ]]; then echo '{"beforeHelm": 1, "timeout": "10"}'; exit 0; fi
+`)
+	err = mm.initModuleHooks(module)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timeout should be a positive duration")
+	}
+
+	// Hooks run in the temporary directory.
+	writeHook(t, hookPath, `
+if [[ "$1" == "--config" ]]; then echo '{"beforeHelm": 1, "timeout": "30s"}'; exit 0; fi
+touch ran
+`)
+	if !assert.NoError(t, mm.initModuleHooks(module)) {
+		return
+	}
+	hookNames, _ := mm.GetModuleHooksInOrder("module", BeforeHelm)
+	if assert.Len(t, hookNames, 1) {
+		moduleHook, _ := mm.GetModuleHook(hookNames[0])
+		assert.Equal(t, 30*time.Second, moduleHook.Config.TimeoutDuration())
+	}
+	if assert.NoError(t, module.runHooksByBinding(BeforeHelm, nil)) {
+		_, err := os.Stat(filepath.Join(tempDir, "ran"))
+		assert.NoError(t, err)
+	}
+}
+
+// Required fields of config values can be set only in values.yaml, so hooks can patch other fields.
+func Test_Hooks_ConfigValuesPatch_RequiredStaticValues(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	globalHooksDir := filepath.Join(rootDir, "global-hooks")
+	writeFile(t, filepath.Join(modulesDir, "values.yaml"), "global:\n  project: test\n")
+	writeFile(t, filepath.Join(modulesDir, "openapi", "config-values.yaml"), "type: object\nrequired: [project]\nproperties:\n  project:\n    type: string\n  clusterName:\n    type: string\n")
+	writeFile(t, filepath.Join(modulesDir, "010-module", "values.yaml"), "moduleEnabled: true\nmodule:\n  name: app\n")
+	writeFile(t, filepath.Join(modulesDir, "010-module", "openapi", "config-values.yaml"), "type: object\nrequired: [name]\nproperties:\n  name:\n    type: string\n  replicas:\n    type: integer\n")
+	writeHook(t, filepath.Join(modulesDir, "010-module", "hooks", "hook"), `
+if [[ "$1" == "--config" ]]; then echo '{"beforeHelm": 1}'; exit 0; fi
+echo '[{"op": "add", "path": "/module/replicas", "value": 2}]' > $CONFIG_VALUES_JSON_PATCH_PATH
+`)
+	writeHook(t, filepath.Join(globalHooksDir, "hook"), `
+if [[ "$1" == "--config" ]]; then echo '{"beforeAll": 1}'; exit 0; fi
+echo '[{"op": "add", "path": "/global/clusterName", "value": "main"}]' > $CONFIG_VALUES_JSON_PATCH_PATH
+`)
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, globalHooksDir, rootDir)
+	mm.WithKubeConfigManager(MockKubeConfigManager{})
+	if err := mm.initModulesIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.initGlobalHooks(); err != nil {
+		t.Fatal(err)
+	}
+	module, _ := mm.GetModule("module")
+	if err := mm.initModuleHooks(module); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.NoError(t, module.runHooksByBinding(BeforeHelm, nil)) {
+		assert.Equal(t, utils.Values{"module": map[string]interface{}{"replicas": 2.0}}, mm.kubeModulesConfigValues["module"])
+	}
+	if assert.NoError(t, mm.RunGlobalHook("hook", BeforeAll, []BindingContext{}, nil)) {
+		assert.Equal(t, "main", mm.kubeGlobalConfigValues["global"].(map[string]interface{})["clusterName"])
+	}
+}
@@ -0,0 +1,77 @@
+package module_manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fake_discovery "k8s.io/client-go/discovery/fake"
+	fake_dynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/flant/shell-operator/pkg/kube"
+)
+
+func Test_ModuleHook_KubernetesPatch(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	oldKubernetes, oldDynamicClient := kube.Kubernetes, kube.DynamicClient
+	defer func() {
+		kube.Kubernetes, kube.DynamicClient = oldKubernetes, oldDynamicClient
+	}()
+	kube.Kubernetes = fake.NewSimpleClientset()
+	kube.Kubernetes.Discovery().(*fake_discovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{{Name: "configmaps", Kind: "ConfigMap", Namespaced: true}},
+	}}
+	dynamicClient := fake_dynamic.NewSimpleDynamicClient(runtime.NewScheme())
+	kube.DynamicClient = dynamicClient
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	writeFile(t, filepath.Join(modulesDir, "010-module", "values.yaml"), "moduleEnabled: true\nmodule:\n  internal: {}\n")
+	hookPath := filepath.Join(modulesDir, "010-module", "hooks", "hook")
+	writeHook(t, hookPath, `
+if [[ "$1" == "--config" ]]; then echo '{"beforeHelm": 1}'; exit 0; fi
+echo '[{"op": "add", "path": "/module/internal/created", "value": true}]' > $VALUES_JSON_PATCH_PATH
+echo '{"operation":"CreateOrUpdate","object":{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default"}}}' > $KUBERNETES_PATCH_PATH
+`)
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, filepath.Join(rootDir, "global-hooks"), rootDir)
+	if err := mm.initModulesIndex(); err != nil {
+		t.Fatal(err)
+	}
+	module, _ := mm.GetModule("module")
+	if err := mm.initModuleHooks(module); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.NoError(t, module.runHooksByBinding(BeforeHelm, nil)) {
+		_, err := dynamicClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).Namespace("default").Get("cm", metav1.GetOptions{})
+		assert.NoError(t, err)
+		internal := module.values()["module"].(map[string]interface{})["internal"].(map[string]interface{})
+		assert.Equal(t, true, internal["created"])
+	}
+
+	// Values are not changed if an operation fails.
+	writeHook(t, hookPath, `
+if [[ "$1" == "--config" ]]; then echo '{"beforeHelm": 1}'; exit 0; fi
+echo '[{"op": "add", "path": "/module/internal/deleted", "value": true}]' > $VALUES_JSON_PATCH_PATH
+echo '{"operation":"Delete","apiVersion":"v1","kind":"Secret","namespace":"default","name":"secret"}' > $KUBERNETES_PATCH_PATH
+`)
+	err = module.runHooksByBinding(BeforeHelm, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "kubernetes patch failed")
+		internal := module.values()["module"].(map[string]interface{})["internal"].(map[string]interface{})
+		assert.NotContains(t, internal, "deleted")
+	}
+}
@@ -7,29 +7,57 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/kennygrant/sanitize"
 	"github.com/otiai10/copy"
 	"github.com/romana/rlog"
 	"gopkg.in/yaml.v2"
 
-	"github.com/flant/shell-operator/pkg/executor"
 	utils_file "github.com/flant/shell-operator/pkg/utils/file"
 
 	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/executor"
 	"github.com/flant/addon-operator/pkg/helm"
+	"github.com/flant/addon-operator/pkg/logger"
+	"github.com/flant/addon-operator/pkg/metrics_storage"
+	"github.com/flant/addon-operator/pkg/module_source"
 	"github.com/flant/addon-operator/pkg/utils"
 )
 
+// Directory and files with OpenAPI schemas for values.
+const (
+	OpenAPIDir             = "openapi"
+	ConfigValuesSchemaFile = "config-values.yaml"
+	ValuesSchemaFile       = "values.yaml"
+)
+
 type Module struct {
 	Name          string
 	DirectoryName string
 	Path          string
+	// Source is a bundle or an OCI image layout of the module. Source and Version
+	// are empty for modules from the modules directory.
+	Source  string
+	Version string
+	// Requires are modules from module.yaml that should be enabled for this module.
+	Requires []string
+	// Weight orders modules without dependencies between them.
+	Weight int
+	// ParallelHooks allows to run hooks with the same order concurrently.
+	ParallelHooks bool
 	// module values from modules/values.yaml file
 	CommonStaticConfig *utils.ModuleConfig
 	// module values from modules/<module name>/values.yaml
 	StaticConfig  *utils.ModuleConfig
 
+	// HelmReleaseRevision and HelmReleaseChecksum are saved after the last helm upgrade.
+	HelmReleaseRevision string
+	HelmReleaseChecksum string
+
+	// isRemoved is true if module directory is removed. Only helm release can be deleted.
+	isRemoved bool
+
 	moduleManager *MainModuleManager
 }
 
@@ -45,40 +73,71 @@ func (m *Module) SafeName() string {
 
 // Run is a phase of module lifecycle that runs onStartup and beforeHelm hooks, helm upgrade --install command and afterHelm hook.
 // It is a handler of task MODULE_RUN
-func (m *Module) Run(onStartup bool) error {
-	if err := m.cleanup(); err != nil {
+func (m *Module) Run(onStartup bool, logLabels map[string]string) error {
+	if err := m.runPhase("cleanup", m.cleanup); err != nil {
 		return err
 	}
 
 	if onStartup {
-		if err := m.runHooksByBinding(OnStartup); err != nil {
+		err := m.runPhase("onStartup", func() error {
+			return m.runHooksByBinding(OnStartup, logLabels)
+		})
+		if err != nil {
 			return err
 		}
 	}
 
-	if err := m.runHooksByBinding(BeforeHelm); err != nil {
+	err := m.runPhase("beforeHelm", func() error {
+		return m.runHooksByBinding(BeforeHelm, logLabels)
+	})
+	if err != nil {
 		return err
 	}
 
-	if err := m.runHelmInstall(); err != nil {
+	if err := m.runPhase("helm", m.runHelmInstall); err != nil {
 		return err
 	}
 
-	if err := m.runHooksByBinding(AfterHelm); err != nil {
+	err = m.runPhase("afterHelm", func() error {
+		return m.runHooksByBinding(AfterHelm, logLabels)
+	})
+	if err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// ModuleRunPhaseError is an error of the module run with the name of the failed phase.
+type ModuleRunPhaseError struct {
+	Phase string
+	Err   error
+}
+
+func (e *ModuleRunPhaseError) Error() string {
+	return e.Err.Error()
+}
+
+// runPhase runs a phase of the module run and sends its duration to the module_run_seconds metric.
+func (m *Module) runPhase(phase string, fn func() error) error {
+	defer m.moduleManager.observeDuration("module_run_seconds", time.Now(), map[string]string{"module": m.Name, "phase": phase})
+	if err := fn(); err != nil {
+		return &ModuleRunPhaseError{Phase: phase, Err: err}
+	}
+	return nil
+}
+
 // Delete removes helm release if it exists and runs afterDeleteHelm hooks.
 // It is a handler for MODULE_DELETE task.
-func (m *Module) Delete() error {
+func (m *Module) Delete(logLabels map[string]string) error {
 	// Если есть chart, но нет релиза — warning
 	// если нет чарта — молча перейти к хукам
 	// если есть и chart и релиз — удалить
-	chartExists, _ := m.checkHelmChart()
-	if chartExists {
+	chartExists, err := m.checkHelmChart()
+	if err != nil {
+		return err
+	}
+	if chartExists || m.isRemoved {
 		releaseExists, err := helm.Client.IsReleaseExists(m.generateHelmReleaseName())
 		if !releaseExists {
 			if err != nil {
@@ -95,17 +154,23 @@ func (m *Module) Delete() error {
 		}
 	}
 
-	return m.runHooksByBinding(AfterDeleteHelm)
+	// Hooks of the removed module are not available.
+	if m.isRemoved {
+		return nil
+	}
+
+	return m.runHooksByBinding(AfterDeleteHelm, logLabels)
 }
 
 
 func (m *Module) cleanup() error {
 	chartExists, err := m.checkHelmChart()
+	if err != nil {
+		return err
+	}
 	if !chartExists {
-		if err != nil {
-			rlog.Debugf("MODULE '%s': cleanup is not needed: %s", m.Name, err)
-			return nil
-		}
+		rlog.Debugf("MODULE '%s': cleanup is not needed: no Chart.yaml", m.Name)
+		return nil
 	}
 
 	//rlog.Infof("MODULE '%s': cleanup helm revisions...", m.Name)
@@ -122,39 +187,17 @@ func (m *Module) cleanup() error {
 
 func (m *Module) runHelmInstall() error {
 	chartExists, err := m.checkHelmChart()
-	if !chartExists {
-		if err != nil {
-			rlog.Debugf("Module '%s': no Chart.yaml, helm is not needed: %s", m.Name, err)
-			return nil
-		}
-	}
-
-	helmReleaseName := m.generateHelmReleaseName()
-
-	// valuesPath, err := values.Dump
-	//valuesPath := filepath.Join(m.moduleManager.TempDir, fmt.Sprintf("%s.module-values.yaml", m.SafeName()))
-	//err := values.Dump(m.values(), NewDumperToYamlFile(valuesPath))
-	//err := m.values().Dump(values.ToYamlFile(valuesPath))
-
-	valuesPath, err := m.prepareValuesYamlFile()
-	if err != nil {
-		return err
-	}
-
-	// Create a temporary chart with empty values.yaml
-	runChartPath := filepath.Join(m.moduleManager.TempDir, fmt.Sprintf("%s.chart", m.SafeName()))
-
-	err = os.RemoveAll(runChartPath)
 	if err != nil {
 		return err
 	}
-	err = copy.Copy(m.Path, runChartPath)
-	if err != nil {
-		return err
+	if !chartExists {
+		rlog.Debugf("Module '%s': no Chart.yaml, helm is not needed", m.Name)
+		return nil
 	}
 
-	// Prepare dummy empty values.yaml for helm not to fail
-	err = os.Truncate(filepath.Join(runChartPath, "values.yaml"), 0)
+	helmReleaseName := m.generateHelmReleaseName()
+
+	runChartPath, valuesPath, err := m.prepareHelmChart()
 	if err != nil {
 		return err
 	}
@@ -171,8 +214,10 @@ func (m *Module) runHelmInstall() error {
 		return err
 	}
 
+	revision := ""
 	if isReleaseExists {
-		_, status, err := helm.Client.LastReleaseStatus(helmReleaseName)
+		var status string
+		revision, status, err = helm.Client.LastReleaseStatus(helmReleaseName)
 		if err != nil {
 			return err
 		}
@@ -200,35 +245,96 @@ func (m *Module) runHelmInstall() error {
 	if doRelease {
 		rlog.Debugf("MODULE_RUN '%s': helm release '%s' checksum '%s': installing/upgrading release", m.Name, helmReleaseName, checksum)
 
-		return helm.Client.UpgradeRelease(
+		err = helm.Client.UpgradeRelease(
 			helmReleaseName, runChartPath,
 			[]string{valuesPath},
 			[]string{fmt.Sprintf("_addonOperatorModuleChecksum=%s", checksum)},
 			//helm.Client.TillerNamespace(),
 			app.Namespace,
 		)
+		if err != nil {
+			return err
+		}
+
+		// The revision is only shown in the module status, so an error is not a reason to fail the module run.
+		revision, _, err = helm.Client.LastReleaseStatus(helmReleaseName)
+		if err != nil {
+			rlog.Warnf("MODULE_RUN '%s': cannot get revision of helm release '%s': %s", m.Name, helmReleaseName, err)
+			revision = ""
+		}
 	} else {
 		rlog.Debugf("MODULE_RUN '%s': helm release '%s' checksum '%s': release install/upgrade is skipped", m.Name, helmReleaseName, checksum)
 	}
 
+	m.HelmReleaseRevision = revision
+	m.HelmReleaseChecksum = checksum
+
 	return nil
 }
 
 
-func (m *Module) runHooksByBinding(binding BindingType) error {
-	moduleHooksAfterHelm, err := m.moduleManager.GetModuleHooksInOrder(m.Name, binding)
+// prepareHelmChart copies module chart into a temporary directory and dumps module values for helm.
+func (m *Module) prepareHelmChart() (runChartPath string, valuesPath string, err error) {
+	// valuesPath, err := values.Dump
+	//valuesPath := filepath.Join(m.moduleManager.TempDir, fmt.Sprintf("%s.module-values.yaml", m.SafeName()))
+	//err := values.Dump(m.values(), NewDumperToYamlFile(valuesPath))
+	//err := m.values().Dump(values.ToYamlFile(valuesPath))
+
+	valuesPath, err = m.prepareValuesYamlFile()
+	if err != nil {
+		return "", "", err
+	}
+
+	// Create a temporary chart with empty values.yaml
+	runChartPath = filepath.Join(m.moduleManager.TempDir, fmt.Sprintf("%s.chart", m.SafeName()))
+
+	err = os.RemoveAll(runChartPath)
+	if err != nil {
+		return "", "", err
+	}
+	err = copy.Copy(m.Path, runChartPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Prepare dummy empty values.yaml for helm not to fail
+	err = os.Truncate(filepath.Join(runChartPath, "values.yaml"), 0)
+	if err != nil {
+		return "", "", err
+	}
+
+	return runChartPath, valuesPath, nil
+}
+
+// runHooksByBinding runs hooks in order. Hooks with the same order run concurrently
+// if all of them are parallel, see runHooksInParallel.
+func (m *Module) runHooksByBinding(binding BindingType, logLabels map[string]string) error {
+	moduleHooksNames, err := m.moduleManager.GetModuleHooksInOrder(m.Name, binding)
 	if err != nil {
 		return err
 	}
 
-	for _, moduleHookName := range moduleHooksAfterHelm {
+	moduleHooks := make([]*ModuleHook, 0, len(moduleHooksNames))
+	for _, moduleHookName := range moduleHooksNames {
 		moduleHook, err := m.moduleManager.GetModuleHook(moduleHookName)
 		if err != nil {
 			return err
 		}
+		moduleHooks = append(moduleHooks, moduleHook)
+	}
 
-		if err := moduleHook.run(binding, []BindingContext{{Binding: ContextBindingType[binding]}}); err != nil {
-			return err
+	for _, group := range groupHooksByOrder(moduleHooks, binding) {
+		if len(group) > 1 && isParallelGroup(group) {
+			if err := runHooksInParallel(group, binding, logLabels); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, moduleHook := range group {
+			if err := moduleHook.run(binding, []BindingContext{{Binding: ContextBindingType[binding]}}, logLabels); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -301,11 +407,16 @@ func (m *Module) prepareValuesJsonFileForEnabledScript(precedingEnabledModules [
 	return m.prepareValuesJsonFileWith(m.valuesForEnabledScript(precedingEnabledModules))
 }
 
+// checkHelmChart returns true if the module has Chart.yaml. Error is returned if Chart.yaml cannot be checked.
 func (m *Module) checkHelmChart() (bool, error) {
 	chartPath := filepath.Join(m.Path, "Chart.yaml")
 
-	if _, err := os.Stat(chartPath); os.IsNotExist(err) {
-		return false, fmt.Errorf("path '%s' is not found", chartPath)
+	_, err := os.Stat(chartPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("check '%s': %s", chartPath, err)
 	}
 	return true, nil
 }
@@ -317,8 +428,30 @@ func (m *Module) generateHelmReleaseName() string {
 	return m.Name
 }
 
+// MaxRetries returns a count of retries for failed module tasks from the ConfigMap,
+// modules/<module>/values.yaml or from modules/values.yaml. Zero means a default setting.
+func (m *Module) MaxRetries() int {
+	configs := []*utils.ModuleConfig{m.StaticConfig, m.CommonStaticConfig}
+	if m.moduleManager != nil {
+		m.moduleManager.valuesLock.RLock()
+		if kubeConfig, has := m.moduleManager.kubeModuleConfigs[m.Name]; has {
+			configs = append([]*utils.ModuleConfig{&kubeConfig}, configs...)
+		}
+		m.moduleManager.valuesLock.RUnlock()
+	}
+	for _, config := range configs {
+		if config != nil && config.MaxRetries != nil {
+			return *config.MaxRetries
+		}
+	}
+	return 0
+}
+
 // configValues returns values from ConfigMap: global section and module section
 func (m *Module) configValues() utils.Values {
+	m.moduleManager.valuesLock.RLock()
+	defer m.moduleManager.valuesLock.RUnlock()
+
 	return utils.MergeValues(
 		// global section
 		utils.Values{"global": map[string]interface{}{}},
@@ -331,19 +464,24 @@ func (m *Module) configValues() utils.Values {
 
 // constructValues returns effective values for module hook:
 //
-// global section: static + kube + patches from hooks
+// global section: schema defaults + static + kube + patches from hooks
 //
-// module section: static + kube + patches from hooks
+// module section: schema defaults + static + kube + patches from hooks
 func (m *Module) constructValues() utils.Values {
 	var err error
 
+	m.moduleManager.valuesLock.RLock()
+	defer m.moduleManager.valuesLock.RUnlock()
+
 	res := utils.MergeValues(
 		// global
 		utils.Values{"global": map[string]interface{}{}},
+		m.moduleManager.ValuesValidator.GlobalDefaults(),
 		m.moduleManager.globalCommonStaticValues,
 		m.moduleManager.kubeGlobalConfigValues,
 		// module
 		utils.Values{utils.ModuleNameToValuesKey(m.Name): map[string]interface{}{}},
+		m.moduleManager.ValuesValidator.ModuleDefaults(m.moduleValuesKey()),
 		m.CommonStaticConfig.Values,
 		m.StaticConfig.Values,
 		m.moduleManager.kubeModulesConfigValues[m.Name],
@@ -420,7 +558,7 @@ func (m *Module) readModuleEnabledResult(filePath string) (bool, error) {
 	return false, fmt.Errorf("expected 'true' or 'false', got '%s'", value)
 }
 
-func (m *Module) checkIsEnabledByScript(precedingEnabledModules []string) (bool, error) {
+func (m *Module) checkIsEnabledByScript(precedingEnabledModules []string, logLabels map[string]string) (bool, error) {
 	enabledScriptPath := filepath.Join(m.Path, "enabled")
 
 	f, err := os.Stat(enabledScriptPath)
@@ -460,7 +598,18 @@ func (m *Module) checkIsEnabledByScript(precedingEnabledModules []string) (bool,
 
 	cmd := executor.MakeCommand("", enabledScriptPath, []string{}, envs)
 
-	if err := executor.Run(cmd, true); err != nil {
+	logLabels = utils.MergeLabels(logLabels, map[string]string{
+		logger.ModuleField: m.Name,
+		logger.HookField:   "enabled",
+	})
+	enabledScriptStart := time.Now()
+	err = executor.RunAndLogLines(cmd, logLabels, app.HookTimeout)
+	m.moduleManager.observeDuration("module_enabled_script_seconds", enabledScriptStart, map[string]string{"module": m.Name})
+	if executor.IsTimeout(err) {
+		m.moduleManager.sendCounterMetric("module_hook_timeouts", map[string]string{"module": m.Name, "hook": "enabled"})
+		return false, fmt.Errorf("enabled script '%s' timed out: %s", enabledScriptPath, err)
+	}
+	if err != nil {
 		return false, err
 	}
 
@@ -478,14 +627,14 @@ func (m *Module) checkIsEnabledByScript(precedingEnabledModules []string) (bool,
 	return false, nil
 }
 
-// initModulesIndex load all available modules from modules directory
-// FIXME: Only 000-name modules are loaded, allow non-prefixed modules.
+// initModulesIndex load all available modules from modules directory and module sources
+// in the order of dependencies.
 func (mm *MainModuleManager) initModulesIndex() error {
 	rlog.Debug("INIT: Search modules ...")
 
-	files, err := ioutil.ReadDir(mm.ModulesDir) // returns a list of modules sorted by filename
+	modulesDirs, err := mm.readModulesDirs()
 	if err != nil {
-		return fmt.Errorf("INIT: cannot list modules directory '%s': %s", mm.ModulesDir, err)
+		return err
 	}
 
 	// load global and modules common static values from modules/values.yaml
@@ -493,45 +642,194 @@ func (mm *MainModuleManager) initModulesIndex() error {
 		return fmt.Errorf("INIT: load common values: %s", err)
 	}
 
-	var validModuleName = regexp.MustCompile(`^[0-9][0-9][0-9]-(.*)$`)
+	// load global values schemas from modules/openapi
+	if err := mm.loadGlobalValuesSchemas(); err != nil {
+		return fmt.Errorf("INIT: load global values schemas: %s", err)
+	}
+
+	for _, moduleDir := range modulesDirs {
+		rlog.Infof("INIT: Register module '%s'", moduleDir.Name)
+
+		module := NewModule(mm)
+		moduleDir.apply(module)
+
+		if err := module.loadValuesFiles(); err != nil {
+			return err
+		}
+
+		mm.allModulesByName[module.Name] = module
+		mm.allModulesNamesInOrder = append(mm.allModulesNamesInOrder, module.Name)
+	}
+
+	rlog.Debugf("INIT: initModulesIndex registered modules: %v", mm.allModulesByName)
+
+	mm.warnGoHooksForUnknownModules()
+	mm.removeUnusedModuleSources()
+
+	return nil
+}
+
+// moduleDir is a name of the module and its directory in the modules directory or in a module source.
+type moduleDir struct {
+	Name          string
+	DirectoryName string
+	Path          string
+	Source        string
+	Version       string
+	Requires      []string
+	Weight        int
+	ParallelHooks bool
+}
+
+func (d moduleDir) apply(module *Module) {
+	module.Name = d.Name
+	module.DirectoryName = d.DirectoryName
+	module.Path = d.Path
+	module.Source = d.Source
+	module.Version = d.Version
+	module.Requires = d.Requires
+	module.Weight = d.Weight
+	module.ParallelHooks = d.ParallelHooks
+}
+
+var validModuleName = regexp.MustCompile(`^[0-9][0-9][0-9]-(.*)$`)
 
+// readModulesDirs returns modules directories in the order of dependencies. Modules from
+// module sources replace modules with the same name from the modules directory.
+func (mm *MainModuleManager) readModulesDirs() ([]moduleDir, error) {
+	files, err := ioutil.ReadDir(mm.ModulesDir) // returns a list of modules sorted by filename
+	if err != nil {
+		return nil, fmt.Errorf("INIT: cannot list modules directory '%s': %s", mm.ModulesDir, err)
+	}
+
+	modulesDirs := make([]moduleDir, 0)
 	badModulesDirs := make([]string, 0)
 
 	for _, file := range files {
-		if file.IsDir() {
-			matchRes := validModuleName.FindStringSubmatch(file.Name())
-			if matchRes != nil {
-				moduleName := matchRes[1]
-				rlog.Infof("INIT: Register module '%s'", moduleName)
-
-				modulePath := filepath.Join(mm.ModulesDir, file.Name())
-
-				module := NewModule(mm)
-				module.Name = moduleName
-				module.DirectoryName = file.Name()
-				module.Path = modulePath
-
-				// load static config from values.yaml
-				err := module.loadStaticValues()
-				if err != nil {
-					return err
-				}
+		if !file.IsDir() || file.Name() == OpenAPIDir {
+			// Directory with global values schemas.
+			continue
+		}
+		dir, ok, err := newModuleDir(file.Name(), filepath.Join(mm.ModulesDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			modulesDirs = append(modulesDirs, dir)
+		} else {
+			badModulesDirs = append(badModulesDirs, filepath.Join(mm.ModulesDir, file.Name()))
+		}
+	}
 
-				mm.allModulesByName[module.Name] = module
-				mm.allModulesNamesInOrder = append(mm.allModulesNamesInOrder, module.Name)
-			} else {
-				badModulesDirs = append(badModulesDirs, filepath.Join(mm.ModulesDir, file.Name()))
+	for _, source := range mm.ModuleSources {
+		sourceDirs, err := module_source.LoadModules(source, mm.moduleSourcesDir())
+		if err != nil {
+			return nil, fmt.Errorf("load module source: %s", err)
+		}
+		for _, sourceDir := range sourceDirs {
+			dir, ok, err := newModuleDir(sourceDir.DirectoryName, sourceDir.Path)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				badModulesDirs = append(badModulesDirs, fmt.Sprintf("%s in %s", sourceDir.DirectoryName, sourceDir.Source))
+				continue
+			}
+			dir.Source = sourceDir.Source
+			dir.Version = sourceDir.Version
+			replaced := false
+			for i := range modulesDirs {
+				if modulesDirs[i].Name == dir.Name {
+					rlog.Debugf("INIT: module '%s' from '%s' replaces '%s'", dir.Name, dir.Source, modulesDirs[i].Path)
+					modulesDirs[i] = dir
+					replaced = true
+				}
+			}
+			if !replaced {
+				modulesDirs = append(modulesDirs, dir)
 			}
 		}
 	}
 
-	rlog.Debugf("INIT: initModulesIndex registered modules: %v", mm.allModulesByName)
-
 	if len(badModulesDirs) > 0 {
-		return fmt.Errorf("found directories not matched regex '%s': %s", validModuleName, strings.Join(badModulesDirs, ", "))
+		return nil, fmt.Errorf("found directories not matched regex '%s' and without %s: %s", validModuleName, ModuleDefinitionFile, strings.Join(badModulesDirs, ", "))
 	}
 
-	return nil
+	return sortModulesDirs(modulesDirs)
+}
+
+// moduleSourcesDir is a directory for unpacked module sources.
+func (mm *MainModuleManager) moduleSourcesDir() string {
+	return filepath.Join(mm.TempDir, "module-sources")
+}
+
+// removeUnusedModuleSources removes unpacked bundles that are replaced by new versions.
+func (mm *MainModuleManager) removeUnusedModuleSources() {
+	if len(mm.ModuleSources) == 0 {
+		return
+	}
+	usedPaths := make([]string, 0)
+	for _, module := range mm.allModulesByName {
+		usedPaths = append(usedPaths, module.Path)
+	}
+	for _, module := range mm.removedModules {
+		usedPaths = append(usedPaths, module.Path)
+	}
+	if err := module_source.RemoveUnused(mm.moduleSourcesDir(), usedPaths); err != nil {
+		rlog.Errorf("MODULE_SOURCE: remove unused module sources: %s", err)
+	}
+}
+
+// sendModuleSourceMetric exposes a source and a version of the deployed module.
+func (mm *MainModuleManager) sendModuleSourceMetric(module *Module) {
+	if mm.metricStorage == nil {
+		return
+	}
+	value := 1.0
+	metricLabels := map[string]string{"module": module.Name}
+	err := mm.metricStorage.SendHookMetrics([]metrics_storage.MetricOperation{
+		// Metric with a previous version is deleted.
+		{Group: "module_source", Action: metrics_storage.ExpireAction},
+		{
+			Name:   app.PrometheusMetricsPrefix + "module_source_info",
+			Group:  "module_source",
+			Action: metrics_storage.SetAction,
+			Value:  &value,
+			Labels: map[string]string{"source": module.Source, "version": module.Version},
+		},
+	}, metricLabels)
+	if err != nil {
+		rlog.Errorf("Module '%s' source metric: %s", module.Name, err)
+	}
+}
+
+// expireModuleSourceMetric deletes the source metric of the deleted module.
+func (mm *MainModuleManager) expireModuleSourceMetric(moduleName string) {
+	if mm.metricStorage == nil {
+		return
+	}
+	err := mm.metricStorage.SendHookMetrics([]metrics_storage.MetricOperation{
+		{Group: "module_source", Action: metrics_storage.ExpireAction},
+	}, map[string]string{"module": moduleName})
+	if err != nil {
+		rlog.Errorf("Module '%s' source metric: %s", moduleName, err)
+	}
+}
+
+// loadValuesFiles loads static values and values schemas of the module and checks static values.
+func (m *Module) loadValuesFiles() error {
+	// load static config from values.yaml
+	err := m.loadStaticValues()
+	if err != nil {
+		return err
+	}
+
+	// load values schemas from openapi directory and check static values
+	err = m.loadValuesSchemas()
+	if err != nil {
+		return err
+	}
+	return m.validateStaticValues()
 }
 
 // loadStaticValues loads config for module from values.yaml
@@ -564,6 +862,77 @@ func (m *Module) loadStaticValues() (err error) {
 	return nil
 }
 
+// loadValuesSchemas loads OpenAPI schemas for module values from openapi directory.
+func (m *Module) loadValuesSchemas() error {
+	configSchema, valuesSchema, err := readValuesSchemasFiles(filepath.Join(m.Path, OpenAPIDir))
+	if err != nil {
+		return fmt.Errorf("module '%s': %s", m.Name, err)
+	}
+
+	return m.moduleManager.ValuesValidator.AddModuleSchemas(m.moduleValuesKey(), configSchema, valuesSchema)
+}
+
+// validateStaticValues checks module values from modules/values.yaml and from module's values.yaml.
+// Required fields are checked later in merged values: they can be set in the ConfigMap.
+func (m *Module) validateStaticValues() error {
+	staticValues := utils.MergeValues(
+		m.CommonStaticConfig.Values,
+		m.StaticConfig.Values,
+	)
+
+	if err := m.moduleManager.ValuesValidator.ValidateModuleStaticValues(m.moduleValuesKey(), staticValues); err != nil {
+		return fmt.Errorf("module '%s' static values: %s", m.Name, err)
+	}
+	return nil
+}
+
+// loadGlobalValuesSchemas loads OpenAPI schemas for global values from modules/openapi directory
+// and checks global section of modules/values.yaml.
+func (mm *MainModuleManager) loadGlobalValuesSchemas() error {
+	configSchema, valuesSchema, err := readValuesSchemasFiles(filepath.Join(mm.ModulesDir, OpenAPIDir))
+	if err != nil {
+		return err
+	}
+
+	err = mm.ValuesValidator.AddGlobalSchemas(configSchema, valuesSchema)
+	if err != nil {
+		return err
+	}
+
+	if err := mm.ValuesValidator.ValidateGlobalStaticValues(mm.globalCommonStaticValues); err != nil {
+		return fmt.Errorf("global static values: %s", err)
+	}
+	return nil
+}
+
+// readValuesSchemasFiles returns content of config-values.yaml and values.yaml files
+// in a schemas directory. Content is empty if file is not exists.
+func readValuesSchemasFiles(schemasDir string) (configSchema []byte, valuesSchema []byte, err error) {
+	configSchema, err = readFileIfExists(filepath.Join(schemasDir, ConfigValuesSchemaFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	valuesSchema, err = readFileIfExists(filepath.Join(schemasDir, ValuesSchemaFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return configSchema, valuesSchema, nil
+}
+
+func readFileIfExists(filePath string) ([]byte, error) {
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read '%s': %s", filePath, err)
+	}
+	return data, nil
+}
+
 func (mm *MainModuleManager) loadCommonStaticValues() (error) {
 	valuesPath := filepath.Join(mm.ModulesDir, "values.yaml")
 	if _, err := os.Stat(valuesPath); os.IsNotExist(err) {
@@ -0,0 +1,150 @@
+package module_manager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ModuleDefinitionFile is an optional file in the module directory with dependencies of the module.
+//
+//	requires:
+//	- cert-manager
+//	weight: 100
+const ModuleDefinitionFile = "module.yaml"
+
+// ModuleDefinition is a content of module.yaml.
+type ModuleDefinition struct {
+	// Requires are names of modules that should be enabled and run before this module.
+	Requires []string `yaml:"requires"`
+	// Weight orders independent modules. It is the numeric prefix of the directory by default.
+	Weight *int `yaml:"weight"`
+	// ParallelHooks allows to run hooks with the same order concurrently.
+	ParallelHooks bool `yaml:"parallelHooks"`
+}
+
+// readModuleDefinition returns nil if module.yaml does not exist.
+func readModuleDefinition(modulePath string) (*ModuleDefinition, error) {
+	path := filepath.Join(modulePath, ModuleDefinitionFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	def := &ModuleDefinition{}
+	if err := yaml.Unmarshal(data, def); err != nil {
+		return nil, fmt.Errorf("parse '%s': %s", path, err)
+	}
+	return def, nil
+}
+
+// newModuleDir returns a module name, a weight and dependencies for the module directory.
+// Directory should be named 'NNN-name' or should contain module.yaml. ok is false for
+// other directories.
+func newModuleDir(directoryName string, path string) (dir moduleDir, ok bool, err error) {
+	def, err := readModuleDefinition(path)
+	if err != nil {
+		return dir, false, err
+	}
+
+	dir = moduleDir{
+		Name:          directoryName,
+		DirectoryName: directoryName,
+		Path:          path,
+	}
+	matchRes := validModuleName.FindStringSubmatch(directoryName)
+	if matchRes != nil {
+		dir.Name = matchRes[1]
+		dir.Weight, _ = strconv.Atoi(directoryName[:3])
+	} else if def == nil {
+		return dir, false, nil
+	}
+
+	if def != nil {
+		dir.Requires = def.Requires
+		dir.ParallelHooks = def.ParallelHooks
+		if def.Weight != nil {
+			dir.Weight = *def.Weight
+		}
+	}
+	return dir, true, nil
+}
+
+// sortModulesDirs returns modules in the topological order of dependencies. Independent
+// modules are ordered by weight and then by directory name. Requirements of unknown
+// modules are ignored here, such modules are disabled in determineEnableStateWithScript.
+func sortModulesDirs(modulesDirs []moduleDir) ([]moduleDir, error) {
+	known := make(map[string]bool)
+	for _, dir := range modulesDirs {
+		known[dir.Name] = true
+	}
+
+	pending := append([]moduleDir{}, modulesDirs...)
+	sort.SliceStable(pending, func(i, j int) bool {
+		if pending[i].Weight != pending[j].Weight {
+			return pending[i].Weight < pending[j].Weight
+		}
+		return pending[i].DirectoryName < pending[j].DirectoryName
+	})
+
+	res := make([]moduleDir, 0, len(modulesDirs))
+	placed := make(map[string]bool)
+	for len(pending) > 0 {
+		// The first module with all required modules placed.
+		next := -1
+		for i, dir := range pending {
+			ready := true
+			for _, required := range dir.Requires {
+				if known[required] && !placed[required] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+
+		if next == -1 {
+			names := make([]string, 0, len(pending))
+			for _, dir := range pending {
+				names = append(names, dir.Name)
+			}
+			return nil, fmt.Errorf("modules dependencies have a cycle, unresolved modules: %s", strings.Join(names, ", "))
+		}
+
+		res = append(res, pending[next])
+		placed[pending[next].Name] = true
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+
+	return res, nil
+}
+
+// disabledDependency returns a reason to disable the module if one of required modules is not enabled.
+func (mm *MainModuleManager) disabledDependency(module *Module, enabledModules []string) string {
+	enabled := make(map[string]bool)
+	for _, name := range enabledModules {
+		enabled[name] = true
+	}
+	for _, required := range module.Requires {
+		if enabled[required] {
+			continue
+		}
+		if _, has := mm.allModulesByName[required]; !has {
+			return fmt.Sprintf("required module '%s' is not found", required)
+		}
+		return fmt.Sprintf("required module '%s' is disabled", required)
+	}
+	return ""
+}
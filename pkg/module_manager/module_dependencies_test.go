@@ -0,0 +1,73 @@
+package module_manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sortModulesDirs(t *testing.T) {
+	dirs := []moduleDir{
+		{Name: "ingress", DirectoryName: "010-ingress", Weight: 10, Requires: []string{"cert-manager"}},
+		{Name: "cert-manager", DirectoryName: "cert-manager", Weight: 50},
+		{Name: "dashboard", DirectoryName: "020-dashboard", Weight: 20, Requires: []string{"ingress", "absent"}},
+		{Name: "monitoring", DirectoryName: "030-monitoring", Weight: 30},
+	}
+
+	sorted, err := sortModulesDirs(dirs)
+	if assert.NoError(t, err) {
+		names := make([]string, 0)
+		for _, dir := range sorted {
+			names = append(names, dir.Name)
+		}
+		assert.Equal(t, []string{"monitoring", "cert-manager", "ingress", "dashboard"}, names)
+	}
+
+	dirs[1].Requires = []string{"dashboard"}
+	_, err = sortModulesDirs(dirs)
+	assert.Error(t, err)
+}
+
+func Test_MainModuleManager_ModuleDependencies(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	writeFile(t, filepath.Join(modulesDir, "010-ingress", "module.yaml"), "requires:\n- cert-manager\n")
+	writeFile(t, filepath.Join(modulesDir, "cert-manager", "module.yaml"), "weight: 50\n")
+	writeFile(t, filepath.Join(modulesDir, "cert-manager", "values.yaml"), "certManagerEnabled: false\n")
+	writeFile(t, filepath.Join(modulesDir, "020-monitoring", "values.yaml"), "monitoringEnabled: true\n")
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, filepath.Join(rootDir, "global-hooks"), rootDir)
+	if !assert.NoError(t, mm.initModulesIndex()) {
+		return
+	}
+	assert.Equal(t, []string{"monitoring", "cert-manager", "ingress"}, mm.allModulesNamesInOrder)
+	module, _ := mm.GetModule("ingress")
+	assert.Equal(t, []string{"cert-manager"}, module.Requires)
+	assert.Equal(t, 10, module.Weight)
+
+	enabled, err := mm.determineEnableStateWithScript([]string{"ingress", "monitoring"}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"monitoring"}, enabled)
+		assert.Equal(t, "required module 'cert-manager' is disabled", mm.disabledByDependencies["ingress"])
+	}
+
+	enabled, err = mm.determineEnableStateWithScript([]string{"cert-manager", "ingress", "monitoring"}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"monitoring", "cert-manager", "ingress"}, enabled)
+		assert.Empty(t, mm.disabledByDependencies)
+	}
+
+	// Directories without the prefix and without module.yaml are not allowed.
+	writeFile(t, filepath.Join(modulesDir, "bad-module", "values.yaml"), "badModuleEnabled: true\n")
+	_, err = mm.readModulesDirs()
+	assert.Error(t, err)
+}
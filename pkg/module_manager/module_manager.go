@@ -6,14 +6,23 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/romana/rlog"
+	admission "k8s.io/api/admission/v1beta1"
 
+	"github.com/flant/shell-operator/pkg/kube"
 	utils_checksum "github.com/flant/shell-operator/pkg/utils/checksum"
 
+	"github.com/flant/addon-operator/pkg/app"
 	"github.com/flant/addon-operator/pkg/helm"
 	"github.com/flant/addon-operator/pkg/kube_config_manager"
+	"github.com/flant/addon-operator/pkg/kube_patch"
+	"github.com/flant/addon-operator/pkg/metrics_storage"
+	"github.com/flant/addon-operator/pkg/module_events"
 	"github.com/flant/addon-operator/pkg/utils"
+	"github.com/flant/addon-operator/pkg/values_validation"
 )
 
 // TODO separate modules and hooks storage, values storage and actions
@@ -21,20 +30,25 @@ import (
 type ModuleManager interface {
 	Init() error
 	Run()
-	DiscoverModulesState() (*ModulesState, error)
+	DiscoverModulesState(logLabels map[string]string) (*ModulesState, error)
 	GetModule(name string) (*Module, error)
 	GetModuleNamesInOrder() []string
 	GetGlobalHook(name string) (*GlobalHook, error)
 	GetModuleHook(name string) (*ModuleHook, error)
 	GetGlobalHooksInOrder(bindingType BindingType) []string
 	GetModuleHooksInOrder(moduleName string, bindingType BindingType) ([]string, error)
-	DeleteModule(moduleName string) error
-	RunModule(moduleName string, onStartup bool) error
-	RunGlobalHook(hookName string, binding BindingType, bindingContext []BindingContext) error
-	RunModuleHook(hookName string, binding BindingType, bindingContext []BindingContext) error
+	DeleteModule(moduleName string, logLabels map[string]string) error
+	RunModule(moduleName string, onStartup bool, logLabels map[string]string) error
+	RunGlobalHook(hookName string, binding BindingType, bindingContext []BindingContext, logLabels map[string]string) error
+	RunModuleHook(hookName string, binding BindingType, bindingContext []BindingContext, logLabels map[string]string) error
 	Retry()
+	DetectFilesChanges() (*FilesChanges, error)
+	ApplyFilesChanges(changes *FilesChanges) error
 	WithDirectories(modulesDir string, globalHooksDir string, tempDir string) ModuleManager
+	WithModuleSources(moduleSources []string) ModuleManager
 	WithKubeConfigManager(kubeConfigManager kube_config_manager.KubeConfigManager) ModuleManager
+	WithMetricStorage(metricStorage *metrics_storage.MetricStorage) ModuleManager
+	WithEventRecorder(eventRecorder *module_events.Recorder) ModuleManager
 }
 
 // ModulesState is a result of Discovery process, that determines which
@@ -48,6 +62,12 @@ type ModulesState struct {
 	ReleasedUnknownModules []string
 	// modules that was disabled and now are enabled
 	NewlyEnabledModules    []string
+	// modules enabled by values before running of enabled scripts
+	EnabledByConfigModules []string
+	// modules disabled because required modules are disabled, values are reasons
+	DisabledByDependencies map[string]string
+	// all known modules in the order of dependencies
+	AllModules []string
 }
 
 type MainModuleManager struct {
@@ -55,6 +75,8 @@ type MainModuleManager struct {
 	ModulesDir     string
 	GlobalHooksDir string
 	TempDir        string
+	// Directories with .tgz bundles or OCI image layouts with modules.
+	ModuleSources []string
 
 	// Index of all modules in modules directory. Key is module name.
 	allModulesByName map[string]*Module
@@ -62,15 +84,29 @@ type MainModuleManager struct {
 	// Ordered list of all modules names for ordered iterations of allModulesByName.
 	allModulesNamesInOrder []string
 
+	// Modules removed from modules directory until they are deleted.
+	removedModules map[string]*Module
+
+	// Checksums of loaded global hooks, common values and modules directories.
+	filesChecksums map[string]string
+	// Checksums of files from the last check of the modules directory.
+	watchedFilesChecksums map[string]string
+
 	// List of modules enabled by values.yaml or by kube config.
 	// This list is changed on ConfigMap updates.
 	enabledModulesByConfig []string
 
 	// Effective list of enabled modules after enabled script running.
-	// List is sorted by module name.
+	// List is sorted in the order of dependencies.
 	// This list is changed on ConfigMap changes.
 	enabledModulesInOrder []string
 
+	// Modules disabled because required modules are disabled. Values are reasons.
+	disabledByDependencies map[string]string
+
+	// Lock for global hooks indexes. They are replaced by the ReloadFiles task
+	// and read by the events handler.
+	globalHooksLock sync.RWMutex
 	// Index of all global hooks. Key is global hook name
 	globalHooksByName map[string]*GlobalHook
 	// Index for searching global hooks by their bindings.
@@ -85,10 +121,21 @@ type MainModuleManager struct {
 	// global section from modules/values.yaml file
 	globalCommonStaticValues utils.Values
 
+	// Lock for values from ConfigMap and for dynamic values patches.
+	// Tasks for different modules run concurrently and can read and update values simultaneously.
+	valuesLock sync.RWMutex
+
 	// global values from ConfigMap
 	kubeGlobalConfigValues utils.Values
 	// module values from ConfigMap, only for enabled modules
 	kubeModulesConfigValues map[string]utils.Values
+	// module sections from ConfigMap to calculate enabled modules after modules reload
+	kubeModuleConfigs kube_config_manager.ModuleConfigs
+
+	// Objects created by Kubernetes patches of failed hooks by hook names. They are not
+	// errors for Create operations when the hook is retried.
+	kubePatchCreated     map[string]map[string]bool
+	kubePatchCreatedLock sync.Mutex
 
 	// Invariant: do not store patches that cannot be applied.
 	// Give user error for patches early, after patch receive.
@@ -107,6 +154,11 @@ type MainModuleManager struct {
 
 	helm              helm.HelmClient
 	kubeConfigManager kube_config_manager.KubeConfigManager
+	metricStorage     *metrics_storage.MetricStorage
+	eventRecorder     *module_events.Recorder
+
+	// OpenAPI schemas for global and modules values.
+	ValuesValidator *values_validation.ValuesValidator
 
 	// Saved values from ConfigMap to handle Ambigous state.
 	moduleConfigsUpdateBeforeAmbiguos kube_config_manager.ModuleConfigs
@@ -130,18 +182,22 @@ const (
 	Schedule        BindingType = "SCHEDULE"
 	OnStartup       BindingType = "ON_STARTUP"
 	KubeEvents      BindingType = "KUBE_EVENTS"
+
+	// KubernetesValidating hooks are run by the validating webhook server, not by tasks.
+	KubernetesValidating BindingType = "KUBERNETES_VALIDATING"
 )
 
 // ContextBindingType is a reverse index for BindingType constants to use in BINDING_CONTEXT_PATH file.
 var ContextBindingType = map[BindingType]string{
-	BeforeHelm:      "beforeHelm",
-	AfterHelm:       "afterHelm",
-	AfterDeleteHelm: "afterDeleteHelm",
-	BeforeAll:       "beforeAll",
-	AfterAll:        "afterAll",
-	Schedule:        "schedule",
-	OnStartup:       "onStartup",
-	KubeEvents:      "onKubernetesEvent",
+	BeforeHelm:           "beforeHelm",
+	AfterHelm:            "afterHelm",
+	AfterDeleteHelm:      "afterDeleteHelm",
+	BeforeAll:            "beforeAll",
+	AfterAll:             "afterAll",
+	Schedule:             "schedule",
+	OnStartup:            "onStartup",
+	KubeEvents:           "onKubernetesEvent",
+	KubernetesValidating: "kubernetesValidating",
 }
 
 // BindingContext is a json with additional info for schedule and onKubeEvent hooks
@@ -151,6 +207,22 @@ type BindingContext struct {
 	ResourceNamespace string `json:"resourceNamespace,omitempty"`
 	ResourceKind      string `json:"resourceKind,omitempty"`
 	ResourceName      string `json:"resourceName,omitempty"`
+	// Object is the object from the informer cache for bindings with includeObject.
+	Object interface{} `json:"object,omitempty"`
+	// FilterResult is the object filtered with jqFilter for bindings with includeObject.
+	FilterResult interface{} `json:"filterResult,omitempty"`
+	// Snapshots are objects of all onKubernetesEvent bindings of the hook by binding name
+	// for bindings with includeSnapshots.
+	Snapshots map[string][]ObjectAndFilterResult `json:"snapshots,omitempty"`
+	// Review is the AdmissionReview with the request for kubernetesValidating bindings.
+	Review *admission.AdmissionReview `json:"review,omitempty"`
+}
+
+// ObjectAndFilterResult is an object in snapshots. Only one field is set: Object if
+// the binding has no jqFilter, FilterResult otherwise.
+type ObjectAndFilterResult struct {
+	Object       interface{} `json:"object,omitempty"`
+	FilterResult interface{} `json:"filterResult,omitempty"`
 }
 
 // EventType are events for the main loop.
@@ -163,6 +235,8 @@ const (
 	GlobalChanged EventType = "GLOBAL_CHANGED"
 	// Something wrong with module manager.
 	AmbigousState EventType = "AMBIGOUS_STATE"
+	// Modules or global hooks are changed on disk.
+	FilesChanged EventType = "FILES_CHANGED"
 )
 
 // ChangeType are types of module changes.
@@ -199,8 +273,11 @@ func NewMainModuleManager() *MainModuleManager {
 	return &MainModuleManager{
 		allModulesByName:            make(map[string]*Module),
 		allModulesNamesInOrder:      make([]string, 0),
+		removedModules:              make(map[string]*Module),
+		filesChecksums:              make(map[string]string),
 		enabledModulesByConfig:      make([]string, 0),
 		enabledModulesInOrder:       make([]string, 0),
+		disabledByDependencies:      make(map[string]string),
 		globalHooksByName:           make(map[string]*GlobalHook),
 		globalHooksOrder:            make(map[BindingType][]*GlobalHook),
 		modulesHooksOrderByName:     make(map[string]map[BindingType][]*ModuleHook),
@@ -210,11 +287,13 @@ func NewMainModuleManager() *MainModuleManager {
 		kubeModulesConfigValues:     make(map[string]utils.Values),
 		globalDynamicValuesPatches:  make([]utils.ValuesPatch, 0),
 		modulesDynamicValuesPatches: make(map[string][]utils.ValuesPatch),
+		kubePatchCreated:            make(map[string]map[string]bool),
 
 		moduleValuesChanged: make(chan string, 1),
 		globalValuesChanged: make(chan bool, 1),
 
 		kubeConfigManager: nil,
+		ValuesValidator:   values_validation.NewValuesValidator(),
 
 		moduleConfigsUpdateBeforeAmbiguos: make(kube_config_manager.ModuleConfigs),
 		retryOnAmbigous:                   make(chan bool, 1),
@@ -222,14 +301,26 @@ func NewMainModuleManager() *MainModuleManager {
 }
 
 // determineEnableStateWithScript runs enable script for each module that is enabled by config.
+// Modules are checked in the order of dependencies. Module is disabled without running
+// of enable script if one of required modules is disabled.
 // Enable script receives a list of previously enabled modules.
-func (mm *MainModuleManager) determineEnableStateWithScript(enabledByConfig []string) ([]string, error) {
+func (mm *MainModuleManager) determineEnableStateWithScript(enabledByConfig []string, logLabels map[string]string) ([]string, error) {
 	enabledModules := make([]string, 0)
+	disabledByDependencies := make(map[string]string)
 	//rlog.Infof("Run enable scripts for modules list: %s", enabledByConfig)
 
 	for _, name := range utils.SortByReference(enabledByConfig, mm.allModulesNamesInOrder) {
 		module := mm.allModulesByName[name]
-		moduleIsEnabled, err := module.checkIsEnabledByScript(enabledModules)
+		if reason := mm.disabledDependency(module, enabledModules); reason != "" {
+			disabledByDependencies[name] = reason
+			if mm.disabledByDependencies[name] != reason {
+				rlog.Infof("DISCOVER module '%s' is disabled: %s", name, reason)
+				mm.eventRecorder.ModuleWarning(name, module_events.ReasonDependencyDisabled, "Module is disabled: %s", reason)
+			}
+			continue
+		}
+
+		moduleIsEnabled, err := module.checkIsEnabledByScript(enabledModules, logLabels)
 		if err != nil {
 			return nil, err
 		}
@@ -240,6 +331,7 @@ func (mm *MainModuleManager) determineEnableStateWithScript(enabledByConfig []st
 	}
 
 	//rlog.Info("Modules enabled with script: %s", enabledModules)
+	mm.disabledByDependencies = disabledByDependencies
 	return enabledModules, nil
 }
 
@@ -248,13 +340,17 @@ type kubeUpdate struct {
 	EnabledModulesByConfig  []string
 	KubeGlobalConfigValues  utils.Values
 	KubeModulesConfigValues map[string]utils.Values
+	KubeModuleConfigs       kube_config_manager.ModuleConfigs
 	Events                  []Event
 }
 
 func (mm *MainModuleManager) applyKubeUpdate(kubeUpdate *kubeUpdate) error {
 	rlog.Debugf("Apply kubeupdate %+v", kubeUpdate)
+	mm.valuesLock.Lock()
 	mm.kubeGlobalConfigValues = kubeUpdate.KubeGlobalConfigValues
 	mm.kubeModulesConfigValues = kubeUpdate.KubeModulesConfigValues
+	mm.kubeModuleConfigs = kubeUpdate.KubeModuleConfigs
+	mm.valuesLock.Unlock()
 	mm.enabledModulesByConfig = kubeUpdate.EnabledModulesByConfig
 
 	for _, event := range kubeUpdate.Events {
@@ -269,6 +365,7 @@ func (mm *MainModuleManager) handleNewKubeConfig(newConfig kube_config_manager.C
 
 	res := &kubeUpdate{
 		KubeGlobalConfigValues: newConfig.Values,
+		KubeModuleConfigs:      newConfig.ModuleConfigs,
 		Events:                 []Event{{Type: GlobalChanged}},
 	}
 
@@ -290,6 +387,7 @@ func (mm *MainModuleManager) handleNewKubeModuleConfigs(moduleConfigs kube_confi
 	res := &kubeUpdate{
 		Events:                 make([]Event, 0),
 		KubeGlobalConfigValues: mm.kubeGlobalConfigValues,
+		KubeModuleConfigs:      moduleConfigs,
 	}
 
 	// NOTE: values for non changed modules were copied from mm.kubeModulesConfigValues[moduleName].
@@ -320,7 +418,7 @@ func (mm *MainModuleManager) handleNewKubeModuleConfigs(moduleConfigs kube_confi
 
 	// Run enable scripts
 	rlog.Infof("HANDLE_CM_UPD run `enabled` for %s", res.EnabledModulesByConfig)
-	enabledModules, err := mm.determineEnableStateWithScript(res.EnabledModulesByConfig)
+	enabledModules, err := mm.determineEnableStateWithScript(res.EnabledModulesByConfig, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -429,8 +527,32 @@ func (mm *MainModuleManager) Init() error {
 		return err
 	}
 
+	checksums, _, err := mm.calculateFilesChecksums()
+	if err != nil {
+		return fmt.Errorf("INIT: calculate checksums of modules and global hooks: %s", err)
+	}
+	mm.filesChecksums = checksums
+	mm.watchedFilesChecksums = checksums
+
 	kubeConfig := mm.kubeConfigManager.InitialConfig()
+	if validator, ok := mm.kubeConfigManager.(kube_config_manager.ConfigValidator); ok {
+		// An invalid object is skipped, other modules start with their configs.
+		if err := mm.validateGlobalKubeConfig(kubeConfig.Values); err != nil {
+			validator.RejectInitialConfig(kube_config_manager.GlobalModuleConfigName, err)
+		}
+		for moduleName, moduleConfig := range kubeConfig.ModuleConfigs {
+			if err := mm.validateModuleKubeConfig(moduleName, moduleConfig.Values); err != nil {
+				validator.RejectInitialConfig(moduleName, err)
+			}
+		}
+		kubeConfig = mm.kubeConfigManager.InitialConfig()
+		validator.WithConfigValidator(mm.validateKubeConfigObject)
+	} else {
+		// An invalid section is skipped, other modules start with their configs.
+		kubeConfig = mm.rejectInvalidKubeConfig(kubeConfig)
+	}
 	mm.kubeGlobalConfigValues = kubeConfig.Values
+	mm.kubeModuleConfigs = kubeConfig.ModuleConfigs
 
 	var unknown []utils.ModuleConfig
 	mm.enabledModulesByConfig, mm.kubeModulesConfigValues, unknown = mm.calculateEnabledModulesByConfig(kubeConfig.ModuleConfigs)
@@ -448,8 +570,17 @@ func (mm *MainModuleManager) Init() error {
 func (mm *MainModuleManager) Run() {
 	go mm.kubeConfigManager.Run()
 
+	// Modules directory is checked periodically if reload is enabled.
+	var filesCheckCh <-chan time.Time
+	if app.ReloadFilesInterval > 0 {
+		filesCheckCh = time.NewTicker(app.ReloadFilesInterval).C
+	}
+
 	for {
 		select {
+		case <-filesCheckCh:
+			mm.watchFiles()
+
 		case <-mm.globalValuesChanged:
 			rlog.Debugf("MODULE_MANAGER_RUN global values")
 			EventCh <- Event{Type: GlobalChanged}
@@ -468,6 +599,9 @@ func (mm *MainModuleManager) Run() {
 			}
 
 		case newKubeConfig := <-kube_config_manager.ConfigUpdated:
+			// Invalid sections keep their previous configs, other sections are updated.
+			newKubeConfig = *mm.rejectInvalidKubeConfig(&newKubeConfig)
+
 			handleRes, err := mm.handleNewKubeConfig(newKubeConfig)
 			if err != nil {
 				rlog.Errorf("MODULE_MANAGER_RUN unable to handle kube config update: %s", err)
@@ -483,6 +617,10 @@ func (mm *MainModuleManager) Run() {
 			// Сбросить запомненные перед ошибкой конфиги
 			mm.moduleConfigsUpdateBeforeAmbiguos = kube_config_manager.ModuleConfigs{}
 
+			// Invalid values should not be applied and should not be retried.
+			// Other modules are updated, an invalid module keeps its previous config.
+			newModuleConfigs = mm.rejectInvalidModuleConfigs(newModuleConfigs)
+
 			handleRes, err := mm.handleNewKubeModuleConfigs(newModuleConfigs)
 			if err != nil {
 				mm.moduleConfigsUpdateBeforeAmbiguos = newModuleConfigs
@@ -514,6 +652,152 @@ func (mm *MainModuleManager) Run() {
 	}
 }
 
+// rejectInvalidKubeConfig returns the config from ConfigMap with previous values for invalid sections.
+// Global section and module sections merged with static values are checked separately against config
+// values schemas, so an invalid section does not block updates of other modules.
+func (mm *MainModuleManager) rejectInvalidKubeConfig(kubeConfig *kube_config_manager.Config) *kube_config_manager.Config {
+	res := &kube_config_manager.Config{
+		Values:        kubeConfig.Values,
+		ModuleConfigs: mm.rejectInvalidModuleConfigs(kubeConfig.ModuleConfigs),
+	}
+
+	if err := mm.validateGlobalKubeConfig(kubeConfig.Values); err != nil {
+		rlog.Errorf("MODULE_MANAGER_RUN reject global section of kube config: %s", err)
+		mm.valuesLock.RLock()
+		res.Values = mm.kubeGlobalConfigValues
+		mm.valuesLock.RUnlock()
+		if res.Values == nil {
+			res.Values = make(utils.Values)
+		}
+	}
+
+	return res
+}
+
+// validateKubeConfigObject checks values of one ModuleConfig object. It is called
+// by the kube config manager before the object is applied.
+func (mm *MainModuleManager) validateKubeConfigObject(name string, values utils.Values) error {
+	if name == kube_config_manager.GlobalModuleConfigName {
+		return mm.validateGlobalKubeConfig(values)
+	}
+	return mm.validateModuleKubeConfig(name, values)
+}
+
+func (mm *MainModuleManager) validateGlobalKubeConfig(globalValues utils.Values) error {
+	err := mm.ValuesValidator.ValidateGlobalConfigValues(utils.MergeValues(mm.globalCommonStaticValues, globalValues))
+	if err != nil {
+		mm.sendValidationErrorMetric(utils.GlobalValuesKey)
+	}
+	return err
+}
+
+// validateModuleKubeConfig checks module values merged with static values. Unknown modules are skipped.
+func (mm *MainModuleManager) validateModuleKubeConfig(moduleName string, values utils.Values) error {
+	module, has := mm.allModulesByName[moduleName]
+	if !has {
+		return nil
+	}
+	values = utils.MergeValues(module.CommonStaticConfig.Values, module.StaticConfig.Values, values)
+	err := mm.ValuesValidator.ValidateModuleConfigValues(utils.ModuleNameToValuesKey(moduleName), values)
+	if err != nil {
+		mm.sendValidationErrorMetric(moduleName)
+	}
+	return err
+}
+
+// rejectInvalidModuleConfigs returns module configs with previous configs for modules with invalid values.
+// A module without a previous config is removed.
+func (mm *MainModuleManager) rejectInvalidModuleConfigs(moduleConfigs kube_config_manager.ModuleConfigs) kube_config_manager.ModuleConfigs {
+	mm.valuesLock.RLock()
+	prevModuleConfigs := mm.kubeModuleConfigs
+	mm.valuesLock.RUnlock()
+
+	validConfigs := make(kube_config_manager.ModuleConfigs)
+	for moduleName, moduleConfig := range moduleConfigs {
+		err := mm.validateModuleKubeConfig(moduleName, moduleConfig.Values)
+		if err == nil {
+			validConfigs[moduleName] = moduleConfig
+			continue
+		}
+		rlog.Errorf("MODULE_MANAGER_RUN reject module '%s' kube config update: %s", moduleName, err)
+		if prevConfig, has := prevModuleConfigs[moduleName]; has {
+			prevConfig.IsUpdated = false
+			validConfigs[moduleName] = prevConfig
+		}
+	}
+	return validConfigs
+}
+
+func (mm *MainModuleManager) sendValidationErrorMetric(moduleName string) {
+	if mm.metricStorage == nil {
+		return
+	}
+	mm.metricStorage.SendCounterMetric(app.PrometheusMetricsPrefix+"config_values_errors", 1.0, map[string]string{"module": moduleName})
+}
+
+// observeDuration sends a time passed since start to a histogram.
+func (mm *MainModuleManager) observeDuration(metric string, start time.Time, labels map[string]string) {
+	if mm.metricStorage == nil {
+		return
+	}
+	mm.metricStorage.SendHistogramMetric(app.PrometheusMetricsPrefix+metric, time.Since(start).Seconds(), labels, metrics_storage.DurationBuckets)
+}
+
+// sendCounterMetric increases a counter of the operator.
+func (mm *MainModuleManager) sendCounterMetric(metric string, labels map[string]string) {
+	if mm.metricStorage == nil {
+		return
+	}
+	mm.metricStorage.SendCounterMetric(app.PrometheusMetricsPrefix+metric, 1.0, labels)
+}
+
+// applyKubernetesPatch applies Kubernetes operations returned by the hook with the shell-operator kube clients.
+// Created objects are remembered until the hook results are saved, so Create operations succeed when the hook
+// is retried after a failed operation or a failed values update.
+func (mm *MainModuleManager) applyKubernetesPatch(hookName string, operations []kube_patch.Operation) error {
+	if len(operations) == 0 {
+		return nil
+	}
+	if kube.Kubernetes == nil || kube.DynamicClient == nil {
+		return fmt.Errorf("kubernetes client is not initialized")
+	}
+
+	mm.kubePatchCreatedLock.Lock()
+	created := mm.kubePatchCreated[hookName]
+	mm.kubePatchCreatedLock.Unlock()
+	if created == nil {
+		created = make(map[string]bool)
+	}
+
+	err := kube_patch.NewObjectPatcher(kube.DynamicClient, kube.Kubernetes.Discovery()).WithCreated(created).Apply(operations)
+
+	if len(created) > 0 {
+		mm.kubePatchCreatedLock.Lock()
+		mm.kubePatchCreated[hookName] = created
+		mm.kubePatchCreatedLock.Unlock()
+	}
+	return err
+}
+
+// forgetKubernetesPatch is called after the hook results are saved, so objects created by the hook are not
+// ignored by Create operations of the next hook run.
+func (mm *MainModuleManager) forgetKubernetesPatch(hookName string) {
+	mm.kubePatchCreatedLock.Lock()
+	delete(mm.kubePatchCreated, hookName)
+	mm.kubePatchCreatedLock.Unlock()
+}
+
+// sendHookMetrics stores metrics written by the hook to METRICS_PATH file.
+// Bad metrics are logged and do not fail the hook.
+func (mm *MainModuleManager) sendHookMetrics(metrics []metrics_storage.MetricOperation, labels map[string]string) {
+	if mm.metricStorage == nil || len(metrics) == 0 {
+		return
+	}
+	if err := mm.metricStorage.SendHookMetrics(metrics, labels); err != nil {
+		rlog.Errorf("Hook '%s' metrics: %s", labels["hook"], err)
+	}
+}
+
 func (mm *MainModuleManager) Retry() {
 	rlog.Debugf("MODULE_MANAGER Retry on ambigous")
 	mm.retryOnAmbigous <- true
@@ -524,7 +808,9 @@ func (mm *MainModuleManager) Retry() {
 // modules that should be disabled and modules that should be purged.
 //
 // This method requires that mm.enabledModulesByConfig and mm.kubeModulesConfigValues are updated.
-func (mm *MainModuleManager) DiscoverModulesState() (state *ModulesState, err error) {
+func (mm *MainModuleManager) DiscoverModulesState(logLabels map[string]string) (state *ModulesState, err error) {
+	defer mm.observeDuration("modules_discover_seconds", time.Now(), map[string]string{})
+
 	rlog.Debugf("DISCOVER state:\n"+
 		"    mm.enabledModulesByConfig: %v\n"+
 		"    mm.enabledModulesInOrder:  %v\n",
@@ -557,7 +843,7 @@ func (mm *MainModuleManager) DiscoverModulesState() (state *ModulesState, err er
 	// no need to refresh mm.enabledModulesByConfig because
 	// it is updated before in Init or in applyKubeUpdate
 	rlog.Infof("DISCOVER run `enabled` for %s", mm.enabledModulesByConfig)
-	enabledModules, err := mm.determineEnableStateWithScript(mm.enabledModulesByConfig)
+	enabledModules, err := mm.determineEnableStateWithScript(mm.enabledModulesByConfig, logLabels)
 	rlog.Infof("DISCOVER enabled modules %s", enabledModules)
 	if err != nil {
 		return nil, err
@@ -570,13 +856,19 @@ func (mm *MainModuleManager) DiscoverModulesState() (state *ModulesState, err er
 	}
 
 	state.EnabledModules = enabledModules
+	state.EnabledByConfigModules = append([]string{}, mm.enabledModulesByConfig...)
+	state.AllModules = append([]string{}, mm.allModulesNamesInOrder...)
+	state.DisabledByDependencies = make(map[string]string)
+	for name, reason := range mm.disabledByDependencies {
+		state.DisabledByDependencies[name] = reason
+	}
 
 	state.NewlyEnabledModules = utils.ListSubtract(enabledModules, mm.enabledModulesInOrder)
 	// save enabled modules for future usages
 	mm.enabledModulesInOrder = enabledModules
 
 	// Calculate modules that has helm release and are disabled for now.
-	// Sort them in reverse order for proper deletion.
+	// Sort them in reverse order of dependencies: consumers are deleted before providers.
 	state.ModulesToDisable = utils.ListSubtract(mm.allModulesNamesInOrder, enabledModules)
 	state.ModulesToDisable = utils.ListIntersection(state.ModulesToDisable, releasedModules)
 	state.ModulesToDisable = utils.SortReverseByReference(state.ModulesToDisable, mm.allModulesNamesInOrder)
@@ -610,7 +902,9 @@ func (mm *MainModuleManager) GetModuleNamesInOrder() []string {
 }
 
 func (mm *MainModuleManager) GetGlobalHook(name string) (*GlobalHook, error) {
+	mm.globalHooksLock.RLock()
 	globalHook, exist := mm.globalHooksByName[name]
+	mm.globalHooksLock.RUnlock()
 	if exist {
 		return globalHook, nil
 	} else {
@@ -632,8 +926,10 @@ func (mm *MainModuleManager) GetModuleHook(name string) (*ModuleHook, error) {
 }
 
 func (mm *MainModuleManager) GetGlobalHooksInOrder(bindingType BindingType) []string {
-	globalHooks, ok := mm.globalHooksOrder[bindingType]
-	if !ok {
+	mm.globalHooksLock.RLock()
+	globalHooks := append([]*GlobalHook{}, mm.globalHooksOrder[bindingType]...)
+	mm.globalHooksLock.RUnlock()
+	if len(globalHooks) == 0 {
 		return []string{}
 	}
 
@@ -677,36 +973,65 @@ func (mm *MainModuleManager) GetModuleHooksInOrder(moduleName string, bindingTyp
 }
 
 // TODO: moduleManager.Module(modName).Delete()
-func (mm *MainModuleManager) DeleteModule(moduleName string) error {
+func (mm *MainModuleManager) DeleteModule(moduleName string, logLabels map[string]string) error {
 	module, err := mm.GetModule(moduleName)
 	if err != nil {
-		return err
+		removedModule, isRemoved := mm.removedModules[moduleName]
+		if !isRemoved {
+			return err
+		}
+		module = removedModule
 	}
 
-	if err := module.Delete(); err != nil {
+	if err := module.Delete(logLabels); err != nil {
+		mm.eventRecorder.ModuleWarning(moduleName, module_events.ReasonModuleDeleteFailed, "Module delete failed: %s", err)
 		return err
 	}
 
 	// remove hooks structures
 	mm.removeModuleHooks(moduleName)
+	delete(mm.removedModules, moduleName)
+	mm.expireModuleSourceMetric(moduleName)
 
 	return nil
 }
 
 // RunModule runs beforeHelm hook, helm upgrade --install and afterHelm or afterDeleteHelm hook
-func (mm *MainModuleManager) RunModule(moduleName string, onStartup bool) error {
+func (mm *MainModuleManager) RunModule(moduleName string, onStartup bool, logLabels map[string]string) error {
 	module, err := mm.GetModule(moduleName)
 	if err != nil {
 		return err
 	}
 
-	if err := module.Run(onStartup); err != nil {
+	if err := module.Run(onStartup, logLabels); err != nil {
+		mm.recordModuleRunError(moduleName, err)
 		return err
 	}
+	mm.sendModuleSourceMetric(module)
 
 	return nil
 }
 
+// recordModuleRunError emits an event with a reason depending on the failed phase of the module run.
+func (mm *MainModuleManager) recordModuleRunError(moduleName string, err error) {
+	reason := module_events.ReasonModuleRunFailed
+	phase := ""
+	if phaseErr, ok := err.(*ModuleRunPhaseError); ok {
+		phase = phaseErr.Phase
+		switch phase {
+		case "helm":
+			reason = module_events.ReasonHelmUpgradeFailed
+		case "onStartup", "beforeHelm", "afterHelm":
+			reason = module_events.ReasonHookFailed
+		}
+	}
+	if phase != "" {
+		mm.eventRecorder.ModuleWarning(moduleName, reason, "Module run failed in phase '%s': %s", phase, err)
+		return
+	}
+	mm.eventRecorder.ModuleWarning(moduleName, reason, "Module run failed: %s", err)
+}
+
 func valuesChecksum(valuesArr ...utils.Values) (string, error) {
 	valuesJson, err := json.Marshal(utils.MergeValues(valuesArr...))
 	if err != nil {
@@ -715,7 +1040,7 @@ func valuesChecksum(valuesArr ...utils.Values) (string, error) {
 	return utils_checksum.CalculateChecksum(string(valuesJson)), nil
 }
 
-func (mm *MainModuleManager) RunGlobalHook(hookName string, binding BindingType, bindingContext []BindingContext) error {
+func (mm *MainModuleManager) RunGlobalHook(hookName string, binding BindingType, bindingContext []BindingContext, logLabels map[string]string) error {
 	globalHook, err := mm.GetGlobalHook(hookName)
 	if err != nil {
 		return err
@@ -726,7 +1051,7 @@ func (mm *MainModuleManager) RunGlobalHook(hookName string, binding BindingType,
 		return err
 	}
 
-	if err := globalHook.run(binding, bindingContext); err != nil {
+	if err := globalHook.run(binding, bindingContext, logLabels); err != nil {
 		return err
 	}
 
@@ -745,7 +1070,7 @@ func (mm *MainModuleManager) RunGlobalHook(hookName string, binding BindingType,
 	return nil
 }
 
-func (mm *MainModuleManager) RunModuleHook(hookName string, binding BindingType, bindingContext []BindingContext) error {
+func (mm *MainModuleManager) RunModuleHook(hookName string, binding BindingType, bindingContext []BindingContext, logLabels map[string]string) error {
 	moduleHook, err := mm.GetModuleHook(hookName)
 	if err != nil {
 		return err
@@ -756,7 +1081,7 @@ func (mm *MainModuleManager) RunModuleHook(hookName string, binding BindingType,
 		return err
 	}
 
-	if err := moduleHook.run(binding, bindingContext); err != nil {
+	if err := moduleHook.run(binding, bindingContext, logLabels); err != nil {
 		return err
 	}
 
@@ -782,11 +1107,26 @@ func (mm *MainModuleManager) WithDirectories(modulesDir string, globalHooksDir s
 	return mm
 }
 
+func (mm *MainModuleManager) WithModuleSources(moduleSources []string) ModuleManager {
+	mm.ModuleSources = moduleSources
+	return mm
+}
+
 func (mm *MainModuleManager) WithKubeConfigManager(kubeConfigManager kube_config_manager.KubeConfigManager) ModuleManager {
 	mm.kubeConfigManager = kubeConfigManager
 	return mm
 }
 
+func (mm *MainModuleManager) WithMetricStorage(metricStorage *metrics_storage.MetricStorage) ModuleManager {
+	mm.metricStorage = metricStorage
+	return mm
+}
+
+func (mm *MainModuleManager) WithEventRecorder(eventRecorder *module_events.Recorder) ModuleManager {
+	mm.eventRecorder = eventRecorder
+	return mm
+}
+
 // mergeEnabled merges enabled flags. Enabled flag can be nil.
 //
 // If all flags are nil, then false is returned — module is disabled by default.
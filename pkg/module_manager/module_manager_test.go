@@ -24,6 +24,7 @@ import (
 	"github.com/flant/addon-operator/pkg/helm"
 	"github.com/flant/addon-operator/pkg/kube_config_manager"
 	"github.com/flant/addon-operator/pkg/utils"
+	"github.com/flant/addon-operator/pkg/values_validation"
 )
 
 
@@ -208,6 +209,77 @@ func Test_MainModuleManager_LoadValuesInInit(t *testing.T) {
 				assert.Contains(t, mm.enabledModulesByConfig, "with-kube-values")
 			},
 		},
+		{
+			"with_openapi_schemas",
+			"load_values__with_openapi_schemas",
+			func() {
+				assert.NotNil(t, mm.ValuesValidator.GetGlobalSchema(values_validation.ConfigValuesSchema))
+				assert.NotNil(t, mm.ValuesValidator.GetModuleSchema("withSchemas", values_validation.ConfigValuesSchema))
+				assert.NotNil(t, mm.ValuesValidator.GetModuleSchema("withSchemas", values_validation.ValuesSchema))
+
+				// defaults from schemas are applied under static values
+				values := mm.allModulesByName["with-schemas"].constructValues()
+				expectedValues := utils.Values{
+					"global": map[string]interface{}{
+						"project":     "test",
+						"clusterName": "cluster",
+					},
+					"withSchemas": map[string]interface{}{
+						"replicas": 2.0,
+						"storage": map[string]interface{}{
+							"class": "standard",
+							"size":  "10Gi",
+						},
+					},
+				}
+				assert.Equal(t, expectedValues, values)
+
+				// invalid ConfigMap sections are rejected separately, previous values are kept
+				mm.kubeGlobalConfigValues = utils.Values{"global": map[string]interface{}{"project": "prev"}}
+				kubeConfig := mm.rejectInvalidKubeConfig(&kube_config_manager.Config{
+					Values: utils.Values{"global": map[string]interface{}{"project": 1}},
+					ModuleConfigs: map[string]utils.ModuleConfig{
+						"with-schemas": *utils.NewModuleConfig("with-schemas").WithValues(utils.Values{
+							"withSchemas": map[string]interface{}{"replicas": 0},
+						}),
+						"unknown": *utils.NewModuleConfig("unknown"),
+					},
+				})
+				assert.Equal(t, mm.kubeGlobalConfigValues, kubeConfig.Values)
+				assert.NotContains(t, kubeConfig.ModuleConfigs, "with-schemas")
+				assert.Contains(t, kubeConfig.ModuleConfigs, "unknown")
+
+				// required fields are checked in ConfigMap values merged with static values
+				assert.NoError(t, mm.validateGlobalKubeConfig(utils.Values{"global": map[string]interface{}{"clusterName": "main"}}))
+				assert.NoError(t, mm.validateModuleKubeConfig("with-schemas", utils.Values{
+					"withSchemas": map[string]interface{}{"name": "app"},
+				}))
+				err := mm.validateModuleKubeConfig("with-schemas", utils.Values{
+					"withSchemas": map[string]interface{}{"replicas": 3},
+				})
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), "name")
+				}
+
+				// invalid module config is rejected, the previous config of the module is kept
+				mm.kubeModuleConfigs = map[string]utils.ModuleConfig{
+					"with-schemas": *utils.NewModuleConfig("with-schemas").WithValues(utils.Values{
+						"withSchemas": map[string]interface{}{"replicas": 3},
+					}),
+				}
+				newConfig := utils.NewModuleConfig("with-schemas").WithValues(utils.Values{
+					"withSchemas": map[string]interface{}{"replicas": 0},
+				})
+				newConfig.IsUpdated = true
+				moduleConfigs := mm.rejectInvalidModuleConfigs(map[string]utils.ModuleConfig{
+					"with-schemas": *newConfig,
+					"unknown":      *utils.NewModuleConfig("unknown"),
+				})
+				assert.Contains(t, moduleConfigs, "unknown")
+				assert.False(t, moduleConfigs["with-schemas"].IsUpdated)
+				assert.Equal(t, mm.kubeModuleConfigs["with-schemas"].Values, moduleConfigs["with-schemas"].Values)
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -253,6 +325,7 @@ func Test_MainModuleManager_Get_Module(t *testing.T) {
 						IsUpdated:        false,
 						ModuleConfigKey:  "module",
 						ModuleEnabledKey: "moduleEnabled",
+						ModuleMaxRetriesKey: "moduleMaxRetries",
 						RawConfig:        []string{},
 					},
 					StaticConfig: &utils.ModuleConfig{
@@ -262,6 +335,7 @@ func Test_MainModuleManager_Get_Module(t *testing.T) {
 						IsUpdated:        false,
 						ModuleConfigKey:  "module",
 						ModuleEnabledKey: "moduleEnabled",
+						ModuleMaxRetriesKey: "moduleMaxRetries",
 						RawConfig:        []string{},
 					},
 					moduleManager: mm,
@@ -328,20 +402,21 @@ func Test_MainModuleManager_Get_ModuleHook(t *testing.T) {
 							AfterDeleteHelm: 1.0,
 							OnStartup:       1.0,
 						},
+						nil,
 						mm,
 					},
 					&Module{},
 					&ModuleHookConfig{
 						HookConfig{
 							1.0,
-							[]schedule_manager.ScheduleConfig{
-								{
+							[]ScheduleConfig{
+								{ScheduleConfig: schedule_manager.ScheduleConfig{
 									Crontab:      "* * * * *",
 									AllowFailure: true,
-								},
+								}, Queue: "cleanup"},
 							},
-							[]kube_events_manager.OnKubernetesEventConfig{
-								{
+							[]OnKubernetesEventConfig{
+								{OnKubernetesEventConfig: kube_events_manager.OnKubernetesEventConfig{
 									EventTypes: []kube_events_manager.OnKubernetesEventType{kube_events_manager.KubernetesEventOnAdd},
 									Kind:       "configmap",
 									Selector: &metav1.LabelSelector{
@@ -362,8 +437,8 @@ func Test_MainModuleManager_Get_ModuleHook(t *testing.T) {
 									},
 									JqFilter:     ".items[] | del(.metadata, .field1)",
 									AllowFailure: true,
-								},
-								{
+								}},
+								{OnKubernetesEventConfig: kube_events_manager.OnKubernetesEventConfig{
 									EventTypes: []kube_events_manager.OnKubernetesEventType{
 										kube_events_manager.KubernetesEventOnAdd,
 										kube_events_manager.KubernetesEventOnUpdate,
@@ -388,8 +463,8 @@ func Test_MainModuleManager_Get_ModuleHook(t *testing.T) {
 									},
 									JqFilter:     ".items[] | del(.metadata, .field2)",
 									AllowFailure: true,
-								},
-								{
+								}},
+								{OnKubernetesEventConfig: kube_events_manager.OnKubernetesEventConfig{
 									EventTypes: []kube_events_manager.OnKubernetesEventType{
 										kube_events_manager.KubernetesEventOnAdd,
 										kube_events_manager.KubernetesEventOnUpdate,
@@ -414,8 +489,13 @@ func Test_MainModuleManager_Get_ModuleHook(t *testing.T) {
 									},
 									JqFilter:     ".items[] | del(.metadata, .field3)",
 									AllowFailure: true,
-								},
+								}},
 							},
+							0,
+							false,
+							"",
+							nil,
+							0,
 						},
 						1.0,
 						1.0,
@@ -440,6 +520,7 @@ func Test_MainModuleManager_Get_ModuleHook(t *testing.T) {
 						map[BindingType]float64 {
 							BeforeHelm: 1.0,
 						},
+						nil,
 						mm,
 					},
 					&Module{},
@@ -486,7 +567,7 @@ func Test_MainModuleManager_Get_ModuleHooksInOrder(t *testing.T) {
 
 	initModuleManager(t, mm, "get__module_hooks_in_order")
 
-	_, _ = mm.DiscoverModulesState()
+	_, _ = mm.DiscoverModulesState(nil)
 
 	var moduleHooks []string
 	var err error
@@ -590,7 +671,7 @@ func Test_MainModuleManager_RunModule(t *testing.T) {
 		},
 	}
 
-	err := mm.RunModule(moduleName, false)
+	err := mm.RunModule(moduleName, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -635,7 +716,7 @@ func Test_MainModuleManager_DeleteModule(t *testing.T) {
 		},
 	}
 
-	err := mm.DeleteModule(moduleName)
+	err := mm.DeleteModule(moduleName, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -771,7 +852,7 @@ func Test_MainModuleManager_RunModuleHook(t *testing.T) {
 			mm.kubeModulesConfigValues[expectation.moduleName] = expectation.kubeModuleConfigValues
 			mm.modulesDynamicValuesPatches[expectation.moduleName] = expectation.moduleDynamicValuesPatches
 
-			if err := mm.RunModuleHook(expectation.hookName, BeforeHelm, nil); err != nil {
+			if err := mm.RunModuleHook(expectation.hookName, BeforeHelm, nil, nil); err != nil {
 				t.Fatal(err)
 			}
 
@@ -818,19 +899,20 @@ func Test_MainModuleManager_Get_GlobalHook(t *testing.T) {
 							AfterAll:  1.0,
 							OnStartup: 1.0,
 						},
+						nil,
 						mm,
 					},
 					&GlobalHookConfig{
 						HookConfig{
 							1.0,
-							[]schedule_manager.ScheduleConfig{
-								{
+							[]ScheduleConfig{
+								{ScheduleConfig: schedule_manager.ScheduleConfig{
 									Crontab:      "* * * * *",
 									AllowFailure: true,
-								},
+								}},
 							},
-							[]kube_events_manager.OnKubernetesEventConfig{
-								{
+							[]OnKubernetesEventConfig{
+								{OnKubernetesEventConfig: kube_events_manager.OnKubernetesEventConfig{
 									EventTypes: []kube_events_manager.OnKubernetesEventType{kube_events_manager.KubernetesEventOnAdd},
 									Kind:       "configmap",
 									Selector: &metav1.LabelSelector{
@@ -851,8 +933,8 @@ func Test_MainModuleManager_Get_GlobalHook(t *testing.T) {
 									},
 									JqFilter:     ".items[] | del(.metadata, .field1)",
 									AllowFailure: true,
-								},
-								{
+								}},
+								{OnKubernetesEventConfig: kube_events_manager.OnKubernetesEventConfig{
 									EventTypes: []kube_events_manager.OnKubernetesEventType{
 										kube_events_manager.KubernetesEventOnAdd,
 										kube_events_manager.KubernetesEventOnUpdate,
@@ -877,8 +959,8 @@ func Test_MainModuleManager_Get_GlobalHook(t *testing.T) {
 									},
 									JqFilter:     ".items[] | del(.metadata, .field2)",
 									AllowFailure: true,
-								},
-								{
+								}},
+								{OnKubernetesEventConfig: kube_events_manager.OnKubernetesEventConfig{
 									EventTypes: []kube_events_manager.OnKubernetesEventType{
 										kube_events_manager.KubernetesEventOnAdd,
 										kube_events_manager.KubernetesEventOnUpdate,
@@ -903,8 +985,13 @@ func Test_MainModuleManager_Get_GlobalHook(t *testing.T) {
 									},
 									JqFilter:     ".items[] | del(.metadata, .field3)",
 									AllowFailure: true,
-								},
+								}},
 							},
+							0,
+							false,
+							"",
+							nil,
+							0,
 						},
 						1.0,
 						1.0,
@@ -928,6 +1015,7 @@ func Test_MainModuleManager_Get_GlobalHook(t *testing.T) {
 						map[BindingType]float64{
 							BeforeAll: 1.0,
 						},
+						nil,
 						mm,
 					},
 					&GlobalHookConfig{
@@ -935,6 +1023,11 @@ func Test_MainModuleManager_Get_GlobalHook(t *testing.T) {
 							nil,
 							nil,
 							nil,
+							0,
+							false,
+							"",
+							nil,
+							0,
 						},
 						1.0,
 						nil,
@@ -1093,7 +1186,7 @@ func Test_MainModuleManager_Run_GlobalHook(t *testing.T) {
 			mm.kubeGlobalConfigValues = expectation.kubeGlobalConfigValues
 			mm.globalDynamicValuesPatches = expectation.globalDynamicValuesPatches
 
-			if err := mm.RunGlobalHook(expectation.hookName, BeforeHelm, []BindingContext{}); err != nil {
+			if err := mm.RunGlobalHook(expectation.hookName, BeforeHelm, []BindingContext{}, nil); err != nil {
 				t.Fatal(err)
 			}
 
@@ -1149,7 +1242,7 @@ func Test_MainModuleManager_DiscoverModulesState(t *testing.T) {
 				// turn off alpha so gamma, delta and zeta should be disabled
 				// with the next call of DiscoverModulesState
 				mm.enabledModulesByConfig = []string{"beta", "gamma", "delta", "epsilon", "zeta", "eta"}
-				modulesState, err = mm.DiscoverModulesState()
+				modulesState, err = mm.DiscoverModulesState(nil)
 				assert.Equal(t, []string{"epsilon", "eta"}, modulesState.EnabledModules)
 			},
 		},
@@ -1181,7 +1274,7 @@ func Test_MainModuleManager_DiscoverModulesState(t *testing.T) {
 			mm = NewMainModuleManager()
 			initModuleManager(t, mm, test.configPath)
 
-			modulesState, err = mm.DiscoverModulesState()
+			modulesState, err = mm.DiscoverModulesState(nil)
 
 			test.testFn()
 		})
@@ -0,0 +1,108 @@
+package module_manager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/flant/addon-operator/pkg/kube_patch"
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// groupHooksByOrder splits hooks sorted by order into groups of hooks with the same order.
+// Hooks in a group are sorted by name.
+func groupHooksByOrder(hooks []*ModuleHook, binding BindingType) [][]*ModuleHook {
+	groups := make([][]*ModuleHook, 0)
+	for i, hook := range hooks {
+		if i == 0 || hooks[i-1].OrderByBinding[binding] != hook.OrderByBinding[binding] {
+			groups = append(groups, []*ModuleHook{})
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], hook)
+	}
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Name < group[j].Name
+		})
+	}
+	return groups
+}
+
+func isParallelGroup(hooks []*ModuleHook) bool {
+	for _, hook := range hooks {
+		if !hook.isParallel() {
+			return false
+		}
+	}
+	return true
+}
+
+// runHooksInParallel runs hooks concurrently with the same values. The binding fails
+// if one of hooks fails or if two hooks patch the same values path. Otherwise values
+// patches and Kubernetes operations are applied in order of hooks names.
+func runHooksInParallel(hooks []*ModuleHook, binding BindingType, logLabels map[string]string) error {
+	patches := make([]map[utils.ValuesPatchType]*utils.ValuesPatch, len(hooks))
+	kubeOperations := make([][]kube_patch.Operation, len(hooks))
+	errs := make([]error, len(hooks))
+
+	var wg sync.WaitGroup
+	for i, hook := range hooks {
+		wg.Add(1)
+		go func(i int, hook *ModuleHook) {
+			defer wg.Done()
+			patches[i], kubeOperations[i], errs[i] = hook.execute(binding, []BindingContext{{Binding: ContextBindingType[binding]}}, logLabels)
+		}(i, hook)
+	}
+	wg.Wait()
+
+	errMsgs := make([]string, 0)
+	for _, err := range errs {
+		if err != nil {
+			errMsgs = append(errMsgs, err.Error())
+		}
+	}
+	if len(errMsgs) > 0 {
+		return fmt.Errorf("parallel hooks failed: %s", strings.Join(errMsgs, "; "))
+	}
+
+	if err := detectPatchesConflicts(hooks, patches); err != nil {
+		return err
+	}
+
+	for i, hook := range hooks {
+		if err := hook.applyValuesPatches(patches[i], kubeOperations[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detectPatchesConflicts returns error if two hooks patch the same path or a path
+// and its child path of config values or of dynamic values.
+func detectPatchesConflicts(hooks []*ModuleHook, patches []map[utils.ValuesPatchType]*utils.ValuesPatch) error {
+	for _, patchType := range []utils.ValuesPatchType{utils.ConfigMapPatch, utils.MemoryValuesPatch} {
+		// Patched path -> hook name.
+		patchedBy := make(map[string]string)
+		for i, hook := range hooks {
+			patch := patches[i][patchType]
+			if patch == nil {
+				continue
+			}
+			for _, op := range patch.Operations {
+				for path, otherHook := range patchedBy {
+					if otherHook != hook.Name && isSameOrNestedPath(path, op.Path) {
+						return fmt.Errorf("parallel hooks '%s' and '%s' patch the same values path '%s'", otherHook, hook.Name, op.Path)
+					}
+				}
+			}
+			for _, op := range patch.Operations {
+				patchedBy[op.Path] = hook.Name
+			}
+		}
+	}
+	return nil
+}
+
+func isSameOrNestedPath(a string, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
@@ -0,0 +1,101 @@
+package module_manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+func Test_groupHooksByOrder(t *testing.T) {
+	newHook := func(name string, order float64) *ModuleHook {
+		hook := NewModuleHook(name, name, &ModuleHookConfig{}, nil)
+		hook.OrderByBinding[BeforeHelm] = order
+		return hook
+	}
+	hooks := []*ModuleHook{newHook("c", 1), newHook("a", 1), newHook("b", 2)}
+
+	groups := groupHooksByOrder(hooks, BeforeHelm)
+	if assert.Len(t, groups, 2) {
+		assert.Equal(t, "a", groups[0][0].Name)
+		assert.Equal(t, "c", groups[0][1].Name)
+		assert.Equal(t, "b", groups[1][0].Name)
+	}
+}
+
+func Test_detectPatchesConflicts(t *testing.T) {
+	hooks := []*ModuleHook{{CommonHook: &CommonHook{Name: "a"}}, {CommonHook: &CommonHook{Name: "b"}}}
+	patch := func(paths ...string) map[utils.ValuesPatchType]*utils.ValuesPatch {
+		ops := make([]*utils.ValuesPatchOperation, 0)
+		for _, path := range paths {
+			ops = append(ops, &utils.ValuesPatchOperation{Op: "add", Path: path, Value: 1})
+		}
+		return map[utils.ValuesPatchType]*utils.ValuesPatch{utils.MemoryValuesPatch: {Operations: ops}}
+	}
+
+	assert.NoError(t, detectPatchesConflicts(hooks, []map[utils.ValuesPatchType]*utils.ValuesPatch{
+		patch("/module/a", "/module/a/b"), patch("/module/ab"),
+	}))
+	assert.Error(t, detectPatchesConflicts(hooks, []map[utils.ValuesPatchType]*utils.ValuesPatch{
+		patch("/module/a"), patch("/module/a"),
+	}))
+	assert.Error(t, detectPatchesConflicts(hooks, []map[utils.ValuesPatchType]*utils.ValuesPatch{
+		patch("/module/a/b"), patch("/module/a"),
+	}))
+}
+
+func Test_Module_runHooksByBinding_Parallel(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	writeFile(t, filepath.Join(modulesDir, "010-module", "module.yaml"), "parallelHooks: true\n")
+	writeFile(t, filepath.Join(modulesDir, "010-module", "values.yaml"), "moduleEnabled: true\nmodule:\n  internal: {}\n")
+	for _, key := range []string{"a", "b"} {
+		writeHook(t, filepath.Join(modulesDir, "010-module", "hooks", key), `
+if [[ "$1" == "--config" ]]; then echo '{"beforeHelm": 1}'; exit 0; fi
+echo '[{"op": "add", "path": "/module/internal/`+key+`", "value": "`+key+`"}]' > $VALUES_JSON_PATCH_PATH
+`)
+	}
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, filepath.Join(rootDir, "global-hooks"), rootDir)
+	if err := mm.initModulesIndex(); err != nil {
+		t.Fatal(err)
+	}
+	module, _ := mm.GetModule("module")
+	assert.True(t, module.ParallelHooks)
+	if err := mm.initModuleHooks(module); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.NoError(t, module.runHooksByBinding(BeforeHelm, nil)) {
+		internal := module.values()["module"].(map[string]interface{})["internal"].(map[string]interface{})
+		assert.Equal(t, "a", internal["a"])
+		assert.Equal(t, "b", internal["b"])
+	}
+
+	// Hooks patch the same path.
+	writeHook(t, filepath.Join(modulesDir, "010-module", "hooks", "b"), `
+if [[ "$1" == "--config" ]]; then echo '{"beforeHelm": 1}'; exit 0; fi
+echo '[{"op": "add", "path": "/module/internal/a", "value": "b"}]' > $VALUES_JSON_PATCH_PATH
+`)
+	err = module.runHooksByBinding(BeforeHelm, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "patch the same values path")
+	}
+}
+
+func writeHook(t *testing.T, path string, script string) {
+	writeFile(t, path, "#!/usr/bin/env bash\n"+script)
+	if err := os.Chmod(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
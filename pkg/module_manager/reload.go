@@ -0,0 +1,267 @@
+package module_manager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/romana/rlog"
+
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// Keys of checksums of files.
+const (
+	globalHooksChecksumKey = "global-hooks"
+	valuesChecksumKey      = "values"
+	moduleChecksumPrefix   = "module/"
+
+	// failedReloadChecksum is saved for files that are not reloaded because of an error.
+	failedReloadChecksum = "reload-failed"
+)
+
+// FilesChanges are changes of global hooks and modules on disk found by DetectFilesChanges.
+type FilesChanges struct {
+	// GlobalHooksChanged is true if global hooks are added, removed or changed.
+	GlobalHooksChanged bool
+	// ValuesChanged is true if modules/values.yaml or modules/openapi are changed. All modules are reloaded.
+	ValuesChanged bool
+	// ChangedModules are modules with changed files.
+	ChangedModules []string
+	// RemovedModules are modules that are removed from the modules directory.
+	RemovedModules []string
+	// NewModules are modules that are added to the modules directory.
+	NewModules []string
+
+	// DiscoveryNeeded is set by ApplyFilesChanges if modules are added
+	// or the list of modules enabled by config is changed.
+	DiscoveryNeeded bool
+
+	checksums   map[string]string
+	modulesDirs []moduleDir
+}
+
+// IsEmpty returns true if there are no changes.
+func (c *FilesChanges) IsEmpty() bool {
+	return !c.GlobalHooksChanged && !c.ValuesChanged &&
+		len(c.ChangedModules) == 0 && len(c.RemovedModules) == 0 && len(c.NewModules) == 0
+}
+
+// DetectFilesChanges compares checksums of global hooks and modules directories
+// with checksums of loaded files.
+func (mm *MainModuleManager) DetectFilesChanges() (*FilesChanges, error) {
+	checksums, modulesDirs, err := mm.calculateFilesChecksums()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &FilesChanges{
+		ChangedModules: make([]string, 0),
+		RemovedModules: make([]string, 0),
+		NewModules:     make([]string, 0),
+		checksums:      checksums,
+		modulesDirs:    modulesDirs,
+	}
+
+	changes.GlobalHooksChanged = checksums[globalHooksChecksumKey] != mm.filesChecksums[globalHooksChecksumKey]
+	changes.ValuesChanged = checksums[valuesChecksumKey] != mm.filesChecksums[valuesChecksumKey]
+
+	for _, moduleDir := range modulesDirs {
+		key := moduleChecksumPrefix + moduleDir.Name
+		oldChecksum, has := mm.filesChecksums[key]
+		if !has {
+			changes.NewModules = append(changes.NewModules, moduleDir.Name)
+		} else if oldChecksum != checksums[key] {
+			changes.ChangedModules = append(changes.ChangedModules, moduleDir.Name)
+		}
+	}
+
+	for _, moduleName := range mm.allModulesNamesInOrder {
+		if _, has := checksums[moduleChecksumPrefix+moduleName]; !has {
+			changes.RemovedModules = append(changes.RemovedModules, moduleName)
+		}
+	}
+
+	return changes, nil
+}
+
+// ApplyFilesChanges reloads global hooks, values and modules from disk. Hooks of changed
+// and removed modules are removed from the index, hooks of enabled changed modules
+// are loaded again. Removed modules are available only for DeleteModule.
+//
+// Checksums are saved only if all changes are applied. On error checksums of changed files
+// are reset, so all changes are detected again even if files are reverted: objects can be
+// partially reloaded. Modules are removed after all files are loaded, so a failed reload keeps them.
+func (mm *MainModuleManager) ApplyFilesChanges(changes *FilesChanges) (err error) {
+	defer func() {
+		if err != nil {
+			mm.resetFilesChecksums(changes)
+		}
+	}()
+
+	if changes.GlobalHooksChanged {
+		rlog.Infof("RELOAD: global hooks")
+		if err := mm.initGlobalHooks(); err != nil {
+			return err
+		}
+	}
+
+	changedModules := changes.ChangedModules
+	if changes.ValuesChanged {
+		rlog.Infof("RELOAD: common values and global values schemas")
+		if err := mm.loadCommonStaticValues(); err != nil {
+			return err
+		}
+		if err := mm.loadGlobalValuesSchemas(); err != nil {
+			return err
+		}
+		// Common values contain sections for all modules.
+		changedModules = utils.ListSubtract(mm.allModulesNamesInOrder, changes.RemovedModules)
+	}
+
+	dirs := make(map[string]moduleDir)
+	for _, moduleDir := range changes.modulesDirs {
+		dirs[moduleDir.Name] = moduleDir
+	}
+
+	for _, moduleName := range changes.NewModules {
+		rlog.Infof("RELOAD: register new module '%s'", moduleName)
+		module := NewModule(mm)
+		dirs[moduleName].apply(module)
+		if err := module.loadValuesFiles(); err != nil {
+			return err
+		}
+		delete(mm.removedModules, moduleName)
+		mm.allModulesByName[moduleName] = module
+	}
+
+	enabledModules := make(map[string]bool)
+	for _, moduleName := range mm.enabledModulesInOrder {
+		enabledModules[moduleName] = true
+	}
+
+	for _, moduleName := range changedModules {
+		rlog.Infof("RELOAD: module '%s'", moduleName)
+		module := mm.allModulesByName[moduleName]
+		dirs[moduleName].apply(module)
+		if err := module.loadValuesFiles(); err != nil {
+			return err
+		}
+		mm.removeModuleHooks(moduleName)
+		if enabledModules[moduleName] {
+			if err := mm.initModuleHooks(module); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, moduleName := range changes.RemovedModules {
+		rlog.Infof("RELOAD: module '%s' is removed", moduleName)
+		module := mm.allModulesByName[moduleName]
+		module.isRemoved = true
+		mm.removedModules[moduleName] = module
+		delete(mm.allModulesByName, moduleName)
+		mm.removeModuleHooks(moduleName)
+		mm.enabledModulesInOrder = utils.ListSubtract(mm.enabledModulesInOrder, []string{moduleName})
+	}
+
+	mm.allModulesNamesInOrder = make([]string, 0)
+	for _, moduleDir := range changes.modulesDirs {
+		if _, has := mm.allModulesByName[moduleDir.Name]; has {
+			mm.allModulesNamesInOrder = append(mm.allModulesNamesInOrder, moduleDir.Name)
+		}
+	}
+
+	mm.filesChecksums = make(map[string]string)
+	for key, checksum := range changes.checksums {
+		mm.filesChecksums[key] = checksum
+	}
+
+	// Modules can be enabled or disabled in values.yaml files.
+	mm.valuesLock.Lock()
+	enabledByConfig, values, _ := mm.calculateEnabledModulesByConfig(mm.kubeModuleConfigs)
+	mm.kubeModulesConfigValues = values
+	mm.valuesLock.Unlock()
+
+	changes.DiscoveryNeeded = len(changes.NewModules) > 0 || !reflect.DeepEqual(enabledByConfig, mm.enabledModulesByConfig)
+	mm.enabledModulesByConfig = enabledByConfig
+
+	mm.removeUnusedModuleSources()
+
+	return nil
+}
+
+// resetFilesChecksums marks changed files as not loaded.
+func (mm *MainModuleManager) resetFilesChecksums(changes *FilesChanges) {
+	if changes.GlobalHooksChanged {
+		mm.filesChecksums[globalHooksChecksumKey] = failedReloadChecksum
+	}
+	if changes.ValuesChanged {
+		mm.filesChecksums[valuesChecksumKey] = failedReloadChecksum
+	}
+	for _, moduleName := range changes.ChangedModules {
+		mm.filesChecksums[moduleChecksumPrefix+moduleName] = failedReloadChecksum
+	}
+}
+
+// calculateFilesChecksums returns checksums of the global hooks directory, common values
+// and modules directories.
+func (mm *MainModuleManager) calculateFilesChecksums() (map[string]string, []moduleDir, error) {
+	modulesDirs, err := mm.readModulesDirs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	checksums := make(map[string]string)
+
+	checksums[globalHooksChecksumKey], err = pathsChecksum(mm.GlobalHooksDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	checksums[valuesChecksumKey], err = pathsChecksum(filepath.Join(mm.ModulesDir, "values.yaml"), filepath.Join(mm.ModulesDir, OpenAPIDir))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, moduleDir := range modulesDirs {
+		checksum, err := pathsChecksum(moduleDir.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Module is changed if it is moved to another directory or to another source.
+		checksums[moduleChecksumPrefix+moduleDir.Name] = utils.CalculateStringsChecksum(moduleDir.Path, checksum)
+	}
+
+	return checksums, modulesDirs, nil
+}
+
+// watchFiles sends FilesChanged event if checksums of files are changed since the last check.
+func (mm *MainModuleManager) watchFiles() {
+	checksums, _, err := mm.calculateFilesChecksums()
+	if err != nil {
+		rlog.Errorf("MODULE_MANAGER_RUN cannot calculate checksums of modules and global hooks: %s", err)
+		return
+	}
+	if reflect.DeepEqual(checksums, mm.watchedFilesChecksums) {
+		return
+	}
+	mm.watchedFilesChecksums = checksums
+
+	rlog.Infof("MODULE_MANAGER_RUN modules or global hooks are changed on disk")
+	EventCh <- Event{Type: FilesChanged}
+}
+
+// pathsChecksum returns a checksum of existing files and directories.
+func pathsChecksum(paths ...string) (string, error) {
+	existingPaths := make([]string, 0)
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			existingPaths = append(existingPaths, path)
+		}
+	}
+	if len(existingPaths) == 0 {
+		return "", nil
+	}
+	return utils.CalculateChecksumOfPaths(existingPaths...)
+}
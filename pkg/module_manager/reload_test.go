@@ -0,0 +1,265 @@
+package module_manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flant/addon-operator/pkg/kube_config_manager"
+)
+
+func Test_MainModuleManager_ReloadFiles(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	writeFile(t, filepath.Join(modulesDir, "000-module-one", "values.yaml"), "moduleOneEnabled: true\n")
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, filepath.Join(rootDir, "global-hooks"), rootDir)
+	if err := mm.initModulesIndex(); err != nil {
+		t.Fatal(err)
+	}
+	mm.filesChecksums, _, err = mm.calculateFilesChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm.kubeModuleConfigs = kube_config_manager.ModuleConfigs{}
+	mm.enabledModulesByConfig, mm.kubeModulesConfigValues, _ = mm.calculateEnabledModulesByConfig(mm.kubeModuleConfigs)
+	mm.enabledModulesInOrder = []string{"module-one"}
+
+	changes, err := mm.DetectFilesChanges()
+	if assert.NoError(t, err) {
+		assert.True(t, changes.IsEmpty())
+	}
+
+	// New module and changed module.
+	writeFile(t, filepath.Join(modulesDir, "000-module-one", "values.yaml"), "moduleOneEnabled: true\nmoduleOne:\n  param: 1\n")
+	writeFile(t, filepath.Join(modulesDir, "010-module-two", "values.yaml"), "moduleTwoEnabled: true\n")
+
+	changes, err = mm.DetectFilesChanges()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"module-one"}, changes.ChangedModules)
+	assert.Equal(t, []string{"module-two"}, changes.NewModules)
+	assert.False(t, changes.GlobalHooksChanged)
+
+	assert.NoError(t, mm.ApplyFilesChanges(changes))
+	assert.True(t, changes.DiscoveryNeeded)
+	assert.Equal(t, []string{"module-one", "module-two"}, mm.allModulesNamesInOrder)
+	assert.Equal(t, []string{"module-one", "module-two"}, mm.enabledModulesByConfig)
+	module, _ := mm.GetModule("module-one")
+	assert.Equal(t, 1.0, module.StaticConfig.Values["moduleOne"].(map[string]interface{})["param"])
+
+	// Removed module is available only for deletion.
+	assert.NoError(t, os.RemoveAll(filepath.Join(modulesDir, "000-module-one")))
+
+	changes, err = mm.DetectFilesChanges()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"module-one"}, changes.RemovedModules)
+
+	assert.NoError(t, mm.ApplyFilesChanges(changes))
+	_, err = mm.GetModule("module-one")
+	assert.Error(t, err)
+	assert.True(t, mm.removedModules["module-one"].isRemoved)
+	assert.Empty(t, mm.GetModuleNamesInOrder())
+
+	changes, err = mm.DetectFilesChanges()
+	if assert.NoError(t, err) {
+		assert.True(t, changes.IsEmpty())
+	}
+}
+
+// Changes are detected again after a failed reload, removed modules are kept until the reload succeeds.
+func Test_MainModuleManager_ReloadFiles_Failed(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	writeFile(t, filepath.Join(modulesDir, "000-module-one", "values.yaml"), "moduleOneEnabled: true\n")
+	writeFile(t, filepath.Join(modulesDir, "010-module-two", "values.yaml"), "moduleTwoEnabled: true\n")
+	writeFile(t, filepath.Join(modulesDir, "020-module-three", "values.yaml"), "moduleThreeEnabled: true\n")
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, filepath.Join(rootDir, "global-hooks"), rootDir)
+	if err := mm.initModulesIndex(); err != nil {
+		t.Fatal(err)
+	}
+	mm.filesChecksums, _, err = mm.calculateFilesChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm.kubeModuleConfigs = kube_config_manager.ModuleConfigs{}
+	mm.enabledModulesByConfig, mm.kubeModulesConfigValues, _ = mm.calculateEnabledModulesByConfig(mm.kubeModuleConfigs)
+	mm.enabledModulesInOrder = []string{"module-one", "module-two", "module-three"}
+
+	// module-one is reloaded, then values of module-two are broken.
+	writeFile(t, filepath.Join(modulesDir, "000-module-one", "values.yaml"), "moduleOneEnabled: true\nmoduleOne:\n  param: 1\n")
+	writeFile(t, filepath.Join(modulesDir, "010-module-two", "values.yaml"), "moduleTwo: [\n")
+	assert.NoError(t, os.RemoveAll(filepath.Join(modulesDir, "020-module-three")))
+
+	changes, err := mm.DetectFilesChanges()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"module-one", "module-two"}, changes.ChangedModules)
+	assert.Error(t, mm.ApplyFilesChanges(changes))
+	assert.Equal(t, []string{"module-one", "module-two", "module-three"}, mm.GetModuleNamesInOrder())
+	_, err = mm.GetModule("module-three")
+	assert.NoError(t, err)
+
+	// All changes are applied again.
+	changes, err = mm.DetectFilesChanges()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"module-one", "module-two"}, changes.ChangedModules)
+	assert.Equal(t, []string{"module-three"}, changes.RemovedModules)
+
+	writeFile(t, filepath.Join(modulesDir, "010-module-two", "values.yaml"), "moduleTwoEnabled: true\n")
+	changes, err = mm.DetectFilesChanges()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, mm.ApplyFilesChanges(changes))
+	assert.Equal(t, []string{"module-one", "module-two"}, mm.GetModuleNamesInOrder())
+
+	changes, err = mm.DetectFilesChanges()
+	if assert.NoError(t, err) {
+		assert.True(t, changes.IsEmpty())
+	}
+}
+
+func Test_MainModuleManager_ModuleSources(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	writeFile(t, filepath.Join(modulesDir, "010-module-one", "values.yaml"), "moduleOneEnabled: true\n")
+	writeFile(t, filepath.Join(modulesDir, "020-module-two", "values.yaml"), "moduleTwoEnabled: true\n")
+
+	// Bundle replaces module-two and adds module-three.
+	bundlesDir := filepath.Join(rootDir, "bundles")
+	writeBundle := func(content string) [sha256.Size]byte {
+		buf := new(bytes.Buffer)
+		gzw := gzip.NewWriter(buf)
+		tw := tar.NewWriter(gzw)
+		for _, name := range []string{"015-module-two/values.yaml", "030-module-three/values.yaml"} {
+			assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+			_, _ = tw.Write([]byte(content))
+		}
+		assert.NoError(t, tw.Close())
+		assert.NoError(t, gzw.Close())
+		sum := sha256.Sum256(buf.Bytes())
+		writeFile(t, filepath.Join(bundlesDir, "modules.tgz"), buf.String())
+		writeFile(t, filepath.Join(bundlesDir, "modules.tgz.sha256"), hex.EncodeToString(sum[:])+"  modules.tgz\n")
+		return sum
+	}
+	sum := writeBundle("fromBundle: true\n")
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, filepath.Join(rootDir, "global-hooks"), rootDir)
+	mm.WithModuleSources([]string{bundlesDir})
+	if !assert.NoError(t, mm.initModulesIndex()) {
+		return
+	}
+
+	assert.Equal(t, []string{"module-one", "module-two", "module-three"}, mm.allModulesNamesInOrder)
+	module, _ := mm.GetModule("module-one")
+	assert.Equal(t, "", module.Source)
+	module, _ = mm.GetModule("module-two")
+	assert.Equal(t, "015-module-two", module.DirectoryName)
+	assert.Equal(t, filepath.Join(bundlesDir, "modules.tgz"), module.Source)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), module.Version)
+	assert.FileExists(t, filepath.Join(module.Path, "values.yaml"))
+	assert.Equal(t, filepath.Join(rootDir, "module-sources"), filepath.Dir(filepath.Dir(module.Path)))
+
+	// Unpacked files of the previous version are removed after reload.
+	mm.filesChecksums, _, err = mm.calculateFilesChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm.kubeModuleConfigs = kube_config_manager.ModuleConfigs{}
+	oldDir := filepath.Dir(module.Path)
+	newSum := writeBundle("fromBundle: true\nversion: 2\n")
+	changes, err := mm.DetectFilesChanges()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"module-two", "module-three"}, changes.ChangedModules)
+	assert.NoError(t, mm.ApplyFilesChanges(changes))
+	module, _ = mm.GetModule("module-two")
+	assert.Equal(t, "sha256:"+hex.EncodeToString(newSum[:]), module.Version)
+	assert.FileExists(t, filepath.Join(module.Path, "values.yaml"))
+	_, err = os.Stat(oldDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_MainModuleManager_ReloadGlobalHooks_Concurrent(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	globalHooksDir := filepath.Join(rootDir, "global-hooks")
+	writeHook(t, filepath.Join(globalHooksDir, "hook"), `
+if [[ "$1" == "--config" ]]; then echo '{"beforeAll": 1}'; exit 0; fi
+`)
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(filepath.Join(rootDir, "modules"), globalHooksDir, rootDir)
+	if err := mm.initGlobalHooks(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run with -race: hooks are read by the events handler while ReloadFiles replaces them.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, mm.initGlobalHooks())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			_, err := mm.GetGlobalHook("hook")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"hook"}, mm.GetGlobalHooksInOrder(BeforeAll))
+			return
+		default:
+			_, _ = mm.GetGlobalHook("hook")
+			_ = mm.GetGlobalHooksInOrder(BeforeAll)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package module_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/romana/rlog"
+
+	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/helm"
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// HookPatchesFixture is a result of a hook run: patches for config values and for dynamic values.
+// Fixtures are used instead of hooks to render modules.
+type HookPatchesFixture struct {
+	ConfigValues *utils.ValuesPatch
+	Values       *utils.ValuesPatch
+}
+
+// ModuleRender is a result of module rendering: effective values and manifests from helm template.
+type ModuleRender struct {
+	Values    utils.Values `json:"values"`
+	Manifests string       `json:"manifests,omitempty"`
+}
+
+// RenderResult is a result of modules rendering.
+type RenderResult struct {
+	EnabledModules []string                `json:"enabledModules"`
+	Modules        map[string]ModuleRender `json:"modules"`
+}
+
+// LoadHookPatchesFixtures reads patches by hook names from a YAML file:
+//
+//	<hook name>:
+//	  configValues:  # the same as in CONFIG_VALUES_JSON_PATCH_PATH file
+//	  - {"op": "add", "path": "/global/a", "value": 1}
+//	  values:        # the same as in VALUES_JSON_PATCH_PATH file
+//	  - {"op": "add", "path": "/global/b", "value": 2}
+func LoadHookPatchesFixtures(filePath string) (map[string]HookPatchesFixture, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonContent, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return nil, fmt.Errorf("bad yaml in hook patches file '%s': %s", filePath, err)
+	}
+
+	var rawFixtures map[string]map[string]json.RawMessage
+	err = json.Unmarshal(jsonContent, &rawFixtures)
+	if err != nil {
+		return nil, fmt.Errorf("bad hook patches file '%s': %s", filePath, err)
+	}
+
+	fixtures := make(map[string]HookPatchesFixture)
+	for hookName, rawPatches := range rawFixtures {
+		fixture := HookPatchesFixture{}
+		for key, rawPatch := range rawPatches {
+			patch, err := utils.ValuesPatchFromBytes(rawPatch)
+			if err != nil {
+				return nil, fmt.Errorf("bad patch '%s' for hook '%s': %s", key, hookName, err)
+			}
+			switch key {
+			case "configValues":
+				fixture.ConfigValues = patch
+			case "values":
+				fixture.Values = patch
+			default:
+				return nil, fmt.Errorf("bad patch '%s' for hook '%s': use 'configValues' or 'values'", key, hookName)
+			}
+		}
+		fixtures[hookName] = fixture
+	}
+
+	return fixtures, nil
+}
+
+func (f HookPatchesFixture) patches() map[utils.ValuesPatchType]*utils.ValuesPatch {
+	return map[utils.ValuesPatchType]*utils.ValuesPatch{
+		utils.ConfigMapPatch:    f.ConfigValues,
+		utils.MemoryValuesPatch: f.Values,
+	}
+}
+
+// Render calculates enabled modules and their values without Kubernetes.
+// Hooks are not executed, patches from fixtures are applied instead. Global hooks patches
+// are applied before enabled scripts, module hooks patches are applied for enabled modules.
+// Manifests are rendered with helm template if module has a chart.
+//
+// Init should be called before Render.
+func (mm *MainModuleManager) Render(fixtures map[string]HookPatchesFixture) (*RenderResult, error) {
+	hookNames := make([]string, 0, len(fixtures))
+	for hookName := range fixtures {
+		hookNames = append(hookNames, hookName)
+	}
+	sort.Strings(hookNames)
+
+	moduleHookNames := make([]string, 0)
+	for _, hookName := range hookNames {
+		globalHook, err := mm.GetGlobalHook(hookName)
+		if err != nil {
+			moduleHookNames = append(moduleHookNames, hookName)
+			continue
+		}
+		if err := globalHook.applyValuesPatches(fixtures[hookName].patches(), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	enabledModules, err := mm.determineEnableStateWithScript(mm.enabledModulesByConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	mm.enabledModulesInOrder = enabledModules
+
+	for _, moduleName := range enabledModules {
+		if err := mm.initModuleHooks(mm.allModulesByName[moduleName]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hookName := range moduleHookNames {
+		moduleHook, err := mm.GetModuleHook(hookName)
+		if err != nil {
+			rlog.Warnf("RENDER: ignore patches for hook '%s': hook is not found or module is disabled", hookName)
+			continue
+		}
+		if err := moduleHook.applyValuesPatches(fixtures[hookName].patches(), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &RenderResult{
+		EnabledModules: enabledModules,
+		Modules:        make(map[string]ModuleRender),
+	}
+
+	for _, moduleName := range enabledModules {
+		module := mm.allModulesByName[moduleName]
+		moduleRender := ModuleRender{Values: module.values()}
+
+		chartExists, err := module.checkHelmChart()
+		if err != nil {
+			return nil, fmt.Errorf("module '%s': %s", moduleName, err)
+		}
+		if chartExists {
+			runChartPath, valuesPath, err := module.prepareHelmChart()
+			if err != nil {
+				return nil, err
+			}
+			moduleRender.Manifests, err = helm.Client.Render(module.generateHelmReleaseName(), runChartPath, []string{valuesPath}, nil, app.Namespace)
+			if err != nil {
+				return nil, fmt.Errorf("module '%s': %s", moduleName, err)
+			}
+		}
+
+		result.Modules[moduleName] = moduleRender
+	}
+
+	return result, nil
+}
@@ -0,0 +1,92 @@
+package module_manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flant/addon-operator/pkg/helm"
+	"github.com/flant/addon-operator/pkg/kube_config_manager"
+)
+
+func Test_MainModuleManager_Render(t *testing.T) {
+	rootDir := filepath.Join("testdata", "render")
+
+	hc := &helm.MockHelmClient{}
+	helm.Client = hc
+
+	tempDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	configData, err := kube_config_manager.ConfigDataFromFile(filepath.Join(rootDir, "config_map.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubeConfig, err := kube_config_manager.NewConfigFromConfigData(configData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixtures, err := LoadHookPatchesFixtures(filepath.Join(rootDir, "hook_patches.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, fixtures, 3)
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(filepath.Join(rootDir, "modules"), filepath.Join(rootDir, "global-hooks"), tempDir)
+	mm.WithKubeConfigManager(kube_config_manager.NewStaticKubeConfigManager(kubeConfig))
+	if err := mm.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := mm.Render(fixtures)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// beta is enabled by the enabled script because of the global hook patch.
+	assert.Equal(t, []string{"alpha", "beta"}, result.EnabledModules)
+
+	alpha := result.Modules["alpha"]
+	alphaValues := alpha.Values["alpha"].(map[string]interface{})
+	assert.Equal(t, 2.0, alphaValues["replicas"])
+	assert.Equal(t, "nginx", alphaValues["image"])
+	assert.Equal(t, "patched", alphaValues["fromHook"])
+	globalValues := alpha.Values["global"].(map[string]interface{})
+	assert.Equal(t, "render", globalValues["project"])
+	assert.Equal(t, []string{"alpha", "beta"}, globalValues["enabledModules"])
+
+	assert.True(t, hc.RenderExecuted)
+	assert.Equal(t, "# Source: alpha\n", alpha.Manifests)
+	// beta has no chart.
+	assert.Equal(t, "", result.Modules["beta"].Manifests)
+}
+
+func Test_Module_checkHelmChart(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	exists, err := (&Module{Path: tempDir}).checkHelmChart()
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	writeFile(t, filepath.Join(tempDir, "Chart.yaml"), "name: module\n")
+	exists, err = (&Module{Path: tempDir}).checkHelmChart()
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// Module path is a file: Chart.yaml cannot be checked.
+	exists, err = (&Module{Path: filepath.Join(tempDir, "Chart.yaml")}).checkHelmChart()
+	assert.Error(t, err)
+	assert.False(t, exists)
+}
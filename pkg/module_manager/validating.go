@@ -0,0 +1,151 @@
+package module_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/satori/go.uuid.v1"
+	admission "k8s.io/api/admission/v1beta1"
+
+	"github.com/flant/addon-operator/pkg/app"
+	"github.com/flant/addon-operator/pkg/executor"
+	"github.com/flant/addon-operator/pkg/logger"
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// ValidatingResponse is a verdict of a hook for an admission request. A shell hook writes it
+// into the file from the VALIDATING_RESPONSE_PATH environment variable:
+//
+//	{"allowed": false, "message": "Ingress should have a TLS secret"}
+type ValidatingResponse struct {
+	Allowed bool   `json:"allowed"`
+	Message string `json:"message,omitempty"`
+}
+
+// ValidatingResponseFromFile reads a verdict. An empty file is an error: the hook should decide.
+func ValidatingResponseFromFile(filePath string) (*ValidatingResponse, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", filePath, err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, fmt.Errorf("validating response is not written")
+	}
+	res := &ValidatingResponse{}
+	if err := json.Unmarshal(data, res); err != nil {
+		return nil, fmt.Errorf("bad validating response: %s", err)
+	}
+	return res, nil
+}
+
+// RunValidating runs the global hook for the admission request with app.ValidatingHookTimeout.
+// It is called by the webhook server outside of queues, so values patches, metrics and
+// Kubernetes operations of the hook are ignored.
+func (h *GlobalHook) RunValidating(bindingName string, review *admission.AdmissionReview, logLabels map[string]string) (*ValidatingResponse, error) {
+	logLabels = utils.MergeLabels(logLabels, map[string]string{
+		logger.HookField:    h.Name,
+		logger.BindingField: string(KubernetesValidating),
+	})
+	return h.moduleManager.runValidating(h.CommonHook, h.configValues(), h.values(), bindingName, review, logLabels, map[string]string{"hook": h.Name})
+}
+
+// RunValidating runs the module hook for the admission request with app.ValidatingHookTimeout.
+// It is called by the webhook server outside of queues, so values patches, metrics and
+// Kubernetes operations of the hook are ignored.
+func (h *ModuleHook) RunValidating(bindingName string, review *admission.AdmissionReview, logLabels map[string]string) (*ValidatingResponse, error) {
+	logLabels = utils.MergeLabels(logLabels, map[string]string{
+		logger.ModuleField:  h.Module.Name,
+		logger.HookField:    h.Name,
+		logger.BindingField: string(KubernetesValidating),
+	})
+	return h.moduleManager.runValidating(h.CommonHook, h.configValues(), h.values(), bindingName, review, logLabels, map[string]string{"module": h.Module.Name, "hook": h.Name})
+}
+
+func (mm *MainModuleManager) runValidating(h *CommonHook, configValues, values utils.Values, bindingName string, review *admission.AdmissionReview, logLabels map[string]string, metricLabels map[string]string) (*ValidatingResponse, error) {
+	context := []BindingContext{{Binding: bindingName, Review: review}}
+
+	start := time.Now()
+	var res *ValidatingResponse
+	var err error
+	if h.GoHook != nil {
+		var output *GoHookOutput
+		output, err = runGoHook(h.GoHook, &GoHookInput{
+			BindingType:    KubernetesValidating,
+			BindingContext: context,
+			ConfigValues:   configValues,
+			Values:         values,
+			LogEntry:       logger.WithLabels(logLabels),
+		})
+		if err == nil {
+			res = output.ValidatingResponse
+			if res == nil {
+				err = fmt.Errorf("validating response is not returned")
+			}
+		}
+	} else {
+		res, err = mm.execValidating(h, configValues, values, context, logLabels)
+	}
+	mm.observeDuration("validating_hook_run_seconds", start, metricLabels)
+
+	if executor.IsTimeout(err) {
+		mm.sendCounterMetric("validating_hook_errors", metricLabels)
+		return nil, fmt.Errorf("hook '%s' timed out: %s", h.Name, err)
+	}
+	if err != nil {
+		mm.sendCounterMetric("validating_hook_errors", metricLabels)
+		return nil, fmt.Errorf("hook '%s' failed: %s", h.Name, err)
+	}
+	return res, nil
+}
+
+// execValidating runs the executable file of the hook. Requests are handled concurrently,
+// so every run has its own temporary files.
+func (mm *MainModuleManager) execValidating(h *CommonHook, configValues, values utils.Values, context []BindingContext, logLabels map[string]string) (*ValidatingResponse, error) {
+	prefix := filepath.Join(mm.TempDir, fmt.Sprintf("%s.validating-%s", h.SafeName(), uuid.NewV4().String()))
+	tmpFiles := map[string]string{
+		"CONFIG_VALUES_PATH":       prefix + "-config-values.json",
+		"VALUES_PATH":              prefix + "-values.json",
+		"BINDING_CONTEXT_PATH":     prefix + "-binding-context.json",
+		"VALIDATING_RESPONSE_PATH": prefix + "-response.json",
+	}
+	defer func() {
+		for _, filePath := range tmpFiles {
+			_ = os.Remove(filePath)
+		}
+	}()
+
+	contents := map[string]interface{}{
+		"CONFIG_VALUES_PATH":   configValues,
+		"VALUES_PATH":          values,
+		"BINDING_CONTEXT_PATH": context,
+	}
+	for envName, content := range contents {
+		data, err := json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(tmpFiles[envName], data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	if err := ioutil.WriteFile(tmpFiles["VALIDATING_RESPONSE_PATH"], []byte{}, 0644); err != nil {
+		return nil, err
+	}
+
+	envs := os.Environ()
+	for envName, filePath := range tmpFiles {
+		envs = append(envs, fmt.Sprintf("%s=%s", envName, filePath))
+	}
+
+	cmd := executor.MakeCommand("", h.Path, []string{}, envs)
+	if err := executor.RunAndLogLines(cmd, logLabels, app.ValidatingHookTimeout); err != nil {
+		return nil, err
+	}
+
+	return ValidatingResponseFromFile(tmpFiles["VALIDATING_RESPONSE_PATH"])
+}
@@ -0,0 +1,80 @@
+package module_manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admission "k8s.io/api/admission/v1beta1"
+
+	"github.com/flant/addon-operator/pkg/app"
+)
+
+func Test_ModuleHook_RunValidating(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "addon-operator-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	oldTimeout := app.ValidatingHookTimeout
+	defer func() {
+		app.ValidatingHookTimeout = oldTimeout
+	}()
+	app.ValidatingHookTimeout = 5 * time.Second
+
+	modulesDir := filepath.Join(rootDir, "modules")
+	writeFile(t, filepath.Join(modulesDir, "010-module", "values.yaml"), "moduleEnabled: true\nmodule:\n  ingressClass: nginx\n")
+	hookPath := filepath.Join(modulesDir, "010-module", "hooks", "hook")
+	writeHook(t, hookPath, `
+if [[ "$1" == "--config" ]]; then
+  echo '{"kubernetesValidating": [{"name": "ingresses", "rules": [{"operations": ["CREATE"], "apiGroups": [""], "apiVersions": ["v1"], "resources": ["pods"]}]}]}'
+  exit 0
+fi
+class=$(jq -r '.module.ingressClass' $VALUES_PATH)
+name=$(jq -r '.[0].binding + "/" + .[0].review.request.name' $BINDING_CONTEXT_PATH)
+echo "{\"allowed\": false, \"message\": \"$name is not $class\"}" > $VALIDATING_RESPONSE_PATH
+`)
+
+	mm := NewMainModuleManager()
+	mm.WithDirectories(modulesDir, filepath.Join(rootDir, "global-hooks"), rootDir)
+	if err := mm.initModulesIndex(); err != nil {
+		t.Fatal(err)
+	}
+	module, _ := mm.GetModule("module")
+	if err := mm.initModuleHooks(module); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks, _ := mm.GetModuleHooksInOrder("module", KubernetesValidating)
+	if !assert.Len(t, hooks, 1) {
+		return
+	}
+	hook, _ := mm.GetModuleHook(hooks[0])
+
+	review := &admission.AdmissionReview{Request: &admission.AdmissionRequest{Name: "app"}}
+	res, err := hook.RunValidating("ingresses", review, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &ValidatingResponse{Allowed: false, Message: "ingresses/app is not nginx"}, res)
+	}
+	// Temporary files are removed after the run.
+	files, _ := filepath.Glob(filepath.Join(rootDir, "*validating*"))
+	assert.Len(t, files, 0)
+
+	// The hook should write a verdict.
+	writeHook(t, hookPath, `exit 0`)
+	_, err = hook.RunValidating("ingresses", review, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "validating response is not written")
+	}
+
+	app.ValidatingHookTimeout = 100 * time.Millisecond
+	writeHook(t, hookPath, `sleep 5`)
+	_, err = hook.RunValidating("ingresses", review, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out")
+	}
+}
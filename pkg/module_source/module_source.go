@@ -0,0 +1,392 @@
+package module_source
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/romana/rlog"
+)
+
+// BundleExt is an extension of module bundles. A checksum of the bundle is in a file
+// with ChecksumExt extension in the sha256sum format.
+const (
+	BundleExt   = ".tgz"
+	ChecksumExt = ".sha256"
+)
+
+// OCI image layout files.
+const (
+	OCILayoutFile          = "oci-layout"
+	OCIIndexFile           = "index.json"
+	OCIRefNameAnnotation   = "org.opencontainers.image.ref.name"
+	OCIVersionAnnotation   = "org.opencontainers.image.version"
+	ociBlobsDir            = "blobs"
+	ociGzipMediaTypeSuffix = "gzip"
+)
+
+// ModuleDir is a module directory unpacked from a bundle.
+type ModuleDir struct {
+	// DirectoryName is a name of the module directory in the bundle, e.g. 010-module.
+	DirectoryName string
+	// Path is a path of the unpacked directory.
+	Path string
+	// Source is a path of the bundle file or the OCI image layout.
+	Source string
+	// Version is a version annotation or a reference of the OCI image or a checksum of the bundle file.
+	Version string
+}
+
+// LoadModules unpacks modules from the source into destDir. Source is a directory with .tgz bundles
+// or a local OCI image layout. Bundles are unpacked into directories named by their checksums,
+// so unchanged bundles are not unpacked again.
+func LoadModules(source string, destDir string) ([]ModuleDir, error) {
+	if _, err := os.Stat(filepath.Join(source, OCILayoutFile)); err == nil {
+		return loadOCILayout(source, destDir)
+	}
+	return loadBundles(source, destDir)
+}
+
+// loadBundles unpacks .tgz bundles from the directory. Every bundle should have a checksum file.
+func loadBundles(source string, destDir string) ([]ModuleDir, error) {
+	files, err := ioutil.ReadDir(source)
+	if err != nil {
+		return nil, fmt.Errorf("list module bundles in '%s': %s", source, err)
+	}
+
+	res := make([]ModuleDir, 0)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), BundleExt) {
+			continue
+		}
+		bundlePath := filepath.Join(source, file.Name())
+
+		data, err := ioutil.ReadFile(bundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("read module bundle: %s", err)
+		}
+		digest := sha256Hex(data)
+
+		expected, err := readChecksumFile(bundlePath + ChecksumExt)
+		if err != nil {
+			return nil, fmt.Errorf("module bundle '%s': %s", bundlePath, err)
+		}
+		if expected != digest {
+			return nil, fmt.Errorf("module bundle '%s': checksum '%s' does not match '%s'", bundlePath, digest, expected)
+		}
+
+		unpackDir := filepath.Join(destDir, digest)
+		err = unpackOnce(unpackDir, func(dir string) error {
+			return untar(bytes.NewReader(data), true, dir)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unpack module bundle '%s': %s", bundlePath, err)
+		}
+
+		dirs, err := listModuleDirs(unpackDir, bundlePath, "sha256:"+digest)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, dirs...)
+	}
+
+	return res, nil
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// loadOCILayout unpacks layers of all images from the OCI image layout. Blobs are verified by their digests.
+func loadOCILayout(source string, destDir string) ([]ModuleDir, error) {
+	indexData, err := ioutil.ReadFile(filepath.Join(source, OCIIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("read OCI image layout '%s': %s", source, err)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return nil, fmt.Errorf("parse OCI image index in '%s': %s", source, err)
+	}
+
+	res := make([]ModuleDir, 0)
+	for _, desc := range index.Manifests {
+		manifestData, err := readOCIBlob(source, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var manifest ociManifest
+		if err := json.Unmarshal(manifestData, &manifest); err != nil {
+			return nil, fmt.Errorf("parse OCI image manifest '%s' in '%s': %s", desc.Digest, source, err)
+		}
+
+		unpackDir := filepath.Join(destDir, strings.Replace(desc.Digest, ":", "-", 1))
+		err = unpackOnce(unpackDir, func(dir string) error {
+			for _, layer := range manifest.Layers {
+				layerData, err := readOCIBlob(source, layer.Digest)
+				if err != nil {
+					return err
+				}
+				isGzip := strings.HasSuffix(layer.MediaType, ociGzipMediaTypeSuffix)
+				if err := untar(bytes.NewReader(layerData), isGzip, dir); err != nil {
+					return fmt.Errorf("layer '%s': %s", layer.Digest, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unpack OCI image '%s' from '%s': %s", desc.Digest, source, err)
+		}
+
+		version := desc.Annotations[OCIVersionAnnotation]
+		if version == "" {
+			version = desc.Annotations[OCIRefNameAnnotation]
+		}
+		if version == "" {
+			version = desc.Digest
+		}
+
+		dirs, err := listModuleDirs(unpackDir, source, version)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, dirs...)
+	}
+
+	return res, nil
+}
+
+// readOCIBlob returns content of the blob and checks that content matches the digest.
+func readOCIBlob(layoutDir string, digest string) ([]byte, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" {
+		return nil, fmt.Errorf("OCI blob '%s': unsupported digest", digest)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(layoutDir, ociBlobsDir, parts[0], parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("read OCI blob: %s", err)
+	}
+	if sha256Hex(data) != parts[1] {
+		return nil, fmt.Errorf("OCI blob '%s': content does not match the digest", digest)
+	}
+	return data, nil
+}
+
+// readChecksumFile returns the first field of the file: a checksum in the sha256sum format.
+func readChecksumFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read checksum: %s", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum file '%s' is empty", path)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// unpackOnce calls unpackFn with a temporary directory and renames it to dir.
+// Nothing is done if dir already exists.
+func unpackOnce(dir string, unpackFn func(dir string) error) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".tmp-")
+	if err != nil {
+		return err
+	}
+	if err := unpackFn(tmpDir); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return err
+	}
+	rlog.Infof("MODULE_SOURCE: unpacked '%s'", dir)
+	return os.Rename(tmpDir, dir)
+}
+
+// listModuleDirs returns directories in the root of the unpacked bundle.
+func listModuleDirs(unpackDir string, source string, version string) ([]ModuleDir, error) {
+	files, err := ioutil.ReadDir(unpackDir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ModuleDir, 0)
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		res = append(res, ModuleDir{
+			DirectoryName: file.Name(),
+			Path:          filepath.Join(unpackDir, file.Name()),
+			Source:        source,
+			Version:       version,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].DirectoryName < res[j].DirectoryName
+	})
+	return res, nil
+}
+
+// untar extracts directories, regular files and relative symlinks into dir.
+// Entries outside of dir and entries inside of extracted symlinks are rejected.
+func untar(r io.Reader, isGzip bool, dir string) error {
+	if isGzip {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gzr.Close()
+		r = gzr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, hdr.Name)
+		if !isInside(dir, target) {
+			return fmt.Errorf("entry '%s' is outside of the bundle", hdr.Name)
+		}
+
+		// Symlinks are not followed: a chain of relative symlinks can point outside of dir.
+		checkPath := target
+		if hdr.Typeflag == tar.TypeSymlink {
+			checkPath = filepath.Dir(target)
+		}
+		if err := checkNoSymlinks(dir, checkPath); err != nil {
+			return fmt.Errorf("entry '%s': %s", hdr.Name, err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			closeErr := f.Close()
+			if err != nil {
+				return err
+			}
+			if closeErr != nil {
+				return closeErr
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) || !isInside(dir, filepath.Join(filepath.Dir(target), hdr.Linkname)) {
+				return fmt.Errorf("symlink '%s' points outside of the bundle", hdr.Name)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			rlog.Debugf("MODULE_SOURCE: skip entry '%s' with type %c", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+// checkNoSymlinks returns an error if path or one of its parents inside of dir is a symlink.
+func checkNoSymlinks(dir string, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." {
+		return err
+	}
+	cur := dir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("'%s' is a symlink", part)
+		}
+	}
+	return nil
+}
+
+// RemoveUnused removes directories in destDir that do not contain any of the used paths.
+// Unpacked bundles are left in destDir when they are replaced by new versions.
+func RemoveUnused(destDir string, usedPaths []string) error {
+	files, err := ioutil.ReadDir(destDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	for _, path := range usedPaths {
+		rel, err := filepath.Rel(destDir, path)
+		if err != nil || !isInside(destDir, path) {
+			continue
+		}
+		used[strings.SplitN(rel, string(filepath.Separator), 2)[0]] = true
+	}
+
+	for _, file := range files {
+		// Skip unfinished unpacks.
+		if used[file.Name()] || strings.Contains(file.Name(), ".tmp-") {
+			continue
+		}
+		rlog.Infof("MODULE_SOURCE: remove unused '%s'", filepath.Join(destDir, file.Name()))
+		if err := os.RemoveAll(filepath.Join(destDir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isInside(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
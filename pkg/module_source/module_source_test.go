@@ -0,0 +1,202 @@
+package module_source
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LoadModules_Bundles(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "module-source-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	bundlesDir := filepath.Join(rootDir, "bundles")
+	bundle := makeTar(t, true, map[string]string{
+		"010-module-one/values.yaml": "moduleOneEnabled: true\n",
+		"020-module-two/Chart.yaml":  "name: module-two\n",
+	})
+	digest := sha256Hex(bundle)
+	writeFile(t, filepath.Join(bundlesDir, "modules.tgz"), bundle)
+	writeFile(t, filepath.Join(bundlesDir, "modules.tgz.sha256"), []byte(digest+"  modules.tgz\n"))
+
+	dirs, err := LoadModules(bundlesDir, filepath.Join(rootDir, "unpacked"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, dirs, 2) {
+		assert.Equal(t, "010-module-one", dirs[0].DirectoryName)
+		assert.Equal(t, "020-module-two", dirs[1].DirectoryName)
+		assert.Equal(t, filepath.Join(bundlesDir, "modules.tgz"), dirs[0].Source)
+		assert.Equal(t, "sha256:"+digest, dirs[0].Version)
+		assert.FileExists(t, filepath.Join(dirs[0].Path, "values.yaml"))
+	}
+
+	// Bundle is not loaded if the checksum does not match.
+	writeFile(t, filepath.Join(bundlesDir, "modules.tgz.sha256"), []byte(sha256Hex([]byte("other"))+"  modules.tgz\n"))
+	_, err = LoadModules(bundlesDir, filepath.Join(rootDir, "unpacked"))
+	assert.Error(t, err)
+
+	// Bundle without a checksum file is not loaded.
+	assert.NoError(t, os.Remove(filepath.Join(bundlesDir, "modules.tgz.sha256")))
+	_, err = LoadModules(bundlesDir, filepath.Join(rootDir, "unpacked"))
+	assert.Error(t, err)
+}
+
+func Test_LoadModules_OCILayout(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "module-source-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	layoutDir := filepath.Join(rootDir, "layout")
+	layer := makeTar(t, true, map[string]string{
+		"030-module-three/values.yaml": "moduleThreeEnabled: true\n",
+	})
+	layerDigest := writeBlob(t, layoutDir, layer)
+	manifest, _ := json.Marshal(ociManifest{Layers: []ociDescriptor{
+		{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layerDigest},
+	}})
+	manifestDigest := writeBlob(t, layoutDir, manifest)
+	index, _ := json.Marshal(ociIndex{Manifests: []ociDescriptor{
+		{Digest: manifestDigest, Annotations: map[string]string{OCIRefNameAnnotation: "v1.2.0"}},
+	}})
+	writeFile(t, filepath.Join(layoutDir, OCIIndexFile), index)
+	writeFile(t, filepath.Join(layoutDir, OCILayoutFile), []byte(`{"imageLayoutVersion": "1.0.0"}`))
+
+	dirs, err := LoadModules(layoutDir, filepath.Join(rootDir, "unpacked"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, dirs, 1) {
+		assert.Equal(t, "030-module-three", dirs[0].DirectoryName)
+		assert.Equal(t, layoutDir, dirs[0].Source)
+		assert.Equal(t, "v1.2.0", dirs[0].Version)
+		assert.FileExists(t, filepath.Join(dirs[0].Path, "values.yaml"))
+	}
+
+	// Blobs are verified by digests.
+	writeFile(t, filepath.Join(layoutDir, ociBlobsDir, "sha256", layerDigest[len("sha256:"):]), []byte("changed"))
+	_, err = LoadModules(layoutDir, filepath.Join(rootDir, "unpacked-again"))
+	assert.Error(t, err)
+}
+
+func Test_untar_RejectsPathsOutsideOfDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "module-source-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := makeTar(t, false, map[string]string{"../escape": "data"})
+	assert.Error(t, untar(bytes.NewReader(data), false, dir))
+}
+
+func Test_untar_RejectsEntriesInsideOfSymlinks(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "module-source-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	dir := filepath.Join(rootDir, "unpacked")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each symlink points inside of dir, but a/b resolves to the parent of dir.
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "a", Linkname: ".", Typeflag: tar.TypeSymlink},
+		{Name: "a/b", Linkname: "..", Typeflag: tar.TypeSymlink},
+		{Name: "a/b/evil", Mode: 0644, Size: 4, Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tw.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, untar(bytes.NewReader(buf.Bytes()), false, dir))
+	_, err = os.Stat(filepath.Join(rootDir, "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_RemoveUnused(t *testing.T) {
+	destDir, err := ioutil.TempDir("", "module-source-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destDir)
+
+	writeFile(t, filepath.Join(destDir, "old", "010-module", "values.yaml"), []byte("{}"))
+	writeFile(t, filepath.Join(destDir, "new", "010-module", "values.yaml"), []byte("{}"))
+
+	assert.NoError(t, RemoveUnused(destDir, []string{filepath.Join(destDir, "new", "010-module")}))
+	assert.DirExists(t, filepath.Join(destDir, "new", "010-module"))
+	_, err = os.Stat(filepath.Join(destDir, "old"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Nothing is unpacked yet.
+	assert.NoError(t, RemoveUnused(filepath.Join(destDir, "absent"), nil))
+}
+
+func makeTar(t *testing.T, isGzip bool, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	var tw *tar.Writer
+	var gzw *gzip.Writer
+	if isGzip {
+		gzw = gzip.NewWriter(buf)
+		tw = tar.NewWriter(gzw)
+	} else {
+		tw = tar.NewWriter(buf)
+	}
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzw != nil {
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeBlob(t *testing.T, layoutDir string, data []byte) string {
+	digest := sha256Hex(data)
+	writeFile(t, filepath.Join(layoutDir, ociBlobsDir, "sha256", digest), data)
+	return "sha256:" + digest
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
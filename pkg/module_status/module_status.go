@@ -0,0 +1,374 @@
+package module_status
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/romana/rlog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/flant/shell-operator/pkg/kube"
+)
+
+// Results of the last ModuleRun or ModuleDelete task.
+const (
+	RunResultSuccess = "Success"
+	RunResultFailed  = "Failed"
+	RunResultDeleted = "Deleted"
+)
+
+// ModuleStatusLabel is a label with a module name on status ConfigMaps.
+// Use it to get statuses of all modules:
+//
+//	kubectl get cm -l module-status.addon-operator.flant.com/module
+const ModuleStatusLabel = "module-status.addon-operator.flant.com/module"
+
+// ModuleStatus is a state of the module written into the ConfigMap data.
+type ModuleStatus struct {
+	Module          string
+	EnabledByConfig bool
+	EnabledByScript bool
+	// DisabledReason is set if the module is disabled because required modules are disabled.
+	DisabledReason string
+	// Deployed is true after a successful ModuleRun and false after a successful ModuleDelete.
+	// It is used to emit ModuleEnabled and ModuleDisabled events once per change, also after restart.
+	Deployed bool
+	// LastRunResult is a result of the last ModuleRun or ModuleDelete task.
+	LastRunResult       string
+	LastError           string
+	FailureCount        int
+	HelmReleaseRevision string
+	HelmReleaseChecksum string
+	// Source and Version of the module files. They are empty for modules from the modules directory.
+	Source          string
+	Version         string
+	LastRunTime     time.Time
+	LastSuccessTime time.Time
+}
+
+// Data returns a ConfigMap data for the status.
+func (s *ModuleStatus) Data() map[string]string {
+	data := map[string]string{
+		"module":              s.Module,
+		"enabledByConfig":     strconv.FormatBool(s.EnabledByConfig),
+		"enabledByScript":     strconv.FormatBool(s.EnabledByScript),
+		"disabledReason":      s.DisabledReason,
+		"deployed":            strconv.FormatBool(s.Deployed),
+		"lastRunResult":       s.LastRunResult,
+		"lastError":           s.LastError,
+		"failureCount":        strconv.Itoa(s.FailureCount),
+		"helmReleaseRevision": s.HelmReleaseRevision,
+		"helmReleaseChecksum": s.HelmReleaseChecksum,
+		"source":              s.Source,
+		"version":             s.Version,
+		"lastRunTime":         formatTime(s.LastRunTime),
+		"lastSuccessTime":     formatTime(s.LastSuccessTime),
+	}
+	return data
+}
+
+// statusFromData restores a status from a ConfigMap data. Bad values are ignored.
+func statusFromData(data map[string]string) *ModuleStatus {
+	s := &ModuleStatus{
+		Module:              data["module"],
+		DisabledReason:      data["disabledReason"],
+		LastRunResult:       data["lastRunResult"],
+		LastError:           data["lastError"],
+		HelmReleaseRevision: data["helmReleaseRevision"],
+		HelmReleaseChecksum: data["helmReleaseChecksum"],
+		Source:              data["source"],
+		Version:             data["version"],
+	}
+	s.EnabledByConfig, _ = strconv.ParseBool(data["enabledByConfig"])
+	s.EnabledByScript, _ = strconv.ParseBool(data["enabledByScript"])
+	s.Deployed, _ = strconv.ParseBool(data["deployed"])
+	s.FailureCount, _ = strconv.Atoi(data["failureCount"])
+	s.LastRunTime, _ = time.Parse(time.RFC3339, data["lastRunTime"])
+	s.LastSuccessTime, _ = time.Parse(time.RFC3339, data["lastSuccessTime"])
+	return s
+}
+
+// StatusManager keeps statuses of modules in ConfigMaps named '<prefix>-<module name>'.
+// Statuses are kept only in memory if the prefix is empty.
+// Errors of ConfigMap updates are logged, they do not affect tasks.
+type StatusManager struct {
+	Namespace string
+	Prefix    string
+
+	// m guards statuses and saved data. ConfigMaps are updated without it,
+	// so a slow API server does not block status updates of other modules.
+	m        sync.Mutex
+	statuses map[string]*ModuleStatus
+	// Data of ConfigMaps saved to the cluster to skip unchanged updates.
+	saved map[string]map[string]string
+	// saveLocks serialize ConfigMap updates of a module.
+	saveLocks map[string]*sync.Mutex
+}
+
+func NewStatusManager(namespace string, prefix string) *StatusManager {
+	return &StatusManager{
+		Namespace: namespace,
+		Prefix:    prefix,
+		statuses:  make(map[string]*ModuleStatus),
+		saved:     make(map[string]map[string]string),
+		saveLocks: make(map[string]*sync.Mutex),
+	}
+}
+
+// Load reads statuses saved by the previous run of the operator.
+func (sm *StatusManager) Load() error {
+	if sm.Prefix == "" {
+		return nil
+	}
+
+	list, err := kube.Kubernetes.CoreV1().ConfigMaps(sm.Namespace).List(metav1.ListOptions{LabelSelector: ModuleStatusLabel})
+	if err != nil {
+		return err
+	}
+
+	sm.m.Lock()
+	defer sm.m.Unlock()
+
+	for _, obj := range list.Items {
+		moduleName := obj.Labels[ModuleStatusLabel]
+		if obj.Name != sm.ConfigMapName(moduleName) {
+			continue
+		}
+		status := statusFromData(obj.Data)
+		status.Module = moduleName
+		sm.statuses[moduleName] = status
+		sm.saved[moduleName] = obj.Data
+	}
+	return nil
+}
+
+// UpdateEnabled sets enabled state for all modules after modules discovery.
+// disabledReasons are reasons to disable modules with disabled dependencies.
+func (sm *StatusManager) UpdateEnabled(allModules []string, enabledByConfig []string, enabledByScript []string, disabledReasons map[string]string) {
+	byConfig := make(map[string]bool)
+	for _, moduleName := range enabledByConfig {
+		byConfig[moduleName] = true
+	}
+	byScript := make(map[string]bool)
+	for _, moduleName := range enabledByScript {
+		byScript[moduleName] = true
+	}
+
+	sm.m.Lock()
+	for _, moduleName := range allModules {
+		status := sm.status(moduleName)
+		status.EnabledByConfig = byConfig[moduleName]
+		status.EnabledByScript = byScript[moduleName]
+		status.DisabledReason = disabledReasons[moduleName]
+	}
+	sm.m.Unlock()
+
+	for _, moduleName := range allModules {
+		sm.save(moduleName)
+	}
+}
+
+// UpdateRun saves a result of the ModuleRun task. failureCount is a count of failures before this run.
+// It returns true if the module is deployed for the first time since the last delete.
+func (sm *StatusManager) UpdateRun(moduleName string, runErr error, failureCount int, helmReleaseRevision string, helmReleaseChecksum string) (deployed bool) {
+	sm.m.Lock()
+	status := sm.status(moduleName)
+	status.LastRunTime = time.Now()
+	if runErr != nil {
+		status.LastRunResult = RunResultFailed
+		status.LastError = runErr.Error()
+		status.FailureCount = failureCount + 1
+	} else {
+		status.LastRunResult = RunResultSuccess
+		status.LastError = ""
+		status.FailureCount = 0
+		status.LastSuccessTime = status.LastRunTime
+		status.HelmReleaseRevision = helmReleaseRevision
+		status.HelmReleaseChecksum = helmReleaseChecksum
+		deployed = !status.Deployed
+		status.Deployed = true
+	}
+	sm.m.Unlock()
+
+	sm.save(moduleName)
+	return deployed
+}
+
+// UpdateSource saves a source and a version of the module files deployed by the last successful ModuleRun.
+func (sm *StatusManager) UpdateSource(moduleName string, source string, version string) {
+	sm.m.Lock()
+	status := sm.status(moduleName)
+	status.Source = source
+	status.Version = version
+	sm.m.Unlock()
+
+	sm.save(moduleName)
+}
+
+// UpdateDelete saves a result of the ModuleDelete task.
+// It returns true if the module was deployed before the delete.
+func (sm *StatusManager) UpdateDelete(moduleName string, deleteErr error, failureCount int) (deleted bool) {
+	sm.m.Lock()
+	status := sm.status(moduleName)
+	status.LastRunTime = time.Now()
+	if deleteErr != nil {
+		status.LastRunResult = RunResultFailed
+		status.LastError = deleteErr.Error()
+		status.FailureCount = failureCount + 1
+	} else {
+		status.LastRunResult = RunResultDeleted
+		status.LastError = ""
+		status.FailureCount = 0
+		status.LastSuccessTime = status.LastRunTime
+		status.HelmReleaseRevision = ""
+		status.HelmReleaseChecksum = ""
+		deleted = status.Deployed
+		status.Deployed = false
+	}
+	sm.m.Unlock()
+
+	sm.save(moduleName)
+	return deleted
+}
+
+// Delete removes the status ConfigMap of the module. It is used for modules
+// which are removed from the modules directory.
+func (sm *StatusManager) Delete(moduleName string) {
+	sm.m.Lock()
+	delete(sm.statuses, moduleName)
+	delete(sm.saved, moduleName)
+	saveLock := sm.saveLock(moduleName)
+	sm.m.Unlock()
+	if sm.Prefix == "" {
+		return
+	}
+
+	saveLock.Lock()
+	defer saveLock.Unlock()
+	name := sm.ConfigMapName(moduleName)
+	err := kube.Kubernetes.CoreV1().ConfigMaps(sm.Namespace).Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		rlog.Errorf("MODULE_STATUS: cannot delete ConfigMap/%s: %s", name, err)
+	}
+}
+
+// GetStatus returns a copy of the module status.
+func (sm *StatusManager) GetStatus(moduleName string) ModuleStatus {
+	sm.m.Lock()
+	defer sm.m.Unlock()
+	return *sm.status(moduleName)
+}
+
+func (sm *StatusManager) ConfigMapName(moduleName string) string {
+	return ConfigMapName(sm.Prefix, moduleName)
+}
+
+// ConfigMapName returns a name of the ConfigMap with the module status.
+func ConfigMapName(prefix string, moduleName string) string {
+	return fmt.Sprintf("%s-%s", prefix, moduleName)
+}
+
+func (sm *StatusManager) status(moduleName string) *ModuleStatus {
+	status, has := sm.statuses[moduleName]
+	if !has {
+		status = &ModuleStatus{Module: moduleName}
+		sm.statuses[moduleName] = status
+	}
+	return status
+}
+
+// saveLock returns a lock for ConfigMap updates of the module. sm.m should be locked.
+func (sm *StatusManager) saveLock(moduleName string) *sync.Mutex {
+	saveLock, has := sm.saveLocks[moduleName]
+	if !has {
+		saveLock = &sync.Mutex{}
+		sm.saveLocks[moduleName] = saveLock
+	}
+	return saveLock
+}
+
+// save creates or updates the ConfigMap if the module status is changed. The data is built
+// from the current status after the module save lock is acquired, so a concurrent save
+// cannot overwrite the ConfigMap with an older status. sm.m should not be locked.
+func (sm *StatusManager) save(moduleName string) {
+	if sm.Prefix == "" {
+		return
+	}
+
+	sm.m.Lock()
+	saveLock := sm.saveLock(moduleName)
+	sm.m.Unlock()
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	sm.m.Lock()
+	status, has := sm.statuses[moduleName]
+	var data map[string]string
+	if has {
+		data = status.Data()
+	}
+	unchanged := !has || isEqualData(sm.saved[moduleName], data)
+	sm.m.Unlock()
+	if unchanged {
+		return
+	}
+
+	if err := sm.saveConfigMap(moduleName, data); err != nil {
+		rlog.Errorf("MODULE_STATUS: cannot save ConfigMap/%s: %s", sm.ConfigMapName(moduleName), err)
+		return
+	}
+
+	sm.m.Lock()
+	// The module can be deleted during the update.
+	if sm.statuses[moduleName] == status {
+		sm.saved[moduleName] = data
+	}
+	sm.m.Unlock()
+}
+
+func (sm *StatusManager) saveConfigMap(moduleName string, data map[string]string) error {
+	name := sm.ConfigMapName(moduleName)
+	obj, err := kube.Kubernetes.CoreV1().ConfigMaps(sm.Namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		obj = &v1.ConfigMap{}
+		obj.Name = name
+		obj.Labels = map[string]string{ModuleStatusLabel: moduleName}
+		obj.Data = data
+		_, err = kube.Kubernetes.CoreV1().ConfigMaps(sm.Namespace).Create(obj)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if obj.Labels == nil {
+		obj.Labels = make(map[string]string)
+	}
+	obj.Labels[ModuleStatusLabel] = moduleName
+	obj.Data = data
+	_, err = kube.Kubernetes.CoreV1().ConfigMaps(sm.Namespace).Update(obj)
+	return err
+}
+
+func isEqualData(a map[string]string, b map[string]string) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
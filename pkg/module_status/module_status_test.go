@@ -0,0 +1,126 @@
+package module_status
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+
+	"github.com/flant/shell-operator/pkg/kube"
+)
+
+func Test_StatusManager(t *testing.T) {
+	kube.Kubernetes = fake.NewSimpleClientset()
+	sm := NewStatusManager("default", "addon-operator-module")
+
+	sm.UpdateEnabled([]string{"module-one", "module-two"}, []string{"module-one", "module-two"}, []string{"module-one"},
+		map[string]string{"module-two": "required module 'module-three' is disabled"})
+	data := getStatusData(t, "addon-operator-module-module-two")
+	assert.Equal(t, "true", data["enabledByConfig"])
+	assert.Equal(t, "false", data["enabledByScript"])
+	assert.Equal(t, "required module 'module-three' is disabled", data["disabledReason"])
+
+	assert.False(t, sm.UpdateRun("module-one", fmt.Errorf("helm upgrade failed"), 2, "", ""))
+	data = getStatusData(t, "addon-operator-module-module-one")
+	assert.Equal(t, RunResultFailed, data["lastRunResult"])
+	assert.Equal(t, "helm upgrade failed", data["lastError"])
+	assert.Equal(t, "3", data["failureCount"])
+	assert.NotEmpty(t, data["lastRunTime"])
+	assert.Empty(t, data["lastSuccessTime"])
+
+	assert.True(t, sm.UpdateRun("module-one", nil, 3, "4", "abc"))
+	data = getStatusData(t, "addon-operator-module-module-one")
+	assert.Equal(t, RunResultSuccess, data["lastRunResult"])
+	assert.Equal(t, "", data["lastError"])
+	assert.Equal(t, "0", data["failureCount"])
+	assert.Equal(t, "4", data["helmReleaseRevision"])
+	assert.Equal(t, "abc", data["helmReleaseChecksum"])
+	assert.Equal(t, "true", data["deployed"])
+	assert.NotEmpty(t, data["lastSuccessTime"])
+
+	sm.UpdateSource("module-one", "/bundles/modules.tgz", "sha256:abc")
+	data = getStatusData(t, "addon-operator-module-module-one")
+	assert.Equal(t, "/bundles/modules.tgz", data["source"])
+	assert.Equal(t, "sha256:abc", data["version"])
+
+	// Deployed state is restored after restart.
+	restarted := NewStatusManager("default", "addon-operator-module")
+	if assert.NoError(t, restarted.Load()) {
+		assert.Equal(t, "abc", restarted.GetStatus("module-one").HelmReleaseChecksum)
+		assert.False(t, restarted.UpdateRun("module-one", nil, 0, "4", "abc"))
+	}
+
+	assert.True(t, sm.UpdateDelete("module-one", nil, 0))
+	assert.False(t, sm.UpdateDelete("module-one", nil, 0))
+	status := sm.GetStatus("module-one")
+	assert.Equal(t, RunResultDeleted, status.LastRunResult)
+	assert.Equal(t, "", status.HelmReleaseRevision)
+
+	list, err := kube.Kubernetes.CoreV1().ConfigMaps("default").List(metav1.ListOptions{LabelSelector: ModuleStatusLabel})
+	if assert.NoError(t, err) {
+		assert.Len(t, list.Items, 2)
+	}
+
+	sm.Delete("module-one")
+	sm.Delete("module-three")
+	list, err = kube.Kubernetes.CoreV1().ConfigMaps("default").List(metav1.ListOptions{LabelSelector: ModuleStatusLabel})
+	if assert.NoError(t, err) {
+		assert.Len(t, list.Items, 1)
+	}
+	assert.Equal(t, "", sm.GetStatus("module-one").LastRunResult)
+}
+
+func Test_StatusManager_SlowUpdate(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	kube.Kubernetes = client
+	sm := NewStatusManager("default", "addon-operator-module")
+
+	// ConfigMap of module-one is updated slowly.
+	started := make(chan struct{})
+	var startedOnce sync.Once
+	unblock := make(chan struct{})
+	client.PrependReactor("get", "configmaps", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		if action.(k8s_testing.GetAction).GetName() == "addon-operator-module-module-one" {
+			startedOnce.Do(func() { close(started) })
+			<-unblock
+		}
+		return false, nil, nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		sm.UpdateRun("module-one", nil, 0, "1", "abc")
+		close(done)
+	}()
+	<-started
+
+	// Statuses are not locked during the ConfigMap update.
+	read := make(chan struct{})
+	go func() {
+		assert.Equal(t, RunResultSuccess, sm.GetStatus("module-one").LastRunResult)
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("statuses are locked during the ConfigMap update")
+	}
+
+	close(unblock)
+	<-done
+	assert.Equal(t, RunResultSuccess, getStatusData(t, "addon-operator-module-module-one")["lastRunResult"])
+}
+
+func getStatusData(t *testing.T, name string) map[string]string {
+	obj, err := kube.Kubernetes.CoreV1().ConfigMaps("default").Get(name, metav1.GetOptions{})
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	return obj.Data
+}
@@ -0,0 +1,39 @@
+package task
+
+import (
+	"math/rand"
+	"time"
+)
+
+// CalculateBackoff returns a delay before the next retry of a failed task.
+//
+// Delay is doubled on every failure starting from initialDelay and is limited by maxDelay.
+// Half of the delay is random (equal jitter), so tasks failed at the same time are not retried simultaneously.
+func CalculateBackoff(failureCount int, initialDelay time.Duration, maxDelay time.Duration) time.Duration {
+	if failureCount < 1 {
+		failureCount = 1
+	}
+
+	delay := initialDelay
+	for i := 1; i < failureCount; i++ {
+		delay *= 2
+		if maxDelay > 0 && delay >= maxDelay {
+			break
+		}
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// IsReady returns true if the task can be executed at the moment.
+func IsReady(t Task, now time.Time) bool {
+	retryAt := t.GetRetryAt()
+	return retryAt.IsZero() || !now.Before(retryAt)
+}
@@ -0,0 +1,84 @@
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculateBackoff(t *testing.T) {
+	initial := 4 * time.Second
+	max := 60 * time.Second
+
+	tests := []struct {
+		failureCount int
+		expected     time.Duration
+	}{
+		{0, 4 * time.Second},
+		{1, 4 * time.Second},
+		{2, 8 * time.Second},
+		{3, 16 * time.Second},
+		{4, 32 * time.Second},
+		{5, 60 * time.Second},
+		{100, 60 * time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 10; i++ {
+			delay := CalculateBackoff(test.failureCount, initial, max)
+			// Half of the delay is random.
+			assert.True(t, delay >= test.expected/2 && delay <= test.expected,
+				"failureCount=%d: delay %s is not in [%s, %s]", test.failureCount, delay, test.expected/2, test.expected)
+		}
+	}
+}
+
+func TestTasksQueue_ContainsReadyTasks(t *testing.T) {
+	q := NewTasksQueue()
+	now := time.Now()
+
+	waiting := NewTask(GlobalHookRun, "hook")
+	waiting.SetRetryAt(now.Add(time.Minute))
+	q.Add(waiting)
+
+	assert.False(t, IsReady(waiting, now))
+	assert.False(t, q.ContainsReadyTasks(now))
+	assert.True(t, q.ContainsReadyTasks(now.Add(2*time.Minute)))
+
+	q.Add(NewTask(ModuleRun, "module"))
+	assert.True(t, q.ContainsReadyTasks(now))
+}
+
+func TestTasksQueue_MoveReadyTaskToHead(t *testing.T) {
+	q := NewTasksQueue()
+	now := time.Now()
+	byName := func(t Task) string {
+		return t.GetName()
+	}
+
+	waiting := NewTask(ModuleHookRun, "module-a")
+	waiting.SetRetryAt(now.Add(time.Minute))
+	q.Add(waiting)
+	q.Add(NewTask(ModuleRun, "module-a"))
+	q.Add(NewTask(ModuleHookRun, "module-b"))
+	q.Add(NewTask(ModuleRun, "module-b"))
+
+	// Task of the same module does not pass the waiting task.
+	assert.True(t, q.MoveReadyTaskToHead(now, byName))
+	head, _ := q.Peek()
+	assert.Equal(t, "module-b", head.GetName())
+	assert.Equal(t, ModuleHookRun, head.GetType())
+	q.Pop()
+
+	// The second task of module-b is behind the first task of module-a.
+	assert.True(t, q.MoveReadyTaskToHead(now, byName))
+	head, _ = q.Peek()
+	assert.Equal(t, "module-b", head.GetName())
+	q.Pop()
+
+	assert.False(t, q.MoveReadyTaskToHead(now, byName))
+	head, _ = q.Peek()
+	assert.Equal(t, waiting, head)
+	assert.Equal(t, 2, q.Length())
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"time"
 
+	"gopkg.in/satori/go.uuid.v1"
+
 	"github.com/flant/addon-operator/pkg/module_manager"
 )
 
@@ -20,6 +22,8 @@ const (
 	ModulePurge TaskType = "TASK_MODULE_PURGE"
 	// retry module_manager-а
 	ModuleManagerRetry TaskType = "TASK_MODULE_MANAGER_RETRY"
+	// reload of modules and global hooks changed on disk
+	ReloadFiles TaskType = "TASK_RELOAD_FILES"
 	// вспомогательные задачи: задержка и остановка обработки
 	Delay TaskType = "TASK_DELAY"
 	Stop  TaskType = "TASK_STOP"
@@ -27,6 +31,7 @@ const (
 
 type Task interface {
 	GetName() string
+	GetEventID() string
 	GetType() TaskType
 	GetBinding() module_manager.BindingType
 	GetBindingContext() []module_manager.BindingContext
@@ -35,6 +40,11 @@ type Task interface {
 	GetDelay() time.Duration
 	GetAllowFailure() bool
 	GetOnStartupHooks() bool
+	GetQueueName() string
+	GetRetryAt() time.Time
+	SetRetryAt(retryAt time.Time)
+	GetQueuedAt() time.Time
+	SetQueuedAt(queuedAt time.Time)
 }
 
 type BaseTask struct {
@@ -47,6 +57,14 @@ type BaseTask struct {
 	AllowFailure   bool // Task considered as 'ok' if hook failed. False by default. Can be true for some schedule hooks.
 
 	OnStartupHooks bool // Run module onStartup hooks on Addon-operator startup or on module enabled.
+
+	QueueName string // Name of a queue for the task. Empty name means a default queue for the task type.
+
+	RetryAt time.Time // Failed task is not executed before this time. Zero time means that task can be executed immediately.
+
+	EventID string // Unique id of the task to correlate log messages.
+
+	QueuedAt time.Time // Time when the task is added to the queue.
 }
 
 func NewTask(taskType TaskType, name string) *BaseTask {
@@ -56,6 +74,7 @@ func NewTask(taskType TaskType, name string) *BaseTask {
 		Type:           taskType,
 		AllowFailure:   false,
 		BindingContext: make([]module_manager.BindingContext, 0),
+		EventID:        uuid.NewV4().String(),
 	}
 }
 
@@ -63,6 +82,10 @@ func (t *BaseTask) GetName() string {
 	return t.Name
 }
 
+func (t *BaseTask) GetEventID() string {
+	return t.EventID
+}
+
 func (t *BaseTask) GetType() TaskType {
 	return t.Type
 }
@@ -87,6 +110,10 @@ func (t *BaseTask) GetOnStartupHooks() bool {
 	return t.OnStartupHooks
 }
 
+func (t *BaseTask) GetQueueName() string {
+	return t.QueueName
+}
+
 func (t *BaseTask) WithBinding(binding module_manager.BindingType) *BaseTask {
 	t.Binding = binding
 	return t
@@ -112,12 +139,36 @@ func (t *BaseTask) WithOnStartupHooks(onStartupHooks bool) *BaseTask {
 	return t
 }
 
+func (t *BaseTask) WithQueueName(queueName string) *BaseTask {
+	t.QueueName = queueName
+	return t
+}
+
+func (t *BaseTask) GetRetryAt() time.Time {
+	return t.RetryAt
+}
+
+func (t *BaseTask) SetRetryAt(retryAt time.Time) {
+	t.RetryAt = retryAt
+}
+
+func (t *BaseTask) GetQueuedAt() time.Time {
+	return t.QueuedAt
+}
+
+func (t *BaseTask) SetQueuedAt(queuedAt time.Time) {
+	t.QueuedAt = queuedAt
+}
+
 func (t *BaseTask) DumpAsText() string {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("%s '%s'", t.Type, t.Name))
 	if t.FailureCount > 0 {
 		buf.WriteString(fmt.Sprintf(" failed %d times. ", t.FailureCount))
 	}
+	if !t.RetryAt.IsZero() {
+		buf.WriteString(fmt.Sprintf(" retry at %s. ", t.RetryAt.Format(time.RFC3339)))
+	}
 	return buf.String()
 }
 
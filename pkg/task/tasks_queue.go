@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/flant/shell-operator/pkg/queue"
 )
@@ -55,16 +56,26 @@ type FailureCountIncrementable interface {
 
 type TasksQueue struct {
 	*queue.Queue
+	Name string
 }
 
 func (tq *TasksQueue) Add(task Task) {
+	setQueuedAt(task)
 	tq.Queue.Add(task)
 }
 
 func (tq *TasksQueue) Push(task Task) {
+	setQueuedAt(task)
 	tq.Queue.Push(task)
 }
 
+// setQueuedAt sets time of the first queueing. Requeued task keeps its time.
+func setQueuedAt(task Task) {
+	if task.GetQueuedAt().IsZero() {
+		task.SetQueuedAt(time.Now())
+	}
+}
+
 func (tq *TasksQueue) Peek() (task Task, err error) {
 	res, err := tq.Queue.Peek()
 	if err != nil {
@@ -85,6 +96,131 @@ func NewTasksQueue() *TasksQueue {
 	}
 }
 
+func (tq *TasksQueue) WithName(name string) *TasksQueue {
+	tq.Name = name
+	return tq
+}
+
+// Length returns a count of tasks. Queues are handled concurrently, so length is calculated under the queue lock.
+func (tq *TasksQueue) Length() int {
+	length := 0
+	tq.Queue.IterateWithLock(func(_ interface{}, _ int) string {
+		length++
+		return ""
+	})
+	return length
+}
+
+// ContainsTaskTypes returns true if queue has a task of one of the types.
+func (tq *TasksQueue) ContainsTaskTypes(types ...TaskType) bool {
+	found := false
+	tq.Queue.IterateWithLock(func(item interface{}, _ int) string {
+		t, ok := item.(Task)
+		if !ok {
+			return ""
+		}
+		for _, taskType := range types {
+			if t.GetType() == taskType {
+				found = true
+			}
+		}
+		return ""
+	})
+	return found
+}
+
+// ContainsReadyTasks returns true if queue has a task that can be executed at the moment.
+func (tq *TasksQueue) ContainsReadyTasks(now time.Time) bool {
+	found := false
+	tq.Queue.IterateWithLock(func(item interface{}, _ int) string {
+		if t, ok := item.(Task); ok && IsReady(t, now) {
+			found = true
+		}
+		return ""
+	})
+	return found
+}
+
+// MoveReadyTaskToHead moves the first ready task to the head of the queue if there is no task
+// with the same order key before it. So a ready task can pass tasks that wait for a retry, but
+// tasks with the same key are kept in FIFO order. It returns false if there is no such task.
+func (tq *TasksQueue) MoveReadyTaskToHead(now time.Time, orderKey func(Task) string) bool {
+	var found interface{}
+	index := -1
+	keys := make(map[string]bool)
+	tq.Queue.IterateWithLock(func(item interface{}, i int) string {
+		t, ok := item.(Task)
+		if index >= 0 || !ok {
+			return ""
+		}
+		key := orderKey(t)
+		if i > 0 && IsReady(t, now) && !keys[key] {
+			found = item
+			index = i
+			return ""
+		}
+		keys[key] = true
+		return ""
+	})
+	if index < 0 {
+		return false
+	}
+
+	// There is no method to remove a task from the middle of the queue, so tasks before
+	// the found task are popped and pushed back. Tasks are popped only by the queue runner,
+	// but Stop task can be pushed concurrently, so the found task is checked after Pop.
+	popped := make([]interface{}, 0, index+1)
+	for i := 0; i <= index; i++ {
+		popped = append(popped, tq.Queue.Pop())
+	}
+	moved := false
+	for i := len(popped) - 1; i >= 0; i-- {
+		if popped[i] == found && !moved {
+			moved = true
+			continue
+		}
+		tq.Queue.Push(popped[i])
+	}
+	if moved {
+		tq.Queue.Push(found)
+	}
+	return moved
+}
+
+// IsBlockedByFailedTask returns true if the first task except Delay tasks has failed and waits
+// for a retry. Tasks behind it are not executed until the retry is successful.
+func (tq *TasksQueue) IsBlockedByFailedTask() bool {
+	blocked := false
+	found := false
+	tq.Queue.IterateWithLock(func(item interface{}, _ int) string {
+		t, ok := item.(Task)
+		if found || !ok || t.GetType() == Delay {
+			return ""
+		}
+		blocked = t.GetFailureCount() > 0
+		found = true
+		return ""
+	})
+	return blocked
+}
+
+// HeadTaskAge returns a time passed since the first task in the queue is queued.
+// Delay tasks are skipped. Zero is returned for a queue without tasks.
+func (tq *TasksQueue) HeadTaskAge(now time.Time) time.Duration {
+	var age time.Duration
+	found := false
+	tq.Queue.IterateWithLock(func(item interface{}, _ int) string {
+		t, ok := item.(Task)
+		if found || !ok || t.GetType() == Delay || t.GetQueuedAt().IsZero() {
+			return ""
+		}
+		age = now.Sub(t.GetQueuedAt())
+		found = true
+		return ""
+	})
+	return age
+}
+
 func (tq *TasksQueue) IncrementFailureCount() {
 	tq.Queue.WithLock(func(topTask interface{}) string {
 		if v, ok := topTask.(FailureCountIncrementable); ok {
@@ -7,13 +7,18 @@ import (
 	"github.com/romana/rlog"
 )
 
+// QueueDumpReader is a queue or a set of queues that can be dumped.
+type QueueDumpReader interface {
+	DumpReader() io.Reader
+}
+
 type TasksQueueDumper struct {
 	DumpFilePath string
-	queue        *TasksQueue
+	queue        QueueDumpReader
 	eventCh      chan struct{}
 }
 
-func NewTasksQueueDumper(dumpFilePath string, queue *TasksQueue) *TasksQueueDumper {
+func NewTasksQueueDumper(dumpFilePath string, queue QueueDumpReader) *TasksQueueDumper {
 	result := &TasksQueueDumper{
 		DumpFilePath: dumpFilePath,
 		queue:        queue,
@@ -24,8 +29,12 @@ func NewTasksQueueDumper(dumpFilePath string, queue *TasksQueue) *TasksQueueDump
 }
 
 // QueueChangeCallback dumps a queue to a dump file when queue changes.
+// Callback is not blocked if a dump is already pending.
 func (t *TasksQueueDumper) QueueChangeCallback() {
-	t.eventCh <- struct{}{}
+	select {
+	case t.eventCh <- struct{}{}:
+	default:
+	}
 }
 
 func (t *TasksQueueDumper) WatchQueue() {
@@ -0,0 +1,216 @@
+package task
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/flant/shell-operator/pkg/queue"
+)
+
+// MainQueueName is a name of the queue for global hooks, modules discovery and other tasks
+// that should not run concurrently with modules tasks.
+const MainQueueName = "main"
+
+// FailedTask is a task that is failed more times than allowed. It is not retried anymore.
+type FailedTask struct {
+	QueueName string
+	Task      Task
+}
+
+// TasksQueueSet is a set of named queues. Tasks from different queues are handled concurrently.
+type TasksQueueSet struct {
+	m        sync.RWMutex
+	queues   map[string]*TasksQueue
+	watchers []queue.QueueWatcher
+	// Tasks with exhausted retries.
+	failed []FailedTask
+	// Callback to start a handler for a newly created queue.
+	newQueueCallback func(tq *TasksQueue)
+}
+
+func NewTasksQueueSet() *TasksQueueSet {
+	set := &TasksQueueSet{
+		queues:   make(map[string]*TasksQueue),
+		watchers: make([]queue.QueueWatcher, 0),
+		failed:   make([]FailedTask, 0),
+	}
+	set.queues[MainQueueName] = NewTasksQueue().WithName(MainQueueName)
+	return set
+}
+
+// WithNewQueueCallback sets a function that is called for every queue created by GetOrCreate.
+// The function is also called for already created queues except the main queue.
+func (s *TasksQueueSet) WithNewQueueCallback(cb func(tq *TasksQueue)) *TasksQueueSet {
+	s.m.Lock()
+	s.newQueueCallback = cb
+	existing := make([]*TasksQueue, 0)
+	for name, tq := range s.queues {
+		if name != MainQueueName {
+			existing = append(existing, tq)
+		}
+	}
+	s.m.Unlock()
+
+	if cb != nil {
+		for _, tq := range existing {
+			cb(tq)
+		}
+	}
+	return s
+}
+
+// GetMain returns the main queue.
+func (s *TasksQueueSet) GetMain() *TasksQueue {
+	return s.Get(MainQueueName)
+}
+
+// Get returns a queue by name or nil if there is no such queue.
+func (s *TasksQueueSet) Get(name string) *TasksQueue {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.queues[name]
+}
+
+// GetOrCreate returns a queue by name. New queue is created if there is no such queue.
+func (s *TasksQueueSet) GetOrCreate(name string) *TasksQueue {
+	s.m.Lock()
+	tq, ok := s.queues[name]
+	if ok {
+		s.m.Unlock()
+		return tq
+	}
+
+	tq = NewTasksQueue().WithName(name)
+	for _, watcher := range s.watchers {
+		tq.AddWatcher(watcher)
+	}
+	tq.ChangesEnable(true)
+	s.queues[name] = tq
+	cb := s.newQueueCallback
+	s.m.Unlock()
+
+	if cb != nil {
+		cb(tq)
+	}
+	return tq
+}
+
+// Names returns names of all queues: the main queue is first, other names are sorted.
+func (s *TasksQueueSet) Names() []string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	names := make([]string, 0, len(s.queues))
+	for name := range s.queues {
+		if name != MainQueueName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return append([]string{MainQueueName}, names...)
+}
+
+// AddWatcher adds a watcher to all existing queues and to queues that will be created.
+func (s *TasksQueueSet) AddWatcher(watcher queue.QueueWatcher) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.watchers = append(s.watchers, watcher)
+	for _, tq := range s.queues {
+		tq.AddWatcher(watcher)
+	}
+}
+
+// ContainsTaskTypes returns true if there is a task of one of the types
+// in any queue except the main queue.
+func (s *TasksQueueSet) ContainsTaskTypes(types ...TaskType) bool {
+	for _, name := range s.Names() {
+		if name == MainQueueName {
+			continue
+		}
+		if tq := s.Get(name); tq != nil && tq.ContainsTaskTypes(types...) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsPendingTaskTypes returns true if there is a task of one of the types in any queue
+// except the main queue and this queue is not blocked by a failed task. Tasks behind a failed
+// task can wait for retries forever, so they are not pending.
+func (s *TasksQueueSet) ContainsPendingTaskTypes(types ...TaskType) bool {
+	for _, name := range s.Names() {
+		if name == MainQueueName {
+			continue
+		}
+		tq := s.Get(name)
+		if tq != nil && tq.ContainsTaskTypes(types...) && !tq.IsBlockedByFailedTask() {
+			return true
+		}
+	}
+	return false
+}
+
+// AddFailed moves the task to the failed tasks. A previous failed task with the same type,
+// name and binding from the same queue is replaced, so failed tasks are not accumulated.
+func (s *TasksQueueSet) AddFailed(queueName string, t Task) {
+	s.m.Lock()
+	failed := make([]FailedTask, 0, len(s.failed)+1)
+	for _, f := range s.failed {
+		if f.QueueName == queueName && f.Task.GetType() == t.GetType() &&
+			f.Task.GetName() == t.GetName() && f.Task.GetBinding() == t.GetBinding() {
+			continue
+		}
+		failed = append(failed, f)
+	}
+	s.failed = append(failed, FailedTask{QueueName: queueName, Task: t})
+	watchers := s.watchers
+	s.m.Unlock()
+
+	for _, watcher := range watchers {
+		watcher.QueueChangeCallback()
+	}
+}
+
+// FailedTasks returns a copy of the failed tasks list.
+func (s *TasksQueueSet) FailedTasks() []FailedTask {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return append([]FailedTask{}, s.failed...)
+}
+
+// DumpReader returns a dump of all queues.
+func (s *TasksQueueSet) DumpReader() io.Reader {
+	readers := make([]io.Reader, 0)
+	for _, name := range s.Names() {
+		tq := s.Get(name)
+		if tq == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("Queue '%s': ", name))
+		readers = append(readers, &buf, tq.DumpReader(), bytes.NewBufferString("\n"))
+	}
+
+	failed := s.FailedTasks()
+	if len(failed) > 0 {
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("Failed tasks: %d\n\n", len(failed)))
+		for _, f := range failed {
+			buf.WriteString(fmt.Sprintf("%s: ", f.QueueName))
+			if dumper, ok := f.Task.(TextDumper); ok {
+				buf.WriteString(dumper.DumpAsText())
+			} else {
+				buf.WriteString(fmt.Sprintf("%s '%s'", f.Task.GetType(), f.Task.GetName()))
+			}
+			buf.WriteString("\n")
+		}
+		readers = append(readers, &buf)
+	}
+
+	return io.MultiReader(readers...)
+}
@@ -0,0 +1,98 @@
+package task
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTasksQueueSet_GetOrCreate(t *testing.T) {
+	set := NewTasksQueueSet()
+
+	assert.NotNil(t, set.GetMain())
+	assert.Equal(t, MainQueueName, set.GetMain().Name)
+	assert.Nil(t, set.Get("module-b"))
+
+	created := make([]string, 0)
+	set.WithNewQueueCallback(func(tq *TasksQueue) {
+		created = append(created, tq.Name)
+	})
+
+	qb := set.GetOrCreate("module-b")
+	qa := set.GetOrCreate("module-a")
+	assert.Equal(t, qb, set.GetOrCreate("module-b"))
+	assert.Equal(t, qa, set.Get("module-a"))
+
+	// Callback is called once for each new queue.
+	assert.Equal(t, []string{"module-b", "module-a"}, created)
+	assert.Equal(t, []string{MainQueueName, "module-a", "module-b"}, set.Names())
+
+	// Callback is called for existing queues except the main queue.
+	existing := make([]string, 0)
+	set.WithNewQueueCallback(func(tq *TasksQueue) {
+		existing = append(existing, tq.Name)
+	})
+	assert.ElementsMatch(t, []string{"module-a", "module-b"}, existing)
+}
+
+func TestTasksQueueSet_ContainsTaskTypes(t *testing.T) {
+	set := NewTasksQueueSet()
+
+	set.GetMain().Add(NewTask(ModuleRun, "in-main"))
+	assert.False(t, set.ContainsTaskTypes(ModuleRun), "main queue should be ignored")
+
+	set.GetOrCreate("module-a").Add(NewTask(ModuleHookRun, "hook"))
+	assert.False(t, set.ContainsTaskTypes(ModuleRun, ModuleDelete))
+
+	set.GetOrCreate("module-b").Add(NewTask(ModuleDelete, "module-b"))
+	assert.True(t, set.ContainsTaskTypes(ModuleRun, ModuleDelete))
+}
+
+func TestTasksQueueSet_ContainsPendingTaskTypes(t *testing.T) {
+	set := NewTasksQueueSet()
+
+	failed := NewTask(ModuleRun, "module-a")
+	failed.IncrementFailureCount()
+	qa := set.GetOrCreate("module-a")
+	qa.Add(NewTaskDelay(time.Second))
+	qa.Add(failed)
+	qa.Add(NewTask(ModuleRun, "module-a"))
+	assert.True(t, set.ContainsTaskTypes(ModuleRun))
+	assert.False(t, set.ContainsPendingTaskTypes(ModuleRun), "tasks behind a failed task should be ignored")
+
+	set.GetOrCreate("module-b").Add(NewTask(ModuleRun, "module-b"))
+	assert.True(t, set.ContainsPendingTaskTypes(ModuleRun))
+}
+
+func TestTasksQueueSet_DumpReader(t *testing.T) {
+	set := NewTasksQueueSet()
+	set.GetMain().Add(NewTask(DiscoverModulesState, ""))
+	set.GetOrCreate("module-a").Add(NewTask(ModuleRun, "module-a"))
+
+	dump, err := ioutil.ReadAll(set.DumpReader())
+	assert.NoError(t, err)
+	assert.Contains(t, string(dump), "Queue 'main': ")
+	assert.Contains(t, string(dump), "Queue 'module-a': ")
+	assert.Contains(t, string(dump), "TASK_MODULE_RUN 'module-a'")
+}
+
+func TestTasksQueueSet_AddFailed(t *testing.T) {
+	set := NewTasksQueueSet()
+
+	set.AddFailed("module-a", NewTask(ModuleRun, "module-a"))
+	set.AddFailed("main", NewTask(GlobalHookRun, "hook").WithBinding("schedule"))
+	// Same task replaces the previous failed task.
+	set.AddFailed("module-a", NewTask(ModuleRun, "module-a"))
+
+	failed := set.FailedTasks()
+	assert.Len(t, failed, 2)
+	assert.Equal(t, "main", failed[0].QueueName)
+	assert.Equal(t, "module-a", failed[1].QueueName)
+
+	dump, err := ioutil.ReadAll(set.DumpReader())
+	assert.NoError(t, err)
+	assert.Contains(t, string(dump), "Failed tasks: 2")
+	assert.Contains(t, string(dump), "module-a: TASK_MODULE_RUN 'module-a'")
+}
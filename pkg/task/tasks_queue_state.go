@@ -0,0 +1,265 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/romana/rlog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/flant/shell-operator/pkg/kube"
+
+	"github.com/flant/addon-operator/pkg/module_manager"
+)
+
+// QueueStateVersion is a version of the queue state format.
+const QueueStateVersion = 1
+
+// QueueStateConfigMapKey is a key in the ConfigMap with the queue state.
+const QueueStateConfigMapKey = "tasks-queue.json"
+
+// QueueState is a durable representation of tasks in all queues.
+type QueueState struct {
+	Version int         `json:"version"`
+	Tasks   []TaskState `json:"tasks"`
+}
+
+// TaskState is a durable representation of a task.
+type TaskState struct {
+	Queue          string                          `json:"queue"`
+	Type           TaskType                        `json:"type"`
+	Name           string                          `json:"name"`
+	Binding        module_manager.BindingType      `json:"binding,omitempty"`
+	BindingContext []module_manager.BindingContext `json:"bindingContext,omitempty"`
+	FailureCount   int                             `json:"failureCount,omitempty"`
+	AllowFailure   bool                            `json:"allowFailure,omitempty"`
+	OnStartupHooks bool                            `json:"onStartupHooks,omitempty"`
+	QueueName      string                          `json:"queueName,omitempty"`
+	EventID        string                          `json:"eventID,omitempty"`
+}
+
+// NewTaskState returns a durable representation of a task from the queue.
+func NewTaskState(queueName string, t Task) TaskState {
+	return TaskState{
+		Queue:          queueName,
+		Type:           t.GetType(),
+		Name:           t.GetName(),
+		Binding:        t.GetBinding(),
+		BindingContext: t.GetBindingContext(),
+		FailureCount:   t.GetFailureCount(),
+		AllowFailure:   t.GetAllowFailure(),
+		OnStartupHooks: t.GetOnStartupHooks(),
+		QueueName:      t.GetQueueName(),
+		EventID:        t.GetEventID(),
+	}
+}
+
+// Task returns a task restored from the durable representation.
+func (ts TaskState) Task() *BaseTask {
+	t := NewTask(ts.Type, ts.Name).
+		WithBinding(ts.Binding).
+		WithBindingContext(ts.BindingContext).
+		WithAllowFailure(ts.AllowFailure).
+		WithOnStartupHooks(ts.OnStartupHooks).
+		WithQueueName(ts.QueueName)
+	t.FailureCount = ts.FailureCount
+	if ts.EventID != "" {
+		t.EventID = ts.EventID
+	}
+	return t
+}
+
+// State returns tasks from all queues. Delay and Stop tasks are not stored.
+func (s *TasksQueueSet) State() QueueState {
+	state := QueueState{
+		Version: QueueStateVersion,
+		Tasks:   make([]TaskState, 0),
+	}
+
+	for _, name := range s.Names() {
+		tq := s.Get(name)
+		if tq == nil {
+			continue
+		}
+		tq.Queue.IterateWithLock(func(item interface{}, _ int) string {
+			t, ok := item.(Task)
+			if !ok || t.GetType() == Delay || t.GetType() == Stop {
+				return ""
+			}
+			state.Tasks = append(state.Tasks, NewTaskState(name, t))
+			return ""
+		})
+	}
+
+	return state
+}
+
+// ParseQueueState decodes a queue state from JSON. Empty data is an empty state.
+func ParseQueueState(data []byte) (QueueState, error) {
+	state := QueueState{Version: QueueStateVersion, Tasks: make([]TaskState, 0)}
+	if len(data) == 0 {
+		return state, nil
+	}
+
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return state, fmt.Errorf("parse tasks queue state: %v", err)
+	}
+	if state.Version != QueueStateVersion {
+		return state, fmt.Errorf("parse tasks queue state: unsupported version %d", state.Version)
+	}
+	return state, nil
+}
+
+// QueueStateStorage saves and loads a queue state.
+type QueueStateStorage interface {
+	Save(data []byte) error
+	Load() ([]byte, error)
+}
+
+// FileQueueStateStorage stores a queue state in a file.
+type FileQueueStateStorage struct {
+	Path string
+}
+
+var _ QueueStateStorage = &FileQueueStateStorage{}
+
+func NewFileQueueStateStorage(path string) *FileQueueStateStorage {
+	return &FileQueueStateStorage{Path: path}
+}
+
+// Save writes data to a temporary file and renames it, so the state file is never partially written.
+func (f *FileQueueStateStorage) Save(data []byte) error {
+	tmpPath := filepath.Join(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".tmp")
+	err := ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, f.Path)
+}
+
+// Load returns nil data if there is no state file.
+func (f *FileQueueStateStorage) Load() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// ConfigMapQueueStateStorage stores a queue state in a ConfigMap.
+type ConfigMapQueueStateStorage struct {
+	Namespace string
+	Name      string
+}
+
+var _ QueueStateStorage = &ConfigMapQueueStateStorage{}
+
+func NewConfigMapQueueStateStorage(namespace string, name string) *ConfigMapQueueStateStorage {
+	return &ConfigMapQueueStateStorage{Namespace: namespace, Name: name}
+}
+
+func (c *ConfigMapQueueStateStorage) Save(data []byte) error {
+	obj, err := kube.Kubernetes.CoreV1().ConfigMaps(c.Namespace).Get(c.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		obj = &v1.ConfigMap{}
+		obj.Name = c.Name
+		obj.Data = map[string]string{QueueStateConfigMapKey: string(data)}
+		_, err = kube.Kubernetes.CoreV1().ConfigMaps(c.Namespace).Create(obj)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if obj.Data == nil {
+		obj.Data = make(map[string]string)
+	}
+	obj.Data[QueueStateConfigMapKey] = string(data)
+	_, err = kube.Kubernetes.CoreV1().ConfigMaps(c.Namespace).Update(obj)
+	return err
+}
+
+// Load returns nil data if there is no ConfigMap.
+func (c *ConfigMapQueueStateStorage) Load() ([]byte, error) {
+	obj, err := kube.Kubernetes.CoreV1().ConfigMaps(c.Namespace).Get(c.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(obj.Data[QueueStateConfigMapKey]), nil
+}
+
+// TasksQueuePersister is a queue watcher that saves a state of all queues into a storage.
+// Changes are saved not often than once in an interval.
+type TasksQueuePersister struct {
+	queues   *TasksQueueSet
+	storage  QueueStateStorage
+	interval time.Duration
+	eventCh  chan struct{}
+	// pendingTasks returns tasks that are not in queues yet but should be saved.
+	pendingTasks func() []TaskState
+}
+
+func NewTasksQueuePersister(queues *TasksQueueSet, storage QueueStateStorage, interval time.Duration) *TasksQueuePersister {
+	result := &TasksQueuePersister{
+		queues:   queues,
+		storage:  storage,
+		interval: interval,
+		eventCh:  make(chan struct{}, 1),
+	}
+	go result.WatchQueue()
+	return result
+}
+
+// WithPendingTasks sets a function that returns tasks that are not in queues yet, e.g. tasks
+// loaded from the storage and not restored. They are saved after tasks from queues.
+func (p *TasksQueuePersister) WithPendingTasks(pendingTasks func() []TaskState) *TasksQueuePersister {
+	p.pendingTasks = pendingTasks
+	return p
+}
+
+// QueueChangeCallback is not blocked if a save is already pending.
+func (p *TasksQueuePersister) QueueChangeCallback() {
+	select {
+	case p.eventCh <- struct{}{}:
+	default:
+	}
+}
+
+func (p *TasksQueuePersister) WatchQueue() {
+	for {
+		<-p.eventCh
+		err := p.Save()
+		if err != nil {
+			rlog.Errorf("TasksQueuePersister: %v", err)
+		}
+		time.Sleep(p.interval)
+	}
+}
+
+// Save stores a state of all queues and pending tasks.
+func (p *TasksQueuePersister) Save() error {
+	state := p.queues.State()
+	// Pending tasks are got after queues, so a task moved into a queue in between is not saved twice.
+	if p.pendingTasks != nil {
+		state.Tasks = append(state.Tasks, p.pendingTasks()...)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("cannot marshal tasks queue state: %v", err)
+	}
+	err = p.storage.Save(data)
+	if err != nil {
+		return fmt.Errorf("cannot save tasks queue state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package task
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/flant/shell-operator/pkg/kube"
+
+	"github.com/flant/addon-operator/pkg/module_manager"
+)
+
+func TestTasksQueueSet_State(t *testing.T) {
+	set := NewTasksQueueSet()
+	set.GetMain().Add(NewTask(GlobalHookRun, "global-hook").
+		WithBinding(module_manager.Schedule).
+		AppendBindingContext(module_manager.BindingContext{Binding: "every-minute"}))
+	set.GetMain().Add(NewTaskDelay(time.Second))
+
+	hookTask := NewTask(ModuleHookRun, "module-a/hooks/pods").
+		WithBinding(module_manager.KubeEvents).
+		AppendBindingContext(module_manager.BindingContext{
+			Binding:           "pods",
+			ResourceEvent:     "add",
+			ResourceNamespace: "default",
+			ResourceKind:      "Pod",
+			ResourceName:      "pod-1",
+		}).
+		WithAllowFailure(true)
+	hookTask.IncrementFailureCount()
+	set.GetOrCreate("module-a").Add(hookTask)
+
+	data, err := json.Marshal(set.State())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	state, err := ParseQueueState(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Delay task is not saved.
+	if assert.Len(t, state.Tasks, 2) {
+		assert.Equal(t, "main", state.Tasks[0].Queue)
+		assert.Equal(t, "module-a", state.Tasks[1].Queue)
+
+		restored := state.Tasks[1].Task()
+		assert.Equal(t, ModuleHookRun, restored.GetType())
+		assert.Equal(t, "module-a/hooks/pods", restored.GetName())
+		assert.Equal(t, module_manager.KubeEvents, restored.GetBinding())
+		assert.Equal(t, hookTask.GetBindingContext(), restored.GetBindingContext())
+		assert.Equal(t, 1, restored.GetFailureCount())
+		assert.True(t, restored.GetAllowFailure())
+	}
+}
+
+func TestParseQueueState(t *testing.T) {
+	state, err := ParseQueueState(nil)
+	assert.NoError(t, err)
+	assert.Len(t, state.Tasks, 0)
+
+	_, err = ParseQueueState([]byte(`{"version":100,"tasks":[]}`))
+	assert.Error(t, err)
+
+	_, err = ParseQueueState([]byte(`{"version":`))
+	assert.Error(t, err)
+}
+
+func TestFileQueueStateStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue-state")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	storage := NewFileQueueStateStorage(filepath.Join(dir, "state.json"))
+
+	data, err := storage.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	assert.NoError(t, storage.Save([]byte(`{"version":1}`)))
+	data, err = storage.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"version":1}`, string(data))
+}
+
+func TestConfigMapQueueStateStorage(t *testing.T) {
+	kube.Kubernetes = fake.NewSimpleClientset()
+
+	storage := NewConfigMapQueueStateStorage("addon-operator", "addon-operator-tasks-queue")
+
+	data, err := storage.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	// ConfigMap is created on first save and updated on next saves.
+	assert.NoError(t, storage.Save([]byte(`{"version":1,"tasks":[]}`)))
+	assert.NoError(t, storage.Save([]byte(`{"version":1}`)))
+
+	data, err = storage.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"version":1}`, string(data))
+}
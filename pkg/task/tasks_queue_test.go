@@ -35,6 +35,28 @@ func TestTasksQueue_Length(t *testing.T) {
 
 }
 
+func TestTasksQueue_HeadTaskAge(t *testing.T) {
+	q := NewTasksQueue()
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), q.HeadTaskAge(now))
+
+	queued := NewTask(ModuleRun, "prometheus")
+	queued.SetQueuedAt(now.Add(-time.Minute))
+	q.Add(queued)
+	q.Add(NewTask(ModuleRun, "grafana"))
+	// Delay task is skipped.
+	q.Push(NewTaskDelay(time.Second))
+
+	assert.Equal(t, time.Minute, q.HeadTaskAge(now))
+
+	// Requeued task keeps time of the first queueing.
+	q.Pop()
+	q.Pop()
+	q.Add(queued)
+	assert.Equal(t, now.Add(-time.Minute), queued.GetQueuedAt())
+	assert.True(t, q.HeadTaskAge(now) < time.Minute)
+}
+
 // Тест многопоточного добавления/удаления
 func TestTasksQueue_MultiThread(t *testing.T) {
 	q := NewTasksQueue()
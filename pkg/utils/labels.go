@@ -0,0 +1,12 @@
+package utils
+
+// MergeLabels returns a new map with labels from all maps. Labels from later maps win.
+func MergeLabels(labelsMaps ...map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for _, labelsMap := range labelsMaps {
+		for k, v := range labelsMap {
+			labels[k] = v
+		}
+	}
+	return labels
+}
@@ -2,6 +2,8 @@ package utils
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	utils_checksum "github.com/flant/shell-operator/pkg/utils/checksum"
 	"github.com/go-yaml/yaml"
@@ -17,6 +19,9 @@ type ModuleConfig struct {
 	IsUpdated  bool
 	ModuleConfigKey string
 	ModuleEnabledKey string
+	// MaxRetries is a count of retries for failed module tasks. Nil means a default setting.
+	MaxRetries *int
+	ModuleMaxRetriesKey string
 	RawConfig []string
 }
 
@@ -31,6 +36,7 @@ func NewModuleConfig(moduleName string) *ModuleConfig {
 		Values:     make(Values),
 		ModuleConfigKey: ModuleNameToValuesKey(moduleName),
 		ModuleEnabledKey: ModuleNameToValuesKey(moduleName) + "Enabled",
+		ModuleMaxRetriesKey: ModuleNameToValuesKey(moduleName) + "MaxRetries",
 		RawConfig: make([]string, 0),
 	}
 }
@@ -85,6 +91,15 @@ func (mc *ModuleConfig) LoadFromValues(values Values) (*ModuleConfig, error) {
 		}
 	}
 
+	if maxRetries, hasMaxRetries := values[mc.ModuleMaxRetriesKey]; hasMaxRetries {
+		switch v := maxRetries.(type) {
+		case int:
+			mc.MaxRetries = &v
+		default:
+			return nil, fmt.Errorf("load '%s' max retries: value should be int. Got: %#v", mc.ModuleName, maxRetries)
+		}
+	}
+
 	return mc, nil
 }
 
@@ -117,6 +132,7 @@ func (mc *ModuleConfig) FromYaml(yamlString []byte) (*ModuleConfig, error) {
 //   param1: 10
 //   param2: 120
 // simpleModuleEnabled: "true"
+// simpleModuleMaxRetries: "5"
 func (mc *ModuleConfig) FromKeyYamls(configData map[string]string) (*ModuleConfig, error) {
 	// map with moduleNameKey and moduleEnabled keys
 	moduleConfigData := make(Values) // map[interface{}]interface{}{}
@@ -154,6 +170,19 @@ func (mc *ModuleConfig) FromKeyYamls(configData map[string]string) (*ModuleConfi
 		mc.RawConfig = append(mc.RawConfig, enabledString)
 	}
 
+	// if there is max retries key, treat it as integer
+	maxRetriesString, hasKey := configData[mc.ModuleMaxRetriesKey]
+	if hasKey {
+		maxRetries, err := strconv.Atoi(strings.TrimSpace(maxRetriesString))
+		if err != nil {
+			return nil, fmt.Errorf("module max retries key '%s' should have an integer value, got '%v'", mc.ModuleMaxRetriesKey, maxRetriesString)
+		}
+
+		moduleConfigData[mc.ModuleMaxRetriesKey] = maxRetries
+
+		mc.RawConfig = append(mc.RawConfig, maxRetriesString)
+	}
+
 	if len(moduleConfigData) == 0 {
 		return mc, nil
 	}
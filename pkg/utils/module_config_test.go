@@ -57,6 +57,24 @@ testModule:
 				assert.True(t, *config.IsEnabled)
 			},
 		},
+		{
+			"module max retries",
+			`testModuleMaxRetries: 3`,
+			func() {
+				assert.NoError(t, err)
+				assert.NotNil(t, config)
+				assert.Nil(t, config.IsEnabled)
+				assert.Equal(t, 3, *config.MaxRetries)
+			},
+		},
+		{
+			"bad max retries",
+			`testModuleMaxRetries: "3"`,
+			func() {
+				assert.Nil(t, config)
+				assert.Error(t, err)
+			},
+		},
 		{
 			"full module config",
 			`
@@ -159,3 +177,19 @@ func Test_LoadValues(t *testing.T) {
 	assert.NotNil(t, config)
 	assert.Equal(t, expectedData, config.Values)
 }
+
+func Test_FromKeyYamls_MaxRetries(t *testing.T) {
+	config, err := NewModuleConfig("test-module").FromKeyYamls(map[string]string{
+		"testModule":           "hello: world",
+		"testModuleMaxRetries": "3",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, *config.MaxRetries)
+		assert.Contains(t, config.Values, "testModule")
+	}
+
+	_, err = NewModuleConfig("test-module").FromKeyYamls(map[string]string{
+		"testModuleMaxRetries": "three",
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,61 @@
+package values_validation
+
+import (
+	"encoding/json"
+
+	"github.com/go-openapi/spec"
+
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// defaultsValues returns values with defaults from schema under the rootKey.
+// Nil is returned if schema has no defaults.
+func defaultsValues(s *spec.Schema, rootKey string) utils.Values {
+	if s == nil {
+		return nil
+	}
+
+	defaults := ObjectDefaults(s)
+	if len(defaults) == 0 {
+		return nil
+	}
+
+	return utils.Values{rootKey: defaults}
+}
+
+// ObjectDefaults returns an object filled with 'default' values of schema properties.
+// Defaults are collected recursively for nested objects. A new object is
+// returned on every call, so the result is safe to merge and modify.
+func ObjectDefaults(s *spec.Schema) map[string]interface{} {
+	res := make(map[string]interface{})
+
+	for name, prop := range s.Properties {
+		if prop.Default != nil {
+			res[name] = copyValue(prop.Default)
+			continue
+		}
+
+		if len(prop.Properties) > 0 {
+			nested := ObjectDefaults(&prop)
+			if len(nested) > 0 {
+				res[name] = nested
+			}
+		}
+	}
+
+	return res
+}
+
+// copyValue returns a deep copy of a JSON compatible value.
+func copyValue(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+
+	var res interface{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return v
+	}
+	return res
+}
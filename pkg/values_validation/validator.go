@@ -0,0 +1,291 @@
+package values_validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-openapi/errors"
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+// SchemaType is a type of values that schema describes.
+type SchemaType string
+
+const (
+	// ConfigValuesSchema describes values from values.yaml and ConfigMap.
+	// It is loaded from openapi/config-values.yaml file.
+	ConfigValuesSchema SchemaType = "config"
+	// ValuesSchema describes effective values with patches from hooks.
+	// It is an openapi/values.yaml schema extended with properties from
+	// openapi/config-values.yaml.
+	ValuesSchema SchemaType = "values"
+	// StaticValuesSchema describes values from values.yaml files alone. It is a values schema
+	// without required fields: required fields can be set in the ConfigMap.
+	StaticValuesSchema SchemaType = "static"
+)
+
+// ValuesValidator stores OpenAPI schemas for global values and module values
+// and validates values against them.
+type ValuesValidator struct {
+	GlobalSchemas map[SchemaType]*spec.Schema
+	// Schemas of modules. Key is a module values key (camelCased module name).
+	ModuleSchemas map[string]map[SchemaType]*spec.Schema
+}
+
+func NewValuesValidator() *ValuesValidator {
+	return &ValuesValidator{
+		GlobalSchemas: make(map[SchemaType]*spec.Schema),
+		ModuleSchemas: make(map[string]map[SchemaType]*spec.Schema),
+	}
+}
+
+// AddGlobalSchemas loads schemas for global values. Empty data means no schema.
+func (v *ValuesValidator) AddGlobalSchemas(configSchemaData []byte, valuesSchemaData []byte) error {
+	schemas, err := PrepareSchemas(configSchemaData, valuesSchemaData)
+	if err != nil {
+		return fmt.Errorf("global schemas: %s", err)
+	}
+	v.GlobalSchemas = schemas
+	return nil
+}
+
+// AddModuleSchemas loads schemas for module values. Empty data means no schema.
+func (v *ValuesValidator) AddModuleSchemas(moduleValuesKey string, configSchemaData []byte, valuesSchemaData []byte) error {
+	schemas, err := PrepareSchemas(configSchemaData, valuesSchemaData)
+	if err != nil {
+		return fmt.Errorf("module '%s' schemas: %s", moduleValuesKey, err)
+	}
+	v.ModuleSchemas[moduleValuesKey] = schemas
+	return nil
+}
+
+func (v *ValuesValidator) GetGlobalSchema(schemaType SchemaType) *spec.Schema {
+	return v.GlobalSchemas[schemaType]
+}
+
+func (v *ValuesValidator) GetModuleSchema(moduleValuesKey string, schemaType SchemaType) *spec.Schema {
+	schemas, ok := v.ModuleSchemas[moduleValuesKey]
+	if !ok {
+		return nil
+	}
+	return schemas[schemaType]
+}
+
+// ValidateGlobalConfigValues validates 'global' section of values from ConfigMap or values.yaml.
+func (v *ValuesValidator) ValidateGlobalConfigValues(values utils.Values) error {
+	return validateValues(v.GetGlobalSchema(ConfigValuesSchema), utils.GlobalValuesKey, values)
+}
+
+// ValidateGlobalValues validates effective 'global' section of values.
+func (v *ValuesValidator) ValidateGlobalValues(values utils.Values) error {
+	return validateValues(v.GetGlobalSchema(ValuesSchema), utils.GlobalValuesKey, values)
+}
+
+// ValidateGlobalStaticValues validates 'global' section of values from values.yaml. Required fields are not checked.
+func (v *ValuesValidator) ValidateGlobalStaticValues(values utils.Values) error {
+	return validateValues(v.GetGlobalSchema(StaticValuesSchema), utils.GlobalValuesKey, values)
+}
+
+// ValidateModuleConfigValues validates module section of values from ConfigMap or values.yaml.
+func (v *ValuesValidator) ValidateModuleConfigValues(moduleValuesKey string, values utils.Values) error {
+	return validateValues(v.GetModuleSchema(moduleValuesKey, ConfigValuesSchema), moduleValuesKey, values)
+}
+
+// ValidateModuleValues validates effective module section of values.
+func (v *ValuesValidator) ValidateModuleValues(moduleValuesKey string, values utils.Values) error {
+	return validateValues(v.GetModuleSchema(moduleValuesKey, ValuesSchema), moduleValuesKey, values)
+}
+
+// ValidateModuleStaticValues validates module section of values from values.yaml files. Required fields are not checked.
+func (v *ValuesValidator) ValidateModuleStaticValues(moduleValuesKey string, values utils.Values) error {
+	return validateValues(v.GetModuleSchema(moduleValuesKey, StaticValuesSchema), moduleValuesKey, values)
+}
+
+// GlobalDefaults returns values with defaults from global values schema
+// under the 'global' key.
+func (v *ValuesValidator) GlobalDefaults() utils.Values {
+	return defaultsValues(v.GetGlobalSchema(ValuesSchema), utils.GlobalValuesKey)
+}
+
+// ModuleDefaults returns values with defaults from module values schema
+// under the module values key.
+func (v *ValuesValidator) ModuleDefaults(moduleValuesKey string) utils.Values {
+	return defaultsValues(v.GetModuleSchema(moduleValuesKey, ValuesSchema), moduleValuesKey)
+}
+
+// validateValues validates an object under rootKey in values. Values without rootKey are valid.
+func validateValues(s *spec.Schema, rootKey string, values utils.Values) error {
+	if s == nil {
+		return nil
+	}
+
+	obj, hasKey := values[rootKey]
+	if !hasKey {
+		return nil
+	}
+
+	// Validator expects JSON compatible data: pass values through a json marshal/unmarshal cycle.
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	var jsonObj interface{}
+	if err := json.Unmarshal(data, &jsonObj); err != nil {
+		return err
+	}
+
+	validator := validate.NewSchemaValidator(s, nil, rootKey, strfmt.Default)
+	result := validator.Validate(jsonObj)
+	if !result.HasErrors() {
+		return nil
+	}
+
+	return fmt.Errorf("'%s' values are not valid:\n%s", rootKey, formatErrors(result.Errors))
+}
+
+func formatErrors(errs []error) string {
+	lines := make([]string, 0)
+	for _, err := range errs {
+		if compositeErr, ok := err.(*errors.CompositeError); ok {
+			lines = append(lines, formatErrors(compositeErr.Errors))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("- %s", err))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PrepareSchemas creates schemas for config values and for values from yaml data.
+// Values schema is extended with properties from config values schema.
+func PrepareSchemas(configSchemaData []byte, valuesSchemaData []byte) (map[SchemaType]*spec.Schema, error) {
+	res := make(map[SchemaType]*spec.Schema)
+
+	configSchema, err := LoadSchemaFromYaml(configSchemaData)
+	if err != nil {
+		return nil, fmt.Errorf("load config values schema: %s", err)
+	}
+	valuesSchema, err := LoadSchemaFromYaml(valuesSchemaData)
+	if err != nil {
+		return nil, fmt.Errorf("load values schema: %s", err)
+	}
+
+	if configSchema != nil {
+		res[ConfigValuesSchema] = configSchema
+	}
+
+	switch {
+	case valuesSchema != nil && configSchema != nil:
+		res[ValuesSchema] = ExtendSchema(valuesSchema, configSchema)
+	case valuesSchema != nil:
+		res[ValuesSchema] = valuesSchema
+	case configSchema != nil:
+		res[ValuesSchema] = configSchema
+	}
+
+	if res[ValuesSchema] != nil {
+		res[StaticValuesSchema] = WithoutRequired(res[ValuesSchema])
+	}
+
+	return res, nil
+}
+
+// LoadSchemaFromYaml returns a schema from yaml data or nil if data is empty.
+func LoadSchemaFromYaml(data []byte) (*spec.Schema, error) {
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil, nil
+	}
+
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("yaml unmarshal: %s", err)
+	}
+
+	s := new(spec.Schema)
+	if err := json.Unmarshal(jsonData, s); err != nil {
+		return nil, fmt.Errorf("json unmarshal: %s", err)
+	}
+
+	if err := spec.ExpandSchema(s, s, nil); err != nil {
+		return nil, fmt.Errorf("expand schema: %s", err)
+	}
+
+	return s, nil
+}
+
+// ExtendSchema returns a copy of schema with properties and required fields
+// from parent schema that are not defined in schema.
+func ExtendSchema(schema *spec.Schema, parent *spec.Schema) *spec.Schema {
+	res := *schema
+
+	res.Properties = make(map[string]spec.Schema)
+	for name, prop := range parent.Properties {
+		res.Properties[name] = prop
+	}
+	for name, prop := range schema.Properties {
+		res.Properties[name] = prop
+	}
+
+	required := make(map[string]bool)
+	res.Required = make([]string, 0)
+	for _, name := range append(append([]string{}, parent.Required...), schema.Required...) {
+		if !required[name] {
+			required[name] = true
+			res.Required = append(res.Required, name)
+		}
+	}
+
+	return &res
+}
+
+// WithoutRequired returns a copy of schema without required fields on all levels.
+func WithoutRequired(schema *spec.Schema) *spec.Schema {
+	res := *schema
+	res.Required = nil
+
+	if schema.Properties != nil {
+		res.Properties = make(map[string]spec.Schema)
+		for name, prop := range schema.Properties {
+			res.Properties[name] = *WithoutRequired(&prop)
+		}
+	}
+
+	if schema.Items != nil {
+		items := *schema.Items
+		if items.Schema != nil {
+			items.Schema = WithoutRequired(items.Schema)
+		}
+		if items.Schemas != nil {
+			items.Schemas = withoutRequiredList(items.Schemas)
+		}
+		res.Items = &items
+	}
+
+	if schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil {
+		additional := *schema.AdditionalProperties
+		additional.Schema = WithoutRequired(additional.Schema)
+		res.AdditionalProperties = &additional
+	}
+
+	res.AllOf = withoutRequiredList(schema.AllOf)
+	res.AnyOf = withoutRequiredList(schema.AnyOf)
+	res.OneOf = withoutRequiredList(schema.OneOf)
+
+	return &res
+}
+
+func withoutRequiredList(schemas []spec.Schema) []spec.Schema {
+	if schemas == nil {
+		return nil
+	}
+	res := make([]spec.Schema, 0, len(schemas))
+	for i := range schemas {
+		res = append(res, *WithoutRequired(&schemas[i]))
+	}
+	return res
+}
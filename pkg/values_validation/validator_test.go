@@ -0,0 +1,170 @@
+package values_validation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flant/addon-operator/pkg/utils"
+)
+
+const testConfigSchema = `
+type: object
+required: [param1]
+properties:
+  param1:
+    type: string
+    enum: [val1, val2]
+  param2:
+    type: integer
+    default: 3
+  nested:
+    type: object
+    properties:
+      flag:
+        type: boolean
+        default: true
+`
+
+const testValuesSchema = `
+type: object
+properties:
+  internal:
+    type: object
+    properties:
+      counter:
+        type: integer
+`
+
+func Test_Validate_ModuleValues(t *testing.T) {
+	v := NewValuesValidator()
+	err := v.AddModuleSchemas("moduleName", []byte(testConfigSchema), []byte(testValuesSchema))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name    string
+		fn      func(utils.Values) error
+		values  utils.Values
+		isValid bool
+	}{
+		{
+			"valid config values",
+			func(values utils.Values) error { return v.ValidateModuleConfigValues("moduleName", values) },
+			utils.Values{"moduleName": map[string]interface{}{"param1": "val1", "param2": 5}},
+			true,
+		},
+		{
+			"absent module key is valid",
+			func(values utils.Values) error { return v.ValidateModuleConfigValues("moduleName", values) },
+			utils.Values{"otherModule": map[string]interface{}{"param1": 1}},
+			true,
+		},
+		{
+			"required property",
+			func(values utils.Values) error { return v.ValidateModuleConfigValues("moduleName", values) },
+			utils.Values{"moduleName": map[string]interface{}{"param2": 5}},
+			false,
+		},
+		{
+			"enum",
+			func(values utils.Values) error { return v.ValidateModuleConfigValues("moduleName", values) },
+			utils.Values{"moduleName": map[string]interface{}{"param1": "val3"}},
+			false,
+		},
+		{
+			"values schema has properties from config values schema",
+			func(values utils.Values) error { return v.ValidateModuleValues("moduleName", values) },
+			utils.Values{"moduleName": map[string]interface{}{"param1": "val2", "internal": map[string]interface{}{"counter": 1}}},
+			true,
+		},
+		{
+			"values schema checks config values properties",
+			func(values utils.Values) error { return v.ValidateModuleValues("moduleName", values) },
+			utils.Values{"moduleName": map[string]interface{}{"param1": "val2", "param2": "string"}},
+			false,
+		},
+		{
+			"values schema checks own properties",
+			func(values utils.Values) error { return v.ValidateModuleValues("moduleName", values) },
+			utils.Values{"moduleName": map[string]interface{}{"param1": "val2", "internal": map[string]interface{}{"counter": "string"}}},
+			false,
+		},
+		{
+			"module without schemas",
+			func(values utils.Values) error { return v.ValidateModuleValues("otherModule", values) },
+			utils.Values{"otherModule": map[string]interface{}{"param1": 1}},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.fn(test.values)
+			if test.isValid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func Test_Validate_GlobalValues(t *testing.T) {
+	v := NewValuesValidator()
+	err := v.AddGlobalSchemas([]byte(testConfigSchema), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = v.ValidateGlobalConfigValues(utils.Values{"global": map[string]interface{}{"param1": "val1"}})
+	assert.NoError(t, err)
+
+	err = v.ValidateGlobalValues(utils.Values{"global": map[string]interface{}{"param1": "val1", "param2": "a"}})
+	assert.Error(t, err)
+}
+
+func Test_Validate_StaticValues(t *testing.T) {
+	v := NewValuesValidator()
+	err := v.AddModuleSchemas("moduleName", []byte(testConfigSchema), []byte(testValuesSchema))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Required param1 can be set in the ConfigMap.
+	err = v.ValidateModuleStaticValues("moduleName", utils.Values{"moduleName": map[string]interface{}{"param2": 5}})
+	assert.NoError(t, err)
+	err = v.ValidateModuleStaticValues("moduleName", utils.Values{"moduleName": map[string]interface{}{"param2": "a"}})
+	assert.Error(t, err)
+
+	// Schema is not changed.
+	err = v.ValidateModuleConfigValues("moduleName", utils.Values{"moduleName": map[string]interface{}{"param2": 5}})
+	assert.Error(t, err)
+}
+
+func Test_Defaults(t *testing.T) {
+	v := NewValuesValidator()
+	err := v.AddModuleSchemas("moduleName", []byte(testConfigSchema), []byte(testValuesSchema))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	expected := utils.Values{
+		"moduleName": map[string]interface{}{
+			"param2": 3.0,
+			"nested": map[string]interface{}{
+				"flag": true,
+			},
+		},
+	}
+	assert.Equal(t, expected, v.ModuleDefaults("moduleName"))
+
+	// defaults are copied on every call
+	defaults := v.ModuleDefaults("moduleName")
+	defaults["moduleName"].(map[string]interface{})["param2"] = 10.0
+	assert.Equal(t, expected, v.ModuleDefaults("moduleName"))
+
+	assert.Nil(t, v.ModuleDefaults("otherModule"))
+	assert.Nil(t, v.GlobalDefaults())
+}